@@ -1,19 +1,20 @@
 package main
 
 import (
-    "bytes"
     "encoding/base64"
+    "flag"
     "fmt"
-    "image"
-    "image/color"
-    "image/draw"
-    "image/jpeg"
     "log"
     "math"
+    "math/rand"
     "os"
+    "sort"
+    "strings"
     "sync"
     "time"
     
+    "conference/synthmedia"
+    
     "github.com/gorilla/websocket"
 )
 
@@ -45,6 +46,9 @@ type KPIMetrics struct {
     SyncDeltaMS         float64 // Audio-video sync
     DropoutRate         float64
     
+    // Mean JPEG size of the frames this client generated
+    FrameBytes          float64
+    
     // VPS Constraint Metrics
     TotalBandwidthKbps  float64
     PerUserBandwidthKbps float64
@@ -60,12 +64,22 @@ type TestScenario struct {
     VideoResolution string
     AudioBitrate    int
     VideoBitrate    int
+    FrameProfile    string // One of synthmedia.Profiles, from -profile
     Results         []KPIMetrics
 }
 
+// Run settings from the command line
+var (
+    serverURL  string
+    seed       int64 // 0 picks one from the clock
+    reportPath string
+    profiles   string // -profile: one frame profile for every scenario, or one per scenario
+)
+
 // Test client simulates a user
 type TestClient struct {
     ID          string
+    Rand        *rand.Rand // Frame noise, seeded per client
     WS          *websocket.Conn
     Scenario    *TestScenario
     Metrics     *KPIMetrics
@@ -99,8 +113,20 @@ type Message struct {
 }
 
 func main() {
+    flag.StringVar(&serverURL, "server", "ws://localhost:3001/ws", "conference server WebSocket URL")
+    flag.Int64Var(&seed, "seed", 0, "fixed seed for room ids and frame content so runs are comparable (0: from the clock)")
+    flag.StringVar(&reportPath, "out", "conference-kpi-report.md", "report path")
+    flag.StringVar(&profiles, "profile", "solid", "frame content: one of "+strings.Join(synthmedia.Profiles, ", ")+
+        "; a comma-separated list sets one per scenario, in order")
+    flag.Parse()
+    
+    if seed == 0 {
+        seed = time.Now().UnixNano()
+    }
+    
     fmt.Println("🧪 Conference KPI Test Suite")
-    fmt.Println("============================\n")
+    fmt.Println("============================")
+    fmt.Printf("   Server: %s, seed: %d (rerun with -seed %d)\n", serverURL, seed, seed)
     
     // Define test scenarios based on VPS constraints
     // VPS has 1.2 Mbps upload total, must share among all users
@@ -147,13 +173,27 @@ func main() {
         },
     }
     
+    // A single profile covers every scenario
+    picked := strings.Split(profiles, ",")
+    if len(picked) != 1 && len(picked) != len(scenarios) {
+        log.Fatalf("-profile lists %d profiles for %d scenarios", len(picked), len(scenarios))
+    }
+    for i := range scenarios {
+        profile := strings.TrimSpace(picked[min(i, len(picked)-1)])
+        if !synthmedia.ValidProfile(profile) {
+            log.Fatalf("unknown frame profile %q, want one of %s", profile, strings.Join(synthmedia.Profiles, ", "))
+        }
+        scenarios[i].FrameProfile = profile
+    }
+    
     // Run each scenario
-    for _, scenario := range scenarios {
+    for i := range scenarios {
+        scenario := &scenarios[i]
         fmt.Printf("\n📊 Running: %s\n", scenario.Name)
-        fmt.Printf("   Users: %d, Duration: %ds, Resolution: %s\n", 
-            scenario.UserCount, scenario.DurationSeconds, scenario.VideoResolution)
+        fmt.Printf("   Users: %d, Duration: %ds, Resolution: %s, Frames: %s\n", 
+            scenario.UserCount, scenario.DurationSeconds, scenario.VideoResolution, scenario.FrameProfile)
         
-        runScenario(&scenario)
+        runScenario(scenario, i)
         
         // Cool down between tests
         time.Sleep(2 * time.Second)
@@ -163,12 +203,12 @@ func main() {
     generateKPIReport(scenarios)
 }
 
-func runScenario(scenario *TestScenario) {
+func runScenario(scenario *TestScenario, index int) {
     var wg sync.WaitGroup
     clients := make([]*TestClient, scenario.UserCount)
     
-    // Create test room
-    roomID := fmt.Sprintf("test-%d", time.Now().Unix())
+    // Same seed, same room: a rerun lands in a room named like the last one
+    roomID := fmt.Sprintf("test-%d-%d", seed, index)
     
     // Start all clients
     for i := 0; i < scenario.UserCount; i++ {
@@ -176,6 +216,7 @@ func runScenario(scenario *TestScenario) {
         
         client := &TestClient{
             ID:       fmt.Sprintf("user-%d", i+1),
+            Rand:     rand.New(rand.NewSource(seed*1000 + int64(index*100+i))),
             Scenario: scenario,
             Metrics:  &KPIMetrics{UserCount: scenario.UserCount},
         }
@@ -203,13 +244,10 @@ func runScenario(scenario *TestScenario) {
 }
 
 func (c *TestClient) runTest(roomID string) {
-    c.StartTime = time.Now()
-    
     // Generate test data
     c.generateTestData()
     
     // Connect to server
-    serverURL := "ws://localhost:3001/ws" // Local test server
     conn, _, err := websocket.DefaultDialer.Dial(serverURL, nil)
     if err != nil {
         log.Printf("Client %s failed to connect: %v", c.ID, err)
@@ -229,7 +267,8 @@ func (c *TestClient) runTest(roomID string) {
     // Start receiving
     go c.receiveLoop()
     
-    // Start sending
+    // Start sending; the schedule is relative to now, after setup
+    c.StartTime = time.Now()
     c.sendLoop()
     
     // Calculate final metrics
@@ -245,59 +284,37 @@ func (c *TestClient) generateTestData() {
     frameCount := 30 * c.Scenario.DurationSeconds
     c.VideoFrames = make([][]byte, frameCount)
     
+    user := int(c.ID[len(c.ID)-1] - '0')
+    total := 0
     for i := 0; i < frameCount; i++ {
-        // Create test frame with frame number
-        img := image.NewRGBA(image.Rect(0, 0, width, height))
-        
-        // Different color for each user
-        userColor := color.RGBA{
-            R: uint8(100 + (c.ID[len(c.ID)-1]-'0')*50),
-            G: uint8(50 + (c.ID[len(c.ID)-1]-'0')*30),
-            B: uint8(150),
-            A: 255,
-        }
-        draw.Draw(img, img.Bounds(), &image.Uniform{userColor}, image.Point{}, draw.Src)
-        
-        // Add frame number indicator (visual pattern)
-        for y := 0; y < height/10; y++ {
-            for x := 0; x < (i%width); x++ {
-                img.Set(x, y, color.White)
-            }
-        }
-        
-        // Encode to JPEG
-        var buf bytes.Buffer
-        jpeg.Encode(&buf, img, &jpeg.Options{Quality: 70})
-        c.VideoFrames[i] = buf.Bytes()
+        c.VideoFrames[i] = synthmedia.Frame(c.Scenario.FrameProfile, width, height, i, user, c.Rand)
+        total += len(c.VideoFrames[i])
     }
+    c.Metrics.FrameBytes = float64(total) / float64(frameCount)
     
     // Generate audio chunks (50 chunks per second for 5 seconds)
     chunkCount := 50 * c.Scenario.DurationSeconds
     c.AudioChunks = make([][]byte, chunkCount)
     
     for i := 0; i < chunkCount; i++ {
-        // Generate simple sine wave audio
-        sampleRate := 48000
-        duration := 0.02 // 20ms chunks
-        samples := int(float64(sampleRate) * duration)
-        
-        audioData := make([]int16, samples)
-        frequency := 440.0 * (1 + float64(c.ID[len(c.ID)-1]-'0')/10) // Different tone per user
-        
-        for j := 0; j < samples; j++ {
-            t := float64(j) / float64(sampleRate)
-            audioData[j] = int16(32767 * math.Sin(2*math.Pi*frequency*t))
-        }
-        
-        // Convert to bytes
-        audioBytes := make([]byte, len(audioData)*2)
-        for j, sample := range audioData {
-            audioBytes[j*2] = byte(sample & 0xFF)
-            audioBytes[j*2+1] = byte(sample >> 8)
+        c.AudioChunks[i] = synthmedia.Tone(user, i)
+    }
+}
+
+// profileSizes is each profile's mean JPEG frame size at a resolution,
+// over a handful of frames, for the report
+func profileSizes(width, height int) map[string]float64 {
+    const frames = 10
+    sizes := make(map[string]float64, len(synthmedia.Profiles))
+    for _, profile := range synthmedia.Profiles {
+        r := rand.New(rand.NewSource(seed))
+        total := 0
+        for i := 0; i < frames; i++ {
+            total += len(synthmedia.Frame(profile, width, height, i, 1, r))
         }
-        
-        c.AudioChunks[i] = audioBytes
+        sizes[profile] = float64(total) / frames
     }
+    return sizes
 }
 
 func (c *TestClient) sendLoop() {
@@ -305,12 +322,9 @@ func (c *TestClient) sendLoop() {
     // Total bandwidth per user = VideoBitrate + AudioBitrate
     totalBandwidth := float64(c.Scenario.VideoBitrate + c.Scenario.AudioBitrate)
     
-    // Adjust frame rates based on available bandwidth
-    // Assume each video frame is ~10KB for 320x240, ~3KB for 160x120
-    frameSize := 10000.0 // bytes
-    if c.Scenario.VideoResolution == "160x120" {
-        frameSize = 3000.0
-    }
+    // Adjust frame rates based on available bandwidth, going by the
+    // generated frames since their size depends on the profile
+    frameSize := c.Metrics.FrameBytes
     
     // Calculate sustainable FPS: bitrate / (frameSize * 8)
     maxVideoFPS := float64(c.Scenario.VideoBitrate) / (frameSize * 8)
@@ -322,52 +336,75 @@ func (c *TestClient) sendLoop() {
     }
     
     videoInterval := time.Duration(1000/maxVideoFPS) * time.Millisecond
-    videoTicker := time.NewTicker(videoInterval)
-    defer videoTicker.Stop()
     
     // Audio always at 50 Hz (20ms) for quality
-    audioTicker := time.NewTicker(20 * time.Millisecond)
-    defer audioTicker.Stop()
-    
-    endTime := c.StartTime.Add(time.Duration(c.Scenario.DurationSeconds) * time.Second)
-    
-    // Track bandwidth usage
-    bytesSentThisSecond := 0
-    bandwidthResetTicker := time.NewTicker(1 * time.Second)
-    defer bandwidthResetTicker.Stop()
+    audioInterval := 20 * time.Millisecond
     
     maxBytesPerSecond := totalBandwidth / 8 // Convert from bits to bytes
     
-    for {
-        select {
-        case <-videoTicker.C:
-            if time.Now().After(endTime) {
-                return
-            }
-            
-            // Check bandwidth limit
-            if float64(bytesSentThisSecond) < maxBytesPerSecond*0.8 { // Use 80% for video
-                frameBytes := len(c.VideoFrames[c.FramesSent%len(c.VideoFrames)])
-                bytesSentThisSecond += frameBytes
-                c.sendVideoFrame()
-            }
-            
-        case <-audioTicker.C:
-            if time.Now().After(endTime) {
-                return
+    // The schedule is fixed on a virtual clock before anything is sent, so
+    // which frames go out never depends on ticker jitter; playback only
+    // waits for each event's offset
+    events := c.schedule(videoInterval, audioInterval, maxBytesPerSecond)
+    for _, ev := range events {
+        if wait := time.Until(c.StartTime.Add(ev.at)); wait > 0 {
+            time.Sleep(wait)
+        }
+        if ev.video {
+            c.sendVideoFrame()
+        } else {
+            c.sendAudioChunk()
+        }
+    }
+}
+
+// sendEvent is one scheduled send, at an offset from StartTime
+type sendEvent struct {
+    at    time.Duration
+    video bool
+}
+
+// schedule lays out the run's sends on a virtual clock, applying the per-second
+// byte budget by offset rather than by wall time
+func (c *TestClient) schedule(videoInterval, audioInterval time.Duration, maxBytesPerSecond float64) []sendEvent {
+    duration := time.Duration(c.Scenario.DurationSeconds) * time.Second
+    
+    var events []sendEvent
+    for at := videoInterval; at <= duration; at += videoInterval {
+        events = append(events, sendEvent{at: at, video: true})
+    }
+    for at := audioInterval; at <= duration; at += audioInterval {
+        events = append(events, sendEvent{at: at})
+    }
+    sort.SliceStable(events, func(i, j int) bool { return events[i].at < events[j].at })
+    
+    // Track bandwidth usage per virtual second
+    var kept []sendEvent
+    second, bytesThisSecond := time.Duration(0), 0
+    frames, chunks := 0, 0
+    for _, ev := range events {
+        if ev.at/time.Second != second {
+            second, bytesThisSecond = ev.at/time.Second, 0
+        }
+        if ev.video {
+            // Use 80% for video
+            frameBytes := len(c.VideoFrames[frames%len(c.VideoFrames)])
+            if float64(bytesThisSecond) < maxBytesPerSecond*0.8 {
+                bytesThisSecond += frameBytes
+                frames++
+                kept = append(kept, ev)
             }
-            
+        } else {
             // Audio always gets priority (uses remaining 20% bandwidth)
-            if float64(bytesSentThisSecond) < maxBytesPerSecond {
-                chunkBytes := len(c.AudioChunks[c.AudioSent%len(c.AudioChunks)])
-                bytesSentThisSecond += chunkBytes
-                c.sendAudioChunk()
+            chunkBytes := len(c.AudioChunks[chunks%len(c.AudioChunks)])
+            if float64(bytesThisSecond) < maxBytesPerSecond {
+                bytesThisSecond += chunkBytes
+                chunks++
+                kept = append(kept, ev)
             }
-            
-        case <-bandwidthResetTicker.C:
-            bytesSentThisSecond = 0 // Reset bandwidth counter each second
         }
     }
+    return kept
 }
 
 func (c *TestClient) sendVideoFrame() {
@@ -459,7 +496,8 @@ func (c *TestClient) calculateMetrics() {
     c.mu.Lock()
     defer c.mu.Unlock()
     
-    duration := time.Since(c.StartTime).Seconds()
+    // Rates use the scheduled duration so they don't drift with wall time
+    duration := float64(c.Scenario.DurationSeconds)
     
     // Calculate average latency
     if len(c.LatencySamples) > 0 {
@@ -490,7 +528,10 @@ func (c *TestClient) calculateMetrics() {
     }
     
     // Calculate bitrates
-    videoBytes := c.FramesSent * (len(c.VideoFrames[0]) + 100) // Include overhead
+    videoBytes := 0
+    for _, frame := range c.VideoFrames[:c.FramesSent] {
+        videoBytes += len(frame) + 100 // Include overhead
+    }
     c.Metrics.VideoBitrate = float64(videoBytes*8) / duration / 1000 // kbps
     
     audioBytes := c.AudioSent * (len(c.AudioChunks[0]) + 100)
@@ -573,8 +614,9 @@ func generateKPIReport(scenarios []TestScenario) {
 
 ## Test Configuration
 - **Date**: ` + time.Now().Format("2006-01-02 15:04:05") + `
+- **Seed**: ` + fmt.Sprint(seed) + `
 - **Duration per test**: 5 seconds
-- **Server**: Local WebSocket relay
+- **Server**: ` + serverURL + `
 - **VPS Bandwidth Limit**: 1.2 Mbps upload
 
 ## KPI Summary
@@ -616,6 +658,56 @@ func generateKPIReport(scenarios []TestScenario) {
     
     report += `
 
+## Frame Profiles
+
+Encoded size depends on picture content, so bandwidth and loss above only
+hold for content like the profile each scenario ran with.
+
+| Scenario | Profile | Resolution | Mean JPEG frame |
+|----------|---------|------------|-----------------|
+`
+    for _, scenario := range scenarios {
+        if len(scenario.Results) == 0 {
+            continue
+        }
+        var frameBytes float64
+        for _, r := range scenario.Results {
+            frameBytes += r.FrameBytes
+        }
+        report += fmt.Sprintf("| %s | %s | %s | %.0f bytes |\n",
+            scenario.Name[:30], scenario.FrameProfile, scenario.VideoResolution, frameBytes/float64(len(scenario.Results)))
+    }
+    
+    // Every profile at every resolution the scenarios use, for comparison
+    var resolutions []string
+    seen := make(map[string]bool)
+    for _, scenario := range scenarios {
+        if !seen[scenario.VideoResolution] {
+            seen[scenario.VideoResolution] = true
+            resolutions = append(resolutions, scenario.VideoResolution)
+        }
+    }
+    report += "\n| Profile |"
+    for _, res := range resolutions {
+        report += " " + res + " |"
+    }
+    report += "\n|---------|" + strings.Repeat("------|", len(resolutions)) + "\n"
+    sizes := make([]map[string]float64, len(resolutions))
+    for i, res := range resolutions {
+        var width, height int
+        fmt.Sscanf(res, "%dx%d", &width, &height)
+        sizes[i] = profileSizes(width, height)
+    }
+    for _, profile := range synthmedia.Profiles {
+        report += "| " + profile + " |"
+        for i := range resolutions {
+            report += fmt.Sprintf(" %.0f bytes (%.1fx solid) |", sizes[i][profile], sizes[i][profile]/sizes[i]["solid"])
+        }
+        report += "\n"
+    }
+    
+    report += `
+
 ## Performance Analysis
 
 ### Latency Scaling
@@ -744,10 +836,10 @@ Based on the test results:
     report += "   - Consider SFU architecture\n"
     
     // Write report
-    err := os.WriteFile("conference-kpi-report.md", []byte(report), 0644)
+    err := os.WriteFile(reportPath, []byte(report), 0644)
     if err != nil {
         log.Fatal("Failed to write report:", err)
     }
     
-    fmt.Println("\n📊 KPI report generated: conference-kpi-report.md")
+    fmt.Println("\n📊 KPI report generated:", reportPath)
 }
\ No newline at end of file
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "bytes"
+    "image/jpeg"
+    "math/rand"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "conference/synthmedia"
+)
+
+func TestFrameProfilesDifferInSize(t *testing.T) {
+    const width, height = 320, 240
+    generate := func(profile string) *TestClient {
+        c := &TestClient{
+            ID:       "user1",
+            Rand:     rand.New(rand.NewSource(7)),
+            Scenario: &TestScenario{DurationSeconds: 1, VideoResolution: "320x240", FrameProfile: profile},
+            Metrics:  &KPIMetrics{},
+        }
+        c.generateTestData()
+        return c
+    }
+
+    sizes := make(map[string]float64)
+    for _, profile := range synthmedia.Profiles {
+        c := generate(profile)
+        sizes[profile] = c.Metrics.FrameBytes
+        got := c.VideoFrames
+        total := 0
+        for _, frame := range got {
+            total += len(frame)
+        }
+        if want := float64(total) / float64(len(got)); c.Metrics.FrameBytes != want {
+            t.Errorf("%s: FrameBytes = %.0f, want the %.0f-byte mean of the frames generated", profile, c.Metrics.FrameBytes, want)
+        }
+        img, err := jpeg.Decode(bytes.NewReader(got[0]))
+        if err != nil {
+            t.Fatalf("%s: %v", profile, err)
+        }
+        if b := img.Bounds(); b.Dx() != width || b.Dy() != height {
+            t.Errorf("%s frames are %dx%d, want %dx%d", profile, b.Dx(), b.Dy(), width, height)
+        }
+        // Seeded, so two runs compare like for like
+        again := generate(profile).VideoFrames
+        for i := range got {
+            if !bytes.Equal(got[i], again[i]) {
+                t.Errorf("%s frame %d differs between runs with one seed", profile, i)
+                break
+            }
+        }
+    }
+    if synthmedia.ValidProfile("cartoon") || !synthmedia.ValidProfile("realistic-photo") {
+        t.Error("ValidProfile doesn't match Profiles")
+    }
+
+    // Content, not resolution, sets the size
+    for _, order := range [][2]string{
+        {"noise", "solid"},
+        {"noise", "realistic-photo"},
+        {"realistic-photo", "gradient"},
+        {"realistic-photo", "static-slide"},
+    } {
+        if sizes[order[0]] <= sizes[order[1]] {
+            t.Errorf("%s frames average %.0f bytes and %s %.0f, want %s larger", order[0], sizes[order[0]], order[1], sizes[order[1]], order[0])
+        }
+    }
+    if sizes["noise"] < 5*sizes["static-slide"] {
+        t.Errorf("noise is %.0f bytes against a slide's %.0f, want the spread the profiles exist for", sizes["noise"], sizes["static-slide"])
+    }
+}
+
+func TestReportListsEachScenariosFrameProfile(t *testing.T) {
+    prev := reportPath
+    reportPath = filepath.Join(t.TempDir(), "report.md")
+    t.Cleanup(func() { reportPath = prev })
+
+    generateKPIReport([]TestScenario{{
+        Name:            "Photo content over a 1.2 Mbps uplink",
+        UserCount:       2,
+        VideoResolution: "160x120",
+        FrameProfile:    "realistic-photo",
+        Results:         []KPIMetrics{{FrameBytes: 4000}, {FrameBytes: 6000}},
+    }})
+    data, err := os.ReadFile(reportPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    report := string(data)
+    if !strings.Contains(report, "| realistic-photo | 160x120 | 5000 bytes |") {
+        t.Errorf("the report doesn't give the scenario's profile and mean frame size:\n%s", report)
+    }
+    for _, profile := range synthmedia.Profiles {
+        if !strings.Contains(report, "| "+profile+" | ") {
+            t.Errorf("the profile comparison has no %s row", profile)
+        }
+    }
+}
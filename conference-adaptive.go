@@ -2,6 +2,8 @@ package main
 
 import (
     "bytes"
+    "context"
+    "crypto/rand"
     "encoding/base64"
     "encoding/json"
     "fmt"
@@ -10,24 +12,39 @@ import (
     _ "image/jpeg"
     _ "image/png"
     "log"
+    "math"
+    "net"
     "net/http"
+    "os"
+    "strconv"
+    "strings"
     "sync"
     "sync/atomic"
     "time"
 
-    "github.com/chai2010/webp"
+    "conference/framecodec"
+    "conference/webpcodec"
+
     "github.com/gorilla/websocket"
     "github.com/nfnt/resize"
 )
 
+// Build-time variables (set via -ldflags)
+var (
+    BuildTime   = "unknown"
+    BuildCommit = "unknown"
+    BuildBy     = "local"
+    BuildRef    = "unknown"
+)
+
 // Quality presets - from 144p to 4K
 type QualityPreset struct {
-    Name       string
-    Width      uint
-    Height     uint
-    FPS        int
-    Quality    float32
-    Bitrate    int // Target bitrate in kbps
+    Name       string  `json:"name"`
+    Width      uint    `json:"width"`
+    Height     uint    `json:"height"`
+    FPS        int     `json:"fps"`
+    Quality    float32 `json:"quality"` // 0-1, scaled to the codec's 0-100 range
+    Bitrate    int     `json:"bitrate"` // Target bitrate in kbps
 }
 
 var QualityLevels = []QualityPreset{
@@ -42,6 +59,20 @@ var QualityLevels = []QualityPreset{
     {"4K60", 3840, 2160, 60, 0.95, 12000},
 }
 
+// Audio ladder, stepped through per receiver only once its video is at the
+// lowest preset and still congested. Relayed PCM is 16-bit mono at 48kHz;
+// lower rungs downsample it.
+type AudioPreset struct {
+    Name       string
+    SampleRate int
+}
+
+var AudioLevels = []AudioPreset{
+    {"48kHz", 48000},
+    {"32kHz", 32000},
+    {"16kHz", 16000},
+}
+
 // Client performance metrics
 type ClientMetrics struct {
     Bandwidth          float64   // Measured in Mbps
@@ -58,6 +89,24 @@ type ClientMetrics struct {
     BufferHealth      float64   // 0-1, how full is client buffer
     CPUUsage          float64   // Client CPU usage 0-100
     
+    // Clock sync from time-sync exchanges: the client clock minus ours,
+    // and one-way upstream delay per media kind (EWMA, ms)
+    ClockOffset       int64
+    SyncRTT           int64
+    AudioLatency      int64
+    VideoLatency      int64
+    clockSamples      []clockSample
+    synced            bool
+    
+    // Downstream throughput seen by writePump (Mbps), only measured while
+    // Send is backlogged so an idle link doesn't read as a slow one
+    SendBandwidth     float64
+    SendMeasuredAt    time.Time
+    sendBytes         int64
+    sendBusy          time.Duration
+    lastWrite         time.Time
+    backlogged        bool
+    
     mu sync.RWMutex
 }
 
@@ -69,11 +118,45 @@ type Client struct {
     Send          chan []byte
     Hub           *Hub
     
+    // Cancelled once on disconnect; every per-client goroutine exits on it.
+    // Send is never closed, so a late notify can't panic on it.
+    ctx           context.Context
+    cancel        context.CancelFunc
+    
     // Quality management
     CurrentQuality    int // Index in QualityLevels
     TargetQuality     int
     QualityLocked     bool
     LastQualityChange time.Time
+    LastDownStep      time.Time
+    UpStreak          int // Consecutive ticks asking for more quality
+    QualityCeiling    int // Highest index the room's size allows
+    Clamp             qualityClamp // The room's policy clamp, copied on join
+    
+    // The welcome's suggested start is held until feedback arrives or this
+    // passes, so missing metrics don't walk it straight back down
+    QualityHoldUntil  time.Time
+    Subnet            string // Key into bandwidthHistory
+    probe             *bandwidthProbe // Startup burst awaiting acks, nil once the welcome is out
+    
+    // Audio degradation, an index in AudioLevels (0 is full quality)
+    AudioQuality      int
+    AudioCongested    int // Consecutive congested ticks at the lowest video preset
+    AudioClear        int // Consecutive clear ticks while audio is degraded
+    
+    // Audio packet aggregation in ms: the ceiling the client negotiated with
+    // audio-packet-ms (0 until it does, and it then gets audio verbatim) and
+    // the size the congestion controller picked within it
+    MaxAudioPacketMs  int
+    AudioPacketMs     int
+    PacketCongested   int
+    PacketClear       int
+    audioPending      map[string]*pendingAudio // By sender, touched only by the hub goroutine
+    
+    // Room messages the hub offered this client and those dropped on a full
+    // Send (atomic), for the connection-quality summary
+    offered           int64
+    dropped           int64
     
     // Performance tracking
     Metrics          *ClientMetrics
@@ -102,9 +185,84 @@ type Message struct {
     Width         int         `json:"width,omitempty"`
     Height        int         `json:"height,omitempty"`
     FPS           int         `json:"fps,omitempty"`
+    CompressionType string    `json:"compressionType,omitempty"`
     
     // Client feedback
     Feedback      *ClientFeedback `json:"feedback,omitempty"`
+    
+    // Room quality ceiling (quality-ceiling), an index into QualityLevels
+    MaxIndex      *int        `json:"maxIndex,omitempty"`
+    
+    // Suggested starting preset in the welcome, an index into QualityLevels
+    QualityIndex  *int        `json:"qualityIndex,omitempty"`
+    
+    // Room policy clamp on the join that creates a room, as indices into
+    // QualityLevels; later joiners can't change it
+    MinQuality    *int        `json:"minQuality,omitempty"`
+    MaxQuality    *int        `json:"maxQuality,omitempty"`
+    
+    // Why a message was refused (error)
+    Error         string      `json:"error,omitempty"`
+    
+    // welcome: how the server treats this room's media
+    Media         *MediaProfile `json:"media,omitempty"`
+    
+    // false on join skips the startup bandwidth probe
+    Probe         *bool       `json:"probe,omitempty"`
+    
+    // PCM rate of relayed audio and audio-quality events
+    SampleRate    int         `json:"sampleRate,omitempty"`
+    
+    // Audio packet duration: the ceiling a client accepts in audio-packet-ms,
+    // the size the server picked in its reply, and the span of relayed audio
+    PacketMs      int         `json:"packetMs,omitempty"`
+    
+    // time-sync exchange (ms): server send, client receive, client reply
+    T1            int64       `json:"t1,omitempty"`
+    T2            int64       `json:"t2,omitempty"`
+    T3            int64       `json:"t3,omitempty"`
+    
+    // connection-quality: good, fair or poor, and the signals behind anything
+    // short of good
+    Level         string      `json:"level,omitempty"`
+    Reasons       []string    `json:"reasons,omitempty"`
+}
+
+// MediaProfile tells a joiner what the server does with the room's media,
+// so it can capture and encode to match instead of having frames redone
+type MediaProfile struct {
+    Codec      string          `json:"codec"`      // What transcoded frames go out as
+    Accepts    []string        `json:"accepts"`    // Frame formats the encoder decodes
+    Ladder     []QualityPreset `json:"ladder"`     // QualityLevels; qualityIndex and quality events index into it
+    MinQuality int             `json:"minQuality"` // The room's clamp on the ladder
+    MaxQuality int             `json:"maxQuality"`
+    Audio      AudioProfile    `json:"audio"`
+}
+
+// AudioProfile says what happens to audio on the way through
+type AudioProfile struct {
+    Processed        bool  `json:"processed"`   // false: relayed exactly as sent
+    EchoCancellation bool  `json:"echoCancellation"`
+    Mixing           bool  `json:"mixing"`
+    SampleRates      []int `json:"sampleRates"` // Rates a struggling receiver is stepped down through
+}
+
+// mediaProfile is the welcome's account of a client's room. Audio is
+// never mixed here but is resampled for receivers on a lower AudioLevels
+// step.
+func (c *Client) mediaProfile() *MediaProfile {
+    rates := make([]int, len(AudioLevels))
+    for i, level := range AudioLevels {
+        rates[i] = level.SampleRate
+    }
+    return &MediaProfile{
+        Codec:      frameCodec.Name(),
+        Accepts:    []string{"jpeg", "png"},
+        Ladder:     QualityLevels,
+        MinQuality: c.Clamp.Min,
+        MaxQuality: c.Clamp.Max,
+        Audio:      AudioProfile{Processed: true, SampleRates: rates},
+    }
 }
 
 type ClientFeedback struct {
@@ -115,6 +273,7 @@ type ClientFeedback struct {
     Bandwidth      float64 `json:"bandwidth"`      // Mbps
     Latency        int64   `json:"latency"`        // ms
     RequestQuality string  `json:"requestQuality"` // Client requested quality
+    ProbeAck       int     `json:"probeAck,omitempty"` // Seq of a bandwidth-probe packet received; nothing else is read
 }
 
 // Room with quality optimization
@@ -126,6 +285,12 @@ type Room struct {
     TotalBandwidth  float64
     AverageLatency  float64
     
+    // Highest preset every participant may use, from participant count
+    QualityCeiling  int
+    
+    // Policy clamp set at creation; the controller never leaves it
+    Clamp           qualityClamp
+    
     mu sync.RWMutex
 }
 
@@ -147,6 +312,7 @@ type BroadcastMessage struct {
     Room    string
     Message []byte
     From    string
+    IsAudio bool
 }
 
 var (
@@ -157,22 +323,388 @@ var (
     }
     
     hub *Hub
+    
+    // Quality hysteresis, overridable via QUALITY_UP_TICKS / QUALITY_UP_COOLDOWN
+    qualityUpTicks    = 3                // Ticks in the increase region before stepping up
+    qualityUpCooldown = 10 * time.Second // No up-step this soon after a down-step
+    qualityUpSettle   = 2 * time.Second
+    qualityDownSettle = 500 * time.Millisecond
+    
+    // Audio steps down after this many congested ticks at the lowest video
+    // preset, and back up after qualityUpTicks clear ones
+    audioDegradeTicks = 5
+    audioDegradeScore = 50.0 // Score below which a tick counts as congested
+    audioRecoverScore = 80.0
+    
+    // Audio packet sizes in ms; a step up follows audioDegradeTicks congested
+    // ticks, a step down qualityUpTicks clear ones
+    audioFrameMs     = 20
+    maxAudioPacketMs = 60
+    audioResidueTTL  = 100 * time.Millisecond // Buffered audio older than this goes out short
+    
+    // Video codec, chosen from VIDEO_CODEC at startup
+    frameCodec = newFrameCodec("webp")
+    
+    // Room bandwidth the quality ceiling divides up, ROOM_BANDWIDTH_KBPS
+    roomBandwidthKbps = 24000
+    
+    // Share of the room budget left for video, by participant count
+    // (same split as the WebP server)
+    bandwidthAllocation = map[int]struct{ audioPct, videoPct int }{
+        1: {audioPct: 10, videoPct: 90},
+        2: {audioPct: 15, videoPct: 85},
+        3: {audioPct: 20, videoPct: 80},
+        4: {audioPct: 25, videoPct: 75},
+        5: {audioPct: 30, videoPct: 70},
+        6: {audioPct: 35, videoPct: 65},
+    }
+    
+    // Bitrate control, disabled with RATE_CONTROL=off
+    rateControl          = os.Getenv("RATE_CONTROL") != "off"
+    rateSearchIterations = 4    // Encodes per search, RATE_SEARCH_ITERATIONS
+    rateSearchEvery      = 30   // Frames between searches (keyframes)
+    rateTolerance        = 0.15 // Accept sizes within 15% under budget
+    
+    // Clock sync: one time-sync probe per interval, offset taken from the
+    // lowest-RTT sample among the last timeSyncWindow
+    timeSyncInterval = 5 * time.Second
+    timeSyncWindow   = 8
+    
+    // Send-side bandwidth: one estimate per sendEstimateWindow of backlogged
+    // writing, trusted for sendEstimateTTL after the backlog clears
+    sendEstimateWindow = 250 * time.Millisecond
+    sendEstimateTTL    = 10 * time.Second
+    
+    // Starting quality: without history a joiner starts at the preset that
+    // fits 1/startHeadroom of its video share, never above startQualityMax
+    // (START_QUALITY, a preset name; "lowest" always starts at 144p). A
+    // subnet's last measured bandwidth is kept for BANDWIDTH_HISTORY_TTL.
+    startQualityMax     = 4 // 720p
+    startHeadroom       = 4
+    startQualityHold    = 5 * time.Second
+    bandwidthHistoryTTL = 24 * time.Hour
+    maxBandwidthHistory = 10000
+    
+    // Trust X-Forwarded-For from a reverse proxy (Caddy), TRUST_PROXY=true
+    trustProxy = os.Getenv("TRUST_PROXY") == "true"
+    
+    subnetBandwidth = &bandwidthHistory{entries: make(map[string]bandwidthSample)}
+)
+
+// Startup probe: after a join the server sends probePackets filler messages
+// back to back and the client acks each with a feedback probeAck. The spread
+// of the acks gives the downstream rate, which seeds the metrics and the
+// welcome's starting preset, so a fast link doesn't climb up from the
+// bottom one rung at a time.
+const (
+    probePackets     = 8
+    probePacketBytes = 32 * 1024 // Filler per packet, before base64
+    probeTimeout     = 2 * time.Second
+    probeMaxMbps     = 100.0 // Acks too close together to time say no more than this
 )
 
-// Adaptive quality algorithm
-func (c *Client) calculateOptimalQuality() int {
+// bandwidthProbe is one startup burst; guarded by the client's mu
+type bandwidthProbe struct {
+    participants int         // Room size for the welcome that follows
+    sizes        []int       // Wire size of each packet, by seq-1
+    acked        []time.Time // Arrival of each packet's ack, zero until then
+    remaining    int
+}
+
+func newBandwidthProbe(participants int, sizes []int) *bandwidthProbe {
+    return &bandwidthProbe{
+        participants: participants,
+        sizes:        sizes,
+        acked:        make([]time.Time, len(sizes)),
+        remaining:    len(sizes),
+    }
+}
+
+// ack records seq's ack, reporting whether every packet is now acked
+func (p *bandwidthProbe) ack(seq int, now time.Time) bool {
+    if seq < 1 || seq > len(p.acked) || !p.acked[seq-1].IsZero() {
+        return false
+    }
+    p.acked[seq-1] = now
+    p.remaining--
+    return p.remaining == 0
+}
+
+// estimate is the rate in Mbps the ack spread implies: the bytes acked after
+// the first ack over the time they took. It needs two acks; the first
+// packet's size is left out since its travel time includes the RTT.
+func (p *bandwidthProbe) estimate() (float64, bool) {
+    var first, last time.Time
+    firstSize, bytes, acks := 0, 0, 0
+    for i, at := range p.acked {
+        if at.IsZero() {
+            continue
+        }
+        acks++
+        bytes += p.sizes[i]
+        if first.IsZero() || at.Before(first) {
+            first, firstSize = at, p.sizes[i]
+        }
+        if at.After(last) {
+            last = at
+        }
+    }
+    if acks < 2 {
+        return 0, false
+    }
+    bytes -= firstSize
+    
+    span := last.Sub(first).Seconds()
+    if span <= 0 {
+        return probeMaxMbps, true
+    }
+    return math.Min(float64(bytes)*8/span/1e6, probeMaxMbps), true
+}
+
+// startProbe queues the burst; the welcome goes out once every packet is
+// acked or probeTimeout passes, whichever is first
+func (c *Client) startProbe(participants int) {
+    filler := make([]byte, probePacketBytes)
+    packets := make([][]byte, probePackets)
+    sizes := make([]int, probePackets)
+    for i := range packets {
+        rand.Read(filler) // Random so permessage-deflate can't shrink it
+        data, err := json.Marshal(Message{Type: "bandwidth-probe", Seq: i + 1, Data: base64.StdEncoding.EncodeToString(filler)})
+        if err != nil {
+            c.welcome(participants)
+            return
+        }
+        packets[i], sizes[i] = data, len(data)
+    }
+    
+    probe := newBandwidthProbe(participants, sizes)
+    c.mu.Lock()
+    c.probe = probe
+    c.mu.Unlock()
+    time.AfterFunc(probeTimeout, func() { c.finishProbe(probe) })
+    
+    for _, data := range packets {
+        if !c.send(data) {
+            return
+        }
+    }
+}
+
+// ackProbe takes a probeAck, finishing the probe on the last one
+func (c *Client) ackProbe(seq int) {
+    c.mu.Lock()
+    probe := c.probe
+    done := probe != nil && probe.ack(seq, time.Now())
+    c.mu.Unlock()
+    
+    if done {
+        c.finishProbe(probe)
+    }
+}
+
+// finishProbe seeds Metrics.Bandwidth from the probe, unless feedback beat
+// it there, and sends the welcome; only the first call for a probe does
+func (c *Client) finishProbe(probe *bandwidthProbe) {
+    c.mu.Lock()
+    if c.probe != probe {
+        c.mu.Unlock()
+        return
+    }
+    c.probe = nil
+    mbps, ok := probe.estimate()
+    c.mu.Unlock()
+    
+    if ok {
+        c.Metrics.mu.Lock()
+        if c.Metrics.Bandwidth <= 0 {
+            c.Metrics.Bandwidth = mbps
+        }
+        c.Metrics.mu.Unlock()
+        log.Printf("Client %s probe: %.2f Mbps from %d acks", c.ID, mbps, probePackets-probe.remaining)
+    } else {
+        log.Printf("Client %s probe: too few acks for an estimate", c.ID)
+    }
+    c.welcome(probe.participants)
+}
+
+// bandwidthHistory remembers the last bandwidth measured per subnet, so a
+// returning client (or its neighbour) can start at a quality its link has
+// already shown it carries
+type bandwidthHistory struct {
+    entries map[string]bandwidthSample
+    mu      sync.Mutex
+}
+
+type bandwidthSample struct {
+    Mbps float64
+    At   time.Time
+}
+
+func (h *bandwidthHistory) remember(subnet string, mbps float64, now time.Time) {
+    if subnet == "" || mbps <= 0 {
+        return
+    }
+    
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    if _, ok := h.entries[subnet]; !ok && len(h.entries) >= maxBandwidthHistory {
+        for key, sample := range h.entries {
+            if now.Sub(sample.At) > bandwidthHistoryTTL {
+                delete(h.entries, key)
+            }
+        }
+        if len(h.entries) >= maxBandwidthHistory {
+            return
+        }
+    }
+    h.entries[subnet] = bandwidthSample{Mbps: mbps, At: now}
+}
+
+func (h *bandwidthHistory) recall(subnet string, now time.Time) (float64, bool) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    sample, ok := h.entries[subnet]
+    if !ok || now.Sub(sample.At) > bandwidthHistoryTTL {
+        return 0, false
+    }
+    return sample.Mbps, true
+}
+
+// clientIP honours X-Forwarded-For only behind a trusted proxy (TRUST_PROXY=true)
+func clientIP(r *http.Request) string {
+    if trustProxy {
+        if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+            first := strings.TrimSpace(strings.Split(fwd, ",")[0])
+            if net.ParseIP(first) != nil {
+                return first
+            }
+        }
+    }
+    
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// subnetKey groups addresses that likely share a link: /24 for IPv4, /48 for IPv6
+func subnetKey(ip string) string {
+    parsed := net.ParseIP(ip)
+    if parsed == nil {
+        return ""
+    }
+    if v4 := parsed.To4(); v4 != nil {
+        return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+    }
+    return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// qualityClamp bounds a room's presets regardless of bandwidth, e.g. to keep
+// support calls at 480p or below for cost
+type qualityClamp struct {
+    Min, Max int // Indices into QualityLevels
+}
+
+// fullRange is the clamp of a room created without one
+func fullRange() qualityClamp {
+    return qualityClamp{Min: 0, Max: len(QualityLevels) - 1}
+}
+
+// parseClamp reads a join's minQuality/maxQuality, defaulting either end to
+// the full ladder
+func parseClamp(minQuality, maxQuality *int) (qualityClamp, error) {
+    clamp := fullRange()
+    if minQuality != nil {
+        clamp.Min = *minQuality
+    }
+    if maxQuality != nil {
+        clamp.Max = *maxQuality
+    }
+    if clamp.Min < 0 || clamp.Max > len(QualityLevels)-1 {
+        return qualityClamp{}, fmt.Errorf("quality clamp must be within 0-%d", len(QualityLevels)-1)
+    }
+    if clamp.Min > clamp.Max {
+        return qualityClamp{}, fmt.Errorf("minQuality %d is above maxQuality %d", clamp.Min, clamp.Max)
+    }
+    return clamp, nil
+}
+
+// apply moves index into the clamp
+func (q qualityClamp) apply(index int) int {
+    if index > q.Max {
+        index = q.Max
+    }
+    if index < q.Min {
+        index = q.Min
+    }
+    return index
+}
+
+// suggestQuality picks a joiner's starting preset from the room's ceiling
+// and, when known, the bandwidth last measured from its subnet
+func suggestQuality(participants, ceiling int, mbps float64, known bool) int {
+    if startQualityMax <= 0 {
+        return 0
+    }
+    
+    budget, limit := 0, ceiling
+    if known {
+        // Measured links get the same 1.2x margin the controller wants to step up
+        budget = int(mbps * 1000 / 1.2)
+    } else {
+        if participants < 1 {
+            participants = 1
+        }
+        alloc, ok := bandwidthAllocation[participants]
+        if !ok {
+            alloc = bandwidthAllocation[6]
+        }
+        budget = roomBandwidthKbps * alloc.videoPct / 100 / participants / startHeadroom
+        if limit > startQualityMax {
+            limit = startQualityMax
+        }
+    }
+    
+    suggested := 0
+    for i, preset := range QualityLevels {
+        if i <= limit && preset.Bitrate <= budget {
+            suggested = i
+        }
+    }
+    return suggested
+}
+
+// newFrameCodec selects the codec named by VIDEO_CODEC (webp|jpeg), webp at
+// libwebp's default effort
+func newFrameCodec(name string) framecodec.Codec {
+    codec, ok := framecodec.New(name, webpcodec.DefaultEffort)
+    if !ok {
+        log.Printf("Unknown VIDEO_CODEC %q, falling back to %s", name, codec.Name())
+    }
+    return codec
+}
+
+// Adaptive quality algorithm, returns the target level and the score behind it
+func (c *Client) calculateOptimalQuality() (int, float64) {
     c.mu.RLock()
     metrics := c.Metrics
     current := c.CurrentQuality
     c.mu.RUnlock()
     
     if metrics == nil {
-        return 0 // Start with lowest quality
+        return 0, 0 // Start with lowest quality
     }
     
     metrics.mu.RLock()
-    bandwidth := metrics.Bandwidth
+    bandwidth := metrics.usableBandwidth(time.Now())
     latency := metrics.Latency
+    if metrics.synced && metrics.VideoLatency > 0 {
+        // Measured upstream delay beats the client's RTT guess; keep the RTT scale
+        latency = 2 * metrics.VideoLatency
+    }
     packetLoss := metrics.PacketLoss
     bufferHealth := metrics.BufferHealth
     cpuUsage := metrics.CPUUsage
@@ -250,7 +782,16 @@ func (c *Client) calculateOptimalQuality() int {
         }
     }
     
-    return targetQuality
+    // Never above what the room's participant count allows, and never
+    // outside the room's policy clamp
+    c.mu.RLock()
+    if targetQuality > c.QualityCeiling {
+        targetQuality = c.QualityCeiling
+    }
+    targetQuality = c.Clamp.apply(targetQuality)
+    c.mu.RUnlock()
+    
+    return targetQuality, score
 }
 
 // Process client feedback
@@ -299,8 +840,181 @@ func (c *Client) processFeedback(feedback *ClientFeedback) {
     }
 }
 
-// WebP compression with quality settings
-func compressToWebP(data []byte, quality *QualityPreset) ([]byte, error) {
+// clockSample is one time-sync exchange, in ms
+type clockSample struct {
+    offset int64 // Client clock minus server clock
+    rtt    int64 // Round trip less the client's hold time
+}
+
+// estimateClock is the NTP estimate from server send t1, client receive t2,
+// client reply t3 and server receive t4. The offset is exact when both legs
+// take the same time; asymmetry shows up as half the difference.
+func estimateClock(t1, t2, t3, t4 int64) clockSample {
+    return clockSample{
+        offset: ((t2 - t1) + (t3 - t4)) / 2,
+        rtt:    (t4 - t1) - (t3 - t2),
+    }
+}
+
+// usableBandwidth is the client's reported bandwidth, capped by what we
+// could actually push it recently; caller holds m.mu
+func (m *ClientMetrics) usableBandwidth(now time.Time) float64 {
+    bandwidth := m.Bandwidth
+    if m.SendBandwidth > 0 && now.Sub(m.SendMeasuredAt) < sendEstimateTTL &&
+        (bandwidth <= 0 || m.SendBandwidth < bandwidth) {
+        bandwidth = m.SendBandwidth
+    }
+    return bandwidth
+}
+
+// addClockSample records an exchange and re-derives the offset from the
+// least-queued sample in the window, which NTP trusts most
+func (m *ClientMetrics) addClockSample(sample clockSample) {
+    if sample.rtt < 0 {
+        return // Client timestamps out of order
+    }
+    
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    
+    m.clockSamples = append(m.clockSamples, sample)
+    if len(m.clockSamples) > timeSyncWindow {
+        m.clockSamples = m.clockSamples[1:]
+    }
+    
+    best := m.clockSamples[0]
+    for _, s := range m.clockSamples[1:] {
+        if s.rtt < best.rtt {
+            best = s
+        }
+    }
+    m.ClockOffset = best.offset
+    m.SyncRTT = best.rtt
+    m.synced = true
+}
+
+// recordOneWay folds the upstream delay of a media message stamped sentAt
+// by the client into the audio or video average; ignored until synced
+func (m *ClientMetrics) recordOneWay(sentAt, receivedAt int64, audio bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    
+    if !m.synced {
+        return
+    }
+    delay := receivedAt - (sentAt - m.ClockOffset)
+    if delay < 0 {
+        delay = 0 // Within the offset's error
+    }
+    
+    avg := &m.VideoLatency
+    if audio {
+        avg = &m.AudioLatency
+    }
+    if *avg == 0 {
+        *avg = delay
+    } else {
+        *avg = (*avg*7 + delay) / 8
+    }
+}
+
+// recordWrite accounts one message written at `at`. While the queue was
+// backlogged at the previous write, the gap since it is pure write time, so
+// bytes over those gaps is the rate the connection drains at.
+func (m *ClientMetrics) recordWrite(n int, at time.Time, backlogged bool) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    
+    if m.backlogged {
+        m.sendBytes += int64(n)
+        m.sendBusy += at.Sub(m.lastWrite)
+    }
+    m.lastWrite = at
+    m.backlogged = backlogged
+    
+    if m.sendBusy >= sendEstimateWindow {
+        rate := float64(m.sendBytes*8) / m.sendBusy.Seconds() / 1e6
+        if m.SendBandwidth == 0 || at.Sub(m.SendMeasuredAt) > sendEstimateTTL {
+            m.SendBandwidth = rate
+        } else {
+            m.SendBandwidth = m.SendBandwidth*0.7 + rate*0.3
+        }
+        m.SendMeasuredAt = at
+        m.sendBytes, m.sendBusy = 0, 0
+    }
+}
+
+// rateController tracks one sender's codec quality against its byte budget.
+// Only keyframes pay for a search; frames in between reuse the result.
+type rateController struct {
+    preset  string
+    quality float32 // Last quality that fit the budget, 0-100
+    frames  int
+}
+
+// frameBudget is the preset's bitrate spread over its frame rate, in bytes
+func frameBudget(preset *QualityPreset) int {
+    fps := preset.FPS
+    if fps <= 0 {
+        fps = 1
+    }
+    return preset.Bitrate * 1000 / 8 / fps
+}
+
+// encode binary-searches the quality on keyframes, starting from the last
+// result, and keeps the largest encoding that fits the budget
+func (rc *rateController) encode(img image.Image, preset *QualityPreset) ([]byte, error) {
+    if rc.preset != preset.Name {
+        rc.preset = preset.Name
+        rc.quality = preset.Quality * 100
+        rc.frames = 0
+    }
+    
+    rc.frames++
+    if rc.frames%rateSearchEvery != 1 {
+        return frameCodec.Encode(img, rc.quality)
+    }
+    
+    budget := frameBudget(preset)
+    lo, hi := float32(1), float32(100)
+    q := rc.quality
+    
+    var fit, smallest []byte
+    fitQ, smallestQ := q, q
+    
+    for i := 0; i < rateSearchIterations; i++ {
+        data, err := frameCodec.Encode(img, q)
+        if err != nil {
+            return nil, err
+        }
+        
+        if len(data) <= budget {
+            if len(data) > len(fit) {
+                fit, fitQ = data, q
+            }
+            if float64(len(data)) >= float64(budget)*(1-rateTolerance) {
+                break
+            }
+            lo = q
+        } else {
+            if smallest == nil || len(data) < len(smallest) {
+                smallest, smallestQ = data, q
+            }
+            hi = q
+        }
+        q = (lo + hi) / 2
+    }
+    
+    // Nothing fit: ship the smallest attempt and start lower next time
+    if fit == nil {
+        fit, fitQ = smallest, smallestQ
+    }
+    rc.quality = fitQ
+    return fit, nil
+}
+
+// Frame compression with quality settings; rc may be nil for the fixed preset quality
+func compressFrame(data []byte, quality *QualityPreset, rc *rateController) ([]byte, error) {
     img, _, err := image.Decode(bytes.NewReader(data))
     if err != nil {
         return nil, err
@@ -316,19 +1030,11 @@ func compressToWebP(data []byte, quality *QualityPreset) ([]byte, error) {
     rgba := image.NewRGBA(bounds)
     draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
     
-    // Compress to WebP with quality setting
-    var buf bytes.Buffer
-    options := &webp.Options{
-        Lossless: false,
-        Quality:  quality.Quality,
-        Exact:    false,
+    // Compress with the configured codec
+    if rc != nil {
+        return rc.encode(rgba, quality)
     }
-    
-    if err := webp.Encode(&buf, rgba, options); err != nil {
-        return nil, err
-    }
-    
-    return buf.Bytes(), nil
+    return frameCodec.Encode(rgba, quality.Quality*100)
 }
 
 // Handle client connection
@@ -339,13 +1045,20 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
         return
     }
     
+    // Not r.Context(): that ends when this handler returns, not the connection
+    ctx, cancel := context.WithCancel(context.Background())
     client := &Client{
+        ctx:              ctx,
+        cancel:           cancel,
         ID:               fmt.Sprintf("client-%d", time.Now().UnixNano()),
         Conn:             conn,
         Send:             make(chan []byte, 256),
         Hub:              hub,
         CurrentQuality:   0, // Start with lowest
         TargetQuality:    0,
+        QualityCeiling:   len(QualityLevels) - 1,
+        Clamp:            fullRange(),
+        Subnet:           subnetKey(clientIP(r)),
         Metrics:          &ClientMetrics{},
         FeedbackInterval: time.Second,
         LastFrameTime:    time.Now(),
@@ -359,58 +1072,545 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 }
 
 // Quality monitoring goroutine
+func (c *Client) notifyQuality(index int) {
+    quality := QualityLevels[index]
+    msg := Message{
+        Type:    "quality-change",
+        Quality: quality.Name,
+        Width:   int(quality.Width),
+        Height:  int(quality.Height),
+        FPS:     quality.FPS,
+    }
+    
+    data, _ := json.Marshal(msg)
+    select {
+    case c.Send <- data:
+    default:
+    }
+}
+
+// applyCeiling caps the client at the room ceiling, dropping it right away
+// instead of waiting for the feedback loop to notice congestion
+func (c *Client) applyCeiling(ceiling int) {
+    now := time.Now()
+    
+    c.mu.Lock()
+    c.QualityCeiling = ceiling
+    ceiling = c.Clamp.apply(ceiling)
+    dropped := c.CurrentQuality > ceiling
+    if dropped {
+        c.CurrentQuality = ceiling
+        c.LastQualityChange = now
+        c.LastDownStep = now
+        c.UpStreak = 0
+    }
+    c.mu.Unlock()
+    
+    if data, err := json.Marshal(Message{Type: "quality-ceiling", MaxIndex: &ceiling}); err == nil {
+        select {
+        case c.Send <- data:
+        default:
+        }
+    }
+    if dropped {
+        c.notifyQuality(ceiling)
+    }
+}
+
+// roomCeiling is the highest preset whose bitrate fits each participant's
+// video share of the room budget
+func roomCeiling(participants int) int {
+    if participants < 1 {
+        participants = 1
+    }
+    alloc, ok := bandwidthAllocation[participants]
+    if !ok {
+        alloc = bandwidthAllocation[6]
+    }
+    perSender := roomBandwidthKbps * alloc.videoPct / 100 / participants
+    
+    ceiling := 0
+    for i, preset := range QualityLevels {
+        if preset.Bitrate <= perSender {
+            ceiling = i
+        }
+    }
+    return ceiling
+}
+
+// updateCeiling recomputes the room ceiling and pushes it to everyone when it
+// changed; a joiner is told the ceiling either way
+func (h *Hub) updateCeiling(room *Room, joiner *Client) {
+    room.mu.Lock()
+    ceiling := roomCeiling(len(room.Clients))
+    changed := ceiling != room.QualityCeiling
+    room.QualityCeiling = ceiling
+    clients := make([]*Client, 0, len(room.Clients))
+    for _, client := range room.Clients {
+        clients = append(clients, client)
+    }
+    room.mu.Unlock()
+    
+    if !changed {
+        if joiner != nil {
+            joiner.applyCeiling(ceiling)
+        }
+        return
+    }
+    
+    log.Printf("Room %s quality ceiling now %s (%d participants)", room.ID, QualityLevels[ceiling].Name, len(clients))
+    for _, client := range clients {
+        client.applyCeiling(ceiling)
+    }
+}
+
 func (c *Client) qualityMonitor() {
     ticker := time.NewTicker(time.Second)
     defer ticker.Stop()
     
+    // Fan-out counts at the last tick and the connection-quality level last pushed
+    var lastOffered, lastDropped int64
+    var connLevel string
+    var connPushedAt time.Time
+    
     for {
         select {
+        case <-c.ctx.Done():
+            return
+            
         case <-ticker.C:
             // Calculate optimal quality
-            optimal := c.calculateOptimalQuality()
+            optimal, score := c.calculateOptimalQuality()
+            now := time.Now()
+            
+            c.Metrics.mu.RLock()
+            measured := !c.Metrics.LastUpdate.IsZero() && now.Sub(c.Metrics.LastUpdate) < 5*time.Second
+            c.Metrics.mu.RUnlock()
             
             c.mu.Lock()
             oldQuality := c.CurrentQuality
-            
-            // Smooth quality transitions
-            if optimal > c.CurrentQuality && time.Since(c.LastQualityChange) > 2*time.Second {
-                c.CurrentQuality++
-                c.LastQualityChange = time.Now()
-            } else if optimal < c.CurrentQuality && time.Since(c.LastQualityChange) > 500*time.Millisecond {
-                c.CurrentQuality--
-                c.LastQualityChange = time.Now()
-            }
+            oldAudio := c.AudioQuality
+            oldPacket := c.AudioPacketMs
+            decision := c.stepLadders(optimal, score, measured, now)
             
             newQuality := c.CurrentQuality
+            newAudio := c.AudioQuality
+            newPacket := c.AudioPacketMs
             c.mu.Unlock()
             
+            if newPacket != oldPacket {
+                c.notifyAudioPacket(newPacket)
+                log.Printf("Client %s audio packets %dms -> %dms (score %.1f)", c.ID, oldPacket, newPacket, score)
+            }
+            
             // Notify client of quality change
             if newQuality != oldQuality {
-                quality := QualityLevels[newQuality]
-                msg := Message{
-                    Type:    "quality-change",
-                    Quality: quality.Name,
-                    Width:   int(quality.Width),
-                    Height:  int(quality.Height),
-                    FPS:     quality.FPS,
-                }
-                
-                data, _ := json.Marshal(msg)
-                select {
-                case c.Send <- data:
-                default:
+                c.notifyQuality(newQuality)
+            }
+            if newAudio != oldAudio {
+                c.notifyAudioQuality(newAudio)
+                log.Printf("Client %s audio quality %s -> %s (video %s, score %.1f)",
+                    c.ID, AudioLevels[oldAudio].Name, AudioLevels[newAudio].Name, QualityLevels[newQuality].Name, score)
+            }
+            
+            if optimal != oldQuality {
+                c.Metrics.mu.RLock()
+                log.Printf("Client %s quality %s: %s -> %s (target %s, score %.1f, bandwidth %.2f Mbps (sent %.2f), latency %dms, loss %.1f%%, buffer %.2f)",
+                    c.ID, decision, QualityLevels[oldQuality].Name, QualityLevels[newQuality].Name,
+                    QualityLevels[optimal].Name, score, c.Metrics.Bandwidth, c.Metrics.SendBandwidth, c.Metrics.Latency,
+                    c.Metrics.PacketLoss, c.Metrics.BufferHealth)
+                c.Metrics.mu.RUnlock()
+            }
+            
+            offered, dropped := atomic.LoadInt64(&c.offered), atomic.LoadInt64(&c.dropped)
+            level, reasons := rateConnection(c.connectionSignals(offered-lastOffered, dropped-lastDropped))
+            lastOffered, lastDropped = offered, dropped
+            if level != connLevel || now.Sub(connPushedAt) >= connQualityRepeat {
+                if c.notifyConnectionQuality(level, reasons) {
+                    connLevel, connPushedAt = level, now
                 }
-                
-                log.Printf("Client %s quality changed: %s -> %s (bandwidth: %.2f Mbps, latency: %dms)",
-                    c.ID, QualityLevels[oldQuality].Name, quality.Name,
-                    c.Metrics.Bandwidth, c.Metrics.Latency)
             }
         }
     }
 }
 
+// Connection quality is the user-facing health badge, separate from the
+// preset the quality controller picks. Each signal past its fair or poor
+// bound pulls the level down to that and is named in reasons.
+const (
+    connFairLatency   = 150 // Round trip, ms
+    connPoorLatency   = 400
+    connFairDrops     = 2.0 // Percent, ours or the client's, whichever is worse
+    connPoorDrops     = 10.0
+    connFairQueue     = 0.5 // Share of Send in use
+    connPoorQueue     = 0.9
+    connFairBitrate   = 1.0 // Usable bandwidth over the current preset's bitrate
+    connPoorBitrate   = 0.5
+    connQualityRepeat = 5 * time.Second // An unchanged level is pushed again this often
+)
+
+// connectionSignals are the measurements a connection is judged on
+type connectionSignals struct {
+    LatencyMs    int64
+    DropPct      float64
+    QueueFill    float64
+    BitrateRatio float64 // 0 while bandwidth is unmeasured
+}
+
+// rateConnection grades signals as good, fair or poor
+func rateConnection(s connectionSignals) (string, []string) {
+    level := 0
+    var reasons []string
+    judge := func(reason string, fair, poor bool) {
+        switch {
+        case poor:
+            level = 2
+        case fair:
+            level = max(level, 1)
+        default:
+            return
+        }
+        reasons = append(reasons, reason)
+    }
+    
+    judge("latency", s.LatencyMs > connFairLatency, s.LatencyMs > connPoorLatency)
+    judge("drops", s.DropPct > connFairDrops, s.DropPct > connPoorDrops)
+    judge("send-queue", s.QueueFill > connFairQueue, s.QueueFill > connPoorQueue)
+    measured := s.BitrateRatio > 0
+    judge("bitrate", measured && s.BitrateRatio < connFairBitrate, measured && s.BitrateRatio < connPoorBitrate)
+    
+    return [...]string{"good", "fair", "poor"}[level], reasons
+}
+
+// connectionSignals samples what the server already tracks for the client;
+// offered and dropped are the hub's fan-out counts since the last sample
+func (c *Client) connectionSignals(offered, dropped int64) connectionSignals {
+    s := connectionSignals{QueueFill: float64(len(c.Send)) / float64(cap(c.Send))}
+    if offered > 0 {
+        s.DropPct = float64(dropped) / float64(offered) * 100
+    }
+    
+    c.mu.RLock()
+    current := c.CurrentQuality
+    c.mu.RUnlock()
+    
+    m := c.Metrics
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    
+    // Our own time-sync round trip beats the client's report once synced
+    s.LatencyMs = m.Latency
+    if m.synced {
+        s.LatencyMs = m.SyncRTT
+    }
+    s.DropPct = max(s.DropPct, m.PacketLoss)
+    if bandwidth := m.usableBandwidth(time.Now()); bandwidth > 0 {
+        s.BitrateRatio = bandwidth / (float64(QualityLevels[current].Bitrate) / 1000.0)
+    }
+    return s
+}
+
+// notifyConnectionQuality pushes the badge, reporting false when Send was full
+func (c *Client) notifyConnectionQuality(level string, reasons []string) bool {
+    data, _ := json.Marshal(Message{Type: "connection-quality", Level: level, Reasons: reasons})
+    select {
+    case c.Send <- data:
+        return true
+    default:
+        return false
+    }
+}
+
+// stepLadders moves video, then audio, one tick toward the measured link;
+// caller holds c.mu. Audio is the last to degrade and the first to recover,
+// so video is held where it is until audio is back at full quality.
+func (c *Client) stepLadders(optimal int, score float64, measured bool, now time.Time) string {
+    videoTarget := optimal
+    if c.AudioQuality > 0 && videoTarget > c.CurrentQuality {
+        videoTarget = c.CurrentQuality
+    }
+    decision := "hold (starting quality)"
+    if measured || !now.Before(c.QualityHoldUntil) {
+        decision = c.stepQuality(videoTarget, now)
+    }
+    if measured {
+        c.stepAudio(score)
+        c.stepAudioPacket(score)
+    }
+    return decision
+}
+
+// stepQuality applies the hysteresis band to the optimal level; caller holds c.mu.
+// Up-steps need qualityUpTicks consecutive requests and must not follow a
+// down-step within qualityUpCooldown, so borderline links settle instead of flapping.
+func (c *Client) stepQuality(optimal int, now time.Time) string {
+    switch {
+    case optimal > c.CurrentQuality:
+        c.UpStreak++
+        if c.UpStreak < qualityUpTicks {
+            return fmt.Sprintf("hold (up streak %d/%d)", c.UpStreak, qualityUpTicks)
+        }
+        if now.Sub(c.LastDownStep) < qualityUpCooldown {
+            return "hold (cooldown after down-step)"
+        }
+        if now.Sub(c.LastQualityChange) <= qualityUpSettle {
+            return "hold (settling)"
+        }
+        c.CurrentQuality++
+        c.LastQualityChange = now
+        c.UpStreak = 0
+        return "up"
+        
+    case optimal < c.CurrentQuality:
+        c.UpStreak = 0
+        if now.Sub(c.LastQualityChange) <= qualityDownSettle {
+            return "hold (settling)"
+        }
+        c.CurrentQuality--
+        c.LastQualityChange = now
+        c.LastDownStep = now
+        return "down"
+    }
+    
+    c.UpStreak = 0
+    return "hold"
+}
+
+// stepAudio counts congestion at the lowest video preset the room allows and
+// moves one audio rung at a time; caller holds c.mu
+func (c *Client) stepAudio(score float64) {
+    switch {
+    case c.CurrentQuality <= c.Clamp.Min && score < audioDegradeScore:
+        c.AudioClear = 0
+        c.AudioCongested++
+        if c.AudioCongested >= audioDegradeTicks && c.AudioQuality < len(AudioLevels)-1 {
+            c.AudioQuality++
+            c.AudioCongested = 0
+        }
+        
+    case c.AudioQuality > 0 && score >= audioRecoverScore:
+        c.AudioCongested = 0
+        c.AudioClear++
+        if c.AudioClear >= qualityUpTicks {
+            c.AudioQuality--
+            c.AudioClear = 0
+        }
+        
+    default:
+        c.AudioCongested = 0
+        c.AudioClear = 0
+    }
+}
+
+// stepAudioPacket grows audio packets by one frame under congestion, trading
+// latency for per-message overhead, and shrinks them once the link clears;
+// caller holds c.mu. Clients that never negotiated stay at verbatim relay.
+func (c *Client) stepAudioPacket(score float64) {
+    if c.MaxAudioPacketMs == 0 {
+        return
+    }
+    
+    switch {
+    case score < audioDegradeScore:
+        c.PacketClear = 0
+        c.PacketCongested++
+        if c.PacketCongested >= audioDegradeTicks && c.AudioPacketMs+audioFrameMs <= c.MaxAudioPacketMs {
+            c.AudioPacketMs += audioFrameMs
+            c.PacketCongested = 0
+        }
+        
+    case c.AudioPacketMs > audioFrameMs && score >= audioRecoverScore:
+        c.PacketCongested = 0
+        c.PacketClear++
+        if c.PacketClear >= qualityUpTicks {
+            c.AudioPacketMs -= audioFrameMs
+            c.PacketClear = 0
+        }
+        
+    default:
+        c.PacketCongested = 0
+        c.PacketClear = 0
+    }
+}
+
+// negotiateAudioPacket records the largest packet a client can split, rounded
+// down to whole frames, and answers with the size it gets now
+func (c *Client) negotiateAudioPacket(maxMs int) {
+    maxMs = min(maxMs, maxAudioPacketMs) / audioFrameMs * audioFrameMs
+    
+    c.mu.Lock()
+    if maxMs < audioFrameMs {
+        c.MaxAudioPacketMs, c.AudioPacketMs = 0, 0
+    } else {
+        c.MaxAudioPacketMs = maxMs
+        c.AudioPacketMs = min(max(c.AudioPacketMs, audioFrameMs), maxMs)
+    }
+    current := c.AudioPacketMs
+    c.mu.Unlock()
+    
+    c.notifyAudioPacket(current)
+}
+
+// notifyAudioPacket is the audio-packet-ms hint: relayed audio now arrives in
+// packets this long, and the client may send its own at the same size
+func (c *Client) notifyAudioPacket(ms int) {
+    data, _ := json.Marshal(Message{Type: "audio-packet-ms", PacketMs: ms})
+    select {
+    case c.Send <- data:
+    default:
+    }
+}
+
+// pendingAudio is one sender's PCM waiting to fill a receiver's packet
+type pendingAudio struct {
+    header Message // First buffered chunk, minus its data
+    rate   int
+    pcm    []byte
+    since  time.Time
+}
+
+// packAudio rebuffers a sender's audio into packetMs packets for this
+// receiver: 20ms chunks are joined and larger ones split. A remainder waits
+// for the next chunk, or goes out short once older than audioResidueTTL.
+// Hub goroutine only.
+func (c *Client) packAudio(from string, data []byte, packetMs int) [][]byte {
+    var msg Message
+    if err := json.Unmarshal(data, &msg); err != nil {
+        return [][]byte{data}
+    }
+    pcm, err := base64.StdEncoding.DecodeString(msg.Data)
+    if err != nil {
+        return [][]byte{data}
+    }
+    rate := msg.SampleRate
+    if rate == 0 {
+        rate = AudioLevels[0].SampleRate
+    }
+    
+    if c.audioPending == nil {
+        c.audioPending = make(map[string]*pendingAudio)
+    }
+    p := c.audioPending[from]
+    if p == nil {
+        p = &pendingAudio{}
+        c.audioPending[from] = p
+    }
+    
+    var out [][]byte
+    now := time.Now()
+    if len(p.pcm) > 0 && (now.Sub(p.since) > audioResidueTTL || p.rate != rate) {
+        out = append(out, p.emit(len(p.pcm)))
+    }
+    if len(p.pcm) == 0 {
+        p.header = msg
+        p.header.Data = ""
+        p.rate = rate
+        p.since = now
+    }
+    p.pcm = append(p.pcm, pcm...)
+    
+    size := packetMs * rate / 1000 * 2 // 16-bit mono
+    for size > 0 && len(p.pcm) >= size {
+        out = append(out, p.emit(size))
+        p.since = now
+    }
+    return out
+}
+
+// emit cuts n bytes off the front of the buffer into one relayed message;
+// the remainder's header moves on by the span sent
+func (p *pendingAudio) emit(n int) []byte {
+    msg := p.header
+    msg.Data = base64.StdEncoding.EncodeToString(p.pcm[:n])
+    msg.PacketMs = n / 2 * 1000 / p.rate
+    data, _ := json.Marshal(msg)
+    
+    p.pcm = append(p.pcm[:0], p.pcm[n:]...)
+    p.header.Timestamp += int64(msg.PacketMs)
+    p.header.Seq += msg.PacketMs / audioFrameMs
+    return data
+}
+
+// notifyAudioQuality tells the receiver the sample rate its audio now arrives at
+func (c *Client) notifyAudioQuality(index int) {
+    level := AudioLevels[index]
+    data, _ := json.Marshal(Message{Type: "audio-quality", Quality: level.Name, SampleRate: level.SampleRate})
+    select {
+    case c.Send <- data:
+    default:
+    }
+}
+
+// degradeAudio re-encodes a relayed audio message at a lower ladder rung
+func degradeAudio(data []byte, index int) ([]byte, error) {
+    var msg Message
+    if err := json.Unmarshal(data, &msg); err != nil {
+        return nil, err
+    }
+    pcm, err := base64.StdEncoding.DecodeString(msg.Data)
+    if err != nil {
+        return nil, err
+    }
+    
+    rate := AudioLevels[index].SampleRate
+    msg.Data = base64.StdEncoding.EncodeToString(downsamplePCM(pcm, AudioLevels[0].SampleRate, rate))
+    msg.SampleRate = rate
+    return json.Marshal(msg)
+}
+
+// downsamplePCM converts 16-bit mono PCM to a lower rate by linear interpolation
+func downsamplePCM(pcm []byte, from, to int) []byte {
+    in := len(pcm) / 2
+    if in == 0 || to >= from {
+        return pcm
+    }
+    
+    sample := func(i int) float64 {
+        return float64(int16(uint16(pcm[i*2]) | uint16(pcm[i*2+1])<<8))
+    }
+    
+    n := in * to / from
+    out := make([]byte, n*2)
+    step := float64(from) / float64(to)
+    for i := 0; i < n; i++ {
+        pos := float64(i) * step
+        j := int(pos)
+        v := sample(j)
+        if j+1 < in {
+            frac := pos - float64(j)
+            v = v*(1-frac) + sample(j+1)*frac
+        }
+        val := int16(v)
+        out[i*2] = byte(val)
+        out[i*2+1] = byte(val >> 8)
+    }
+    return out
+}
+
+// send queues a message, waiting for room in Send unless the client is gone
+func (c *Client) send(data []byte) bool {
+    select {
+    case c.Send <- data:
+        return true
+    case <-c.ctx.Done():
+        return false
+    }
+}
+
+// offer queues a room message without waiting, counting it and whether the
+// full buffer dropped it
+func (c *Client) offer(data []byte) {
+    atomic.AddInt64(&c.offered, 1)
+    select {
+    case c.Send <- data:
+    default:
+        atomic.AddInt64(&c.dropped, 1)
+    }
+}
+
 func (c *Client) readPump() {
     defer func() {
+        c.cancel()
         hub.Unregister <- c
         c.Conn.Close()
     }()
@@ -421,6 +1621,12 @@ func (c *Client) readPump() {
         return nil
     })
     
+    // Frames are only compressed here, so the controller needs no locking
+    var rate *rateController
+    if rateControl {
+        rate = &rateController{}
+    }
+    
     for {
         _, data, err := c.Conn.ReadMessage()
         if err != nil {
@@ -432,19 +1638,37 @@ func (c *Client) readPump() {
             continue
         }
         
+        received := time.Now().UnixMilli()
+        
         switch msg.Type {
         case "join":
+            clamp, err := parseClamp(msg.MinQuality, msg.MaxQuality)
+            if err != nil {
+                if data, err := json.Marshal(Message{Type: "error", Error: err.Error()}); err == nil {
+                    c.send(data)
+                }
+                break
+            }
             c.Room = msg.Room
-            hub.joinRoom(c, msg.Room)
+            participants := hub.joinRoom(c, msg.Room, clamp)
+            if msg.Probe == nil || *msg.Probe {
+                c.startProbe(participants)
+            } else {
+                c.welcome(participants)
+            }
             
         case "frame":
+            if msg.Timestamp > 0 {
+                c.Metrics.recordOneWay(msg.Timestamp, received, false)
+            }
+            
             // Process and compress frame based on current quality
             c.mu.RLock()
             quality := QualityLevels[c.CurrentQuality]
             c.mu.RUnlock()
             
             if decoded, err := base64.StdEncoding.DecodeString(msg.Data); err == nil {
-                if compressed, err := compressToWebP(decoded, &quality); err == nil {
+                if compressed, err := compressFrame(decoded, &quality, rate); err == nil {
                     // Broadcast compressed frame
                     outMsg := Message{
                         Type:      "webp-frame",
@@ -455,6 +1679,7 @@ func (c *Client) readPump() {
                         Width:     int(quality.Width),
                         Height:    int(quality.Height),
                         FPS:       quality.FPS,
+                        CompressionType: frameCodec.Name(),
                     }
                     
                     if outData, err := json.Marshal(outMsg); err == nil {
@@ -468,14 +1693,25 @@ func (c *Client) readPump() {
             }
             
         case "audio":
+            if msg.Timestamp > 0 {
+                c.Metrics.recordOneWay(msg.Timestamp, received, true)
+            }
+            
             // Forward audio with priority
             hub.Broadcast <- &BroadcastMessage{
                 Room:    c.Room,
                 Message: data,
                 From:    c.ID,
+                IsAudio: true,
             }
             
         case "feedback":
+            // Probe acks carry nothing else, so they mustn't zero the metrics
+            if msg.Feedback != nil && msg.Feedback.ProbeAck > 0 {
+                c.ackProbe(msg.Feedback.ProbeAck)
+                break
+            }
+            
             // Process client feedback
             if msg.Feedback != nil {
                 c.processFeedback(msg.Feedback)
@@ -493,6 +1729,9 @@ func (c *Client) readPump() {
                 }
             }
             
+        case "audio-packet-ms":
+            c.negotiateAudioPacket(msg.PacketMs)
+            
         case "ping":
             // Respond with pong
             pong := Message{
@@ -500,37 +1739,86 @@ func (c *Client) readPump() {
                 Timestamp: msg.Timestamp,
             }
             if data, err := json.Marshal(pong); err == nil {
-                c.Send <- data
+                c.send(data)
+            }
+            
+        case "time-sync":
+            // Reply to our probe, echoing t1 with the client's t2/t3
+            if msg.T1 > 0 && msg.T2 > 0 && msg.T3 > 0 {
+                c.Metrics.addClockSample(estimateClock(msg.T1, msg.T2, msg.T3, received))
+            }
+            
+        case "capabilities":
+            if data, err := json.Marshal(capabilities()); err == nil {
+                c.send(data)
             }
         }
     }
 }
 
+// capabilities describes this server so a generic client can adapt to it
+func capabilities() map[string]interface{} {
+    levels := make([]string, len(QualityLevels))
+    for i, q := range QualityLevels {
+        levels[i] = q.Name
+    }
+    
+    return map[string]interface{}{
+        "type":             "capabilities",
+        "server":           "adaptive-conference",
+        "accepts":          []string{"join", "frame", "audio", "feedback", "ping", "time-sync", "audio-packet-ms", "capabilities"},
+        "sends":            []string{"participants", "welcome", "webp-frame", "audio", "quality-change", "audio-quality", "pong", "time-sync", "audio-packet-ms", "capabilities", "error", "bandwidth-probe"},
+        "codec":            frameCodec.Name(),
+        "maxParticipants":  0, // No per-room limit
+        "echoCancellation": false,
+        "adaptiveQuality":  true,
+        "qualityLevels":    levels,
+        "build": map[string]string{
+            "time":       BuildTime,
+            "commit":     BuildCommit,
+            "deployedBy": BuildBy,
+            "ref":        BuildRef,
+        },
+    }
+}
+
 func (c *Client) writePump() {
     ticker := time.NewTicker(54 * time.Second)
+    syncTicker := time.NewTicker(timeSyncInterval)
     defer func() {
         ticker.Stop()
+        syncTicker.Stop()
+        c.cancel() // A failed write tears down the reader and monitor too
         c.Conn.Close()
     }()
     
     for {
         select {
-        case message, ok := <-c.Send:
-            if !ok {
-                c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-                return
-            }
+        case <-c.ctx.Done():
+            c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+            c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+            return
             
+        case message := <-c.Send:
             c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
             if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
                 return
             }
+            c.Metrics.recordWrite(len(message), time.Now(), len(c.Send) > 0)
             
         case <-ticker.C:
             c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
             if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
                 return
             }
+            
+        case <-syncTicker.C:
+            // Stamped at write time so queueing in Send doesn't skew t1
+            probe, _ := json.Marshal(Message{Type: "time-sync", T1: time.Now().UnixMilli()})
+            c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+            if err := c.Conn.WriteMessage(websocket.TextMessage, probe); err != nil {
+                return
+            }
         }
     }
 }
@@ -553,15 +1841,29 @@ func (h *Hub) run() {
             
         case client := <-h.Unregister:
             h.mu.Lock()
-            if room, ok := h.Rooms[client.Room]; ok {
+            room, ok := h.Rooms[client.Room]
+            if ok {
                 room.mu.Lock()
                 delete(room.Clients, client.ID)
                 room.mu.Unlock()
             }
             atomic.AddInt64(&h.ActiveStreams, -1)
-            close(client.Send)
             h.mu.Unlock()
             
+            client.Metrics.mu.RLock()
+            bandwidth := client.Metrics.usableBandwidth(time.Now())
+            client.Metrics.mu.RUnlock()
+            subnetBandwidth.remember(client.Subnet, bandwidth, time.Now())
+            
+            if ok {
+                room.mu.RLock()
+                for _, other := range room.Clients {
+                    delete(other.audioPending, client.ID)
+                }
+                room.mu.RUnlock()
+                h.updateCeiling(room, nil)
+            }
+            
             log.Printf("Client unregistered: %s", client.ID)
             
         case broadcast := <-h.Broadcast:
@@ -579,34 +1881,79 @@ func (h *Hub) run() {
                 }
                 room.mu.RUnlock()
                 
+                // Degraded receivers share one re-encode per rung
+                var degraded map[int][]byte
+                
                 // Send to all clients in parallel
                 for _, client := range clients {
-                    select {
-                    case client.Send <- broadcast.Message:
-                    default:
-                        // Client buffer full, skip
+                    message := broadcast.Message
+                    if broadcast.IsAudio {
+                        client.mu.RLock()
+                        level := client.AudioQuality
+                        packetMs := client.AudioPacketMs
+                        client.mu.RUnlock()
+                        
+                        // Negotiated receivers get their own packet size
+                        if packetMs > 0 {
+                            for _, packet := range client.packAudio(broadcast.From, broadcast.Message, packetMs) {
+                                if level > 0 {
+                                    if data, err := degradeAudio(packet, level); err == nil {
+                                        packet = data
+                                    }
+                                }
+                                client.offer(packet)
+                            }
+                            continue
+                        }
+                        
+                        if level > 0 {
+                            if degraded == nil {
+                                degraded = make(map[int][]byte)
+                            }
+                            if _, done := degraded[level]; !done {
+                                data, err := degradeAudio(broadcast.Message, level)
+                                if err != nil {
+                                    data = broadcast.Message
+                                }
+                                degraded[level] = data
+                            }
+                            message = degraded[level]
+                        }
                     }
+                    
+                    client.offer(message)
                 }
             }
         }
     }
 }
 
-func (h *Hub) joinRoom(client *Client, roomID string) {
+// joinRoom adds client to roomID, creating the room with clamp if it's new;
+// an existing room keeps the clamp it was created with. It returns the room's
+// size for the welcome, which the caller sends.
+func (h *Hub) joinRoom(client *Client, roomID string, clamp qualityClamp) int {
     h.mu.Lock()
-    defer h.mu.Unlock()
-    
     room, exists := h.Rooms[roomID]
     if !exists {
         room = &Room{
-            ID:      roomID,
-            Clients: make(map[string]*Client),
+            ID:             roomID,
+            Clients:        make(map[string]*Client),
+            QualityCeiling: len(QualityLevels) - 1,
+            Clamp:          clamp,
         }
         h.Rooms[roomID] = room
+        if clamp != fullRange() {
+            log.Printf("Room %s clamped to %s-%s", roomID, QualityLevels[clamp.Min].Name, QualityLevels[clamp.Max].Name)
+        }
     }
+    h.mu.Unlock()
     
     room.mu.Lock()
     room.Clients[client.ID] = client
+    participants := len(room.Clients)
+    client.mu.Lock()
+    client.Clamp = room.Clamp
+    client.mu.Unlock()
     
     // Notify other clients
     users := make([]string, 0, len(room.Clients))
@@ -623,11 +1970,94 @@ func (h *Hub) joinRoom(client *Client, roomID string) {
         Room: roomID,
     }
     if data, err := json.Marshal(msg); err == nil {
-        client.Send <- data
+        client.send(data)
+    }
+    
+    h.updateCeiling(room, client)
+    return participants
+}
+
+// welcome starts the client at the suggested preset instead of 144p and
+// tells it which; the feedback loop steps down from there if the link can't
+// keep up
+func (c *Client) welcome(participants int) {
+    mbps, known := subnetBandwidth.recall(c.Subnet, time.Now())
+    
+    // Bandwidth set by now came from the startup probe (or feedback that
+    // arrived during it) and beats the subnet's history
+    c.Metrics.mu.RLock()
+    probed := c.Metrics.Bandwidth
+    c.Metrics.mu.RUnlock()
+    if probed > 0 {
+        mbps, known = probed, true
+    }
+    
+    c.mu.Lock()
+    start := c.Clamp.apply(suggestQuality(participants, c.QualityCeiling, mbps, known))
+    if start > 0 {
+        c.CurrentQuality = start
+        c.TargetQuality = start
+        c.LastQualityChange = time.Now()
+        c.QualityHoldUntil = time.Now().Add(startQualityHold)
+    }
+    c.mu.Unlock()
+    
+    quality := QualityLevels[start]
+    msg := Message{
+        Type:         "welcome",
+        ID:           c.ID,
+        Room:         c.Room,
+        Quality:      quality.Name,
+        QualityIndex: &start,
+        Width:        int(quality.Width),
+        Height:       int(quality.Height),
+        FPS:          quality.FPS,
+        Media:        c.mediaProfile(),
+    }
+    if data, err := json.Marshal(msg); err == nil {
+        c.send(data)
+    }
+    
+    if probed > 0 {
+        log.Printf("Client %s starts at %s (%.2f Mbps probed)", c.ID, quality.Name, mbps)
+    } else if known {
+        log.Printf("Client %s starts at %s (%.2f Mbps last seen from %s)", c.ID, quality.Name, mbps, c.Subnet)
+    } else {
+        log.Printf("Client %s starts at %s (%d participants)", c.ID, quality.Name, participants)
     }
 }
 
 func main() {
+    frameCodec = newFrameCodec(os.Getenv("VIDEO_CODEC"))
+    if !webpcodec.Available && os.Getenv("VIDEO_CODEC") != "jpeg" {
+        log.Printf("Built without cgo, so no WebP encoder: relaying video as jpeg")
+    }
+    
+    if v, err := strconv.Atoi(os.Getenv("QUALITY_UP_TICKS")); err == nil && v > 0 {
+        qualityUpTicks = v
+    }
+    if v, err := time.ParseDuration(os.Getenv("QUALITY_UP_COOLDOWN")); err == nil {
+        qualityUpCooldown = v
+    }
+    if v, err := strconv.Atoi(os.Getenv("ROOM_BANDWIDTH_KBPS")); err == nil && v > 0 {
+        roomBandwidthKbps = v
+    }
+    if v, err := strconv.Atoi(os.Getenv("RATE_SEARCH_ITERATIONS")); err == nil && v > 0 {
+        rateSearchIterations = v
+    }
+    if v := os.Getenv("START_QUALITY"); v == "lowest" {
+        startQualityMax = 0
+    } else if v != "" {
+        for i, q := range QualityLevels {
+            if q.Name == v {
+                startQualityMax = i
+            }
+        }
+    }
+    if v, err := time.ParseDuration(os.Getenv("BANDWIDTH_HISTORY_TTL")); err == nil && v > 0 {
+        bandwidthHistoryTTL = v
+    }
+    
     hub = &Hub{
         Rooms:      make(map[string]*Room),
         Register:   make(chan *Client),
@@ -0,0 +1,1137 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "reflect"
+    "runtime"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// qualityChange is one step the monitor took
+type qualityChange struct {
+    at time.Duration
+    up bool
+}
+
+// runQualityTicks drives calculateOptimalQuality and stepQuality once a
+// second from start, as qualityMonitor does, with the bandwidth bandwidthAt
+// reports; changes are timed from start
+func runQualityTicks(c *Client, start time.Time, ticks int, bandwidthAt func(tick int) float64) []qualityChange {
+    var changes []qualityChange
+    for tick := 1; tick <= ticks; tick++ {
+        c.Metrics.mu.Lock()
+        c.Metrics.Bandwidth = bandwidthAt(tick)
+        c.Metrics.mu.Unlock()
+
+        optimal, _ := c.calculateOptimalQuality()
+        at := time.Duration(tick) * time.Second
+        c.mu.Lock()
+        before := c.CurrentQuality
+        c.stepQuality(optimal, start.Add(at))
+        after := c.CurrentQuality
+        c.mu.Unlock()
+        if after != before {
+            changes = append(changes, qualityChange{at: at, up: after > before})
+        }
+    }
+    return changes
+}
+
+func TestQualityDoesNotFollowAnOscillatingLink(t *testing.T) {
+    // A link swinging between plenty for 720p and too little for it every
+    // few seconds used to flap a step each way per swing. Down-steps still
+    // follow it at once; the way back up waits out the cooldown.
+    for _, period := range []int{1, 2, 4, 8} {
+        c := &Client{
+            QualityCeiling: len(QualityLevels) - 1,
+            Clamp:          fullRange(),
+            CurrentQuality: 4, // 720p
+            Metrics:        &ClientMetrics{Latency: 50, BufferHealth: 1},
+        }
+        changes := runQualityTicks(c, time.Now(), 120, func(tick int) float64 {
+            if (tick/period)%2 == 0 {
+                return 2.0
+            }
+            return 0.3
+        })
+
+        if len(changes) == 0 {
+            t.Fatalf("period %ds: quality never moved, so the signal tested nothing", period)
+        }
+        for i := 1; i < len(changes); i++ {
+            prev, next := changes[i-1], changes[i]
+            if next.up && !prev.up && next.at-prev.at < qualityUpCooldown {
+                t.Errorf("period %ds: stepped up %s after a down-step, within the %s cooldown (changes %v)",
+                    period, next.at-prev.at, qualityUpCooldown, changes)
+            }
+        }
+    }
+}
+
+func TestQualityUpNeedsAStreak(t *testing.T) {
+    c := &Client{
+        QualityCeiling: len(QualityLevels) - 1,
+        Clamp:          fullRange(),
+        CurrentQuality: 2, // 360p
+        Metrics:        &ClientMetrics{Latency: 50, BufferHealth: 1},
+    }
+
+    // One good tick in every qualityUpTicks isn't a streak
+    start := time.Now()
+    changes := runQualityTicks(c, start, 30, func(tick int) float64 {
+        if tick%qualityUpTicks == 0 {
+            return 5.0
+        }
+        return 0.2
+    })
+    for _, change := range changes {
+        if change.up {
+            t.Fatalf("stepped up at %s on isolated good ticks (changes %v)", change.at, changes)
+        }
+    }
+
+    // A steady good link climbs, one step per streak
+    changes = runQualityTicks(c, start.Add(30*time.Second), qualityUpTicks, func(int) float64 { return 5.0 })
+    if len(changes) != 1 || !changes[0].up {
+        t.Errorf("after %d good ticks got changes %v, want one up-step", qualityUpTicks, changes)
+    }
+}
+
+// startAdaptiveServer runs the hub main builds behind a test server
+func startAdaptiveServer(t *testing.T) string {
+    t.Helper()
+    hub = &Hub{
+        Rooms:      make(map[string]*Room),
+        Register:   make(chan *Client),
+        Unregister: make(chan *Client),
+        Broadcast:  make(chan *BroadcastMessage, 256),
+    }
+    go hub.run()
+
+    // Until its clients have unregistered, their readPumps still read hub,
+    // so the next test can't swap in its own
+    h := hub
+    t.Cleanup(func() {
+        deadline := time.Now().Add(2 * time.Second)
+        for atomic.LoadInt64(&h.ActiveStreams) > 0 && time.Now().Before(deadline) {
+            time.Sleep(5 * time.Millisecond)
+        }
+    })
+    srv := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+    t.Cleanup(srv.Close)
+    return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// joinAndLeave connects, joins without the startup probe, waits for the
+// welcome and hangs up
+func joinAndLeave(t *testing.T, url string) {
+    t.Helper()
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    probe := false
+    if err := conn.WriteJSON(Message{Type: "join", Room: "leak", Probe: &probe}); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        var msg Message
+        if err := conn.ReadJSON(&msg); err != nil {
+            t.Fatalf("no welcome: %v", err)
+        }
+        if msg.Type == "welcome" {
+            return
+        }
+    }
+}
+
+// TestDisconnectLeavesNoGoroutines checks, as goleak would, that the
+// goroutines a connection starts are all gone once it closes
+func TestDisconnectLeavesNoGoroutines(t *testing.T) {
+    url := startAdaptiveServer(t)
+    joinAndLeave(t, url) // Whatever starts once per process starts here
+
+    settled := func(want int) bool {
+        deadline := time.Now().Add(3 * time.Second)
+        for runtime.NumGoroutine() > want {
+            if time.Now().After(deadline) {
+                return false
+            }
+            time.Sleep(10 * time.Millisecond)
+        }
+        return true
+    }
+    // The warm-up connection's goroutines are still winding down
+    baseline := runtime.NumGoroutine()
+    for stable := 0; stable < 5; stable++ {
+        time.Sleep(10 * time.Millisecond)
+        if n := runtime.NumGoroutine(); n != baseline {
+            baseline, stable = n, 0
+        }
+    }
+
+    for i := 0; i < 20; i++ {
+        joinAndLeave(t, url)
+    }
+    if !settled(baseline) {
+        buf := make([]byte, 1<<20)
+        t.Fatalf("%d goroutines 20 disconnects after a baseline of %d:\n%s",
+            runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+    }
+}
+
+// sizedCodec encodes every frame to size(quality) bytes, noting each quality
+// it was asked for, so the search can be followed without a real encoder
+type sizedCodec struct {
+    size  func(quality float32) int
+    asked *[]float32
+}
+
+func (sizedCodec) Name() string { return "sized" }
+
+func (c sizedCodec) Encode(_ image.Image, quality float32) ([]byte, error) {
+    *c.asked = append(*c.asked, quality)
+    return make([]byte, c.size(quality)), nil
+}
+
+// withSizedCodec swaps frameCodec for a sizedCodec for one test and returns
+// what it is asked for
+func withSizedCodec(t *testing.T, size func(quality float32) int) *[]float32 {
+    prev := frameCodec
+    asked := new([]float32)
+    frameCodec = sizedCodec{size: size, asked: asked}
+    t.Cleanup(func() { frameCodec = prev })
+    return asked
+}
+
+func TestRateSearchStopsAtTheIterationCap(t *testing.T) {
+    preset := &QualityLevels[2]
+    budget := frameBudget(preset)
+    // Half the budget or twice it, so no attempt lands within rateTolerance
+    asked := withSizedCodec(t, func(q float32) int {
+        if q < 50 {
+            return budget / 2
+        }
+        return budget * 2
+    })
+
+    rc := &rateController{}
+    data, err := rc.encode(nil, preset)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(*asked) != rateSearchIterations {
+        t.Fatalf("keyframe took %d encodes %v, want the cap of %d", len(*asked), *asked, rateSearchIterations)
+    }
+    if len(data) != budget/2 {
+        t.Errorf("shipped %d bytes, want the %d that fit", len(data), budget/2)
+    }
+
+    // Frames between keyframes get one encode each at the searched quality
+    *asked = nil
+    for i := 1; i < rateSearchEvery; i++ {
+        rc.encode(nil, preset)
+    }
+    if len(*asked) != rateSearchEvery-1 {
+        t.Fatalf("%d frames between keyframes took %d encodes", rateSearchEvery-1, len(*asked))
+    }
+    for _, q := range *asked {
+        if q != rc.quality {
+            t.Fatalf("a frame between keyframes encoded at %g, want the searched %g", q, rc.quality)
+        }
+    }
+}
+
+func TestRateQualityCarriesOverBetweenKeyframes(t *testing.T) {
+    preset := &QualityLevels[2]
+    budget := frameBudget(preset)
+    perQuality := float32(budget) / 80 // Fills the budget at quality 80
+    asked := withSizedCodec(t, func(q float32) int { return int(q * perQuality) })
+
+    rc := &rateController{}
+    rc.encode(nil, preset)
+    found := rc.quality
+    if found == preset.Quality*100 {
+        t.Fatalf("the first search kept the preset's %g with sizes it doesn't fit", found)
+    }
+
+    // The next keyframe starts where the last search ended and, the frames
+    // being alike, stops there
+    for i := 1; i < rateSearchEvery; i++ {
+        rc.encode(nil, preset)
+    }
+    *asked = nil
+    rc.encode(nil, preset)
+    if len(*asked) != 1 || (*asked)[0] != found {
+        t.Errorf("second keyframe asked for %v, want just the %g found before", *asked, found)
+    }
+
+    // A busier picture starts the search from there too, then goes lower
+    perQuality *= 2
+    for i := 1; i < rateSearchEvery; i++ {
+        rc.encode(nil, preset)
+    }
+    *asked = nil
+    data, _ := rc.encode(nil, preset)
+    if len(*asked) == 0 || (*asked)[0] != found {
+        t.Errorf("third keyframe asked for %v, want it to start at %g", *asked, found)
+    }
+    if rc.quality >= found || len(data) > budget {
+        t.Errorf("a picture twice as costly settled at quality %g, %d bytes against a budget of %d", rc.quality, len(data), budget)
+    }
+
+    // Another preset starts over from its own quality
+    *asked = nil
+    rc.encode(nil, &QualityLevels[3])
+    if (*asked)[0] != QualityLevels[3].Quality*100 {
+        t.Errorf("a new preset's first search started at %g, want its quality %g", (*asked)[0], QualityLevels[3].Quality*100)
+    }
+}
+
+func TestRateSearchFallsBackToTheSmallestAttempt(t *testing.T) {
+    preset := &QualityLevels[2]
+    budget := frameBudget(preset)
+    // Every quality overshoots, less so the lower it goes
+    asked := withSizedCodec(t, func(q float32) int { return budget + 100 + int(q) })
+
+    rc := &rateController{}
+    data, err := rc.encode(nil, preset)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lowest := (*asked)[0]
+    for _, q := range *asked {
+        lowest = min(lowest, q)
+    }
+    if want := budget + 100 + int(lowest); len(data) != want {
+        t.Errorf("with nothing fitting shipped %d bytes, want the smallest attempt's %d", len(data), want)
+    }
+    if rc.quality != lowest {
+        t.Errorf("next search starts at %g, want the smallest attempt's %g", rc.quality, lowest)
+    }
+}
+
+// rateTestFrame is a width x height picture whose cost to encode grows with
+// noise, from a flat gradient at 0 up to static at 255
+func rateTestFrame(width, height, noise int) image.Image {
+    img := image.NewRGBA(image.Rect(0, 0, width, height))
+    rng := rand.New(rand.NewSource(1))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            n := 0
+            if noise > 0 {
+                n = rng.Intn(noise)
+            }
+            img.SetRGBA(x, y, color.RGBA{
+                R: uint8((x*200/width + n) % 256),
+                G: uint8((y*200/height + n) % 256),
+                B: uint8(((x+y)*200/(width+height) + n) % 256),
+                A: 255,
+            })
+        }
+    }
+    return img
+}
+
+// BenchmarkRateController runs a keyframe search per iteration and reports
+// the achieved size against the preset's frame budget, which should stay
+// just under 1 across pictures of very different cost once the first
+// searches have brought the quality in
+func BenchmarkRateController(b *testing.B) {
+    for _, preset := range []*QualityPreset{&QualityLevels[1], &QualityLevels[2], &QualityLevels[4]} {
+        for _, noise := range []int{0, 8, 24} {
+            img := rateTestFrame(int(preset.Width), int(preset.Height), noise)
+            b.Run(fmt.Sprintf("%s/noise%d", preset.Name, noise), func(b *testing.B) {
+                rc, total := &rateController{}, 0
+                for i := 0; i < b.N; i++ {
+                    rc.frames = 0 // Every frame a keyframe, each search starting from the last
+                    data, err := rc.encode(img, preset)
+                    if err != nil {
+                        b.Fatal(err)
+                    }
+                    total += len(data)
+                }
+                b.ReportMetric(float64(total)/float64(b.N)/float64(frameBudget(preset)), "size/budget")
+            })
+        }
+    }
+}
+
+// ladderTick is one measured qualityMonitor tick at start+at seconds on a
+// link reporting bandwidth Mbps
+func ladderTick(c *Client, start time.Time, at int, bandwidth float64) {
+    c.Metrics.mu.Lock()
+    c.Metrics.Bandwidth = bandwidth
+    c.Metrics.mu.Unlock()
+
+    optimal, score := c.calculateOptimalQuality()
+    c.mu.Lock()
+    c.stepLadders(optimal, score, true, start.Add(time.Duration(at)*time.Second))
+    c.mu.Unlock()
+}
+
+func TestAudioDegradesOnlyOnceVideoIsAtItsFloor(t *testing.T) {
+    c := &Client{
+        QualityCeiling: len(QualityLevels) - 1,
+        Clamp:          fullRange(),
+        CurrentQuality: len(QualityLevels) - 1, // More steps down than audioDegradeTicks
+        Metrics:        &ClientMetrics{Latency: 50, BufferHealth: 1},
+    }
+    start := time.Now()
+    tick := func(at int, bandwidth float64) { ladderTick(c, start, at, bandwidth) }
+
+    // Far too little even for 144p: video walks down a step a tick, and audio
+    // only starts counting once there is no video left to give up
+    at := 0
+    for ; c.AudioQuality == 0; at++ {
+        if at > 60 {
+            t.Fatal("audio never degraded on a link too slow for the lowest preset")
+        }
+        tick(at, 0.01)
+        if c.AudioQuality > 0 && c.CurrentQuality > c.Clamp.Min {
+            t.Fatalf("tick %d: audio degraded to rung %d with video still at %s",
+                at, c.AudioQuality, QualityLevels[c.CurrentQuality].Name)
+        }
+    }
+    for ; c.AudioQuality < len(AudioLevels)-1; at++ {
+        tick(at, 0.01)
+    }
+
+    // On the way back audio climbs all the way before video takes a step
+    for ; c.AudioQuality > 0; at++ {
+        if at > 200 {
+            t.Fatal("audio never recovered on a clear link")
+        }
+        tick(at, 10)
+        if c.AudioQuality > 0 && c.CurrentQuality > c.Clamp.Min {
+            t.Fatalf("tick %d: video stepped up to %s with audio still at rung %d",
+                at, QualityLevels[c.CurrentQuality].Name, c.AudioQuality)
+        }
+    }
+    for end := at + 30; at < end; at++ {
+        tick(at, 10)
+    }
+    if c.CurrentQuality == c.Clamp.Min {
+        t.Error("video stayed at its floor after audio recovered on a clear link")
+    }
+}
+
+func TestAudioPacketsGrowUnderCongestion(t *testing.T) {
+    newClient := func() *Client {
+        return &Client{
+            QualityCeiling: len(QualityLevels) - 1,
+            Clamp:          fullRange(),
+            Metrics:        &ClientMetrics{Latency: 50, BufferHealth: 1},
+            Send:           make(chan []byte, 16),
+        }
+    }
+    start := time.Now()
+
+    // A client that never sent audio-packet-ms can't split, so keeps 20ms
+    plain := newClient()
+    for at := 0; at < 30; at++ {
+        ladderTick(plain, start, at, 0.01)
+    }
+    if plain.AudioPacketMs != 0 {
+        t.Errorf("un-negotiated client got %dms audio packets, want verbatim relay", plain.AudioPacketMs)
+    }
+
+    c := newClient()
+    c.negotiateAudioPacket(100)
+    var hint Message
+    if err := json.Unmarshal(<-c.Send, &hint); err != nil || hint.Type != "audio-packet-ms" || hint.PacketMs != audioFrameMs {
+        t.Fatalf("negotiating got %+v (%v), want an audio-packet-ms reply of %dms", hint, err, audioFrameMs)
+    }
+    if c.MaxAudioPacketMs != maxAudioPacketMs {
+        t.Fatalf("a 100ms ceiling was kept as %dms, want it capped at %dms", c.MaxAudioPacketMs, maxAudioPacketMs)
+    }
+
+    // One frame more per audioDegradeTicks congested ticks, up to the ceiling
+    at := 0
+    for want := audioFrameMs + audioFrameMs; want <= maxAudioPacketMs; want += audioFrameMs {
+        for i := 0; i < audioDegradeTicks; i++ {
+            ladderTick(c, start, at, 0.01)
+            at++
+        }
+        if c.AudioPacketMs != want {
+            t.Fatalf("after %d congested ticks audio packets are %dms, want %dms", at, c.AudioPacketMs, want)
+        }
+    }
+    for end := at + 3*audioDegradeTicks; at < end; at++ {
+        ladderTick(c, start, at, 0.01)
+    }
+    if c.AudioPacketMs != maxAudioPacketMs {
+        t.Errorf("audio packets grew to %dms past the %dms ceiling", c.AudioPacketMs, maxAudioPacketMs)
+    }
+
+    // And back to a single frame once the link clears
+    for end := at + 60; at < end && c.AudioPacketMs > audioFrameMs; at++ {
+        ladderTick(c, start, at, 10)
+    }
+    if c.AudioPacketMs != audioFrameMs {
+        t.Errorf("audio packets still %dms after the link cleared, want %dms", c.AudioPacketMs, audioFrameMs)
+    }
+}
+
+func TestPackedAudioReassembles(t *testing.T) {
+    const rate = 48000
+    chunk := func(seq int, ms int) ([]byte, []byte) {
+        pcm := make([]byte, ms*rate/1000*2)
+        for i := range pcm {
+            pcm[i] = byte(seq*31 + i)
+        }
+        data, _ := json.Marshal(Message{
+            Type: "audio", From: "alice", Seq: seq, Timestamp: int64(1000 + seq*audioFrameMs),
+            SampleRate: rate, Data: base64.StdEncoding.EncodeToString(pcm),
+        })
+        return data, pcm
+    }
+    receive := func(packets [][]byte, wantMs int) (pcm []byte, msgs []Message) {
+        for _, data := range packets {
+            var msg Message
+            if err := json.Unmarshal(data, &msg); err != nil {
+                t.Fatal(err)
+            }
+            got, err := base64.StdEncoding.DecodeString(msg.Data)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if msg.PacketMs != wantMs || len(got) != wantMs*rate/1000*2 {
+                t.Errorf("packet of %d bytes labelled %dms, want %dms", len(got), msg.PacketMs, wantMs)
+            }
+            pcm = append(pcm, got...)
+            msgs = append(msgs, msg)
+        }
+        return pcm, msgs
+    }
+
+    // 20ms chunks joined three to a packet, in order and without a gap
+    bob := &Client{ID: "bob"}
+    var sent, got []byte
+    var msgs []Message
+    for seq := 0; seq < 9; seq++ {
+        data, pcm := chunk(seq, audioFrameMs)
+        sent = append(sent, pcm...)
+        pcm, m := receive(bob.packAudio("alice", data, 60), 60)
+        got = append(got, pcm...)
+        msgs = append(msgs, m...)
+    }
+    if !bytes.Equal(got, sent) || len(msgs) != 3 {
+        t.Fatalf("9 chunks came out as %d packets, %d of %d bytes matching", len(msgs), commonPrefix(got, sent), len(sent))
+    }
+    for i, msg := range msgs {
+        if wantSeq := i * 3; msg.Seq != wantSeq || msg.Timestamp != int64(1000+wantSeq*audioFrameMs) || msg.From != "alice" {
+            t.Errorf("packet %d has seq %d timestamp %d from %q, want its first chunk's", i, msg.Seq, msg.Timestamp, msg.From)
+        }
+    }
+
+    // A 100ms chunk split into 40ms packets, the last 20ms carried into the next
+    carol := &Client{ID: "carol"}
+    big, bigPCM := chunk(0, 100)
+    got, msgs = receive(carol.packAudio("alice", big, 40), 40)
+    if len(msgs) != 2 || msgs[1].Seq != 2 || msgs[1].Timestamp != 1040 {
+        t.Fatalf("100ms split into %+v, want two 40ms packets with the second at seq 2", msgs)
+    }
+    next, nextPCM := chunk(5, audioFrameMs)
+    more, _ := receive(carol.packAudio("alice", next, 40), 40)
+    if got = append(got, more...); !bytes.Equal(got, append(bigPCM, nextPCM...)) {
+        t.Errorf("split audio reassembled to %d of %d bytes matching", commonPrefix(got, append(bigPCM, nextPCM...)), len(bigPCM)+len(nextPCM))
+    }
+
+    // A remainder left waiting too long goes out short ahead of the next chunk
+    dave := &Client{ID: "dave"}
+    first, firstPCM := chunk(0, audioFrameMs)
+    if out := dave.packAudio("alice", first, 60); len(out) != 0 {
+        t.Fatalf("one 20ms chunk went out as %d 60ms packets", len(out))
+    }
+    dave.audioPending["alice"].since = time.Now().Add(-2 * audioResidueTTL)
+    late, _ := chunk(7, audioFrameMs)
+    got, _ = receive(dave.packAudio("alice", late, 60), audioFrameMs)
+    if !bytes.Equal(got, firstPCM) {
+        t.Errorf("stale residue came out as %d bytes, want the %d buffered", len(got), len(firstPCM))
+    }
+}
+
+// commonPrefix is how many leading bytes a and b share
+func commonPrefix(a, b []byte) int {
+    n := 0
+    for n < len(a) && n < len(b) && a[n] == b[n] {
+        n++
+    }
+    return n
+}
+
+// lastCeiling drains c's queue and returns the last quality-ceiling on it, or
+// -1 if none was pushed
+func lastCeiling(t *testing.T, c *Client) int {
+    t.Helper()
+    ceiling := -1
+    for {
+        select {
+        case data := <-c.Send:
+            var msg Message
+            if err := json.Unmarshal(data, &msg); err != nil {
+                t.Fatal(err)
+            }
+            if msg.Type == "quality-ceiling" {
+                ceiling = *msg.MaxIndex
+            }
+        default:
+            return ceiling
+        }
+    }
+}
+
+func TestCeilingFollowsParticipantCount(t *testing.T) {
+    top := len(QualityLevels) - 1
+    h := &Hub{Rooms: make(map[string]*Room)}
+    room := &Room{ID: "ceiling", Clients: make(map[string]*Client), QualityCeiling: top, Clamp: fullRange()}
+    if roomCeiling(5) >= roomCeiling(4) {
+        t.Fatalf("ceiling for 5 is %d against %d for 4, want lower", roomCeiling(5), roomCeiling(4))
+    }
+
+    var clients []*Client
+    for n := 1; n <= 5; n++ {
+        c := &Client{
+            ID: fmt.Sprintf("user%d", n), Send: make(chan []byte, 16),
+            CurrentQuality: top, QualityCeiling: top, Clamp: fullRange(),
+            Metrics: &ClientMetrics{Bandwidth: 100, Latency: 10, BufferHealth: 1},
+        }
+        clients = append(clients, c)
+        room.Clients[c.ID] = c
+        h.updateCeiling(room, c)
+
+        want := roomCeiling(n)
+        for _, other := range clients {
+            got := lastCeiling(t, other)
+            if other != c && want == roomCeiling(n-1) {
+                // Unchanged, so only the joiner is told
+                if got != -1 {
+                    t.Errorf("%d joined: %s was pushed ceiling %d with it unchanged", n, other.ID, got)
+                }
+            } else if got != want {
+                t.Errorf("%d joined: %s was pushed ceiling %d, want %d", n, other.ID, got, want)
+            }
+            if other.CurrentQuality > want {
+                t.Errorf("%d joined: %s still at %s above the ceiling %s", n, other.ID, QualityLevels[other.CurrentQuality].Name, QualityLevels[want].Name)
+            }
+            if optimal, _ := other.calculateOptimalQuality(); optimal > want {
+                t.Errorf("%d joined: %s on a fast link aims for %s above the ceiling", n, other.ID, QualityLevels[optimal].Name)
+            }
+        }
+    }
+
+    // The 5th leaving raises the ceiling for everyone left
+    delete(room.Clients, clients[4].ID)
+    h.updateCeiling(room, nil)
+    for _, c := range clients[:4] {
+        if got := lastCeiling(t, c); got != roomCeiling(4) {
+            t.Errorf("after a leave %s was pushed ceiling %d, want %d", c.ID, got, roomCeiling(4))
+        }
+        if c.QualityCeiling != roomCeiling(4) {
+            t.Errorf("after a leave %s clamps to %d, want %d", c.ID, c.QualityCeiling, roomCeiling(4))
+        }
+    }
+}
+
+func TestClockSyncEstimatesOffsetAndOneWayDelay(t *testing.T) {
+    // A fake clock: the client runs 5s ahead of us, and each exchange takes
+    // down ms to reach it, is held for 3ms, and takes up ms to come back
+    const skew = 5000
+    now := int64(1700000000000)
+    exchange := func(down, up int64) clockSample {
+        t1 := now
+        t2 := t1 + down + skew
+        t3 := t2 + 3
+        t4 := t3 - skew + up
+        now = t4 + 1000
+        return estimateClock(t1, t2, t3, t4)
+    }
+    m := &ClientMetrics{}
+
+    m.recordOneWay(now, now+30, true)
+    if m.AudioLatency != 0 {
+        t.Errorf("one-way delay of %dms recorded before any time-sync", m.AudioLatency)
+    }
+
+    m.addClockSample(exchange(20, 20))
+    if m.ClockOffset != skew || m.SyncRTT != 40 {
+        t.Fatalf("symmetric exchange: offset %d rtt %d, want %d and 40", m.ClockOffset, m.SyncRTT, skew)
+    }
+
+    // A queued downlink skews the sample by half the asymmetry, but its RTT
+    // is higher so the clean one still wins
+    queued := exchange(300, 20)
+    if queued.offset != skew+140 || queued.rtt != 320 {
+        t.Fatalf("asymmetric exchange: offset %d rtt %d, want %d and 320", queued.offset, queued.rtt, skew+140)
+    }
+    m.addClockSample(queued)
+    if m.ClockOffset != skew {
+        t.Errorf("offset %d after a queued sample, want the lowest-RTT %d", m.ClockOffset, skew)
+    }
+    m.addClockSample(clockSample{offset: -skew, rtt: -10})
+    if m.ClockOffset != skew {
+        t.Errorf("offset %d after a sample with client stamps out of order", m.ClockOffset)
+    }
+
+    // Once the clean sample leaves the window the best of the rest is used
+    for i := 0; i < timeSyncWindow; i++ {
+        m.addClockSample(exchange(60, 40))
+    }
+    if m.ClockOffset != skew+10 || m.SyncRTT != 100 {
+        t.Errorf("offset %d rtt %d with only 60/40 samples left, want %d and 100", m.ClockOffset, m.SyncRTT, skew+10)
+    }
+    m.addClockSample(exchange(20, 20))
+
+    // Media stamped by the client clock, audio and video averaged apart
+    m.recordOneWay(now+skew, now+30, true)
+    m.recordOneWay(now+skew, now+80, false)
+    if m.AudioLatency != 30 || m.VideoLatency != 80 {
+        t.Errorf("one-way audio %dms video %dms, want 30 and 80", m.AudioLatency, m.VideoLatency)
+    }
+    m.recordOneWay(now+skew, now+160, false)
+    if m.VideoLatency != 90 || m.AudioLatency != 30 {
+        t.Errorf("after a 160ms video frame: audio %dms video %dms, want 30 and 90", m.AudioLatency, m.VideoLatency)
+    }
+    m.recordOneWay(now+skew+50, now+20, true)
+    if m.AudioLatency != 26 {
+        t.Errorf("a stamp ahead of arrival moved audio to %dms, want it counted as 0 (26)", m.AudioLatency)
+    }
+}
+
+// throttledConn sleeps out each write at bps, like a slow downlink
+type throttledConn struct {
+    net.Conn
+    bps float64
+}
+
+func (c throttledConn) Write(b []byte) (int, error) {
+    time.Sleep(time.Duration(float64(len(b)*8) / c.bps * float64(time.Second)))
+    return c.Conn.Write(b)
+}
+
+type throttledListener struct {
+    net.Listener
+    bps float64
+}
+
+func (l throttledListener) Accept() (net.Conn, error) {
+    conn, err := l.Listener.Accept()
+    return throttledConn{conn, l.bps}, err
+}
+
+// throttledClient upgrades a connection whose server side writes at bps and
+// returns its client, before its writePump runs, with the count read so far
+func throttledClient(t *testing.T, bps float64) (*Client, *int64) {
+    t.Helper()
+    clients := make(chan *Client, 1)
+    srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            t.Error(err)
+            return
+        }
+        ctx, cancel := context.WithCancel(context.Background())
+        clients <- &Client{ctx: ctx, cancel: cancel, Conn: conn, Send: make(chan []byte, 256), Metrics: &ClientMetrics{}}
+    }))
+    srv.Listener = throttledListener{srv.Listener, bps}
+    srv.Start()
+    t.Cleanup(srv.Close)
+
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    read := new(int64)
+    go func() {
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+            atomic.AddInt64(read, 1)
+        }
+    }()
+
+    c := <-clients
+    t.Cleanup(c.cancel)
+    return c, read
+}
+
+func TestSendBandwidthIsMeasuredOnAThrottledLink(t *testing.T) {
+    const link = 1e6 // 1 Mbps
+    frame := bytes.Repeat([]byte("x"), 8000)
+    wait := func(read *int64, n int64) {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for atomic.LoadInt64(read) < n {
+            if time.Now().After(deadline) {
+                t.Fatalf("only %d of %d messages read", atomic.LoadInt64(read), n)
+            }
+            time.Sleep(5 * time.Millisecond)
+        }
+    }
+
+    // Written one at a time the queue never backs up, so nothing is learned
+    idle, read := throttledClient(t, link)
+    go idle.writePump()
+    for i := int64(1); i <= 4; i++ {
+        idle.Send <- frame
+        wait(read, i)
+    }
+    idle.Metrics.mu.RLock()
+    if idle.Metrics.SendBandwidth != 0 {
+        t.Errorf("an idle link was measured at %.2f Mbps", idle.Metrics.SendBandwidth)
+    }
+    idle.Metrics.mu.RUnlock()
+
+    // A backlog of frames drains at the link rate whatever the client claims
+    c, read := throttledClient(t, link)
+    top := len(QualityLevels) - 1
+    c.CurrentQuality, c.QualityCeiling, c.Clamp = 5, top, fullRange()
+    c.Metrics.Bandwidth, c.Metrics.Latency, c.Metrics.BufferHealth = 100, 10, 1
+    claimed, _ := c.calculateOptimalQuality()
+    for i := 0; i < 12; i++ {
+        c.Send <- frame
+    }
+    go c.writePump()
+    wait(read, 12)
+
+    c.Metrics.mu.RLock()
+    measured := c.Metrics.SendBandwidth
+    usable := c.Metrics.usableBandwidth(time.Now())
+    c.Metrics.mu.RUnlock()
+    if measured < 0.7 || measured > 1.3 {
+        t.Errorf("a 1 Mbps link was measured at %.2f Mbps", measured)
+    }
+    if usable != measured {
+        t.Errorf("usable bandwidth %.2f Mbps, want the measured %.2f over the claimed 100", usable, measured)
+    }
+    if optimal, _ := c.calculateOptimalQuality(); optimal >= claimed {
+        t.Errorf("optimal quality %s with the link measured, want below %s on the claim alone",
+            QualityLevels[optimal].Name, QualityLevels[claimed].Name)
+    }
+}
+
+// welcomeIndex joins room without the startup probe and returns the
+// quality index its welcome suggests, leaving the connection open
+func welcomeIndex(t *testing.T, url, room string) int {
+    t.Helper()
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    probe := false
+    if err := conn.WriteJSON(Message{Type: "join", Room: room, Probe: &probe}); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        var msg Message
+        if err := conn.ReadJSON(&msg); err != nil {
+            t.Fatalf("no welcome in %s: %v", room, err)
+        }
+        if msg.Type == "welcome" {
+            return *msg.QualityIndex
+        }
+    }
+}
+
+func TestWelcomeSuggestsAStartFromRoomSizeAndHistory(t *testing.T) {
+    url := startAdaptiveServer(t)
+
+    solo := welcomeIndex(t, url, "solo")
+    var crowd int
+    for i := 0; i < 6; i++ {
+        crowd = welcomeIndex(t, url, "crowd")
+    }
+    if solo <= crowd || solo == 0 {
+        t.Errorf("a lone joiner starts at %s and the sixth at %s, want the lone one higher and above 144p",
+            QualityLevels[solo].Name, QualityLevels[crowd].Name)
+    }
+
+    // The test server's subnet has history: a fast link starts higher, a
+    // slow one lower than a guess from the room alone
+    subnet := subnetKey("127.0.0.1")
+    t.Cleanup(func() { subnetBandwidth.remember(subnet, 1, time.Now().Add(-2*bandwidthHistoryTTL)) })
+    subnetBandwidth.remember(subnet, 50, time.Now())
+    if fast := welcomeIndex(t, url, "fast"); fast <= solo {
+        t.Errorf("a joiner from a 50 Mbps subnet starts at %s, want above the %s guessed without history",
+            QualityLevels[fast].Name, QualityLevels[solo].Name)
+    }
+    subnetBandwidth.remember(subnet, 0.2, time.Now())
+    if slow := welcomeIndex(t, url, "slow"); slow >= solo {
+        t.Errorf("a joiner from a 0.2 Mbps subnet starts at %s, want below the %s guessed without history",
+            QualityLevels[slow].Name, QualityLevels[solo].Name)
+    }
+}
+
+func TestSaturatedQueueWithDropsIsPoor(t *testing.T) {
+    healthy := func() *Client {
+        return &Client{
+            Send:           make(chan []byte, 8),
+            CurrentQuality: 2,
+            Metrics:        &ClientMetrics{Latency: 50, Bandwidth: 10},
+        }
+    }
+    if level, reasons := rateConnection(healthy().connectionSignals(0, 0)); level != "good" || len(reasons) != 0 {
+        t.Errorf("an idle client on a fast link rated %s %v, want good", level, reasons)
+    }
+    slow := healthy()
+    slow.Metrics.Latency = 200
+    if level, reasons := rateConnection(slow.connectionSignals(0, 0)); level != "fair" || !reflect.DeepEqual(reasons, []string{"latency"}) {
+        t.Errorf("a 200ms round trip rated %s %v, want fair for latency", level, reasons)
+    }
+
+    // The room offers more than the receiver drains: Send fills and the rest drop
+    c := healthy()
+    for i := 0; i < 4*cap(c.Send); i++ {
+        c.offer([]byte(`{"type":"video-frame"}`))
+    }
+    offered, dropped := atomic.LoadInt64(&c.offered), atomic.LoadInt64(&c.dropped)
+    if offered != int64(4*cap(c.Send)) || dropped != int64(3*cap(c.Send)) {
+        t.Fatalf("offered %d and dropped %d, want %d and %d", offered, dropped, 4*cap(c.Send), 3*cap(c.Send))
+    }
+    level, reasons := rateConnection(c.connectionSignals(offered, dropped))
+    if level != "poor" || !reflect.DeepEqual(reasons, []string{"drops", "send-queue"}) {
+        t.Errorf("a full queue dropping 75%% rated %s %v, want poor for drops and send-queue", level, reasons)
+    }
+
+    // The badge waits for room in Send rather than dropping a message
+    if c.notifyConnectionQuality(level, reasons) {
+        t.Error("the badge was pushed into a full Send")
+    }
+    for len(c.Send) > 0 {
+        <-c.Send
+    }
+    if !c.notifyConnectionQuality(level, reasons) {
+        t.Fatal("the badge wasn't pushed into an empty Send")
+    }
+    var msg Message
+    if err := json.Unmarshal(<-c.Send, &msg); err != nil || msg.Type != "connection-quality" || msg.Level != "poor" ||
+        !reflect.DeepEqual(msg.Reasons, reasons) {
+        t.Errorf("pushed %+v (%v), want connection-quality poor with its reasons", msg, err)
+    }
+}
+
+// joinClamped joins room asking for a clamp and returns the welcome or error
+func joinClamped(t *testing.T, url, room string, minQuality, maxQuality *int) Message {
+    t.Helper()
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    probe := false
+    join := Message{Type: "join", Room: room, Probe: &probe, MinQuality: minQuality, MaxQuality: maxQuality}
+    if err := conn.WriteJSON(join); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        var msg Message
+        if err := conn.ReadJSON(&msg); err != nil {
+            t.Fatalf("no answer to the join of %s: %v", room, err)
+        }
+        if msg.Type == "welcome" || msg.Type == "error" {
+            return msg
+        }
+    }
+}
+
+func TestClampedRoomNeverLeavesItsPresets(t *testing.T) {
+    ptr := func(i int) *int { return &i }
+    index := func(name string) *int {
+        for i, preset := range QualityLevels {
+            if preset.Name == name {
+                return ptr(i)
+            }
+        }
+        t.Fatalf("no %s preset", name)
+        return nil
+    }
+    p240, p480, p720 := index("240p"), index("480p"), index("720p")
+
+    for _, bad := range [][2]*int{{p480, p240}, {nil, ptr(len(QualityLevels))}, {ptr(-1), nil}} {
+        if _, err := parseClamp(bad[0], bad[1]); err == nil {
+            t.Errorf("parseClamp accepted %v-%v", bad[0], bad[1])
+        }
+    }
+    if clamp, err := parseClamp(nil, nil); err != nil || clamp != fullRange() {
+        t.Errorf("no clamp parsed to %+v (%v), want the full ladder", clamp, err)
+    }
+
+    // The join that creates the room sets the clamp; later ones can't widen it
+    url := startAdaptiveServer(t)
+    if msg := joinClamped(t, url, "support", p480, p240); msg.Type != "error" {
+        t.Errorf("a join with min above max got %s, want an error", msg.Type)
+    }
+    joinClamped(t, url, "support", p240, p480)
+    joinClamped(t, url, "support", nil, index("4K60"))
+    hub.mu.RLock()
+    room := hub.Rooms["support"]
+    hub.mu.RUnlock()
+    want := qualityClamp{Min: *p240, Max: *p480}
+    room.mu.RLock()
+    clamp, joined := room.Clamp, len(room.Clients)
+    for _, client := range room.Clients {
+        client.mu.RLock()
+        if client.Clamp != want {
+            t.Errorf("a client in the room has clamp %+v, want the room's %+v", client.Clamp, want)
+        }
+        client.mu.RUnlock()
+    }
+    room.mu.RUnlock()
+    if clamp != want || joined != 2 {
+        t.Fatalf("the room has clamp %+v with %d clients, want %+v with the two good joins", clamp, joined, want)
+    }
+
+    // Abundant bandwidth walks up to the cap and no further; a poor link
+    // walks down to the floor and no further
+    c := &Client{
+        QualityCeiling: len(QualityLevels) - 1,
+        Clamp:          clamp,
+        CurrentQuality: clamp.Min,
+        Metrics:        &ClientMetrics{Latency: 20, BufferHealth: 1},
+    }
+    start := time.Now()
+    for at := 0; at < 120; at++ {
+        ladderTick(c, start, at, 100)
+        if c.CurrentQuality >= *p720 {
+            t.Fatalf("tick %d: a room clamped to 480p picked %s at 100 Mbps", at, QualityLevels[c.CurrentQuality].Name)
+        }
+    }
+    if c.CurrentQuality != *p480 {
+        t.Errorf("at 100 Mbps the clamped room settled at %s, want 480p", QualityLevels[c.CurrentQuality].Name)
+    }
+    for at := 120; at < 240; at++ {
+        ladderTick(c, start, at, 0.01)
+        if c.CurrentQuality < *p240 {
+            t.Fatalf("tick %d: a room clamped to 240p dropped to %s", at, QualityLevels[c.CurrentQuality].Name)
+        }
+    }
+    if c.CurrentQuality != *p240 {
+        t.Errorf("on a poor link the clamped room settled at %s, want 240p", QualityLevels[c.CurrentQuality].Name)
+    }
+}
+
+// probedJoin joins room, acking each bandwidth probe packet gap after the
+// one before, and returns the welcome's start and the probe's estimate
+func probedJoin(t *testing.T, url, room string, gap time.Duration) (int, float64) {
+    t.Helper()
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    if err := conn.WriteJSON(Message{Type: "join", Room: room}); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(probeTimeout + time.Second))
+    acks := 0
+    for {
+        var msg Message
+        if err := conn.ReadJSON(&msg); err != nil {
+            t.Fatalf("no welcome in %s: %v", room, err)
+        }
+        switch msg.Type {
+        case "bandwidth-probe":
+            if acks > 0 {
+                time.Sleep(gap)
+            }
+            acks++
+            if err := conn.WriteJSON(Message{Type: "feedback", Feedback: &ClientFeedback{ProbeAck: msg.Seq}}); err != nil {
+                t.Fatal(err)
+            }
+        case "welcome":
+            if acks != probePackets {
+                t.Errorf("%s was welcomed after %d probe packets, want %d", room, acks, probePackets)
+            }
+            hub.mu.RLock()
+            defer hub.mu.RUnlock()
+            for _, client := range hub.Rooms[room].Clients {
+                client.Metrics.mu.RLock()
+                defer client.Metrics.mu.RUnlock()
+                return *msg.QualityIndex, client.Metrics.Bandwidth
+            }
+            t.Fatalf("nobody in %s", room)
+        }
+    }
+}
+
+func TestStartupProbeSeedsBandwidthFromAckSpeed(t *testing.T) {
+    // Runs after the server's cleanup, once the probed clients have been
+    // remembered for the test subnet
+    subnet := subnetKey("127.0.0.1")
+    t.Cleanup(func() { subnetBandwidth.remember(subnet, 1, time.Now().Add(-2*bandwidthHistoryTTL)) })
+    url := startAdaptiveServer(t)
+
+    fastStart, fast := probedJoin(t, url, "fast-link", 0)
+    slowStart, slow := probedJoin(t, url, "slow-link", 150*time.Millisecond)
+    if fast < probeMaxMbps/2 {
+        t.Errorf("acks as fast as the packets came estimated %.2f Mbps, want near the %g cap", fast, probeMaxMbps)
+    }
+    // Seven 32 KB packets, base64 and all, over about a second
+    if slow < 1 || slow > 4 {
+        t.Errorf("acks 150ms apart estimated %.2f Mbps, want 1-4", slow)
+    }
+    if fastStart <= slowStart {
+        t.Errorf("the fast link started at %s and the slow one at %s, want the fast one higher",
+            QualityLevels[fastStart].Name, QualityLevels[slowStart].Name)
+    }
+}
+
+func TestWelcomeDescribesTheRoomsMedia(t *testing.T) {
+    url := startAdaptiveServer(t)
+    low, high := 2, 5
+    msg := joinClamped(t, url, "profiled", &low, &high)
+    if msg.Type != "welcome" || msg.Media == nil {
+        t.Fatalf("the join was answered with %+v, want a welcome with a media profile", msg)
+    }
+
+    rates := make([]int, len(AudioLevels))
+    for i, level := range AudioLevels {
+        rates[i] = level.SampleRate
+    }
+    want := &MediaProfile{
+        Codec:      frameCodec.Name(),
+        Accepts:    []string{"jpeg", "png"},
+        Ladder:     QualityLevels,
+        MinQuality: low,
+        MaxQuality: high,
+        Audio:      AudioProfile{Processed: true, SampleRates: rates},
+    }
+    if !reflect.DeepEqual(msg.Media, want) {
+        t.Errorf("the welcome's media is %+v, want %+v", msg.Media, want)
+    }
+    // qualityIndex is a position in the ladder the welcome just gave
+    if i := *msg.QualityIndex; i < low || i > high || msg.Media.Ladder[i].Width != uint(msg.Width) {
+        t.Errorf("qualityIndex %d at %dpx doesn't pick a step of the welcome's ladder within %d-%d", i, msg.Width, low, high)
+    }
+
+    if msg := joinClamped(t, url, "unclamped", nil, nil); msg.Media.MinQuality != 0 || msg.Media.MaxQuality != len(QualityLevels)-1 {
+        t.Errorf("an unclamped room's media is clamped to %d-%d, want the whole ladder", msg.Media.MinQuality, msg.Media.MaxQuality)
+    }
+}
@@ -2,20 +2,28 @@ package main
 
 import (
     "bytes"
+    "crypto/subtle"
     "encoding/base64"
+    "encoding/binary"
     "encoding/json"
+    "errors"
     "fmt"
     "image"
     "image/draw"
-    _ "image/jpeg"
+    "image/jpeg"
     _ "image/png"
+    "io"
     "log"
     "math"
     "net/http"
+    "net/http/pprof"
+    "os"
+    "strconv"
     "sync"
+    "sync/atomic"
     "time"
 
-    "github.com/chai2010/webp"
+    "conference/webpcodec"
     "github.com/gorilla/websocket"
     "github.com/nfnt/resize"
 )
@@ -30,17 +38,82 @@ var (
 
 // Audio processing constants
 const (
-    // Echo cancellation parameters
+    // Echo cancellation parameters; the three tunables are AudioParams
+    // defaults, overridden by the env vars of the same name
     ECHO_THRESHOLD     = 0.3  // Similarity threshold for echo detection
     SILENCE_THRESHOLD  = 0.01 // Audio level below this is considered silence
     GATE_THRESHOLD     = 0.02 // Noise gate threshold
     DUCKING_FACTOR     = 0.3  // How much to reduce audio when someone else is talking
+    SPEAKING_HOLD      = 500 * time.Millisecond // A speaker with no audio for this long counts as silent
     
     // Audio buffer settings
     AUDIO_BUFFER_SIZE  = 48000 // 1 second at 48kHz
+    
+    // Room audio format: every inbound stream is converted to this before
+    // echo cancellation and mixing
+    MIX_SAMPLE_RATE    = 48000
+    MIX_CHANNELS       = 1
     ECHO_DELAY_MS      = 200   // Expected echo delay in milliseconds
+    
+    // Per-listener volume control
+    MAX_GAIN           = 2.0   // Upper bound for set-volume gain
+    
+    // Inbound message limits
+    MAX_MESSAGE_SIZE     = 2 * 1024 * 1024 // Largest accepted message in bytes
+    MAX_MESSAGES_PER_SEC = 100
+    MAX_TRANSCODE_SIZE   = 64 * 1024 // Largest audio chunk the hub converts between JSON and binary
 )
 
+// Binary audio frames skip base64: one kind byte, then the payload. Frames
+// the server relays set audioFrameRelayed and put the sender, sequence and
+// format between the kind and the payload.
+const (
+    audioFramePCM     = 0x01 // Little-endian 16-bit PCM in the join's format
+    audioFrameOpus    = 0x02 // One Opus packet; relayed as is, never processed
+    audioFrameRelayed = 0x80
+)
+
+// ErrorCode says why the server refused a message
+type ErrorCode string
+
+const (
+    ErrMalformed   ErrorCode = "malformed-json"
+    ErrUnknownType ErrorCode = "unknown-type"
+    ErrTooLarge    ErrorCode = "payload-too-large"
+    ErrRoomFull    ErrorCode = "room-full"
+    ErrRoomLocked  ErrorCode = "room-locked"
+    ErrRateLimited ErrorCode = "rate-limited"
+    ErrBadAudio    ErrorCode = "bad-audio-frame"
+    ErrForbidden   ErrorCode = "forbidden"
+    ErrBadParams   ErrorCode = "invalid-audio-params"
+)
+
+// AudioParams are a room's processing thresholds, all in 0-1: levels are
+// RMS of samples in [-1, 1], the factors are gains
+type AudioParams struct {
+    GateThreshold float32 `json:"gateThreshold"`
+    DuckingFactor float32 `json:"duckingFactor"`
+    EchoThreshold float32 `json:"echoThreshold"`
+}
+
+// validate rejects values outside 0-1
+func (p AudioParams) validate() error {
+    fields := []struct {
+        name  string
+        value float32
+    }{
+        {"gateThreshold", p.GateThreshold},
+        {"duckingFactor", p.DuckingFactor},
+        {"echoThreshold", p.EchoThreshold},
+    }
+    for _, field := range fields {
+        if field.value < 0 || field.value > 1 {
+            return fmt.Errorf("%s must be between 0 and 1", field.name)
+        }
+    }
+    return nil
+}
+
 // AudioProcessor handles echo cancellation and feedback prevention
 type AudioProcessor struct {
     // Echo cancellation buffers
@@ -62,11 +135,71 @@ type AudioProcessor struct {
     mu sync.RWMutex
 }
 
+// Conn is what the pumps need from a connection; *websocket.Conn satisfies it
+type Conn interface {
+    ReadMessage() (messageType int, p []byte, err error)
+    WriteMessage(messageType int, data []byte) error
+    Close() error
+    SetReadDeadline(t time.Time) error
+    SetWriteDeadline(t time.Time) error
+    SetPongHandler(h func(appData string) error)
+}
+
+// fakeConn is a channel-backed Conn for driving a Hub without sockets:
+// push client messages on In, read what the server wrote from Out
+type fakeConn struct {
+    In     chan []byte
+    Out    chan []byte
+    closed chan struct{}
+    once   sync.Once
+}
+
+func newFakeConn() *fakeConn {
+    return &fakeConn{
+        In:     make(chan []byte, 64),
+        Out:    make(chan []byte, 256),
+        closed: make(chan struct{}),
+    }
+}
+
+func (f *fakeConn) ReadMessage() (int, []byte, error) {
+    select {
+    case data := <-f.In:
+        if len(data) > 0 && data[0] != '{' {
+            return websocket.BinaryMessage, data, nil
+        }
+        return websocket.TextMessage, data, nil
+    case <-f.closed:
+        return 0, nil, io.EOF
+    }
+}
+
+func (f *fakeConn) WriteMessage(messageType int, data []byte) error {
+    if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
+        return nil
+    }
+    select {
+    case f.Out <- data:
+        return nil
+    case <-f.closed:
+        return io.ErrClosedPipe
+    }
+}
+
+func (f *fakeConn) Close() error {
+    f.once.Do(func() { close(f.closed) })
+    return nil
+}
+
+func (f *fakeConn) SetReadDeadline(time.Time) error   { return nil }
+func (f *fakeConn) SetWriteDeadline(time.Time) error  { return nil }
+func (f *fakeConn) SetPongHandler(func(string) error) {}
+
 // Client with audio processing
 type Client struct {
     ID            string
     Room          string
-    Conn          *websocket.Conn
+    Conn          Conn
     Send          chan []byte
     Hub           *Hub
     
@@ -76,14 +209,81 @@ type Client struct {
     AudioSequence     int
     IsCurrentSpeaker  bool
     AudioLevel        float32
+    AudioFormat       AudioFormat // Capture and playback format from the join
+    BinaryAudio       atomic.Bool // Joined with binaryAudio or has sent a binary frame
     
     // Quality management (from adaptive version)
     CurrentQuality    int
     Metrics          *ClientMetrics
     
+    // Per-speaker playback gain chosen by this listener
+    Gains            map[string]float32
+    
+    // Guards Send against the mixer and readPump sending as the hub closes it
+    sendMu           sync.RWMutex
+    sendClosed       bool
+    
     mu sync.RWMutex
 }
 
+// pipe queues data without blocking. Only the hub may close Send, so every
+// other goroutine sends through here, which checks under sendMu that it
+// hasn't been closed in the meantime.
+func (c *Client) pipe(data []byte) bool {
+    c.sendMu.RLock()
+    defer c.sendMu.RUnlock()
+    if c.sendClosed {
+        return false
+    }
+    select {
+    case c.Send <- data:
+        return true
+    default:
+        return false
+    }
+}
+
+// closeSend closes Send for writePump; hub goroutine only
+func (c *Client) closeSend() {
+    c.sendMu.Lock()
+    c.sendClosed = true
+    close(c.Send)
+    c.sendMu.Unlock()
+}
+
+// setGain stores the listener's gain for a speaker, clamped to [0, MAX_GAIN]
+func (c *Client) setGain(targetID string, gain float32) float32 {
+    if gain < 0 {
+        gain = 0
+    } else if gain > MAX_GAIN {
+        gain = MAX_GAIN
+    }
+    
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    if c.Gains == nil {
+        c.Gains = make(map[string]float32)
+    }
+    if gain == 1 {
+        delete(c.Gains, targetID)
+    } else {
+        c.Gains[targetID] = gain
+    }
+    return gain
+}
+
+func (c *Client) gainsSnapshot() map[string]float32 {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    
+    gains := make(map[string]float32, len(c.Gains))
+    for id, gain := range c.Gains {
+        gains[id] = gain
+    }
+    return gains
+}
+
 // Room with audio management
 type Room struct {
     ID              string
@@ -94,9 +294,28 @@ type Room struct {
     SpeakerQueue     []string
     AudioMixer       *AudioMixer
     
+    // Set by the creating join's mode; video frames are dropped undecoded
+    AudioOnly        bool
+    VideoDropped     int64
+    
+    // Set by the creating join's audioProcessing:false; audio skips the
+    // AudioProcessor and mixer and is relayed as sent
+    Passthrough      bool
+    
+    // Gate, ducking and echo thresholds; starts at defaultAudioParams and
+    // changes with set-audio-params
+    Params           AudioParams
+    
     mu sync.RWMutex
 }
 
+// audioParams reads the room's current thresholds
+func (r *Room) audioParams() AudioParams {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.Params
+}
+
 // AudioMixer handles room-level audio mixing and echo cancellation
 type AudioMixer struct {
     // Active speakers
@@ -109,9 +328,84 @@ type AudioMixer struct {
     // Feedback detection
     FeedbackDetector *FeedbackDetector
     
+    // Server-side mixing: processed samples waiting for the next mix tick
+    Pending          map[string][]float32
+    
     mu sync.RWMutex
 }
 
+func newAudioMixer() *AudioMixer {
+    return &AudioMixer{
+        ActiveSpeakers:   make(map[string]*SpeakerInfo),
+        RoomEchoBuffer:   make([]float32, AUDIO_BUFFER_SIZE),
+        EchoPatterns:     make(map[string][]float32),
+        FeedbackDetector: &FeedbackDetector{},
+        Pending:          make(map[string][]float32),
+    }
+}
+
+// addChunk queues a speaker's processed samples for the next mix
+func (m *AudioMixer) addChunk(clientID string, samples []float32) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    
+    m.Pending[clientID] = append(m.Pending[clientID], samples...)
+}
+
+// takePending hands over the queued chunks and starts a fresh batch
+func (m *AudioMixer) takePending() map[string][]float32 {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    
+    pending := m.Pending
+    m.Pending = make(map[string][]float32)
+    return pending
+}
+
+// mixFor sums every pending speaker except the listener, so nobody hears themselves.
+// Each contribution is scaled by the listener's gain for that speaker (default 1).
+func mixFor(listener string, pending map[string][]float32, gains map[string]float32) ([]float32, []string) {
+    var mix []float32
+    speakers := make([]string, 0, len(pending))
+    
+    for id, samples := range pending {
+        if id == listener {
+            continue
+        }
+        
+        gain, ok := gains[id]
+        if !ok {
+            gain = 1
+        }
+        if gain == 0 {
+            continue
+        }
+        
+        if len(samples) > len(mix) {
+            mix = append(mix, make([]float32, len(samples)-len(mix))...)
+        }
+        for i, sample := range samples {
+            mix[i] += sample * gain
+        }
+        speakers = append(speakers, id)
+    }
+    
+    if len(speakers) == 0 {
+        return nil, nil
+    }
+    
+    // Clamp the sum back into PCM range
+    for i := range mix {
+        if mix[i] > 1.0 {
+            mix[i] = 1.0
+        } else if mix[i] < -1.0 {
+            mix[i] = -1.0
+        }
+    }
+    
+    return mix, speakers
+}
+
 type SpeakerInfo struct {
     ClientID        string
     StartTime       time.Time
@@ -144,10 +438,43 @@ type Message struct {
     AudioSeq      int         `json:"audioSeq,omitempty"`
     AudioLevel    float32     `json:"audioLevel,omitempty"`
     IsSpeaking    bool        `json:"isSpeaking,omitempty"`
+    Speakers      []string    `json:"speakers,omitempty"` // Contributors to an audio-mixed chunk
+    SampleRate    int         `json:"sampleRate,omitempty"` // PCM format on join, audio and welcome
+    Channels      int         `json:"channels,omitempty"`
+    Codec         string      `json:"codec,omitempty"`       // "opus" on audio relayed from an Opus binary frame
     
-    // Quality fields (from adaptive)
+    // true on join delivers other participants' audio as binary frames
+    BinaryAudio   bool        `json:"binaryAudio,omitempty"`
+    
+    // Per-listener volume (set-volume / volume-hint)
+    TargetID      string      `json:"targetId,omitempty"`
+    Gain          *float32    `json:"gain,omitempty"`
+    
+    // set-audio-params: ADMIN_TOKEN and the fields to change; the
+    // audio-params reply carries the room's full set
+    Token         string      `json:"token,omitempty"`
+    AudioParams   json.RawMessage `json:"audioParams,omitempty"`
+    
+    // Quality fields (from adaptive); compressionType is webp-frame's actual codec
     Quality       string      `json:"quality,omitempty"`
+    CompressionType string    `json:"compressionType,omitempty"`
     Feedback      *ClientFeedback `json:"feedback,omitempty"`
+    
+    // Room mode: "audio-only" on join; welcome sets AudioOnly so clients skip video capture
+    Mode          string      `json:"mode,omitempty"`
+    AudioOnly     bool        `json:"audioOnly,omitempty"`
+    
+    // false on join relays the room's audio unprocessed, for small calls
+    // where browser echo cancellation suffices; welcome echoes the room's setting
+    AudioProcessing *bool     `json:"audioProcessing,omitempty"`
+    
+    // welcome: how the server treats this room's media
+    Media         *MediaProfile `json:"media,omitempty"`
+    
+    // Error replies
+    Code          ErrorCode   `json:"code,omitempty"`
+    Text          string      `json:"message,omitempty"`
+    Ref           string      `json:"ref,omitempty"` // Type of the offending message
 }
 
 type ClientFeedback struct {
@@ -180,23 +507,79 @@ type Hub struct {
     Unregister chan *Client
     Broadcast  chan *BroadcastMessage
     
+    // Messages shed by the overflow policy
+    BroadcastOverflow int64
+    
+    // Audio chunks converted between JSON and binary for mixed rooms
+    Transcoded      int64
+    TranscodeFailed int64
+    
     mu sync.RWMutex
 }
 
+// Broadcast overflow policies, chosen with BROADCAST_OVERFLOW
+const (
+    OverflowBlock      = "block"       // Wait for the hub (couples every sender to the slowest moment)
+    OverflowDropOldest = "drop-oldest" // Evict the oldest queued message
+    OverflowDropVideo  = "drop-video"  // Shed incoming video, wait only for audio
+)
+
 type BroadcastMessage struct {
     Room    string
     Message []byte
+    Binary  []byte // Same audio as a binary frame, for BinaryAudio receivers
+    
+    // Audio is queued in the sender's own form; the hub transcodes to the
+    // other only when the room has receivers of both kinds
+
     From    string
     IsAudio bool
 }
 
 // Quality presets (simplified from adaptive)
 type QualityPreset struct {
-    Name       string
-    Width      uint
-    Height     uint
-    FPS        int
-    Quality    float32
+    Name       string  `json:"name"`
+    Width      uint    `json:"width"`
+    Height     uint    `json:"height"`
+    FPS        int     `json:"fps"`
+    Quality    float32 `json:"quality"`
+}
+
+// MediaProfile tells a joiner what the server does with the room's media,
+// so it can capture and encode to match instead of having frames redone
+type MediaProfile struct {
+    Video   bool            `json:"video"`             // false in audio-only rooms
+    Codec   string          `json:"codec,omitempty"`   // What transcoded frames go out as
+    Accepts []string        `json:"accepts,omitempty"` // Frame formats the encoder decodes
+    Ladder  []QualityPreset `json:"ladder,omitempty"`  // Presets frames are scaled to
+    Audio   AudioProfile    `json:"audio"`
+}
+
+// AudioProfile says what happens to audio on the way through
+type AudioProfile struct {
+    Processed        bool `json:"processed"` // false: relayed exactly as sent
+    EchoCancellation bool `json:"echoCancellation"`
+    Mixing           bool `json:"mixing"`
+}
+
+// mediaProfile is the welcome's account of the room. Every frame is
+// encoded at the client's fixed CurrentQuality, so the ladder has one step.
+func (c *Client) mediaProfile(room *Room) *MediaProfile {
+    processed := !room.Passthrough
+    profile := &MediaProfile{
+        Audio: AudioProfile{
+            Processed:        processed,
+            EchoCancellation: processed,
+            Mixing:           processed && audioMixing,
+        },
+    }
+    if !room.AudioOnly {
+        profile.Video = true
+        profile.Codec = videoCodec
+        profile.Accepts = []string{"jpeg", "png"}
+        profile.Ladder = QualityLevels[c.CurrentQuality : c.CurrentQuality+1]
+    }
+    return profile
 }
 
 var QualityLevels = []QualityPreset{
@@ -215,12 +598,110 @@ var (
     }
     
     hub *Hub
+    
+    // AUDIO_MIX=true sends each receiver one mixed stream instead of N
+    audioMixing   = os.Getenv("AUDIO_MIX") == "true"
+    mixInterval   = 40 * time.Millisecond
+    
+    // Hub queue sizing, BROADCAST_BUFFER / BROADCAST_OVERFLOW
+    broadcastBuffer = 256
+    overflowPolicy  = OverflowBlock
+    
+    // MAX_USERS_PER_ROOM caps participants per room, 0 means unlimited
+    maxUsersPerRoom, _ = strconv.Atoi(os.Getenv("MAX_USERS_PER_ROOM"))
+    
+    // WEBP_EFFORT is the libwebp method, 0 (fast, large) to 6 (slow, small)
+    webpEffort = webpcodec.DefaultEffort
+    
+    // Frame encoding: webp, or jpeg in builds without cgo
+    videoCodec = "webp"
+    
+    // New rooms' thresholds, from GATE_THRESHOLD, DUCKING_FACTOR and ECHO_THRESHOLD
+    defaultAudioParams = AudioParams{
+        GateThreshold: GATE_THRESHOLD,
+        DuckingFactor: DUCKING_FACTOR,
+        EchoThreshold: ECHO_THRESHOLD,
+    }
+    
+    // ADMIN_TOKEN authorizes set-audio-params; unset disables it
+    adminToken = os.Getenv("ADMIN_TOKEN")
 )
 
 // Audio processing functions
 
+// AudioFormat describes interleaved 16-bit PCM
+type AudioFormat struct {
+    SampleRate int
+    Channels   int
+}
+
+var mixFormat = AudioFormat{SampleRate: MIX_SAMPLE_RATE, Channels: MIX_CHANNELS}
+
+// audioFormat reads a format from a message, falling back to def for
+// missing or implausible values
+func audioFormat(msg Message, def AudioFormat) AudioFormat {
+    format := def
+    if msg.SampleRate >= 8000 && msg.SampleRate <= 192000 {
+        format.SampleRate = msg.SampleRate
+    }
+    if msg.Channels == 1 || msg.Channels == 2 {
+        format.Channels = msg.Channels
+    }
+    return format
+}
+
+// relayAudio forwards a chunk untouched in the sender's own format, only
+// stamping sender, sequence and time
+func (c *Client) relayAudio(msg Message) {
+    format := audioFormat(msg, c.AudioFormat)
+    
+    c.mu.Lock()
+    c.LastAudioTime = time.Now()
+    c.AudioSequence++
+    seq := c.AudioSequence
+    c.mu.Unlock()
+    
+    audioMsg := Message{
+        Type:       "audio",
+        From:       c.ID,
+        Data:       msg.Data,
+        AudioSeq:   seq,
+        Timestamp:  time.Now().UnixMilli(),
+        SampleRate: format.SampleRate,
+        Channels:   format.Channels,
+    }
+    if outData, err := json.Marshal(audioMsg); err == nil {
+        c.Hub.broadcast(&BroadcastMessage{
+            Room:    c.Room,
+            Message: outData,
+            From:    c.ID,
+            IsAudio: true,
+        })
+    }
+}
+
 // ProcessAudioFrame handles echo cancellation and feedback prevention
-func (c *Client) ProcessAudioFrame(audioData []byte) ([]byte, bool) {
+func (c *Client) ProcessAudioFrame(audioData []byte, format AudioFormat) ([]byte, bool) {
+    samples, ok := c.ProcessAudioSamples(audioData, format)
+    if !ok {
+        return nil, false
+    }
+    return encodeAudioData(samples, mixFormat), true
+}
+
+// ProcessAudioSamples runs VAD, echo cancellation, gating and ducking and
+// returns the processed PCM at the mix format, or false when the frame should
+// not be sent
+func (c *Client) ProcessAudioSamples(audioData []byte, format AudioFormat) ([]float32, bool) {
+    return c.processSamples(decodeAudioData(audioData, format))
+}
+
+// ProcessAudioPCM is ProcessAudioSamples for raw PCM from a binary frame
+func (c *Client) ProcessAudioPCM(pcm []byte, format AudioFormat) ([]float32, bool) {
+    return c.processSamples(decodeAudioPCM(pcm, format))
+}
+
+func (c *Client) processSamples(samples []float32) ([]float32, bool) {
     if c.AudioProc == nil {
         c.AudioProc = &AudioProcessor{
             InputBuffer:     make([]float32, AUDIO_BUFFER_SIZE),
@@ -230,8 +711,6 @@ func (c *Client) ProcessAudioFrame(audioData []byte) ([]byte, bool) {
         }
     }
     
-    // Decode audio data
-    samples := decodeAudioData(audioData)
     if len(samples) == 0 {
         return nil, false
     }
@@ -240,31 +719,32 @@ func (c *Client) ProcessAudioFrame(audioData []byte) ([]byte, bool) {
     level := calculateAudioLevel(samples)
     c.AudioLevel = level
     
-    // Voice Activity Detection (VAD)
-    isSpeaking := level > GATE_THRESHOLD
-    
     // Get room for audio mixing context
     room := c.getRoom()
     if room == nil {
-        return audioData, true
+        return samples, true
     }
+    params := room.audioParams()
+    
+    // Voice Activity Detection (VAD)
+    isSpeaking := level > params.GateThreshold
     
     // Check if this client should be allowed to speak (prevent feedback)
-    if !c.shouldTransmitAudio(room, isSpeaking, level) {
+    if !c.shouldTransmitAudio(room, isSpeaking, level, params.GateThreshold) {
         return nil, false
     }
     
     // Apply echo cancellation
-    processed := c.applyEchoCancellation(samples, room)
+    processed := c.applyEchoCancellation(samples, room, params.EchoThreshold)
     
     // Apply noise gate
-    if level < GATE_THRESHOLD {
+    if level < params.GateThreshold {
         processed = applySilence(processed)
     }
     
     // Apply ducking if others are speaking
     if room.CurrentSpeaker != "" && room.CurrentSpeaker != c.ID {
-        processed = applyDucking(processed, DUCKING_FACTOR)
+        processed = applyDucking(processed, params.DuckingFactor)
     }
     
     // Check for feedback
@@ -285,12 +765,11 @@ func (c *Client) ProcessAudioFrame(audioData []byte) ([]byte, bool) {
         room.updateCurrentSpeaker(c.ID, level)
     }
     
-    // Encode processed audio
-    return encodeAudioData(processed), true
+    return processed, true
 }
 
 // shouldTransmitAudio determines if audio should be transmitted (prevents echo)
-func (c *Client) shouldTransmitAudio(room *Room, isSpeaking bool, level float32) bool {
+func (c *Client) shouldTransmitAudio(room *Room, isSpeaking bool, level, gate float32) bool {
     room.mu.RLock()
     currentSpeaker := room.CurrentSpeaker
     room.mu.RUnlock()
@@ -306,7 +785,7 @@ func (c *Client) shouldTransmitAudio(room *Room, isSpeaking bool, level float32)
     }
     
     // If someone else is speaking, check if we should interrupt
-    if isSpeaking && level > GATE_THRESHOLD * 2 {
+    if isSpeaking && level > gate * 2 {
         // Only interrupt if significantly louder
         return true
     }
@@ -315,7 +794,7 @@ func (c *Client) shouldTransmitAudio(room *Room, isSpeaking bool, level float32)
 }
 
 // applyEchoCancellation removes echo from audio
-func (c *Client) applyEchoCancellation(samples []float32, room *Room) []float32 {
+func (c *Client) applyEchoCancellation(samples []float32, room *Room, threshold float32) []float32 {
     c.AudioProc.mu.Lock()
     defer c.AudioProc.mu.Unlock()
     
@@ -332,7 +811,7 @@ func (c *Client) applyEchoCancellation(samples []float32, room *Room) []float32
             // Subtract estimated echo
             for i := range processed {
                 if i < len(echoBuffer) {
-                    processed[i] -= echoBuffer[i] * ECHO_THRESHOLD
+                    processed[i] -= echoBuffer[i] * threshold
                     
                     // Clamp to valid range
                     if processed[i] > 1.0 {
@@ -384,18 +863,46 @@ func (c *Client) detectFeedback(samples []float32) bool {
     return false
 }
 
+// speakerState is the part of a participant audio routing looks at
+type speakerState struct {
+    ID       string
+    Speaking bool // Above the gate within the last SPEAKING_HOLD
+}
+
+// speakerState snapshots the client's speaking flag, which goes stale once
+// its audio stops arriving
+func (c *Client) speakerState(now time.Time) speakerState {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return speakerState{
+        ID:       c.ID,
+        Speaking: c.IsCurrentSpeaker && now.Sub(c.LastAudioTime) < SPEAKING_HOLD,
+    }
+}
+
+// shouldRouteAudio decides whether sender's audio reaches receiver. Audio
+// never goes back to its sender. A participant who is talking only hears
+// others who are talking too, whether or not they're the room's loudest, so
+// two people talking over each other both hear each other, while a silent
+// participant's mic (typically the talker's own voice coming back off their
+// speakers) doesn't echo to them. Everyone who isn't talking hears everything.
+func shouldRouteAudio(sender, receiver speakerState) bool {
+    switch {
+    case sender.ID == receiver.ID:
+        return false
+    case !receiver.Speaking:
+        return true
+    }
+    return sender.Speaking
+}
+
 // Room audio management
 func (r *Room) updateCurrentSpeaker(clientID string, level float32) {
     r.mu.Lock()
     defer r.mu.Unlock()
     
     if r.AudioMixer == nil {
-        r.AudioMixer = &AudioMixer{
-            ActiveSpeakers:  make(map[string]*SpeakerInfo),
-            RoomEchoBuffer:  make([]float32, AUDIO_BUFFER_SIZE),
-            EchoPatterns:    make(map[string][]float32),
-            FeedbackDetector: &FeedbackDetector{},
-        }
+        r.AudioMixer = newAudioMixer()
     }
     
     // Update or add speaker
@@ -429,6 +936,58 @@ func (r *Room) updateCurrentSpeaker(clientID string, level float32) {
     r.CurrentSpeaker = primarySpeaker
 }
 
+// mixer returns the room's AudioMixer, creating it on first use
+func (r *Room) mixer() *AudioMixer {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    if r.AudioMixer == nil {
+        r.AudioMixer = newAudioMixer()
+    }
+    return r.AudioMixer
+}
+
+// mixAndSend delivers one audio-mixed chunk per receiver, excluding its own audio
+func (r *Room) mixAndSend() {
+    r.mu.RLock()
+    mixer := r.AudioMixer
+    clients := make([]*Client, 0, len(r.Clients))
+    for _, client := range r.Clients {
+        clients = append(clients, client)
+    }
+    r.mu.RUnlock()
+    
+    if mixer == nil {
+        return
+    }
+    
+    pending := mixer.takePending()
+    if len(pending) == 0 {
+        return
+    }
+    
+    now := time.Now().UnixMilli()
+    for _, client := range clients {
+        mix, speakers := mixFor(client.ID, pending, client.gainsSnapshot())
+        if mix == nil {
+            continue
+        }
+        
+        // Mixes are built per listener anyway, so each gets its own format
+        msg := Message{
+            Type:       "audio-mixed",
+            Data:       string(encodeAudioData(mix, client.AudioFormat)),
+            Speakers:   speakers,
+            Timestamp:  now,
+            SampleRate: client.AudioFormat.SampleRate,
+            Channels:   client.AudioFormat.Channels,
+        }
+        if data, err := json.Marshal(msg); err == nil {
+            client.pipe(data)
+        }
+    }
+}
+
 // Audio utility functions
 func calculateAudioLevel(samples []float32) float32 {
     if len(samples) == 0 {
@@ -484,25 +1043,44 @@ func detectRepetitivePattern(samples []float32) bool {
     return correlation > 0.7 // High correlation indicates repetitive pattern
 }
 
-func decodeAudioData(data []byte) []float32 {
+// decodeAudioData turns base64 PCM in the given format into mix-format samples
+func decodeAudioData(data []byte, format AudioFormat) []float32 {
     // Decode base64 PCM data
     decoded, err := base64.StdEncoding.DecodeString(string(data))
     if err != nil {
         return nil
     }
-    
+    return decodeAudioPCM(decoded, format)
+}
+
+// decodeAudioPCM turns raw little-endian PCM into mix-format samples
+func decodeAudioPCM(pcm []byte, format AudioFormat) []float32 {
     // Convert to float32
-    samples := make([]float32, len(decoded)/2)
+    samples := make([]float32, len(pcm)/2)
     for i := 0; i < len(samples); i++ {
         // Convert int16 to float32
-        val := int16(decoded[i*2]) | int16(decoded[i*2+1])<<8
+        val := int16(pcm[i*2]) | int16(pcm[i*2+1])<<8
         samples[i] = float32(val) / 32768.0
     }
     
-    return samples
+    // Fast path: already in the room format
+    if format == mixFormat {
+        return samples
+    }
+    return resample(downmix(samples, format.Channels), format.SampleRate, MIX_SAMPLE_RATE)
 }
 
-func encodeAudioData(samples []float32) []byte {
+// encodeAudioData turns mix-format samples into base64 PCM in the given format
+func encodeAudioData(samples []float32, format AudioFormat) []byte {
+    return []byte(base64.StdEncoding.EncodeToString(encodeAudioPCM(samples, format)))
+}
+
+// encodeAudioPCM turns mix-format samples into raw PCM in the given format
+func encodeAudioPCM(samples []float32, format AudioFormat) []byte {
+    if format != mixFormat {
+        samples = upmix(resample(samples, MIX_SAMPLE_RATE, format.SampleRate), format.Channels)
+    }
+    
     // Convert float32 to int16 PCM
     pcm := make([]byte, len(samples)*2)
     
@@ -512,9 +1090,158 @@ func encodeAudioData(samples []float32) []byte {
         pcm[i*2] = byte(val)
         pcm[i*2+1] = byte(val >> 8)
     }
+    return pcm
+}
+
+// encodeAudioFrame builds a relayed binary frame: kind|audioFrameRelayed,
+// sender length and id, then big-endian seq (4), sample rate (4) and
+// channels (1) ahead of the payload
+func encodeAudioFrame(kind byte, from string, seq int, format AudioFormat, payload []byte) []byte {
+    if len(from) > 255 {
+        from = from[:255]
+    }
+    frame := make([]byte, 0, 2+len(from)+9+len(payload))
+    frame = append(frame, kind|audioFrameRelayed, byte(len(from)))
+    frame = append(frame, from...)
+    frame = binary.BigEndian.AppendUint32(frame, uint32(seq))
+    frame = binary.BigEndian.AppendUint32(frame, uint32(format.SampleRate))
+    frame = append(frame, byte(format.Channels))
+    return append(frame, payload...)
+}
+
+// decodeAudioFrame reverses encodeAudioFrame
+func decodeAudioFrame(frame []byte) (kind byte, from string, seq int, format AudioFormat, payload []byte, err error) {
+    if len(frame) < 2 || frame[0]&audioFrameRelayed == 0 {
+        return 0, "", 0, AudioFormat{}, nil, errors.New("not a relayed audio frame")
+    }
+    kind = frame[0] &^ audioFrameRelayed
+    n := int(frame[1])
+    if len(frame) < 2+n+9 {
+        return 0, "", 0, AudioFormat{}, nil, errors.New("truncated audio frame header")
+    }
+    from = string(frame[2 : 2+n])
+    header := frame[2+n:]
+    seq = int(binary.BigEndian.Uint32(header))
+    format = AudioFormat{
+        SampleRate: int(binary.BigEndian.Uint32(header[4:])),
+        Channels:   int(header[8]),
+    }
+    return kind, from, seq, format, header[9:], nil
+}
+
+// transcode fills in the form of an audio broadcast the sender didn't
+// produce: a base64 audio message from a binary frame, or a binary frame
+// from an audio message. Level and speaking state aren't in the frame, so
+// they come from the sender when it's still in the room.
+func (b *BroadcastMessage) transcode(sender *Client) error {
+    if len(b.Message) > MAX_TRANSCODE_SIZE || len(b.Binary) > MAX_TRANSCODE_SIZE {
+        return errors.New("audio chunk too large to transcode")
+    }
     
-    // Encode to base64
-    return []byte(base64.StdEncoding.EncodeToString(pcm))
+    switch {
+    case b.Message == nil && b.Binary != nil:
+        kind, from, seq, format, payload, err := decodeAudioFrame(b.Binary)
+        if err != nil {
+            return err
+        }
+        msg := Message{
+            Type:       "audio",
+            From:       from,
+            Data:       base64.StdEncoding.EncodeToString(payload),
+            AudioSeq:   seq,
+            Timestamp:  time.Now().UnixMilli(),
+            SampleRate: format.SampleRate,
+            Channels:   format.Channels,
+        }
+        if kind == audioFrameOpus {
+            msg.Codec = "opus"
+        }
+        if sender != nil {
+            sender.mu.RLock()
+            msg.AudioLevel = sender.AudioLevel
+            msg.IsSpeaking = sender.IsCurrentSpeaker
+            sender.mu.RUnlock()
+        }
+        data, err := json.Marshal(msg)
+        if err != nil {
+            return err
+        }
+        b.Message = data
+        
+    case b.Binary == nil && b.Message != nil:
+        var msg Message
+        if err := json.Unmarshal(b.Message, &msg); err != nil {
+            return err
+        }
+        if msg.Type != "audio" {
+            return fmt.Errorf("%s messages have no binary form", msg.Type)
+        }
+        payload, err := base64.StdEncoding.DecodeString(msg.Data)
+        if err != nil {
+            return err
+        }
+        kind := byte(audioFramePCM)
+        if msg.Codec == "opus" {
+            kind = audioFrameOpus
+        }
+        b.Binary = encodeAudioFrame(kind, msg.From, msg.AudioSeq, AudioFormat{SampleRate: msg.SampleRate, Channels: msg.Channels}, payload)
+    }
+    return nil
+}
+
+// downmix averages interleaved channels into mono
+func downmix(samples []float32, channels int) []float32 {
+    if channels <= 1 {
+        return samples
+    }
+    
+    mono := make([]float32, len(samples)/channels)
+    for i := range mono {
+        var sum float32
+        for ch := 0; ch < channels; ch++ {
+            sum += samples[i*channels+ch]
+        }
+        mono[i] = sum / float32(channels)
+    }
+    return mono
+}
+
+// upmix copies mono samples onto every channel
+func upmix(samples []float32, channels int) []float32 {
+    if channels <= 1 {
+        return samples
+    }
+    
+    out := make([]float32, len(samples)*channels)
+    for i, sample := range samples {
+        for ch := 0; ch < channels; ch++ {
+            out[i*channels+ch] = sample
+        }
+    }
+    return out
+}
+
+// resample converts mono samples between rates by linear interpolation.
+// Each chunk is resampled on its own, which is inaudible at 20ms chunks.
+func resample(samples []float32, from, to int) []float32 {
+    if from == to || len(samples) == 0 {
+        return samples
+    }
+    
+    n := len(samples) * to / from
+    out := make([]float32, n)
+    step := float64(from) / float64(to)
+    for i := range out {
+        pos := float64(i) * step
+        j := int(pos)
+        if j >= len(samples)-1 {
+            out[i] = samples[len(samples)-1]
+            continue
+        }
+        frac := float32(pos - float64(j))
+        out[i] = samples[j]*(1-frac) + samples[j+1]*frac
+    }
+    return out
 }
 
 func (c *Client) getRoom() *Room {
@@ -552,7 +1279,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 func (c *Client) readPump() {
     defer func() {
-        hub.Unregister <- c
+        c.Hub.Unregister <- c
         c.Conn.Close()
     }()
     
@@ -562,25 +1289,109 @@ func (c *Client) readPump() {
         return nil
     })
     
+    // Excess messages within a one-second window are dropped
+    windowStart := time.Now()
+    windowCount := 0
+    
     for {
         _, data, err := c.Conn.ReadMessage()
         if err != nil {
             break
         }
         
+        if time.Since(windowStart) >= time.Second {
+            windowStart = time.Now()
+            windowCount = 0
+        }
+        windowCount++
+        if windowCount > MAX_MESSAGES_PER_SEC {
+            if windowCount == MAX_MESSAGES_PER_SEC+1 {
+                c.sendError(ErrRateLimited, fmt.Sprintf("more than %d messages per second", MAX_MESSAGES_PER_SEC), "")
+            }
+            continue
+        }
+        
+        if len(data) > MAX_MESSAGE_SIZE {
+            c.sendError(ErrTooLarge, fmt.Sprintf("message of %d bytes exceeds %d", len(data), MAX_MESSAGE_SIZE), "")
+            continue
+        }
+        
+        // Detected per message so JSON and binary clients can share a room;
+        // a client that sends binary frames gets them back from then on
+        if len(data) > 0 && data[0] != '{' {
+            c.BinaryAudio.Store(true)
+            c.handleBinaryAudio(data)
+            continue
+        }
+        
         var msg Message
         if err := json.Unmarshal(data, &msg); err != nil {
+            c.sendError(ErrMalformed, err.Error(), "")
             continue
         }
         
         switch msg.Type {
         case "join":
+            // Set before joining so the mixer only ever sees the final format
+            c.AudioFormat = audioFormat(msg, mixFormat)
+            if msg.BinaryAudio {
+                c.BinaryAudio.Store(true)
+            }
+            room := c.Hub.joinRoom(c, msg)
+            if room == nil {
+                c.sendError(ErrRoomFull, fmt.Sprintf("room %s already has %d participants", msg.Room, maxUsersPerRoom), msg.Type)
+                break
+            }
+            // The hub reads Room when this client registers, which can
+            // still be in flight
+            c.mu.Lock()
             c.Room = msg.Room
-            hub.joinRoom(c, msg.Room)
+            c.mu.Unlock()
+            
+            // Relayed audio arrives in the mix format, mixes in the client's own;
+            // passthrough audio keeps each sender's format, tagged per chunk
+            received := mixFormat
+            if audioMixing {
+                received = c.AudioFormat
+            }
+            if room.Passthrough {
+                received = AudioFormat{}
+            }
+            processing := !room.Passthrough
+            welcome := Message{
+                Type:            "welcome",
+                ID:              c.ID,
+                Room:            room.ID,
+                AudioOnly:       room.AudioOnly,
+                SampleRate:      received.SampleRate,
+                Channels:        received.Channels,
+                AudioProcessing: &processing,
+                BinaryAudio:     c.BinaryAudio.Load(),
+                Media:           c.mediaProfile(room),
+            }
+            if data, err := json.Marshal(welcome); err == nil {
+                c.pipe(data)
+            }
             
         case "audio":
+            // Passthrough rooms skip VAD, echo cancellation, ducking and mixing
+            if room := c.getRoom(); room != nil && room.Passthrough {
+                c.relayAudio(msg)
+                break
+            }
+            
+            // In mixing mode processed samples go to the room mixer instead
+            if audioMixing {
+                if samples, ok := c.ProcessAudioSamples([]byte(msg.Data), audioFormat(msg, c.AudioFormat)); ok && samples != nil {
+                    if room := c.getRoom(); room != nil {
+                        room.mixer().addChunk(c.ID, samples)
+                    }
+                }
+                break
+            }
+            
             // Process audio with echo cancellation
-            if processed, ok := c.ProcessAudioFrame([]byte(msg.Data)); ok && processed != nil {
+            if processed, ok := c.ProcessAudioFrame([]byte(msg.Data), audioFormat(msg, c.AudioFormat)); ok && processed != nil {
                 // Create audio message with metadata
                 audioMsg := Message{
                     Type:       "audio",
@@ -590,38 +1401,47 @@ func (c *Client) readPump() {
                     AudioLevel: c.AudioLevel,
                     IsSpeaking: c.IsCurrentSpeaker,
                     Timestamp:  time.Now().UnixMilli(),
+                    SampleRate: MIX_SAMPLE_RATE,
+                    Channels:   MIX_CHANNELS,
                 }
                 
                 if outData, err := json.Marshal(audioMsg); err == nil {
-                    hub.Broadcast <- &BroadcastMessage{
+                    c.Hub.broadcast(&BroadcastMessage{
                         Room:    c.Room,
                         Message: outData,
                         From:    c.ID,
                         IsAudio: true,
-                    }
+                    })
                 }
             }
             
         case "frame":
+            // Audio-only rooms leave the whole budget to audio
+            if room := c.getRoom(); room != nil && room.AudioOnly {
+                atomic.AddInt64(&room.VideoDropped, 1)
+                break
+            }
+            
             // Video frame handling (simplified from adaptive version)
             quality := QualityLevels[c.CurrentQuality]
             if decoded, err := base64.StdEncoding.DecodeString(msg.Data); err == nil {
-                if compressed, err := compressToWebP(decoded, &quality); err == nil {
+                if compressed, err := compressFrame(decoded, &quality); err == nil {
                     outMsg := Message{
-                        Type:      "webp-frame",
-                        From:      c.ID,
-                        Data:      base64.StdEncoding.EncodeToString(compressed),
-                        Timestamp: time.Now().UnixMilli(),
-                        Quality:   quality.Name,
+                        Type:            "webp-frame",
+                        From:            c.ID,
+                        Data:            base64.StdEncoding.EncodeToString(compressed),
+                        Timestamp:       time.Now().UnixMilli(),
+                        Quality:         quality.Name,
+                        CompressionType: videoCodec,
                     }
                     
                     if outData, err := json.Marshal(outMsg); err == nil {
-                        hub.Broadcast <- &BroadcastMessage{
+                        c.Hub.broadcast(&BroadcastMessage{
                             Room:    c.Room,
                             Message: outData,
                             From:    c.ID,
                             IsAudio: false,
-                        }
+                        })
                     }
                 }
             }
@@ -638,10 +1458,133 @@ func (c *Client) readPump() {
                 Timestamp: msg.Timestamp,
             }
             if data, err := json.Marshal(pong); err == nil {
-                c.Send <- data
+                c.pipe(data)
+            }
+            
+        case "capabilities":
+            if data, err := json.Marshal(capabilities()); err == nil {
+                c.pipe(data)
+            }
+            
+        case "set-volume":
+            if msg.TargetID == "" || msg.Gain == nil {
+                break
+            }
+            gain := c.setGain(msg.TargetID, *msg.Gain)
+            
+            // The mixer applies gains itself; otherwise the client scales playback
+            if !audioMixing {
+                hint := Message{
+                    Type:     "volume-hint",
+                    TargetID: msg.TargetID,
+                    Gain:     &gain,
+                }
+                if data, err := json.Marshal(hint); err == nil {
+                    c.pipe(data)
+                }
             }
+            
+        case "set-audio-params":
+            c.setAudioParams(msg)
+            
+        default:
+            c.sendError(ErrUnknownType, "unsupported message type", msg.Type)
+        }
+    }
+}
+
+// setAudioParams changes the fields present in audioParams for the sender's
+// room and replies with the full set now in effect
+func (c *Client) setAudioParams(msg Message) {
+    if adminToken == "" || subtle.ConstantTimeCompare([]byte(msg.Token), []byte(adminToken)) != 1 {
+        c.sendError(ErrForbidden, "set-audio-params needs the admin token", msg.Type)
+        return
+    }
+    room := c.getRoom()
+    if room == nil {
+        return
+    }
+    
+    room.mu.Lock()
+    params := room.Params
+    err := json.Unmarshal(msg.AudioParams, &params)
+    if err == nil {
+        err = params.validate()
+    }
+    if err == nil {
+        room.Params = params
+    }
+    room.mu.Unlock()
+    if err != nil {
+        c.sendError(ErrBadParams, err.Error(), msg.Type)
+        return
+    }
+    log.Printf("Audio params for room %s set by %s: gate %.3f, ducking %.2f, echo %.2f",
+        room.ID, c.ID, params.GateThreshold, params.DuckingFactor, params.EchoThreshold)
+    
+    encoded, _ := json.Marshal(params)
+    if data, err := json.Marshal(Message{Type: "audio-params", Room: room.ID, AudioParams: encoded}); err == nil {
+        c.pipe(data)
+    }
+}
+
+// handleBinaryAudio takes an audio frame without base64. PCM goes through
+// the same processing as audio messages; Opus can't be decoded here so it
+// is relayed as sent, like audio in a passthrough room.
+func (c *Client) handleBinaryAudio(data []byte) {
+    if len(data) < 2 || (data[0] != audioFramePCM && data[0] != audioFrameOpus) {
+        c.sendError(ErrBadAudio, "binary frames must start with an audio kind byte and carry a payload", "")
+        return
+    }
+    kind, payload := data[0], data[1:]
+    format := c.AudioFormat
+    
+    room := c.getRoom()
+    if kind == audioFrameOpus || (room != nil && room.Passthrough) {
+        c.mu.Lock()
+        c.LastAudioTime = time.Now()
+        c.AudioSequence++
+        seq := c.AudioSequence
+        c.mu.Unlock()
+        c.broadcastAudio(kind, payload, format, seq)
+        return
+    }
+    if len(payload)%2 != 0 {
+        c.sendError(ErrBadAudio, "16-bit PCM payload has an odd length", "")
+        return
+    }
+    
+    samples, ok := c.ProcessAudioPCM(payload, format)
+    if !ok || samples == nil {
+        return
+    }
+    if audioMixing {
+        if room != nil {
+            room.mixer().addChunk(c.ID, samples)
         }
+        return
     }
+    c.broadcastAudio(audioFramePCM, encodeAudioPCM(samples, mixFormat), mixFormat, c.AudioSequence)
+}
+
+// broadcastAudio relays one chunk as a binary frame; the hub turns it into
+// a base64 audio message for any JSON receivers in the room
+func (c *Client) broadcastAudio(kind byte, payload []byte, format AudioFormat, seq int) {
+    c.Hub.broadcast(&BroadcastMessage{
+        Room:    c.Room,
+        Binary:  encodeAudioFrame(kind, c.ID, seq, format, payload),
+        From:    c.ID,
+        IsAudio: true,
+    })
+}
+
+// sendError tells the client why its message was refused; never blocks
+func (c *Client) sendError(code ErrorCode, text, ref string) {
+    data, err := json.Marshal(Message{Type: "error", Code: code, Text: text, Ref: ref})
+    if err != nil {
+        return
+    }
+    c.pipe(data)
 }
 
 func (c *Client) processFeedback(feedback *ClientFeedback) {
@@ -673,8 +1616,14 @@ func (c *Client) writePump() {
                 return
             }
             
+            // JSON always starts with '{'; binary audio with its kind byte
+            messageType := websocket.TextMessage
+            if len(message) > 0 && message[0] != '{' {
+                messageType = websocket.BinaryMessage
+            }
+            
             c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-            if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+            if err := c.Conn.WriteMessage(messageType, message); err != nil {
                 return
             }
             
@@ -688,19 +1637,56 @@ func (c *Client) writePump() {
 }
 
 // Hub methods
+// broadcast queues a message for the hub, applying the overflow policy when full
+func (h *Hub) broadcast(msg *BroadcastMessage) {
+    switch overflowPolicy {
+    case OverflowDropVideo:
+        if msg.IsAudio {
+            h.Broadcast <- msg
+            return
+        }
+        select {
+        case h.Broadcast <- msg:
+        default:
+            atomic.AddInt64(&h.BroadcastOverflow, 1)
+        }
+        
+    case OverflowDropOldest:
+        for {
+            select {
+            case h.Broadcast <- msg:
+                return
+            default:
+            }
+            select {
+            case <-h.Broadcast:
+                atomic.AddInt64(&h.BroadcastOverflow, 1)
+            default:
+            }
+        }
+        
+    default:
+        h.Broadcast <- msg
+    }
+}
+
 func (h *Hub) run() {
     for {
         select {
         case client := <-h.Register:
+            client.mu.RLock()
+            roomID := client.Room
+            client.mu.RUnlock()
+            
             h.mu.Lock()
-            if room, ok := h.Rooms[client.Room]; ok {
+            if room, ok := h.Rooms[roomID]; ok {
                 room.mu.Lock()
                 room.Clients[client.ID] = client
                 room.mu.Unlock()
             }
             h.mu.Unlock()
             
-            log.Printf("Client registered: %s (room: %s)", client.ID, client.Room)
+            log.Printf("Client registered: %s (room: %s)", client.ID, roomID)
             
         case client := <-h.Unregister:
             h.mu.Lock()
@@ -714,7 +1700,7 @@ func (h *Hub) run() {
                 }
                 room.mu.Unlock()
             }
-            close(client.Send)
+            client.closeSend()
             h.mu.Unlock()
             
             log.Printf("Client unregistered: %s", client.ID)
@@ -729,31 +1715,45 @@ func (h *Hub) run() {
                 clients := make([]*Client, 0, len(room.Clients))
                 
                 // Smart audio routing to prevent echo
+                now := time.Now()
+                from := room.Clients[broadcast.From]
+                sender := speakerState{ID: broadcast.From}
+                if from != nil {
+                    sender = from.speakerState(now)
+                }
+                needJSON, needBinary := false, false
                 for _, client := range room.Clients {
-                    shouldSend := true
-                    
-                    // Don't send audio back to sender
-                    if broadcast.IsAudio && client.ID == broadcast.From {
-                        shouldSend = false
-                    }
-                    
-                    // Additional echo prevention logic
-                    if broadcast.IsAudio && client.IsCurrentSpeaker && 
-                       broadcast.From != room.CurrentSpeaker {
-                        // Don't send to active speakers if from non-primary speaker
-                        shouldSend = false
-                    }
-                    
-                    if shouldSend {
+                    if !broadcast.IsAudio || shouldRouteAudio(sender, client.speakerState(now)) {
                         clients = append(clients, client)
+                        if client.BinaryAudio.Load() {
+                            needBinary = true
+                        } else {
+                            needJSON = true
+                        }
                     }
                 }
                 room.mu.RUnlock()
                 
-                // Send to selected clients
+                // Transcode once per chunk, and only for a mixed room
+                if broadcast.IsAudio && ((needJSON && broadcast.Message == nil) || (needBinary && broadcast.Binary == nil)) {
+                    if err := broadcast.transcode(from); err != nil {
+                        atomic.AddInt64(&h.TranscodeFailed, 1)
+                    } else {
+                        atomic.AddInt64(&h.Transcoded, 1)
+                    }
+                }
+                
+                // Send to selected clients; binary receivers still read JSON
                 for _, client := range clients {
+                    message := broadcast.Message
+                    if broadcast.Binary != nil && client.BinaryAudio.Load() {
+                        message = broadcast.Binary
+                    }
+                    if message == nil {
+                        continue
+                    }
                     select {
-                    case client.Send <- broadcast.Message:
+                    case client.Send <- message:
                     default:
                         // Client buffer full
                     }
@@ -763,26 +1763,58 @@ func (h *Hub) run() {
     }
 }
 
-func (h *Hub) joinRoom(client *Client, roomID string) {
+// runMixer emits mixed audio for every room on a fixed cadence
+func (h *Hub) runMixer() {
+    ticker := time.NewTicker(mixInterval)
+    defer ticker.Stop()
+    
+    for range ticker.C {
+        h.mu.RLock()
+        rooms := make([]*Room, 0, len(h.Rooms))
+        for _, room := range h.Rooms {
+            rooms = append(rooms, room)
+        }
+        h.mu.RUnlock()
+        
+        for _, room := range rooms {
+            room.mixAndSend()
+        }
+    }
+}
+
+// joinRoom adds the client to the room, returning nil when the room is full.
+// The join's mode and audioProcessing only apply when it creates the room.
+func (h *Hub) joinRoom(client *Client, join Message) *Room {
     h.mu.Lock()
     defer h.mu.Unlock()
     
-    room, exists := h.Rooms[roomID]
+    room, exists := h.Rooms[join.Room]
     if !exists {
         room = &Room{
-            ID:      roomID,
-            Clients: make(map[string]*Client),
+            ID:          join.Room,
+            Clients:     make(map[string]*Client),
+            AudioOnly:   join.Mode == "audio-only",
+            Passthrough: join.AudioProcessing != nil && !*join.AudioProcessing,
+            Params:      defaultAudioParams,
+        }
+        h.Rooms[join.Room] = room
+        if room.Passthrough {
+            log.Printf("Room %s created with audio passthrough", room.ID)
         }
-        h.Rooms[roomID] = room
     }
     
     room.mu.Lock()
+    defer room.mu.Unlock()
+    
+    if _, rejoin := room.Clients[client.ID]; !rejoin && maxUsersPerRoom > 0 && len(room.Clients) >= maxUsersPerRoom {
+        return nil
+    }
     room.Clients[client.ID] = client
-    room.mu.Unlock()
+    return room
 }
 
-// WebP compression
-func compressToWebP(data []byte, quality *QualityPreset) ([]byte, error) {
+// compressFrame scales a frame to the preset and encodes it with videoCodec
+func compressFrame(data []byte, quality *QualityPreset) ([]byte, error) {
     img, _, err := image.Decode(bytes.NewReader(data))
     if err != nil {
         return nil, err
@@ -796,22 +1828,61 @@ func compressToWebP(data []byte, quality *QualityPreset) ([]byte, error) {
     rgba := image.NewRGBA(bounds)
     draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
     
-    var buf bytes.Buffer
-    options := &webp.Options{
-        Lossless: false,
-        Quality:  quality.Quality,
+    // Presets are 0-1, both encoders take 0-100
+    q := quality.Quality * 100
+    if videoCodec == "jpeg" {
+        var buf bytes.Buffer
+        if err := jpeg.Encode(&buf, rgba, &jpeg.Options{Quality: int(q)}); err != nil {
+            return nil, err
+        }
+        return buf.Bytes(), nil
     }
-    
-    if err := webp.Encode(&buf, rgba, options); err != nil {
-        return nil, err
+    return webpcodec.Encode(rgba, q, webpEffort)
+}
+
+// capabilities describes this server so a generic client can adapt to it
+func capabilities() map[string]interface{} {
+    outbound := []string{"audio", "webp-frame", "pong", "capabilities"}
+    if audioMixing {
+        outbound = append(outbound, "audio-mixed")
+    } else {
+        outbound = append(outbound, "volume-hint")
     }
     
-    return buf.Bytes(), nil
+    return map[string]interface{}{
+        "type":             "capabilities",
+        "server":           "echo-free-conference",
+        "version":          "1.1.0",
+        "accepts":          []string{"join", "audio", "frame", "feedback", "ping", "capabilities", "set-volume", "set-audio-params"},
+        "sends":            outbound,
+        "codec":            videoCodec,
+        "maxParticipants":  0, // No per-room limit
+        "echoCancellation": true,
+        "audioMixing":      audioMixing,
+        "binaryAudio":      []string{"pcm16", "opus"}, // Kind bytes 0x01 and 0x02
+        "audioFormat": map[string]interface{}{
+            "mixSampleRate": MIX_SAMPLE_RATE,
+            "mixChannels":   MIX_CHANNELS,
+            "channels":      []int{1, 2}, // Any rate from 8 to 192 kHz on join or audio
+        },
+        "adaptiveQuality":  false,
+        "build": map[string]string{
+            "time":       BuildTime,
+            "commit":     BuildCommit,
+            "deployedBy": BuildBy,
+            "ref":        BuildRef,
+        },
+    }
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
     
+    features := []string{"echo-cancellation", "VAD", "audio-ducking", "webp-compression", "deployment-tracking", "audio-only-rooms"}
+    if audioMixing {
+        features = append(features, "server-mixing")
+    }
+    
     health := map[string]interface{}{
         "status": "healthy",
         "deployment": map[string]string{
@@ -823,7 +1894,15 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
         "server": map[string]interface{}{
             "type":     "echo-free-conference",
             "version":  "1.1.0",
-            "features": []string{"echo-cancellation", "VAD", "audio-ducking", "webp-compression", "deployment-tracking"},
+            "features": features,
+        },
+        "broadcast": map[string]interface{}{
+            "buffer":          cap(hub.Broadcast),
+            "queued":          len(hub.Broadcast),
+            "policy":          overflowPolicy,
+            "overflow":        atomic.LoadInt64(&hub.BroadcastOverflow),
+            "transcoded":      atomic.LoadInt64(&hub.Transcoded),
+            "transcodeFailed": atomic.LoadInt64(&hub.TranscodeFailed),
         },
         "timestamp": time.Now().UTC().Format(time.RFC3339),
     }
@@ -831,18 +1910,98 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(health)
 }
 
-func main() {
-    hub = &Hub{
+func newHub() *Hub {
+    return &Hub{
         Rooms:      make(map[string]*Room),
         Register:   make(chan *Client),
         Unregister: make(chan *Client),
-        Broadcast:  make(chan *BroadcastMessage, 256),
+        Broadcast:  make(chan *BroadcastMessage, broadcastBuffer),
+    }
+}
+
+// registerPprof mounts the profiler under /debug/pprof/. Importing net/http/pprof
+// also registers it on http.DefaultServeMux, so public routes live on their own mux.
+func registerPprof(mux *http.ServeMux) {
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// enablePprof serves the profiler when ENABLE_PPROF=true, on ADMIN_ADDR when
+// set so it stays off the public port
+func enablePprof(public *http.ServeMux) {
+    if os.Getenv("ENABLE_PPROF") != "true" {
+        return
     }
     
+    adminAddr := os.Getenv("ADMIN_ADDR")
+    if adminAddr == "" {
+        registerPprof(public)
+        log.Printf("pprof enabled on the public listener at /debug/pprof/")
+        return
+    }
+    
+    admin := http.NewServeMux()
+    registerPprof(admin)
+    go func() {
+        log.Printf("pprof enabled on %s/debug/pprof/", adminAddr)
+        if err := http.ListenAndServe(adminAddr, admin); err != nil {
+            log.Printf("Admin listener failed: %v", err)
+        }
+    }()
+}
+
+func main() {
+    if n, err := strconv.Atoi(os.Getenv("BROADCAST_BUFFER")); err == nil && n > 0 {
+        broadcastBuffer = n
+    }
+    for name, value := range map[string]*float32{
+        "GATE_THRESHOLD": &defaultAudioParams.GateThreshold,
+        "DUCKING_FACTOR": &defaultAudioParams.DuckingFactor,
+        "ECHO_THRESHOLD": &defaultAudioParams.EchoThreshold,
+    } {
+        env := os.Getenv(name)
+        if env == "" {
+            continue
+        }
+        if f, err := strconv.ParseFloat(env, 32); err == nil && f >= 0 && f <= 1 {
+            *value = float32(f)
+        } else {
+            log.Printf("%s %q is not 0-1, using %g", name, env, *value)
+        }
+    }
+    if !webpcodec.Available {
+        videoCodec = "jpeg"
+        log.Printf("Built without cgo, so no WebP encoder: webp-frame messages carry jpeg")
+    }
+    if value := os.Getenv("WEBP_EFFORT"); value != "" {
+        if n, err := strconv.Atoi(value); err == nil && n >= webpcodec.MinEffort && n <= webpcodec.MaxEffort {
+            webpEffort = n
+        } else {
+            log.Printf("WEBP_EFFORT %q is not 0-6, using %d", value, webpEffort)
+        }
+    }
+    switch policy := os.Getenv("BROADCAST_OVERFLOW"); policy {
+    case OverflowBlock, OverflowDropOldest, OverflowDropVideo:
+        overflowPolicy = policy
+    case "":
+    default:
+        log.Printf("Unknown BROADCAST_OVERFLOW %q, using %s", policy, overflowPolicy)
+    }
+    
+    hub = newHub()
+    
     go hub.run()
+    if audioMixing {
+        go hub.runMixer()
+        log.Printf("Server-side audio mixing enabled (every %s)", mixInterval)
+    }
     
     // Serve status page
-    http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
         html := `<!DOCTYPE html>
 <html>
 <head>
@@ -892,12 +2051,13 @@ func main() {
         w.Write([]byte(html))
     })
     
-    http.HandleFunc("/ws", handleWebSocket)
-    http.HandleFunc("/health", handleHealth)
-    http.HandleFunc("/info", handleHealth)
+    mux.HandleFunc("/ws", handleWebSocket)
+    mux.HandleFunc("/health", handleHealth)
+    mux.HandleFunc("/info", handleHealth)
+    enablePprof(mux)
     
     log.Println("Starting Echo-Free Conference Server on :3001")
     log.Println("Features: Echo Cancellation | Feedback Prevention | Smart Audio Routing")
     log.Printf("Build info: %s by %s (commit: %s)", BuildTime, BuildBy, BuildCommit)
-    log.Fatal(http.ListenAndServe(":3001", nil))
+    log.Fatal(http.ListenAndServe(":3001", mux))
 }
\ No newline at end of file
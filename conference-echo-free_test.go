@@ -0,0 +1,914 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "image/png"
+    "math"
+    "math/rand"
+    "reflect"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "conference/webpcodec"
+    "github.com/nfnt/resize"
+)
+
+// constantChunk is n mix-format samples all at level
+func constantChunk(level float32, n int) []float32 {
+    samples := make([]float32, n)
+    for i := range samples {
+        samples[i] = level
+    }
+    return samples
+}
+
+func mixRoom(ids ...string) *Room {
+    room := &Room{ID: "mix", Clients: make(map[string]*Client), AudioMixer: newAudioMixer()}
+    for _, id := range ids {
+        room.Clients[id] = &Client{ID: id, Send: make(chan []byte, 4), AudioFormat: mixFormat}
+    }
+    return room
+}
+
+func TestMixForLeavesOutTheListener(t *testing.T) {
+    pending := map[string][]float32{
+        "alice": constantChunk(0.1, 4),
+        "bob":   constantChunk(0.2, 4),
+        "carol": constantChunk(0.3, 2), // Shorter chunk, the tail is the others alone
+    }
+
+    mix, speakers := mixFor("bob", pending, nil)
+    for _, id := range speakers {
+        if id == "bob" {
+            t.Fatalf("bob's own audio is in his mix (speakers %v)", speakers)
+        }
+    }
+    want := []float32{0.4, 0.4, 0.1, 0.1}
+    for i := range want {
+        if math.Abs(float64(mix[i]-want[i])) > 1e-6 {
+            t.Fatalf("bob's mix = %v, want %v", mix, want)
+        }
+    }
+
+    // A listener alone with their own audio gets nothing back at all
+    if mix, speakers := mixFor("alice", map[string][]float32{"alice": constantChunk(0.5, 4)}, nil); mix != nil || speakers != nil {
+        t.Errorf("alice's mix of only herself = %v from %v, want none", mix, speakers)
+    }
+
+    // Muting a speaker takes them out of the mix; other gains scale them
+    mix, speakers = mixFor("alice", pending, map[string]float32{"bob": 0, "carol": 2})
+    if len(speakers) != 1 || speakers[0] != "carol" || math.Abs(float64(mix[0]-0.6)) > 1e-6 {
+        t.Errorf("alice's mix with bob muted and carol doubled = %v from %v, want 0.6 from carol", mix, speakers)
+    }
+}
+
+func TestMixAndSendNeverEchoesAReceiver(t *testing.T) {
+    room := mixRoom("alice", "bob", "carol")
+    levels := map[string]float32{"alice": 0.1, "bob": 0.2, "carol": 0.3}
+    for id, level := range levels {
+        room.AudioMixer.addChunk(id, constantChunk(level, 480))
+    }
+
+    room.mixAndSend()
+
+    for id, client := range room.Clients {
+        var msg Message
+        select {
+        case data := <-client.Send:
+            if err := json.Unmarshal(data, &msg); err != nil {
+                t.Fatal(err)
+            }
+        default:
+            t.Fatalf("%s got no mix", id)
+        }
+        if msg.Type != "audio-mixed" || len(msg.Speakers) != 2 {
+            t.Fatalf("%s got %s from %v, want an audio-mixed of the other two", id, msg.Type, msg.Speakers)
+        }
+
+        var want float32
+        for _, speaker := range msg.Speakers {
+            if speaker == id {
+                t.Fatalf("%s's mix lists their own audio (speakers %v)", id, msg.Speakers)
+            }
+            want += levels[speaker]
+        }
+        samples := decodeAudioData([]byte(msg.Data), client.AudioFormat)
+        if len(samples) != 480 {
+            t.Fatalf("%s's mix has %d samples, want 480", id, len(samples))
+        }
+        for _, sample := range samples {
+            if math.Abs(float64(sample-want)) > 1e-3 {
+                t.Fatalf("%s's mix sample = %.4f, want the others' sum %.4f", id, sample, want)
+            }
+        }
+    }
+}
+
+// The mixer runs on its own goroutine, so it can go on mixing for a client
+// the hub has just closed
+func TestMixAndSendAfterCloseSend(t *testing.T) {
+    room := mixRoom("alice", "bob")
+    room.Clients["alice"].closeSend()
+    room.AudioMixer.addChunk("bob", constantChunk(0.2, 480))
+
+    room.mixAndSend()
+
+    if _, ok := <-room.Clients["alice"].Send; ok {
+        t.Error("a mix was queued on alice's closed Send")
+    }
+}
+
+// startHub runs a fresh hub for one test; it is left running, with no
+// clients, when the test ends
+func startHub(t *testing.T) *Hub {
+    t.Helper()
+    h := newHub()
+    go h.run()
+    return h
+}
+
+// connect registers a client on a fakeConn, joins it to room and reads
+// its welcome
+func connect(t *testing.T, h *Hub, room, id string, join Message) *fakeConn {
+    t.Helper()
+    conn := newFakeConn()
+    client := &Client{ID: id, Conn: conn, Send: make(chan []byte, 256), Hub: h, Metrics: &ClientMetrics{}}
+    h.Register <- client
+    go client.writePump()
+    go client.readPump()
+
+    join.Type, join.Room = "join", room
+    push(t, conn, join)
+    readUntil(t, conn, "welcome")
+    return conn
+}
+
+func push(t *testing.T, conn *fakeConn, msg Message) {
+    t.Helper()
+    data, err := json.Marshal(msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.In <- data
+}
+
+// readUntil returns what the server wrote to conn up to and including the
+// first message of kind
+func readUntil(t *testing.T, conn *fakeConn, kind string) []Message {
+    t.Helper()
+    var got []Message
+    timeout := time.After(2 * time.Second)
+    for {
+        select {
+        case data := <-conn.Out:
+            var msg Message
+            if json.Unmarshal(data, &msg) != nil {
+                continue // Binary audio
+            }
+            got = append(got, msg)
+            if msg.Type == kind {
+                return got
+            }
+        case <-timeout:
+            t.Fatalf("no %s within 2s, got %v", kind, got)
+        }
+    }
+}
+
+// settle round-trips a ping, so everything the hub queued to conn before
+// then has been read; it returns what that was
+func settle(t *testing.T, conn *fakeConn) []Message {
+    t.Helper()
+    push(t, conn, Message{Type: "ping"})
+    return readUntil(t, conn, "pong")
+}
+
+func audioFrom(msgs []Message, from string) int {
+    n := 0
+    for _, msg := range msgs {
+        if msg.Type == "audio" && msg.From == from {
+            n++
+        }
+    }
+    return n
+}
+
+// toneChunk is 20ms of a 440Hz tone at amplitude, base64 PCM in the mix format
+func toneChunk(amplitude float32) string {
+    samples := make([]float32, MIX_SAMPLE_RATE/50)
+    for i := range samples {
+        samples[i] = amplitude * float32(math.Sin(2*math.Pi*440*float64(i)/MIX_SAMPLE_RATE))
+    }
+    return base64.StdEncoding.EncodeToString(encodeAudioPCM(samples, mixFormat))
+}
+
+func roomClients(h *Hub, room string) map[string]bool {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+
+    ids := make(map[string]bool)
+    if r := h.Rooms[room]; r != nil {
+        r.mu.RLock()
+        for id := range r.Clients {
+            ids[id] = true
+        }
+        r.mu.RUnlock()
+    }
+    return ids
+}
+
+func TestRegisterBroadcastUnregister(t *testing.T) {
+    h := startHub(t)
+    passthrough := false
+    alice := connect(t, h, "relay", "alice", Message{AudioProcessing: &passthrough})
+    bob := connect(t, h, "relay", "bob", Message{})
+    carol := connect(t, h, "relay", "carol", Message{})
+
+    if got := roomClients(h, "relay"); len(got) != 3 {
+        t.Fatalf("room holds %v after three joins", got)
+    }
+
+    push(t, alice, Message{Type: "audio", Data: toneChunk(0.2)})
+    for name, conn := range map[string]*fakeConn{"bob": bob, "carol": carol} {
+        if msgs := readUntil(t, conn, "audio"); audioFrom(msgs, "alice") != 1 {
+            t.Errorf("%s didn't get alice's audio: %v", name, msgs)
+        }
+    }
+    if n := audioFrom(settle(t, alice), "alice"); n != 0 {
+        t.Errorf("alice got her own audio back %d times", n)
+    }
+
+    // A dropped connection leaves the room; the others carry on
+    carol.Close()
+    deadline := time.Now().Add(2 * time.Second)
+    for roomClients(h, "relay")["carol"] {
+        if time.Now().After(deadline) {
+            t.Fatal("carol still in the room after her connection closed")
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+    push(t, alice, Message{Type: "audio", Data: toneChunk(0.2)})
+    if msgs := readUntil(t, bob, "audio"); audioFrom(msgs, "alice") != 1 {
+        t.Errorf("bob lost alice's audio after carol left: %v", msgs)
+    }
+}
+
+func TestEchoOfTheSpeakerIsSuppressed(t *testing.T) {
+    h := startHub(t)
+    alice := connect(t, h, "echo", "alice", Message{})
+    bob := connect(t, h, "echo", "bob", Message{})
+
+    // Alice talks and silent bob hears her
+    push(t, alice, Message{Type: "audio", Data: toneChunk(0.4)})
+    if msgs := readUntil(t, bob, "audio"); audioFrom(msgs, "alice") != 1 {
+        t.Fatalf("bob didn't hear alice: %v", msgs)
+    }
+
+    // Bob's mic picks her up off his speakers, above the gate but nowhere
+    // near loud enough to take the floor, and that mustn't reach her. Him
+    // actually talking over her does; the hub relays his audio in order, so
+    // the first she gets from him shows whether the echo went first.
+    push(t, alice, Message{Type: "audio", Data: toneChunk(0.4)})
+    readUntil(t, bob, "audio")
+    push(t, bob, Message{Type: "audio", Data: toneChunk(0.04)})
+    push(t, bob, Message{Type: "audio", Data: toneChunk(0.4)})
+    msgs := readUntil(t, alice, "audio")
+    if got := msgs[len(msgs)-1]; got.From != "bob" || got.AudioLevel < 0.1 {
+        t.Errorf("alice's first audio from bob has level %.3f, want his talking, not her echo", got.AudioLevel)
+    }
+}
+
+func TestShouldRouteAudio(t *testing.T) {
+    talking := func(id string) speakerState { return speakerState{ID: id, Speaking: true} }
+    silent := func(id string) speakerState { return speakerState{ID: id} }
+
+    tests := []struct {
+        name             string
+        sender, receiver speakerState
+        want             bool
+    }{
+        {"own audio while talking", talking("alice"), talking("alice"), false},
+        {"own audio while silent", silent("alice"), silent("alice"), false},
+        {"talker to a listener", talking("alice"), silent("bob"), true},
+        {"simultaneous speakers hear each other", talking("alice"), talking("bob"), true},
+        {"and the other way round", talking("bob"), talking("alice"), true},
+        {"a silent mic doesn't echo to the talker", silent("bob"), talking("alice"), false},
+        {"silence reaches a listener", silent("alice"), silent("bob"), true},
+        {"new speaker to the one who stopped", talking("bob"), silent("alice"), true},
+        {"the one who stopped to the new speaker", silent("alice"), talking("bob"), false},
+    }
+    for _, tt := range tests {
+        if got := shouldRouteAudio(tt.sender, tt.receiver); got != tt.want {
+            t.Errorf("%s: shouldRouteAudio(%+v, %+v) = %v, want %v", tt.name, tt.sender, tt.receiver, got, tt.want)
+        }
+    }
+}
+
+func TestSpeakerStateGoesStale(t *testing.T) {
+    now := time.Now()
+    c := &Client{ID: "alice", IsCurrentSpeaker: true, LastAudioTime: now}
+    if !c.speakerState(now.Add(SPEAKING_HOLD / 2)).Speaking {
+        t.Error("alice stopped counting as speaking within SPEAKING_HOLD")
+    }
+
+    // Her audio stopped arriving, so whoever she was talking over hears everyone again
+    if c.speakerState(now.Add(SPEAKING_HOLD)).Speaking {
+        t.Error("alice still counts as speaking SPEAKING_HOLD after her last audio")
+    }
+}
+
+// cameraFrame is a PNG of gradients under a little noise, the kind of frame
+// a client sends
+func cameraFrame(t *testing.T, width, height int) ([]byte, image.Image) {
+    t.Helper()
+    img := image.NewRGBA(image.Rect(0, 0, width, height))
+    rng := rand.New(rand.NewSource(1))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            noise := rng.Intn(16)
+            img.SetRGBA(x, y, color.RGBA{
+                R: uint8(min(255, x*232/width+noise)),
+                G: uint8(min(255, y*232/height+noise)),
+                B: uint8(min(255, (x+y)*232/(width+height)+noise)),
+                A: 255,
+            })
+        }
+    }
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, img); err != nil {
+        t.Fatal(err)
+    }
+    return buf.Bytes(), img
+}
+
+// meanError is the mean absolute difference per channel between two images
+// of the same size
+func meanError(a, b image.Image) float64 {
+    var sum float64
+    bounds := a.Bounds()
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            r1, g1, b1, _ := a.At(x, y).RGBA()
+            r2, g2, b2, _ := b.At(x, y).RGBA()
+            sum += math.Abs(float64(r1)-float64(r2)) + math.Abs(float64(g1)-float64(g2)) + math.Abs(float64(b1)-float64(b2))
+        }
+    }
+    return sum / 257 / 3 / float64(bounds.Dx()*bounds.Dy())
+}
+
+func TestCompressFrameAtPresetQuality(t *testing.T) {
+    // jpeg is what a build without cgo falls back to
+    codecs := []string{"jpeg"}
+    if webpcodec.Available {
+        codecs = append(codecs, "webp")
+    }
+    prev := videoCodec
+    t.Cleanup(func() { videoCodec = prev })
+
+    data, src := cameraFrame(t, 1280, 720)
+    for _, codec := range codecs {
+        videoCodec = codec
+        for _, preset := range QualityLevels[:3] {
+            out, err := compressFrame(data, &preset)
+            if err != nil {
+                t.Fatalf("%s at %s: %v", codec, preset.Name, err)
+            }
+            img, format, err := image.Decode(bytes.NewReader(out))
+            if err != nil {
+                t.Fatalf("%s at %s doesn't decode: %v", codec, preset.Name, err)
+            }
+            if format != codec || img.Bounds().Dx() != int(preset.Width) || img.Bounds().Dy() != int(preset.Height) {
+                t.Fatalf("%s at %s gave a %v %s", codec, preset.Name, img.Bounds().Size(), format)
+            }
+
+            // Encoded at 1 of 100 a frame misses by over ten levels on average,
+            // and is a fraction of the size
+            want := resize.Resize(preset.Width, preset.Height, src, resize.Lanczos3)
+            if e := meanError(img, want); e > 6 {
+                t.Errorf("%s at %s (quality %.1f) is off by %.1f levels on average", codec, preset.Name, preset.Quality, e)
+            }
+            floor := preset
+            floor.Quality = 0.01
+            worst, err := compressFrame(data, &floor)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if 2*len(out) < 3*len(worst) {
+                t.Errorf("%s at %s is %d bytes against %d at quality 1, so the preset's quality was lost",
+                    codec, preset.Name, len(out), len(worst))
+            }
+        }
+    }
+}
+
+func TestZeroGainTakesASpeakerOutOfOneMix(t *testing.T) {
+    room := mixRoom("alice", "bob", "carol")
+    room.Clients["alice"].setGain("bob", 0)
+    room.AudioMixer.addChunk("bob", constantChunk(0.2, 480))
+    room.AudioMixer.addChunk("carol", constantChunk(0.3, 480))
+
+    room.mixAndSend()
+
+    want := map[string]struct {
+        speakers []string
+        level    float32
+    }{
+        "alice": {[]string{"carol"}, 0.3},
+        "carol": {[]string{"bob"}, 0.2}, // Alice turning bob down is hers alone
+        "bob":   {[]string{"carol"}, 0.3},
+    }
+    for id, client := range room.Clients {
+        var msg Message
+        select {
+        case data := <-client.Send:
+            if err := json.Unmarshal(data, &msg); err != nil {
+                t.Fatal(err)
+            }
+        default:
+            t.Fatalf("%s got no mix", id)
+        }
+        w := want[id]
+        if len(msg.Speakers) != 1 || msg.Speakers[0] != w.speakers[0] {
+            t.Errorf("%s's mix is from %v, want %v", id, msg.Speakers, w.speakers)
+        }
+        if samples := decodeAudioData([]byte(msg.Data), client.AudioFormat); math.Abs(float64(samples[0]-w.level)) > 1e-3 {
+            t.Errorf("%s's mix sample = %.4f, want %.4f", id, samples[0], w.level)
+        }
+    }
+}
+
+func TestSetGainClamps(t *testing.T) {
+    c := &Client{ID: "alice"}
+    for _, tc := range []struct{ in, want float32 }{{-1, 0}, {0.5, 0.5}, {MAX_GAIN + 3, MAX_GAIN}} {
+        if got := c.setGain("bob", tc.in); got != tc.want {
+            t.Errorf("setGain(%v) = %v, want %v", tc.in, got, tc.want)
+        }
+    }
+    c.setGain("bob", 1)
+    if _, ok := c.gainsSnapshot()["bob"]; ok {
+        t.Error("a gain back at 1 is still stored")
+    }
+}
+
+func TestSetVolumeRelaysAHintWithoutTheMixer(t *testing.T) {
+    h := startHub(t)
+    alice := connect(t, h, "volume", "alice", Message{})
+    connect(t, h, "volume", "bob", Message{})
+
+    loud := float32(5)
+    push(t, alice, Message{Type: "set-volume", TargetID: "bob", Gain: &loud})
+    msgs := readUntil(t, alice, "volume-hint")
+    if hint := msgs[len(msgs)-1]; hint.TargetID != "bob" || hint.Gain == nil || *hint.Gain != MAX_GAIN {
+        t.Errorf("volume-hint = %+v, want bob clamped to %v", hint, MAX_GAIN)
+    }
+
+    // Nothing to set without a target and a gain
+    push(t, alice, Message{Type: "set-volume", TargetID: "bob"})
+    for _, msg := range settle(t, alice) {
+        if msg.Type == "volume-hint" {
+            t.Errorf("set-volume without a gain got %+v", msg)
+        }
+    }
+
+    // The mixer applies gains itself, so mixing rooms get no hint
+    prev := audioMixing
+    audioMixing = true
+    t.Cleanup(func() { audioMixing = prev })
+    quiet := float32(0.5)
+    push(t, alice, Message{Type: "set-volume", TargetID: "bob", Gain: &quiet})
+    for _, msg := range settle(t, alice) {
+        if msg.Type == "volume-hint" {
+            t.Errorf("set-volume with the mixer on got %+v", msg)
+        }
+    }
+}
+
+func TestRefusalsCarryAnErrorCode(t *testing.T) {
+    prev := maxUsersPerRoom
+    maxUsersPerRoom = 1
+    t.Cleanup(func() { maxUsersPerRoom = prev })
+
+    h := startHub(t)
+    alice := connect(t, h, "errors", "alice", Message{})
+    for name, tc := range map[string]struct {
+        data []byte
+        want ErrorCode
+        ref  string
+    }{
+        "malformed JSON": {[]byte(`{"type":`), ErrMalformed, ""},
+        "unknown type":   {[]byte(`{"type":"teleport"}`), ErrUnknownType, "teleport"},
+        "oversized":      {append([]byte(`{"type":"audio","data":"`), make([]byte, MAX_MESSAGE_SIZE)...), ErrTooLarge, ""},
+    } {
+        alice.In <- tc.data
+        msgs := readUntil(t, alice, "error")
+        if got := msgs[len(msgs)-1]; got.Code != tc.want || got.Ref != tc.ref || got.Text == "" {
+            t.Errorf("%s message: error %+v, want code %s ref %q with a reason", name, got, tc.want, tc.ref)
+        }
+    }
+
+    // A full room refuses the join and says why
+    conn := newFakeConn()
+    bob := &Client{ID: "bob", Conn: conn, Send: make(chan []byte, 256), Hub: h, Metrics: &ClientMetrics{}}
+    go bob.writePump()
+    go bob.readPump()
+    push(t, conn, Message{Type: "join", Room: "errors"})
+    msgs := readUntil(t, conn, "error")
+    if got := msgs[len(msgs)-1]; got.Code != ErrRoomFull || got.Ref != "join" {
+        t.Errorf("joining a full room: error %+v, want %s for the join", got, ErrRoomFull)
+    }
+    conn.Close()
+
+    // A burst over the rate limit is told once, not per message dropped
+    for i := 0; i < MAX_MESSAGES_PER_SEC+20; i++ {
+        push(t, alice, Message{Type: "ping"})
+    }
+    limited := 0
+    for timeout := time.After(200 * time.Millisecond); ; {
+        select {
+        case data := <-alice.Out:
+            var msg Message
+            if json.Unmarshal(data, &msg) == nil && msg.Code == ErrRateLimited {
+                limited++
+            }
+            continue
+        case <-timeout:
+        }
+        break
+    }
+    if limited != 1 {
+        t.Errorf("a burst of %d messages got %d rate-limited errors, want 1", MAX_MESSAGES_PER_SEC+20, limited)
+    }
+}
+
+func TestAudioOnlyRoomDropsVideoAndStillProcessesAudio(t *testing.T) {
+    h := startHub(t)
+    alice := connect(t, h, "radio", "alice", Message{Mode: "audio-only"})
+    bob := connect(t, h, "radio", "bob", Message{})
+
+    frame := base64.StdEncoding.EncodeToString([]byte("not decoded anyway"))
+    push(t, alice, Message{Type: "frame", Data: frame})
+    push(t, alice, Message{Type: "frame", Data: frame})
+    push(t, alice, Message{Type: "audio", Data: toneChunk(0.4)})
+    msgs := readUntil(t, bob, "audio")
+    if got := msgs[len(msgs)-1]; got.From != "alice" || got.AudioLevel == 0 {
+        t.Errorf("bob got %+v, want alice's audio with its level measured", got)
+    }
+    for _, msg := range append(msgs, settle(t, bob)...) {
+        if msg.Type == "webp-frame" {
+            t.Errorf("bob got alice's video in an audio-only room")
+        }
+    }
+
+    h.mu.RLock()
+    room := h.Rooms["radio"]
+    h.mu.RUnlock()
+    settle(t, alice)
+    if !room.AudioOnly || atomic.LoadInt64(&room.VideoDropped) != 2 {
+        t.Errorf("audio-only %v with %d frames dropped, want 2", room.AudioOnly, atomic.LoadInt64(&room.VideoDropped))
+    }
+}
+
+func TestBroadcastOverflowPolicies(t *testing.T) {
+    prevBuffer, prevPolicy := broadcastBuffer, overflowPolicy
+    t.Cleanup(func() { broadcastBuffer, overflowPolicy = prevBuffer, prevPolicy })
+    broadcastBuffer = 3
+
+    // A hub with nobody reading, i.e. one that can't keep up
+    saturated := func(policy string) *Hub {
+        overflowPolicy = policy
+        h := newHub()
+        for i := 0; i < broadcastBuffer; i++ {
+            h.broadcast(&BroadcastMessage{Room: fmt.Sprint(i)})
+        }
+        return h
+    }
+    // returns reports whether broadcasting msg gets back within a moment
+    returns := func(h *Hub, msg *BroadcastMessage) (bool, chan struct{}) {
+        done := make(chan struct{})
+        go func() {
+            h.broadcast(msg)
+            close(done)
+        }()
+        select {
+        case <-done:
+            return true, done
+        case <-time.After(50 * time.Millisecond):
+            return false, done
+        }
+    }
+    queued := func(h *Hub) []string {
+        var rooms []string
+        for len(h.Broadcast) > 0 {
+            rooms = append(rooms, (<-h.Broadcast).Room)
+        }
+        return rooms
+    }
+
+    h := saturated(OverflowBlock)
+    if ok, done := returns(h, &BroadcastMessage{Room: "video"}); ok {
+        t.Error("block: broadcasting to a full queue returned at once")
+    } else {
+        <-h.Broadcast
+        <-done
+    }
+    if atomic.LoadInt64(&h.BroadcastOverflow) != 0 {
+        t.Error("block: counted an overflow without shedding anything")
+    }
+
+    h = saturated(OverflowDropOldest)
+    if ok, _ := returns(h, &BroadcastMessage{Room: "new"}); !ok {
+        t.Fatal("drop-oldest: broadcasting to a full queue blocked")
+    }
+    if got := queued(h); fmt.Sprint(got) != "[1 2 new]" || atomic.LoadInt64(&h.BroadcastOverflow) != 1 {
+        t.Errorf("drop-oldest: queue %v with %d overflows, want [1 2 new] and 1", got, atomic.LoadInt64(&h.BroadcastOverflow))
+    }
+
+    // Video is shed, while audio waits for the room it is owed
+    h = saturated(OverflowDropVideo)
+    if ok, _ := returns(h, &BroadcastMessage{Room: "video"}); !ok {
+        t.Fatal("drop-video: broadcasting video to a full queue blocked")
+    }
+    if atomic.LoadInt64(&h.BroadcastOverflow) != 1 {
+        t.Errorf("drop-video: %d overflows after shedding a frame, want 1", atomic.LoadInt64(&h.BroadcastOverflow))
+    }
+    ok, done := returns(h, &BroadcastMessage{Room: "audio", IsAudio: true})
+    if ok {
+        t.Fatal("drop-video: audio was shed or jumped a full queue")
+    }
+    <-h.Broadcast
+    <-done
+    if got := queued(h); fmt.Sprint(got) != "[1 2 audio]" {
+        t.Errorf("drop-video: queue %v, want the audio after what was already there", got)
+    }
+}
+
+// sinePCM is ms of a 1kHz tone at rate, as little-endian 16-bit PCM with the
+// same sample on each of channels
+func sinePCM(rate, channels, ms int) []byte {
+    n := rate * ms / 1000
+    pcm := make([]byte, 0, n*channels*2)
+    for i := 0; i < n; i++ {
+        v := int16(16000 * math.Sin(2*math.Pi*1000*float64(i)/float64(rate)))
+        for ch := 0; ch < channels; ch++ {
+            pcm = append(pcm, byte(v), byte(v>>8))
+        }
+    }
+    return pcm
+}
+
+func TestAudioIsResampledToTheMixFormat(t *testing.T) {
+    for _, format := range []AudioFormat{{44100, 1}, {44100, 2}, mixFormat} {
+        data := []byte(base64.StdEncoding.EncodeToString(sinePCM(format.SampleRate, format.Channels, 20)))
+        samples := decodeAudioData(data, format)
+
+        // 20ms is 960 samples at 48kHz mono whatever it was captured at
+        if len(samples) != MIX_SAMPLE_RATE/50 {
+            t.Errorf("%+v: 20ms decoded to %d samples, want %d", format, len(samples), MIX_SAMPLE_RATE/50)
+            continue
+        }
+        var worst float64
+        for i, got := range samples {
+            want := 16000.0 / 32768 * math.Sin(2*math.Pi*1000*float64(i)/MIX_SAMPLE_RATE)
+            worst = math.Max(worst, math.Abs(float64(got)-want))
+        }
+        // Linear interpolation of a 1kHz tone stays within a few percent
+        if worst > 0.03 {
+            t.Errorf("%+v: resampled tone is off by up to %.3f", format, worst)
+        }
+
+        // And back out in the listener's own format
+        if back := encodeAudioPCM(samples, format); len(back) != len(sinePCM(format.SampleRate, format.Channels, 20)) {
+            t.Errorf("%+v: the mix went back out as %d bytes for 20ms, want %d", format, len(back), len(sinePCM(format.SampleRate, format.Channels, 20)))
+        }
+    }
+}
+
+func TestBinaryAudioMatchesBase64SampleForSample(t *testing.T) {
+    for _, format := range []AudioFormat{{44100, 2}, mixFormat} {
+        pcm := sinePCM(format.SampleRate, format.Channels, 20)
+        fromBase64 := decodeAudioData([]byte(base64.StdEncoding.EncodeToString(pcm)), format)
+        if fromPCM := decodeAudioPCM(pcm, format); len(fromPCM) == 0 || !reflect.DeepEqual(fromPCM, fromBase64) {
+            t.Errorf("%+v: raw PCM decoded to %d samples unlike base64's %d", format, len(fromPCM), len(fromBase64))
+        }
+        if encoded := encodeAudioData(fromBase64, format); string(encoded) != base64.StdEncoding.EncodeToString(encodeAudioPCM(fromBase64, format)) {
+            t.Errorf("%+v: base64 encoding isn't the raw PCM's", format)
+        }
+    }
+
+    // The same chunk sent either way, each in its own room so neither
+    // speaker's echo canceller hears the other
+    h := startHub(t)
+    format := AudioFormat{44100, 2}
+    pcm := sinePCM(format.SampleRate, format.Channels, 20)
+    heard := func(room string, send func(conn *fakeConn)) (text Message, frame []byte) {
+        t.Helper()
+        speaker := connect(t, h, room, "speaker", Message{SampleRate: format.SampleRate, Channels: format.Channels})
+        jsonListener := connect(t, h, room, "json", Message{})
+        binaryListener := connect(t, h, room, "binary", Message{BinaryAudio: true})
+        send(speaker)
+
+        msgs := readUntil(t, jsonListener, "audio")
+        text = msgs[len(msgs)-1]
+        timeout := time.After(2 * time.Second)
+        for frame == nil {
+            select {
+            case data := <-binaryListener.Out:
+                if data[0]&audioFrameRelayed != 0 {
+                    frame = data
+                }
+            case <-timeout:
+                t.Fatalf("%s: no binary audio frame within 2s", room)
+            }
+        }
+        return text, frame
+    }
+
+    binText, binFrame := heard("binary-in", func(conn *fakeConn) { conn.In <- append([]byte{audioFramePCM}, pcm...) })
+    b64Text, b64Frame := heard("base64-in", func(conn *fakeConn) {
+        push(t, conn, Message{Type: "audio", Data: base64.StdEncoding.EncodeToString(pcm)})
+    })
+    if binText.Data == "" || binText.Data != b64Text.Data {
+        t.Errorf("JSON listeners got %d base64 bytes from a binary frame, %d from base64", len(binText.Data), len(b64Text.Data))
+    }
+    if binText.SampleRate != b64Text.SampleRate || binText.Channels != b64Text.Channels {
+        t.Errorf("JSON listeners got %d/%d from a binary frame, %d/%d from base64",
+            binText.SampleRate, binText.Channels, b64Text.SampleRate, b64Text.Channels)
+    }
+    for name, frame := range map[string][]byte{"binary": binFrame, "base64": b64Frame} {
+        kind, from, _, got, payload, err := decodeAudioFrame(frame)
+        if err != nil || kind != audioFramePCM || from != "speaker" {
+            t.Fatalf("binary listener's frame from %s input: kind %#x from %q: %v", name, kind, from, err)
+        }
+        want, _ := base64.StdEncoding.DecodeString(b64Text.Data)
+        if got != mixFormat || !bytes.Equal(payload, want) {
+            t.Errorf("binary listener got %d bytes at %+v from %s input, want the JSON listener's %d", len(payload), got, name, len(want))
+        }
+    }
+}
+
+func TestGateThresholdDecidesWhichFramesAreGated(t *testing.T) {
+    prev := adminToken
+    adminToken = "secret"
+    t.Cleanup(func() { adminToken = prev })
+    room := &Room{ID: "tune", Clients: make(map[string]*Client), Params: defaultAudioParams}
+    h := &Hub{Rooms: map[string]*Room{"tune": room}}
+    alice := &Client{ID: "alice", Room: "tune", Hub: h, Send: make(chan []byte, 8), AudioFormat: mixFormat, Metrics: &ClientMetrics{}}
+    room.Clients["alice"] = alice
+
+    // gated lists the levels whose frames come out silent or not at all,
+    // each sent with nobody holding the floor
+    levels := []float32{0.01, 0.03, 0.1, 0.3}
+    gated := func() []float32 {
+        var out []float32
+        for _, level := range levels {
+            room.mu.Lock()
+            room.CurrentSpeaker = ""
+            room.mu.Unlock()
+            samples, ok := alice.ProcessAudioPCM(encodeAudioPCM(constantChunk(level, 960), mixFormat), mixFormat)
+            if !ok || calculateAudioLevel(samples) == 0 {
+                out = append(out, level)
+            }
+        }
+        return out
+    }
+    set := func(token, params string) Message {
+        t.Helper()
+        alice.setAudioParams(Message{Type: "set-audio-params", Token: token, AudioParams: json.RawMessage(params)})
+        var reply Message
+        if err := json.Unmarshal(<-alice.Send, &reply); err != nil {
+            t.Fatal(err)
+        }
+        return reply
+    }
+
+    if got := gated(); !reflect.DeepEqual(got, []float32{0.01}) {
+        t.Errorf("at the default gate %g levels %v were gated, want only 0.01", GATE_THRESHOLD, got)
+    }
+
+    reply := set("secret", `{"gateThreshold": 0.2}`)
+    var params AudioParams
+    if err := json.Unmarshal(reply.AudioParams, &params); err != nil || reply.Type != "audio-params" ||
+        params != (AudioParams{GateThreshold: 0.2, DuckingFactor: DUCKING_FACTOR, EchoThreshold: ECHO_THRESHOLD}) {
+        t.Errorf("set-audio-params replied %+v (%v), want the gate changed and the rest kept", reply, err)
+    }
+    if got := gated(); !reflect.DeepEqual(got, []float32{0.01, 0.03, 0.1}) {
+        t.Errorf("at gate 0.2 levels %v were gated, want all but 0.3", got)
+    }
+
+    // Out of range or without the token, nothing changes
+    if reply := set("secret", `{"gateThreshold": 1.5}`); reply.Code != ErrBadParams {
+        t.Errorf("a gate of 1.5 got %+v, want %s", reply, ErrBadParams)
+    }
+    if reply := set("guess", `{"gateThreshold": 0}`); reply.Code != ErrForbidden {
+        t.Errorf("the wrong token got %+v, want %s", reply, ErrForbidden)
+    }
+    if got := room.audioParams().GateThreshold; got != 0.2 {
+        t.Errorf("gate is %g after refused changes, want 0.2", got)
+    }
+}
+
+func TestMixedRoomTranscodesOnlyWhatItNeeds(t *testing.T) {
+    h := startHub(t)
+    transcoded := func() int64 { return atomic.LoadInt64(&h.Transcoded) }
+
+    // Nobody in a JSON room needs the binary form
+    a := connect(t, h, "plain", "a", Message{})
+    b := connect(t, h, "plain", "b", Message{})
+    push(t, a, Message{Type: "audio", Data: toneChunk(0.5)})
+    readUntil(t, b, "audio")
+    if got := transcoded(); got != 0 {
+        t.Errorf("a JSON-only room transcoded %d chunks", got)
+    }
+
+    // newer joins like any JSON client and just starts sending binary frames
+    older := connect(t, h, "mixed", "older", Message{})
+    newer := connect(t, h, "mixed", "newer", Message{})
+    pcm, err := base64.StdEncoding.DecodeString(toneChunk(0.5))
+    if err != nil {
+        t.Fatal(err)
+    }
+    newer.In <- append([]byte{audioFramePCM}, pcm...)
+    msgs := readUntil(t, older, "audio")
+    heard := msgs[len(msgs)-1]
+    samples := decodeAudioData([]byte(heard.Data), mixFormat)
+    if heard.From != "newer" || heard.AudioSeq != 1 || heard.SampleRate != mixFormat.SampleRate || heard.Channels != mixFormat.Channels ||
+        len(samples) != len(pcm)/2 || calculateAudioLevel(samples) == 0 {
+        t.Errorf("older heard %+v with %d samples, want newer's chunk of %d as base64", heard, len(samples), len(pcm)/2)
+    }
+    if got := transcoded(); got != 1 {
+        t.Errorf("%d chunks transcoded for one binary chunk to a JSON receiver, want 1", got)
+    }
+
+    // Having sent binary, newer gets binary back
+    push(t, older, Message{Type: "audio", Data: toneChunk(0.5)})
+    timeout := time.After(2 * time.Second)
+    for {
+        select {
+        case data := <-newer.Out:
+            if data[0] == '{' {
+                continue
+            }
+            if _, from, _, _, _, err := decodeAudioFrame(data); err != nil || from != "older" {
+                t.Fatalf("newer got a binary frame from %q: %v", from, err)
+            }
+        case <-timeout:
+            t.Fatal("newer got no binary frame of older's audio")
+        }
+        break
+    }
+    if got := transcoded(); got != 2 {
+        t.Errorf("%d chunks transcoded after one each way, want 2", got)
+    }
+
+    // Chunks past MAX_TRANSCODE_SIZE aren't converted
+    big := &BroadcastMessage{Binary: encodeAudioFrame(audioFramePCM, "newer", 2, mixFormat, make([]byte, MAX_TRANSCODE_SIZE))}
+    if err := big.transcode(nil); err == nil || big.Message != nil {
+        t.Errorf("a %d-byte frame was transcoded (%v)", len(big.Binary), err)
+    }
+}
+
+func TestWelcomeDescribesTheRoomsMedia(t *testing.T) {
+    h := startHub(t)
+    media := func(room string, join Message) *MediaProfile {
+        t.Helper()
+        conn := newFakeConn()
+        client := &Client{ID: room + "-alice", Conn: conn, Send: make(chan []byte, 256), Hub: h, Metrics: &ClientMetrics{}}
+        h.Register <- client
+        go client.writePump()
+        go client.readPump()
+        join.Type, join.Room = "join", room
+        push(t, conn, join)
+        got := readUntil(t, conn, "welcome")
+        if welcome := got[len(got)-1]; welcome.Media != nil {
+            return welcome.Media
+        }
+        t.Fatalf("%s's welcome has no media profile", room)
+        return nil
+    }
+    off := false
+
+    want := &MediaProfile{
+        Video:   true,
+        Codec:   videoCodec,
+        Accepts: []string{"jpeg", "png"},
+        Ladder:  QualityLevels[:1],
+        Audio:   AudioProfile{Processed: true, EchoCancellation: true, Mixing: audioMixing},
+    }
+    if got := media("processed", Message{}); !reflect.DeepEqual(got, want) {
+        t.Errorf("a processing room's media is %+v, want %+v", got, want)
+    }
+    want.Audio = AudioProfile{}
+    if got := media("passthrough", Message{AudioProcessing: &off}); !reflect.DeepEqual(got, want) {
+        t.Errorf("a passthrough room's media is %+v, want audio untouched", got)
+    }
+    want = &MediaProfile{Audio: AudioProfile{Processed: true, EchoCancellation: true, Mixing: audioMixing}}
+    if got := media("voice", Message{Mode: "audio-only"}); !reflect.DeepEqual(got, want) {
+        t.Errorf("an audio-only room's media is %+v, want no video", got)
+    }
+}
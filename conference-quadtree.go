@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -24,6 +26,38 @@ type Client struct {
 	userId string
 	room   string
 	hub    *Hub
+	binary bool // Negotiated on join: receive packets in the binary wire format
+
+	// Broadcasts run on every sender's readPump, so send is closed and
+	// written under sendMu rather than by one owning goroutine
+	sendMu     sync.Mutex
+	sendClosed bool
+}
+
+// trySend queues a message without blocking, reporting false if the buffer
+// is full or the client is already gone
+func (c *Client) trySend(message []byte) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendClosed {
+		return false
+	}
+	select {
+	case c.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSend closes send once, whoever gets there first
+func (c *Client) closeSend() {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if !c.sendClosed {
+		c.sendClosed = true
+		close(c.send)
+	}
 }
 
 type Hub struct {
@@ -32,16 +66,27 @@ type Hub struct {
 	broadcast         chan []byte
 	register          chan *Client
 	unregister        chan *Client
+	ready             chan chan hubStatus
 	mu                sync.RWMutex
 	quadTreeProcessor *QuadTreeProcessor
 }
 
+// hubStatus is the hub loop's answer to a readiness probe
+type hubStatus struct {
+	Clients int `json:"connected_clients"`
+	Rooms   int `json:"active_rooms"`
+}
+
+// A hub that can't answer a probe within this long is reported not ready
+const readyTimeout = 500 * time.Millisecond
+
 var hub = &Hub{
 	clients:           make(map[*Client]bool),
 	rooms:             make(map[string]map[*Client]bool),
 	broadcast:         make(chan []byte, 256),
 	register:          make(chan *Client),
 	unregister:        make(chan *Client),
+	ready:             make(chan chan hubStatus),
 	quadTreeProcessor: NewQuadTreeProcessor(),
 }
 
@@ -78,16 +123,7 @@ func (h *Hub) run() {
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				if client.room != "" && h.rooms[client.room] != nil {
-					delete(h.rooms[client.room], client)
-					if len(h.rooms[client.room]) == 0 {
-						delete(h.rooms, client.room)
-					}
-				}
-				close(client.send)
-			}
+			h.remove(client)
 			h.mu.Unlock()
 			
 			log.Printf("Client %s disconnected. Total clients: %d", 
@@ -96,6 +132,12 @@ func (h *Hub) run() {
 		case message := <-h.broadcast:
 			h.broadcastToAll(message)
 
+		case reply := <-h.ready:
+			// readPump also adds to rooms on join, so read under the lock
+			h.mu.RLock()
+			reply <- hubStatus{Clients: len(h.clients), Rooms: len(h.rooms)}
+			h.mu.RUnlock()
+
 		case <-bandwidthTicker.C:
 			// Optimize bandwidth periodically
 			h.quadTreeProcessor.OptimizeForBandwidth(50.0) // Target 50 Mbps
@@ -103,35 +145,99 @@ func (h *Hub) run() {
 	}
 }
 
+// remove drops the client from the hub and its room and closes send; the
+// caller holds the write lock
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	if client.room != "" && h.rooms[client.room] != nil {
+		delete(h.rooms[client.room], client)
+		if len(h.rooms[client.room]) == 0 {
+			delete(h.rooms, client.room)
+		}
+	}
+	client.closeSend()
+}
+
+// evict removes receivers whose buffer was full. Broadcasts only hold the
+// read lock while sending, so they collect these and the maps change here
+// under the write lock; a client some other broadcast evicted first is skipped.
+func (h *Hub) evict(slow []*Client) {
+	if len(slow) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, client := range slow {
+		if h.clients[client] {
+			h.remove(client)
+		}
+	}
+}
+
 func (h *Hub) broadcastToAll(message []byte) {
+	var slow []*Client
 	h.mu.RLock()
-	defer h.mu.RUnlock()
-	
 	for client := range h.clients {
-		select {
-		case client.send <- message:
-		default:
-			delete(h.clients, client)
-			close(client.send)
+		if !client.trySend(message) {
+			slow = append(slow, client)
 		}
 	}
+	h.mu.RUnlock()
+	h.evict(slow)
 }
 
 func (h *Hub) broadcastToRoom(room string, message []byte, sender *Client) {
+	var slow []*Client
+	h.mu.RLock()
+	for client := range h.rooms[room] {
+		if client != sender && !client.trySend(message) {
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+	h.evict(slow)
+}
+
+// broadcastPacket sends a packet to the room, encoding JSON and binary at most
+// once each depending on what the receivers negotiated
+func (h *Hub) broadcastPacket(room string, packet *VideoPacket, sender *Client) {
+	var jsonData, binaryData []byte
+	var slow []*Client
+	defer func() { h.evict(slow) }() // Runs after the RUnlock below
+
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	
-	if roomClients, ok := h.rooms[room]; ok {
-		for client := range roomClients {
-			if client != sender {
-				select {
-				case client.send <- message:
-				default:
-					delete(h.clients, client)
-					delete(roomClients, client)
-					close(client.send)
+
+	for client := range h.rooms[room] {
+		if client == sender {
+			continue
+		}
+
+		var message []byte
+		if client.binary {
+			if binaryData == nil {
+				data, err := EncodeBinaryPacket(packet)
+				if err != nil {
+					log.Printf("Error encoding binary packet: %v", err)
+					continue
 				}
+				binaryData = data
 			}
+			message = binaryData
+		} else {
+			if jsonData == nil {
+				data, err := json.Marshal(packet)
+				if err != nil {
+					log.Printf("Error marshaling packet: %v", err)
+					continue
+				}
+				jsonData = data
+			}
+			message = jsonData
+		}
+
+		if !client.trySend(message) {
+			slow = append(slow, client)
 		}
 	}
 }
@@ -150,7 +256,7 @@ func (c *Client) readPump() {
 	})
 	
 	for {
-		_, message, err := c.conn.ReadMessage()
+		messageType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("error: %v", err)
@@ -158,6 +264,22 @@ func (c *Client) readPump() {
 			break
 		}
 		
+		// Binary frames are always quad-tree packets
+		if messageType == websocket.BinaryMessage {
+			optimizedPacket, err := c.hub.quadTreeProcessor.ProcessBinaryPacket(c.userId, message)
+			if err != nil {
+				log.Printf("Error decoding binary packet from %s: %v", c.userId, err)
+				continue
+			}
+			optimizedPacket.UserID = c.userId
+			optimizedPacket.Room = c.room
+			if optimizedPacket.KeyframeDue {
+				c.requestKeyframe()
+			}
+			c.hub.broadcastPacket(c.room, optimizedPacket, c)
+			continue
+		}
+		
 		// Try to parse as quad-tree packet first
 		var packet VideoPacket
 		if err := json.Unmarshal(message, &packet); err == nil && packet.Type != "" {
@@ -166,11 +288,12 @@ func (c *Client) readPump() {
 			if err == nil {
 				optimizedPacket.UserID = c.userId
 				optimizedPacket.Room = c.room
-				
-				if data, err := json.Marshal(optimizedPacket); err == nil {
-					c.hub.broadcastToRoom(c.room, data, c)
-					continue
+				if optimizedPacket.KeyframeDue {
+					c.requestKeyframe()
 				}
+				
+				c.hub.broadcastPacket(c.room, optimizedPacket, c)
+				continue
 			}
 		}
 		
@@ -184,6 +307,7 @@ func (c *Client) readPump() {
 					c.userId = msg["userId"].(string)
 					
 					c.hub.mu.Lock()
+					c.binary = msg["binary"] == true // Read by broadcastPacket under the hub lock
 					if c.hub.rooms[c.room] == nil {
 						c.hub.rooms[c.room] = make(map[*Client]bool)
 					}
@@ -197,9 +321,10 @@ func (c *Client) readPump() {
 						"type":   "joined",
 						"room":   c.room,
 						"userId": c.userId,
+						"binary": c.binary,
 					}
 					if data, err := json.Marshal(response); err == nil {
-						c.send <- data
+						c.trySend(data)
 					}
 				}
 			} else {
@@ -215,6 +340,20 @@ func (c *Client) readPump() {
 	}
 }
 
+// requestKeyframe asks this sender for a full frame to reset delta drift;
+// skipped rather than blocking the read loop if the send buffer is full, or
+// if another sender's broadcast already evicted the client and closed send
+func (c *Client) requestKeyframe() {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      "request-keyframe",
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	c.trySend(data)
+}
+
 func (c *Client) writePump() {
 	ticker := time.NewTicker(54 * time.Second)
 	defer func() {
@@ -231,7 +370,12 @@ func (c *Client) writePump() {
 				return
 			}
 			
-			c.conn.WriteMessage(websocket.TextMessage, message)
+			// JSON always starts with '{'; binary packets with their version byte
+			messageType := websocket.TextMessage
+			if len(message) > 0 && message[0] == binaryPacketVersion {
+				messageType = websocket.BinaryMessage
+			}
+			c.conn.WriteMessage(messageType, message)
 			
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
@@ -273,6 +417,7 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 			"average_fps":       stats.AverageFPS,
 			"audio_integrity":   stats.AudioIntegrity,
 			"bandwidth_mbps":    stats.BandwidthMbps,
+			"keyframe_requests": stats.KeyframeRequests,
 		},
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
 	}
@@ -280,6 +425,35 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(health)
 }
 
+// handleReady answers 200 only if the hub loop itself responds in time,
+// unlike /health which only proves the process is up
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	timeout := time.After(readyTimeout)
+	reply := make(chan hubStatus, 1)
+
+	select {
+	case hub.ready <- reply:
+		select {
+		case status := <-reply:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "ready",
+				"hub":    status,
+			})
+			return
+		case <-timeout:
+		}
+	case <-timeout:
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "hub not responding",
+	})
+}
+
 func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -305,7 +479,27 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	go client.readPump()
 }
 
+// keyframeSettings reads KEYFRAME_INTERVAL (duration) and KEYFRAME_MAX_DELTAS
+// over the processor defaults; 0 turns either bound off
+func keyframeSettings(qp *QuadTreeProcessor) {
+	if v := os.Getenv("KEYFRAME_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("KEYFRAME_INTERVAL: %v", err)
+		}
+		qp.KeyframeInterval = d
+	}
+	if v := os.Getenv("KEYFRAME_MAX_DELTAS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("KEYFRAME_MAX_DELTAS: %v", err)
+		}
+		qp.KeyframeMaxDeltas = n
+	}
+}
+
 func main() {
+	keyframeSettings(hub.quadTreeProcessor)
 	go hub.run()
 	
 	// Serve static files
@@ -314,10 +508,12 @@ func main() {
 	
 	// API endpoints
 	http.HandleFunc("/health", handleHealth)
+	http.HandleFunc("/ready", handleReady)
 	http.HandleFunc("/ws", handleWebSocket)
 	
 	log.Printf("Quad-Tree Conference Server v3.0 starting on :3001")
 	log.Printf("Features: Audio Priority, Delta Frames, Adaptive Quality")
 	log.Printf("Target: 4K@60fps with guaranteed audio")
+	log.Printf("Keyframe refresh: every %s or %d deltas", hub.quadTreeProcessor.KeyframeInterval, hub.quadTreeProcessor.KeyframeMaxDeltas)
 	log.Fatal(http.ListenAndServe(":3001", nil))
 }
\ No newline at end of file
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestHub builds a hub like the package one, for a test to swap in
+func newTestHub() *Hub {
+	return &Hub{
+		clients:           make(map[*Client]bool),
+		rooms:             make(map[string]map[*Client]bool),
+		broadcast:         make(chan []byte, 256),
+		register:          make(chan *Client),
+		unregister:        make(chan *Client),
+		ready:             make(chan chan hubStatus),
+		quadTreeProcessor: NewQuadTreeProcessor(),
+	}
+}
+
+func probe(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestReadyNeedsTheHubLoop(t *testing.T) {
+	// Nothing serves this hub's loop, as if it were wedged in a handler
+	hub = newTestHub()
+
+	start := time.Now()
+	if rec := probe(handleReady, "/ready"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready with the hub loop stalled = %d %s, want 503", rec.Code, rec.Body)
+	}
+	if waited := time.Since(start); waited < readyTimeout || waited > 2*readyTimeout {
+		t.Errorf("/ready gave up after %s, want about %s", waited, readyTimeout)
+	}
+	if rec := probe(handleHealth, "/health"); rec.Code != http.StatusOK {
+		t.Errorf("/health with the hub loop stalled = %d, want 200: the process is still up", rec.Code)
+	}
+
+	go hub.run()
+	rec := probe(handleReady, "/ready")
+	var body struct {
+		Status string
+		Hub    hubStatus
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || body.Status != "ready" {
+		t.Errorf("/ready with the hub loop running = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestBinaryPacketRoundTrip(t *testing.T) {
+	pcm := base64.StdEncoding.EncodeToString([]byte{1, 2, 3, 4, 5, 6})
+	packets := map[string]*VideoPacket{
+		"keyframe with audio": {
+			Type: "key", Frame: 1, Timestamp: 1700000000123, Quality: "high", UserID: "alice", Room: "main",
+			Audio: &AudioData{Data: pcm, Samples: 3},
+			Video: &VideoData{Data: base64.StdEncoding.EncodeToString([]byte("jpeg bytes")), Width: 640, Height: 480},
+		},
+		"delta": {
+			Type: "delta", Frame: 2, Timestamp: 1700000000156, Quality: "low", UserID: "alice", Room: "main",
+			Video: &VideoData{Width: 640, Height: 480, Regions: []DeltaRegion{
+				{X: 0, Y: 0, W: 16, H: 16, Color: 0xff8800},
+				{X: 624, Y: 464, W: 16, H: 16, Color: 0x00ffff},
+			}},
+		},
+		"delta with nothing changed": {
+			Type: "delta", Frame: 3, Video: &VideoData{Width: 640, Height: 480, Regions: []DeltaRegion{}},
+		},
+		"audio only": {Audio: &AudioData{Data: pcm, Samples: 3}},
+	}
+
+	for name, want := range packets {
+		data, err := EncodeBinaryPacket(want)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, err := DecodeBinaryPacket(data)
+		if err != nil {
+			t.Fatalf("%s: decoding what was just encoded: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s came back as %+v, want %+v", name, got, want)
+		}
+
+		// Every field is needed, so any cut is caught rather than read as zero
+		for n := 0; n < len(data); n++ {
+			if _, err := DecodeBinaryPacket(data[:n]); !errors.Is(err, errShortPacket) {
+				t.Fatalf("%s cut to %d of %d bytes: err = %v, want errShortPacket", name, n, len(data), err)
+			}
+		}
+	}
+
+	if _, err := EncodeBinaryPacket(&VideoPacket{Type: "sprite"}); err == nil {
+		t.Error("a packet type with no wire byte encoded")
+	}
+	data, _ := EncodeBinaryPacket(packets["delta"])
+	for name, corrupt := range map[string]func([]byte){
+		"version": func(b []byte) { b[0] = '{' },
+		"type":    func(b []byte) { b[1] = byte(len(packetTypes)) },
+	} {
+		bad := append([]byte(nil), data...)
+		corrupt(bad)
+		if _, err := DecodeBinaryPacket(bad); err == nil || errors.Is(err, errShortPacket) {
+			t.Errorf("a packet with a bad %s: err = %v", name, err)
+		}
+	}
+}
+
+func TestBinaryDeltaIsSmallerThanJSON(t *testing.T) {
+	regions := make([]DeltaRegion, 200)
+	for i := range regions {
+		regions[i] = DeltaRegion{X: i % 40 * 16, Y: i / 40 * 16, W: 16, H: 16, Color: i * 0x010203}
+	}
+	packet := &VideoPacket{Type: "delta", Frame: 42, Quality: "medium", Video: &VideoData{Width: 640, Height: 480, Regions: regions}}
+
+	jsonData, err := json.Marshal(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryData, err := EncodeBinaryPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binaryData)*2 > len(jsonData) {
+		t.Errorf("binary delta is %d bytes against %d as JSON, want under half", len(binaryData), len(jsonData))
+	}
+}
+
+func TestBroadcastEvictsAFullReceiverOnce(t *testing.T) {
+	hub = newTestHub()
+	sender := &Client{userId: "alice", room: "main", send: make(chan []byte, 1)}
+	fast := &Client{userId: "bob", room: "main", send: make(chan []byte, 64)}
+	slow := &Client{userId: "carol", room: "main", send: make(chan []byte, 1)}
+	slow.send <- []byte("unread")
+	hub.rooms["main"] = map[*Client]bool{}
+	for _, c := range []*Client{sender, fast, slow} {
+		hub.clients[c] = true
+		hub.rooms["main"][c] = true
+	}
+
+	// Every sender's readPump broadcasts, so several find carol full at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hub.broadcastToRoom("main", []byte("frame"), sender)
+			hub.broadcastPacket("main", &VideoPacket{Type: "delta", Video: &VideoData{Regions: []DeltaRegion{}}}, sender)
+		}()
+	}
+	wg.Wait()
+
+	if hub.clients[slow] || hub.rooms["main"][slow] {
+		t.Error("carol is still in the hub with her buffer full")
+	}
+	if !hub.clients[fast] || len(fast.send) != 16 {
+		t.Errorf("bob was evicted or missed frames: %d queued, want 16", len(fast.send))
+	}
+	if len(sender.send) != 0 {
+		t.Error("alice was sent her own frames")
+	}
+	<-slow.send
+	if _, ok := <-slow.send; ok {
+		t.Error("carol's send is still open")
+	}
+
+	// The hub unregistering her afterwards must not close it again
+	hub.mu.Lock()
+	hub.remove(slow)
+	hub.mu.Unlock()
+}
+
+func TestKeyframeRequestedAfterMaxDeltas(t *testing.T) {
+	qp := NewQuadTreeProcessor()
+	qp.KeyframeInterval = 0
+	qp.KeyframeMaxDeltas = 5
+	process := func(typ string) bool {
+		data, err := json.Marshal(VideoPacket{Type: typ, Video: &VideoData{Regions: []DeltaRegion{}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, err := qp.ProcessPacket("alice", data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return packet.KeyframeDue
+	}
+
+	process("key")
+	for i := 1; i < qp.KeyframeMaxDeltas; i++ {
+		if process("delta") {
+			t.Fatalf("keyframe requested after only %d deltas", i)
+		}
+	}
+	if !process("delta") {
+		t.Fatalf("no keyframe requested after %d deltas", qp.KeyframeMaxDeltas)
+	}
+	// The sender gets keyframeRetry to answer before being asked again
+	if process("delta") {
+		t.Error("keyframe requested again straight away")
+	}
+	if qp.stats.KeyframeRequests != 1 {
+		t.Errorf("KeyframeRequests = %d, want 1", qp.stats.KeyframeRequests)
+	}
+
+	// A keyframe starts the count over, whether or not it was asked for
+	process("key")
+	for i := 1; i < qp.KeyframeMaxDeltas; i++ {
+		if process("delta") {
+			t.Fatalf("keyframe requested %d deltas after the sender sent one", i)
+		}
+	}
+}
+
+func TestKeyframeRequestedAfterInterval(t *testing.T) {
+	fb := NewFrameBuffer()
+	delta := &VideoPacket{Type: "delta", Video: &VideoData{}}
+	if fb.trackKeyframe(delta, time.Minute, 0) {
+		t.Fatal("keyframe requested with the last one just seen")
+	}
+	fb.lastKeyframe = time.Now().Add(-time.Minute)
+	if !fb.trackKeyframe(delta, time.Minute, 0) {
+		t.Error("no keyframe requested a whole interval after the last one")
+	}
+	if fb.trackKeyframe(&VideoPacket{Type: "delta"}, time.Minute, 0) {
+		t.Error("an audio-only packet asked for a keyframe")
+	}
+}
+
+func TestRequestKeyframeAfterEviction(t *testing.T) {
+	c := &Client{userId: "alice", send: make(chan []byte, 1)}
+	c.requestKeyframe()
+	var msg map[string]interface{}
+	if err := json.Unmarshal(<-c.send, &msg); err != nil || msg["type"] != "request-keyframe" {
+		t.Fatalf("queued %v (%v), want a request-keyframe", msg, err)
+	}
+
+	// A broadcast can evict alice between her packet and this request
+	c.closeSend()
+	c.requestKeyframe()
+}
@@ -1,21 +1,62 @@
 package main
 
 import (
+    "bufio"
     "bytes"
+    "context"
+    "crypto"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/sha512"
+    "crypto/subtle"
+    "crypto/tls"
+    "crypto/x509"
     "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
     "encoding/json"
+    "encoding/pem"
+    "errors"
     "fmt"
+    "hash/fnv"
     "image"
     "image/draw"
     _ "image/jpeg" // Register JPEG decoder
     _ "image/png"  // Register PNG decoder
+    "io"
     "log"
+    "math"
+    "math/big"
+    mathrand "math/rand"
+    "net"
     "net/http"
+    "net/http/pprof"
+    "net/url"
+    "os"
+    "os/exec"
+    "os/signal"
+    "path/filepath"
+    "reflect"
+    "runtime"
+    "runtime/debug"
+    "sort"
+    "strconv"
+    "strings"
     "sync"
     "sync/atomic"
+    "syscall"
     "time"
+    "unicode"
+    "unicode/utf8"
 
-    "github.com/chai2010/webp"
+    "conference/framecodec"
+    "conference/webpcodec"
     "github.com/gorilla/websocket"
     "github.com/nfnt/resize"
 )
@@ -23,6 +64,11 @@ import (
 // Message types
 type Message struct {
     Type          string `json:"type"`
+    
+    // Unix ms the server took a video-frame in; marshalled right after Type
+    // so WritePump can read it without parsing the frame
+    ServerTime    int64  `json:"serverTime,omitempty"`
+    
     ID            string `json:"id,omitempty"`
     Room          string `json:"room,omitempty"`
     From          string `json:"from,omitempty"`
@@ -31,21 +77,547 @@ type Message struct {
     Seq           int    `json:"seq,omitempty"`
     FrameSize     int    `json:"frameSize,omitempty"`
     CompressionType string `json:"compressionType,omitempty"`
+    
+    // frame-chunk: slice Index of Total of FrameID's base64 data
+    FrameID       string `json:"frameId,omitempty"`
+    Index         int    `json:"index,omitempty"`
+    Total         int    `json:"total,omitempty"`
+    
+    // Room mode: "audio-only", "e2ee" or "echo" on join; welcome sets
+    // AudioOnly so clients skip video capture, Encrypted so they encrypt
+    // before sending, EchoDelayMs to how long echoed media takes
+    Mode          string `json:"mode,omitempty"`
+    AudioOnly     bool   `json:"audioOnly,omitempty"`
+    EchoDelayMs   int64  `json:"echoDelayMs,omitempty"`
+    
+    // server-restart: how long this client should wait before reconnecting
+    ReconnectAfterMs int64 `json:"reconnectAfterMs,omitempty"`
+    
+    // E2EE media header: the payload in Data is ciphertext under KeyID.
+    // key-announce carries a participant's key material in Data, to Target or all.
+    Encrypted     bool   `json:"encrypted,omitempty"`
+    KeyID         string `json:"keyId,omitempty"`
+    
+    // Video distribution for a new room (auto|all|fps-cap|roundrobin|priority)
+    DropStrategy  string `json:"dropStrategy,omitempty"`
+    
+    // Join: the client can take binary media from a direct two-party relay
+    Direct        bool   `json:"direct,omitempty"`
+    
+    // Join: a reconnect after a lost connection, so the server replays the
+    // state the client may have missed
+    Resume        bool   `json:"resume,omitempty"`
+    
+    // Name to show for a participant, from the join and sanitized; carried by
+    // participant-joined, and welcome lists everyone's in names. The id stays
+    // what messages are routed by.
+    DisplayName   string            `json:"displayName,omitempty"`
+    Names         map[string]string `json:"names,omitempty"`
+    
+    // Source frame-rate cap (fps-limit)
+    MaxFPS        int    `json:"maxFps,omitempty"`
+    
+    // Receiver tile size for one source (layer-request), 0 clears it; also
+    // the sender source-started and source-ended are about
+    SourceID      string `json:"sourceId,omitempty"`
+    MaxWidth      uint   `json:"maxWidth,omitempty"`
+    
+    // Sources a receiver wants video from (subscribe-video); omitted means
+    // all, [] means none
+    IDs           []string `json:"ids,omitempty"`
+    
+    // Moderation: token on join, role in welcome, target of mute/unmute/kick
+    Token         string `json:"token,omitempty"`
+    Role          string `json:"role,omitempty"`
+    Moderator     string `json:"moderator,omitempty"`
+    Target        string `json:"target,omitempty"`
+    
+    // Reply to recording-consent-request
+    Granted       bool   `json:"granted,omitempty"`
+    
+    // app: an application-defined channel name and payload, relayed as is to
+    // Target or the whole room
+    Channel       string          `json:"channel,omitempty"`
+    Payload       json.RawMessage `json:"payload,omitempty"`
+    
+    // reaction kind (raise-hand, lower-hand or an emoji name); welcome lists raised hands
+    Reaction      string   `json:"reaction,omitempty"`
+    Hands         []string `json:"hands,omitempty"`
+    
+    // Room view from set-layout, carried by layout-changed and the welcome
+    Layout        *RoomLayout `json:"layout,omitempty"`
+    
+    // welcome: how the server treats this room's media
+    Media         *MediaProfile `json:"media,omitempty"`
+    
+    // mute-state: true means the sender muted that track; an omitted field
+    // keeps its current state. welcome lists everyone muted in either.
+    Audio         *bool `json:"audio,omitempty"`
+    Video         *bool `json:"video,omitempty"`
+    Mutes         map[string]MuteState `json:"mutes,omitempty"`
+    
+    // Operator announcement severity: info, warning or critical
+    Level         string `json:"level,omitempty"`
+    
+    // participant-away: when the server last heard from From, in unix ms
+    LastSeen      int64  `json:"lastSeen,omitempty"`
+    
+    // Client-assigned id, increasing per participant, on control messages a
+    // client may resend after reconnecting; welcome carries the highest one
+    // the room has relayed so a resuming client knows what got through
+    MsgID         uint64 `json:"msgId,omitempty"`
+    
+    // Receiver loss report
+    Feedback      *ClientFeedback `json:"feedback,omitempty"`
+    
+    // Error replies
+    Code          ErrorCode `json:"code,omitempty"`
+    Text          string    `json:"message,omitempty"`
+    Ref           string    `json:"ref,omitempty"` // Type of the offending message
+}
+
+// RoomLayout is the view every participant's UI follows: "grid", or
+// "spotlight" on one participant
+type RoomLayout struct {
+    Mode        string `json:"mode"`
+    SpotlightID string `json:"spotlightId,omitempty"`
+}
+
+// MediaProfile tells a joiner what the server does with the room's media,
+// so it can capture and encode to match instead of having frames redone
+type MediaProfile struct {
+    Video      bool          `json:"video"`              // false in audio-only rooms
+    Transcoded bool          `json:"transcoded"`         // false: frames reach receivers as sent (e2ee)
+    Codec      string        `json:"codec,omitempty"`    // What transcoded frames go out as
+    Accepts    []string      `json:"accepts,omitempty"`  // Frame formats the encoder decodes
+    Ladder     []QualityStep `json:"ladder,omitempty"`   // Encode per room size, one participant first; the last covers larger rooms
+    Audio      AudioProfile  `json:"audio"`
+}
+
+// AudioProfile says what happens to audio on the way through
+type AudioProfile struct {
+    Processed        bool `json:"processed"` // false: relayed exactly as sent
+    EchoCancellation bool `json:"echoCancellation"`
+    Mixing           bool `json:"mixing"`
+}
+
+// mediaProfile describes the room to a joiner. Audio is always relayed
+// untouched here.
+func (r *Room) mediaProfile() *MediaProfile {
+    switch {
+    case r.AudioOnly:
+        return &MediaProfile{}
+    case r.Encrypted:
+        return &MediaProfile{Video: true}
+    }
+    return &MediaProfile{
+        Video:      true,
+        Transcoded: true,
+        Codec:      frameCodec.Name(),
+        Accepts:    []string{"jpeg", "png"},
+        Ladder:     qualityLadder,
+    }
+}
+
+// MuteState is what a participant has muted on their own side, as opposed
+// to a moderator's mute
+type MuteState struct {
+    Audio bool `json:"audio"`
+    Video bool `json:"video"`
+}
+
+// ErrorCode says why the server refused a message
+type ErrorCode string
+
+const (
+    ErrMalformed    ErrorCode = "malformed-json"
+    ErrUnknownType  ErrorCode = "unknown-type"
+    ErrTooLarge     ErrorCode = "payload-too-large"
+    ErrRoomFull     ErrorCode = "room-full"
+    ErrRoomLocked   ErrorCode = "room-locked"
+    ErrRateLimited  ErrorCode = "rate-limited"
+    ErrBadFrame     ErrorCode = "bad-frame"
+    ErrNotModerator ErrorCode = "not-moderator"
+    ErrNoTarget     ErrorCode = "unknown-target"
+    ErrNotEncrypted ErrorCode = "not-encrypted"
+    ErrNoRecording  ErrorCode = "recording-unavailable"
+    ErrBadReaction  ErrorCode = "unknown-reaction"
+    ErrInvalid      ErrorCode = "invalid-message"
+    ErrRoomLimit    ErrorCode = "room-limit-reached"
+    ErrIncomplete   ErrorCode = "frame-incomplete"
+)
+
+const (
+    maxMessageSize       = 2 * 1024 * 1024 // Largest accepted message in bytes
+    maxMessagesPerSecond = 100
+)
+
+// relayedTypes are the client messages ReadPump hands to the hub
+var relayedTypes = map[string]bool{
+    "audio-chunk": true,
+    "video-frame": true,
+    "feedback":    true,
+    "typing-start": true,
+    "typing-stop":  true,
+    "layer-request": true,
+    "key-announce":  true,
+    "recording-consent": true,
+    "reaction":      true,
+    "subscribe-video": true,
+    "frame-chunk":   true, // Reassembled into a video-frame first
+    "app":           true,
+    "mute-state":    true,
+    "keyframe-request": true,
+    
+    // Moderator commands, checked by the hub
+    "mute":   true,
+    "unmute": true,
+    "kick":   true,
+    "lock":   true,
+    "unlock": true,
+    "start-recording": true,
+    "stop-recording":  true,
+    "set-layout":      true,
+}
+
+// dedupedTypes are the relayed types whose msgId the hub checks: repeating
+// them has a visible effect, unlike media where a late copy is just dropped
+var dedupedTypes = map[string]bool{
+    "layer-request":     true,
+    "key-announce":      true,
+    "recording-consent": true,
+    "reaction":          true,
+    "subscribe-video":   true,
+    "mute":   true,
+    "unmute": true,
+    "kick":   true,
+    "lock":   true,
+    "unlock": true,
+    "start-recording": true,
+    "stop-recording":  true,
+    "set-layout":      true,
+}
+
+// Payload ceilings below maxMessageSize for types that never need it
+const (
+    maxAudioData = 64 * 1024 // base64 of well over 100ms of 48kHz PCM
+    maxKeyData   = 16 * 1024
+    maxIDLength  = 128
+    maxSubscriptions = 256
+    maxAppPayload = 16 * 1024
+    maxChannelLength = 64
+)
+
+// messageRules check the fields each relayed type needs before the hub sees
+// it; a rule returns "" or what's wrong. Constant strings keep the valid path
+// allocation-free. Types without a rule (typing, lock, ...) carry no fields.
+var messageRules = map[string]func(*Message) string{
+    "audio-chunk": func(m *Message) string {
+        switch {
+        case m.Data == "":
+            return "data is required"
+        case len(m.Data) > maxAudioData:
+            return "data exceeds the audio limit"
+        case m.Seq < 0:
+            return "seq must not be negative"
+        }
+        return ""
+    },
+    "video-frame": func(m *Message) string {
+        switch {
+        case m.Data == "":
+            return "data is required"
+        case m.Seq < 0:
+            return "seq must not be negative"
+        }
+        return ""
+    },
+    "feedback": func(m *Message) string {
+        f := m.Feedback
+        switch {
+        case f == nil:
+            return "feedback is required"
+        case f.Sender == "" || len(f.Sender) > maxIDLength:
+            return "feedback.sender is required"
+        case f.Stream != "audio" && f.Stream != "video":
+            return "feedback.stream must be audio or video"
+        case f.Received < 0 || f.Lost < 0:
+            return "feedback counts must not be negative"
+        }
+        return ""
+    },
+    "layer-request": func(m *Message) string {
+        switch {
+        case m.SourceID == "" || len(m.SourceID) > maxIDLength:
+            return "sourceId is required"
+        case m.MaxWidth > 4096:
+            return "maxWidth must be at most 4096"
+        }
+        return ""
+    },
+    "key-announce": func(m *Message) string {
+        switch {
+        case m.Data == "":
+            return "data is required"
+        case len(m.Data) > maxKeyData:
+            return "data exceeds the key limit"
+        case m.KeyID == "" || len(m.KeyID) > maxIDLength:
+            return "keyId is required"
+        case len(m.Target) > maxIDLength:
+            return "target is too long"
+        }
+        return ""
+    },
+    "reaction": func(m *Message) string {
+        if m.Reaction == "" || len(m.Reaction) > 32 {
+            return "reaction is required"
+        }
+        return ""
+    },
+    "subscribe-video": func(m *Message) string {
+        if len(m.IDs) > maxSubscriptions {
+            return "ids lists too many sources"
+        }
+        for _, id := range m.IDs {
+            if id == "" || len(id) > maxIDLength {
+                return "ids must be participant ids"
+            }
+        }
+        return ""
+    },
+    "mute-state": func(m *Message) string {
+        if m.Audio == nil && m.Video == nil {
+            return "audio or video is required"
+        }
+        return ""
+    },
+    "set-layout": func(m *Message) string {
+        switch {
+        case m.Layout == nil:
+            return "layout is required"
+        case m.Layout.Mode != "grid" && m.Layout.Mode != "spotlight":
+            return "layout.mode must be grid or spotlight"
+        case m.Layout.Mode == "spotlight" && m.Layout.SpotlightID == "":
+            return "layout.spotlightId is required for spotlight"
+        }
+        return ""
+    },
+    "frame-chunk": func(m *Message) string {
+        switch {
+        case m.FrameID == "" || len(m.FrameID) > maxIDLength:
+            return "frameId is required"
+        case m.Total < 1 || m.Total > maxChunksPerFrame:
+            return "total must be between 1 and 64"
+        case m.Index < 0 || m.Index >= m.Total:
+            return "index must be below total"
+        case m.Data == "":
+            return "data is required"
+        }
+        return ""
+    },
+    "app": func(m *Message) string {
+        switch {
+        case m.Channel == "" || len(m.Channel) > maxChannelLength:
+            return "channel is required"
+        case len(m.Payload) == 0:
+            return "payload is required"
+        case len(m.Payload) > maxAppPayload:
+            return "payload exceeds the app limit"
+        case len(m.Target) > maxIDLength:
+            return "target is too long"
+        }
+        return ""
+    },
+    "keyframe-request": requireTarget,
+    "mute":   requireTarget,
+    "unmute": requireTarget,
+    "kick":   requireTarget,
 }
 
+func requireTarget(m *Message) string {
+    if m.Target == "" || len(m.Target) > maxIDLength {
+        return "target is required"
+    }
+    return ""
+}
+
+// Typing indicators expire without a stop so a crashed client can't leave one stuck
+const (
+    typingTimeout      = 5 * time.Second
+    maxTypingPerSecond = 5
+)
+
+// app messages share one budget per sender across channels, enough for a
+// cursor at 30Hz with room for whiteboard strokes
+const maxAppPerSecond = 50
+
+// Raised hands stay up until lowered or handTimeout; emoji reactions show for
+// reactionTTL, and repeats within it are counted instead of relayed again
+const (
+    handTimeout = 10 * time.Minute
+    reactionTTL = 3 * time.Second
+)
+
+// reactions are the emoji a client may send besides raise-hand/lower-hand
+var reactions = map[string]bool{
+    "thumbs-up":   true,
+    "thumbs-down": true,
+    "clap":        true,
+    "laugh":       true,
+    "heart":       true,
+    "surprised":   true,
+}
+
+// Idle clients get an idle-warning after idleTimeout and are closed idleGrace later
+var (
+    idleGrace         = 15 * time.Second
+    idleCheckInterval = 5 * time.Second
+)
+
+// ClientFeedback reports sequence gaps a receiver saw on one sender's stream
+type ClientFeedback struct {
+    Sender   string `json:"sender"`
+    Stream   string `json:"stream"`   // "audio" or "video"
+    Received int64  `json:"received"` // frames received since last report
+    Lost     int64  `json:"lost"`     // seq gaps since last report
+}
+
+// Conn is the part of *websocket.Conn the pumps use, so the hub can run without sockets
+type Conn interface {
+    ReadMessage() (messageType int, p []byte, err error)
+    WriteMessage(messageType int, data []byte) error
+    NextWriter(messageType int) (io.WriteCloser, error)
+    Close() error
+    SetReadDeadline(t time.Time) error
+    SetWriteDeadline(t time.Time) error
+    SetPongHandler(h func(appData string) error)
+    EnableWriteCompression(enable bool)
+    WriteControl(messageType int, data []byte, deadline time.Time) error
+}
+
+// Close codes for server-initiated closes, so clients know whether to
+// reconnect. 4000-4999 are application codes; see the README table.
+const (
+    CloseKicked      = 4001 // Removed by the moderator; don't reconnect
+    CloseRoomFull    = 4002 // MAX_USERS_PER_ROOM reached; retry later
+    CloseRoomLocked  = 4004 // Moderator locked the room; don't reconnect
+    CloseIDInUse     = 4005 // JOIN_POLICY=reject and the id is connected; rejoin with another id
+    CloseReplaced    = 4006 // A newer connection joined with this id; don't reconnect
+    CloseIdle        = 4007 // IDLE_TIMEOUT passed without media; reconnect on user action
+    CloseRoomLimit   = 4008 // MAX_ROOMS reached with no empty room to evict; retry later
+    ClosePresence    = 4009 // Nothing read for LEAVE_AFTER; reconnect
+    CloseBacklog     = 4010 // Queued messages went unwritten past MAX_BACKLOG_AGE; reconnect
+)
+
 // Client with smart bandwidth management
 type Client struct {
     ID            string
     Room          string
-    Conn          *websocket.Conn
+    Conn          Conn
     Send          chan []byte
     Hub           *Hub
     
+    // Connection metadata captured at upgrade
+    UserAgent     string
+    RemoteIP      string
+    Mode          string // Requested room mode from the join
+    DropStrategy  string // Requested room drop strategy from the join
+    Direct        bool   // Join offered direct binary media
+    Resume        bool   // Join was a reconnect-resume
+    DisplayName   string // Sanitized from the join, "" for none
+    AssignedID    bool   // ID came from allocateID, not the join
+    JoinedAt      time.Time
+    ModToken      bool   // Join presented MODERATOR_TOKEN
+    Spectator     bool   // Joined with role spectator; receives media, never sends
+    Identity      *Identity // What the authenticator vouched for, nil without one
+    
+    // Server-side mute set by the moderator, touched only by the hub goroutine
+    Muted         bool
+    
+    // Answer to the room's recording-consent-request; hub goroutine only
+    RecordingConsent bool
+    
+    // Last relayed audio chunk, for the priority drop strategy; hub goroutine only
+    LastSpokeAt   time.Time
+    
     // Frame management
     LastFrameSeq      int
     FrameSkipCount    int
     LastAudioTime     time.Time
     
+    // Authoritative relay sequence, restarted per connection
+    AudioSeq          int
+    VideoSeq          int
+    
+    // Source frame-rate cap, touched only by the hub goroutine
+    LastVideoAccepted time.Time
+    FPSHint           int
+    LastFPSHint       time.Time
+    
+    // Announced with source-started and not yet source-ended; hub goroutine only
+    VideoActive       bool
+    
+    // Requested max width per source from layer-request, touched only by the hub goroutine
+    Layers            map[string]uint
+    
+    // Sources this receiver wants video from (subscribe-video), nil for all; guarded by mu
+    VideoSubs         map[string]bool
+    
+    // Consecutive undecodable frames and all oversized ones, touched only by
+    // this sender's encoder worker
+    badFrames         int
+    oversizedFrames   int
+    
+    // Typing event budget, touched only by ReadPump
+    typingWindow      time.Time
+    typingCount       int
+    
+    // app message budget, touched only by ReadPump
+    appWindow         time.Time
+    appCount          int
+    
+    // Incomplete frame-chunk frames by frameId, touched only by ReadPump
+    chunks            map[string]*partialFrame
+    
+    // Last media or typing message; pongs keep the socket alive but not this
+    LastMeaningfulActivity time.Time
+    
+    // Unix nanos of the last frame read, pongs included; away is the
+    // presence sweeper's last verdict, hub goroutine only
+    lastSeen    atomic.Int64
+    away        bool
+    
+    // Close frame WritePump sends once Send is closed; set just before closing it
+    closeCode   int
+    closeReason string
+    
+    // Set by ReadPump on a leave message, before it unregisters
+    leaving     bool
+    
+    // Closed by WritePump once everything queued and the close frame are
+    // written and the connection is closed
+    flushed     chan struct{}
+    
+    // Outbound bytes over the last second against CLIENT_BANDWIDTH_KBPS, nil
+    // when uncapped; WritePump only
+    budget      *sendBudget
+    
+    // Media waiting out echoDelay, nil outside an echo room
+    echoes      chan echoItem
+    
+    // Messages WritePump has taken off Send, and the backlog sweeper's marks
+    // of how far the queue reached when; marks are hub goroutine only
+    dequeued     atomic.Int64
+    backlogMarks []backlogMark
+    
+    // Where this client's binary media goes while the room is in direct
+    // mode, nil otherwise; set by the hub, read by ReadPump
+    direct       atomic.Pointer[directRoute]
+    
+    // Guards Send against the peer's ReadPump piping into it as it closes
+    sendMu       sync.RWMutex
+    sendClosed   bool
+    
     mu sync.RWMutex
 }
 
@@ -53,14 +625,224 @@ type Client struct {
 type Room struct {
     ID              string
     Clients         map[string]*Client
+    CreatedAt       time.Time
+    
+    // Set by the creating join's mode; video frames are dropped undecoded
+    AudioOnly       bool
+    VideoDropped    int64
+    
+    // Also set by the creating join's mode; media is relayed without decoding
+    Encrypted       bool
     
-    // Frame distribution
-    NextVideoTarget int
+    // A private echo-test room: its one participant's media comes back to it
+    Echo            bool
+    
+    // Frame distribution, chosen by the creating join's dropStrategy
+    Strategy        DropStrategy
+    VideoServed     map[string]int64 // Video bytes handed to each receiver, for the round-robin
     LastFrameTime   time.Time
     
+    // Loss reported by receivers
+    AudioReceived   int64
+    AudioLost       int64
+    VideoReceived   int64
+    VideoLost       int64
+    
+    // Empty rooms are kept until idle past roomTTL
+    LastActivity    time.Time
+    
+    // Who is typing, until when
+    Typing          map[string]time.Time
+    
+    // Raised hands by client id with when they went up, and each client's
+    // latest emoji reaction while it lasts
+    Hands           map[string]time.Time
+    Reactions       map[string]*activeReaction
+    
+    // Self-reported mute state of clients that muted anything
+    Mutes           map[string]MuteState
+    
+    // Moderator client id; a locked room admits only rejoins and token holders
+    Moderator       string
+    Locked          bool
+    
+    // Moderator-set view, grid until changed
+    Layout          RoomLayout
+    
+    // Moderator-requested recording, nil when off; hub goroutine only
+    Recording       *roomRecording
+    
+    // Video routing trace an operator turned on, nil when off
+    trace           atomic.Pointer[frameTrace]
+    
+    // Media the hub queued to this room's receivers, and video deliveries
+    // made and dropped; sampled into Series every second
+    sentBytes       int64
+    framesSent      int64
+    framesDropped   int64
+    Series          roomSeries
+    
+    // msgIds relayed per participant, kept across reconnects; hub goroutine only
+    delivered       map[string]*msgWindow
+    
     mu sync.RWMutex
 }
 
+// senderCount counts the clients that may publish media; caller holds r.mu
+func (r *Room) senderCount() int {
+    n := 0
+    for _, c := range r.Clients {
+        if !c.Spectator {
+            n++
+        }
+    }
+    return n
+}
+
+// size is how many participants the room holds
+func (r *Room) size() int {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return len(r.Clients)
+}
+
+// withLock runs f holding the room lock, and withRLock holding it for
+// reading, so a panic in f can't leave the room locked
+func (r *Room) withLock(f func()) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    f()
+}
+
+func (r *Room) withRLock(f func()) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    f()
+}
+
+// members lists the participants under the room lock
+func (r *Room) members() []*Client {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    
+    clients := make([]*Client, 0, len(r.Clients))
+    for _, client := range r.Clients {
+        clients = append(clients, client)
+    }
+    return clients
+}
+
+// client looks a participant up under the room lock
+func (r *Room) client(id string) *Client {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.Clients[id]
+}
+
+// nextSeq stamps the next per-sender sequence for the given stream
+func (r *Room) nextSeq(from string, audio bool) int {
+    sender := r.client(from)
+    if sender == nil {
+        return 0
+    }
+    
+    sender.mu.Lock()
+    defer sender.mu.Unlock()
+    
+    if audio {
+        sender.AudioSeq++
+        return sender.AudioSeq
+    }
+    sender.VideoSeq++
+    return sender.VideoSeq
+}
+
+// recordLoss folds a receiver's gap report into the room totals
+func (r *Room) recordLoss(fb *ClientFeedback) {
+    if fb.Received < 0 || fb.Lost < 0 {
+        return
+    }
+    
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    switch fb.Stream {
+    case "audio":
+        r.AudioReceived += fb.Received
+        r.AudioLost += fb.Lost
+    case "video":
+        r.VideoReceived += fb.Received
+        r.VideoLost += fb.Lost
+    }
+}
+
+// dedupWindow is how many ids below the highest seen a msgWindow remembers
+const dedupWindow = 64
+
+// msgWindow remembers the highest msgId relayed from one participant and
+// which of the dedupWindow ids below it were too
+type msgWindow struct {
+    highest uint64
+    seen    uint64 // bit i set: highest-i was relayed
+}
+
+// first reports whether id hasn't been relayed yet and records it. Ids
+// older than the window can't be told apart and count as repeats.
+func (w *msgWindow) first(id uint64) bool {
+    switch {
+    case id > w.highest:
+        shift := id - w.highest
+        if shift >= dedupWindow {
+            w.seen = 0
+        } else {
+            w.seen <<= shift
+        }
+        w.seen |= 1
+        w.highest = id
+        return true
+    case w.highest-id >= dedupWindow:
+        return false
+    }
+    bit := uint64(1) << (w.highest - id)
+    if w.seen&bit != 0 {
+        return false
+    }
+    w.seen |= bit
+    return true
+}
+
+// firstDelivery checks a deduplicated message from a participant against the
+// ids already relayed; messages without a msgId always pass
+func (r *Room) firstDelivery(from string, msg Message) bool {
+    if msg.MsgID == 0 || !dedupedTypes[msg.Type] {
+        return true
+    }
+    if r.delivered == nil {
+        r.delivered = make(map[string]*msgWindow)
+    }
+    w := r.delivered[from]
+    if w == nil {
+        w = &msgWindow{}
+        r.delivered[from] = w
+    }
+    return w.first(msg.MsgID)
+}
+
+// lastMsgID is the highest msgId relayed from a participant, 0 if none
+func (r *Room) lastMsgID(id string) uint64 {
+    if w := r.delivered[id]; w != nil {
+        return w.highest
+    }
+    return 0
+}
+
+func lossRate(received, lost int64) float64 {
+    if received+lost == 0 {
+        return 0
+    }
+    return float64(lost) / float64(received+lost) * 100
+}
+
 // Hub manages everything
 type Hub struct {
     Rooms      map[string]*Room
@@ -73,16 +855,81 @@ type Hub struct {
     DroppedFrames    int64
     CompressedFrames int64
     BytesSaved       int64
+    EncodeDropped    int64
+    ThrottledFrames  int64 // Dropped at the source for exceeding the fps cap
+    DecodeFailures   int64 // Client frames that weren't a decodable image
+    OversizedFrames  int64 // Client frames refused for their declared dimensions
+    RejectedConns    int64 // Upgrades refused by the connection limits
+    EncryptedBytes   int64 // Opaque media relayed in e2ee rooms
+    EncodeFailures   int64
+    StalledWrites    int64 // Connections dropped for a streamed write that stopped draining
+    DuplicateMessages int64 // Resent control messages whose msgId was already relayed
+    BandwidthDropped int64 // Video writes refused by a receiver's bandwidth cap
+    StaleDropped     int64 // Video frames older than STALE_VIDEO_AFTER by the time they'd be written
+    AppDropped       int64 // app messages over a sender's per-second budget
+    BacklogDisconnects int64 // Receivers removed for a send queue stuck past MAX_BACKLOG_AGE
+    DirectMessages   int64 // Binary media piped between the two ends of a direct pair
+    DirectDropped    int64 // Binary messages outside direct mode or of no known kind
+    MutedDropped     int64 // Media from a sender whose own mute-state says muted
+    HubPanics        int64 // Recovered on the hub goroutine; each dropped one event
+    Echoed           int64 // Media sent back to its sender in an echo room
+    EchoDropped      int64 // Echo media that found the delay buffer or send queue full
+    KeyframeRequests int64 // Sent to sources, by receivers or for a resume
+    AuthFailures     int64 // Upgrades refused by the authenticator
+    
+    // Transcode pool: one queue per worker, results come back to Run
+    encodeQueues     []chan *encodeJob
+    encoded          chan *encodeJob
+    
+    // Readiness probes and operator announcements answered from inside Run
+    ready            chan chan hubStatus
+    announcements    chan *announcement
+    operatorActions  chan *operatorAction
+    
+    // Shutdown requests; once draining, Run turns every new join away with
+    // a reconnect delay drawn from restartSpread
+    shutdown         chan chan []*Client
+    draining         bool
+    restartSpread    time.Duration
+    
+    // Server-assigned ids in use per room, guarded by mu
+    assignedIDs      map[string]map[string]bool
+    
+    // Where this hub reports, the package metrics sink when it was made
+    metrics          MetricsSink
     
     mu sync.RWMutex
 }
 
+// hubStatus is the hub loop's answer to a readiness probe
+type hubStatus struct {
+    Rooms   int `json:"rooms"`
+    Clients int `json:"clients"`
+}
+
+// A hub that can't answer a probe within this long is reported not ready
+const readyTimeout = 500 * time.Millisecond
+
 type BroadcastMessage struct {
     Room    string
     Message []byte
     From    string
 }
 
+// encodeJob carries a video frame to an encoder worker and back to the hub
+type encodeJob struct {
+    room      *Room
+    msg       Message
+    from      string
+    userCount int
+    
+    // Simulcast: receiver id -> layer, layer -> width to encode it at, and
+    // the encoded variants the worker fills in
+    layerOf   map[string]uint
+    layers    map[uint]uint
+    variants  map[uint][]byte
+}
+
 var (
     upgrader = websocket.Upgrader{
         ReadBufferSize:  1024 * 8,
@@ -92,6 +939,102 @@ var (
     
     hub *Hub
     
+    // Video codec, chosen from VIDEO_CODEC at startup
+    frameCodec = newFrameCodec("webp", defaultWebPEffort)
+    
+    // Transcode pool, sized by ENCODE_WORKERS / ENCODE_QUEUE
+    encodeWorkers   = runtime.NumCPU()
+    encodeQueueSize = 8
+    
+    // MAX_USERS_PER_ROOM caps participants per room, 0 means unlimited
+    maxUsersPerRoom = 0
+    
+    // MAX_ROOMS caps rooms per process, 0 means unlimited; past it the
+    // oldest empty room is evicted, or the new room refused
+    maxRooms = 0
+    
+    // MODERATOR_TOKEN lets a joiner claim the moderator role from the first joiner
+    moderatorToken = os.Getenv("MODERATOR_TOKEN")
+    
+    // SERVER_ASSIGNED_IDS=true ignores the join's id and hands out a random one
+    serverAssignedIDs = os.Getenv("SERVER_ASSIGNED_IDS") == "true"
+    
+    // VALIDATE_MESSAGES=false relays messages without checking messageRules
+    validateMessages = true
+    
+    // JOIN_POLICY=reject turns away a duplicate id instead of replacing the old connection
+    rejectDuplicateJoin = os.Getenv("JOIN_POLICY") == "reject"
+    
+    // WritePump batching: queued messages drained after the first, and a byte
+    // ceiling so 4K frames don't pile into one wakeup (WRITE_BATCH / WRITE_BATCH_BYTES)
+    writeBatch      = 10
+    writeBatchBytes = 1024 * 1024
+    
+    // FRAME_PACING spreads queued video writes across the frame interval
+    // instead of flushing a hub burst back-to-back; audio is never paced
+    framePacing bool
+    
+    // Video frames per second a room may ingest in total, ROOM_FPS_BUDGET
+    roomFPSBudget = 60
+    
+    // Frame distribution for rooms whose join names no strategy, and the
+    // room sizes where auto moves from all to fps-cap to round-robin
+    defaultDropStrategy  = "auto"
+    sendAllMaxUsers      = 2
+    fpsCapMaxUsers       = 4
+    roundRobinSingleOver = 8
+    
+    // IDLE_TIMEOUT closes clients that send no media or typing for this long, 0 disables
+    idleTimeout time.Duration
+    
+    // Presence: a client unheard for AWAY_AFTER is announced away and one
+    // unheard for LEAVE_AFTER is removed; 0 disables either
+    awayAfter  time.Duration
+    leaveAfter time.Duration
+    
+    // BAD_FRAME_LIMIT consecutive undecodable frames earn the sender a bad-frame
+    // error; BAD_FRAME_POLICY=disconnect also closes its connection
+    badFrameLimit         = 5
+    disconnectOnBadFrames = os.Getenv("BAD_FRAME_POLICY") == "disconnect"
+    
+    // A frame whose header declares more than these is refused undecoded; 0
+    // lifts a limit. Oversized frames never reset like bad ones do, and
+    // BAD_FRAME_LIMIT of them disconnect the sender whatever the policy.
+    maxFrameWidth  = 3840
+    maxFrameHeight = 3840
+    maxFramePixels = 3840 * 2160
+    
+    // Connection timeouts and the per-room-size encode ladder, from Config
+    readTimeout   = 60 * time.Second
+    pingInterval  = 54 * time.Second
+    writeTimeout  = 10 * time.Second
+    writeStallTimeout = 2 * time.Second
+    qualityLadder = defaultConfig().QualityLadder
+    
+    // Outbound kbps per receiver, CLIENT_BANDWIDTH_KBPS; 0 is uncapped
+    clientBandwidthKbps = 1200
+    
+    // Video older than this since the server took it in is dropped instead
+    // of written, STALE_VIDEO_AFTER; 0 writes it however late
+    staleVideoAfter = 500 * time.Millisecond
+    
+    // A receiver whose oldest queued message has waited this long is
+    // disconnected, MAX_BACKLOG_AGE; 0 leaves it to the write deadline
+    maxBacklogAge = 5 * time.Second
+    
+    // Once Send is closed, how long WritePump has to write paced video still
+    // waiting for its slot and the close frame
+    flushTimeout = 2 * time.Second
+    
+    // How long an empty room survives so a quick reconnect lands back in it
+    roomTTL = 30 * time.Second
+    
+    // RECORD_LOG appends every inbound message for later replay
+    recorder *messageRecorder
+    
+    // Trust X-Forwarded-For from a reverse proxy (Caddy)
+    trustProxy = os.Getenv("TRUST_PROXY") == "true"
+    
     // Bandwidth allocations for 1.2 Mbps total
     // Prioritize audio, use WebP for video
     bandwidthAllocation = map[int]struct{ audioPct, videoPct int }{
@@ -104,487 +1047,6944 @@ var (
     }
 )
 
-// WebP compression with adaptive quality
-func webpCompressFrame(data []byte, userCount int) []byte {
-    // Decode the image
-    img, format, err := image.Decode(bytes.NewReader(data))
-    if err != nil {
-        log.Printf("Failed to decode image: %v (format: %s, size: %d bytes)", err, format, len(data))
-        return data
+const defaultWebPEffort = webpcodec.DefaultEffort
+
+// newFrameCodec selects the codec named by VIDEO_CODEC (webp|jpeg); effort
+// only applies to webp
+func newFrameCodec(name string, effort int) framecodec.Codec {
+    codec, ok := framecodec.New(name, effort)
+    if !ok {
+        log.Printf("Unknown VIDEO_CODEC %q, falling back to %s", name, codec.Name())
     }
-    
-    bounds := img.Bounds()
-    originalSize := bounds.Max.X
-    
-    // Adaptive sizing based on user count
-    var targetWidth uint
-    var quality float32
-    
-    switch userCount {
-    case 1:
-        targetWidth = 320  // Good quality for single user
-        quality = 75
-    case 2:
-        targetWidth = 240  // Medium quality
-        quality = 65
-    case 3:
-        targetWidth = 180  // Lower resolution
-        quality = 55
-    case 4:
-        targetWidth = 120  // Small
-        quality = 45
-    case 5:
-        targetWidth = 100  // Tiny
-        quality = 35
-    default:
-        targetWidth = 80   // Ultra tiny for 6+
-        quality = 25
+    return codec
+}
+
+// runEffortBench encodes every image in dir at each effort and prints the
+// time and size per frame, at the ladder's top step and at 1280px wide
+func runEffortBench(dir string) error {
+    if !webpcodec.Available {
+        return webpcodec.ErrUnavailable
     }
-    
-    // Resize if needed
-    var finalImg image.Image
-    if uint(originalSize) > targetWidth {
-        finalImg = resize.Resize(targetWidth, 0, img, resize.Lanczos3)
-    } else {
-        finalImg = img
+    paths, err := filepath.Glob(filepath.Join(dir, "*"))
+    if err != nil {
+        return err
     }
-    
-    // For 5+ users, use grayscale to save more
-    if userCount >= 5 {
-        gray := image.NewGray(finalImg.Bounds())
-        draw.Draw(gray, gray.Bounds(), finalImg, finalImg.Bounds().Min, draw.Src)
-        finalImg = gray
+    var images []image.Image
+    for _, path := range paths {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            continue
+        }
+        if img, _, err := image.Decode(bytes.NewReader(data)); err == nil {
+            images = append(images, img)
+        }
     }
-    
-    // Encode to WebP
-    var buf bytes.Buffer
-    options := &webp.Options{
-        Lossless: false,
-        Quality:  quality,
-        Exact:    false,
+    if len(images) == 0 {
+        return fmt.Errorf("no decodable images in %s", dir)
     }
     
-    if err := webp.Encode(&buf, finalImg, options); err != nil {
-        // Fallback to original if WebP fails
-        return data
+    top := qualityLadder[0]
+    fmt.Printf("%d images from %s\n", len(images), dir)
+    for _, width := range []uint{top.Width, 1280} {
+        frames := make([]image.Image, len(images))
+        for i, img := range images {
+            frames[i] = resize.Resize(width, 0, img, resize.Lanczos3)
+        }
+        
+        fmt.Printf("\n%dpx @ quality %.0f\n effort   ms/frame   bytes/frame   vs effort 4\n", width, top.Quality)
+        var baseline float64
+        for _, effort := range []int{4, 0, 1, 2, 3, 5, 6} {
+            var elapsed time.Duration
+            total := 0
+            for _, frame := range frames {
+                start := time.Now()
+                data, err := webpcodec.Encode(frame, top.Quality, effort)
+                elapsed += time.Since(start)
+                if err != nil {
+                    return err
+                }
+                total += len(data)
+            }
+            perFrame := float64(total) / float64(len(frames))
+            if effort == defaultWebPEffort {
+                baseline = perFrame
+            }
+            fmt.Printf(" %6d   %8.1f   %11.0f   %+10.1f%%\n", effort,
+                float64(elapsed.Microseconds())/1000/float64(len(frames)), perFrame, 100*(perFrame/baseline-1))
+        }
     }
-    
-    compressedSize := buf.Len()
-    atomic.AddInt64(&hub.CompressedFrames, 1)
-    atomic.AddInt64(&hub.BytesSaved, int64(len(data)-compressedSize))
-    
-    // Log significant compressions
-    ratio := float64(len(data)) / float64(compressedSize)
-    if ratio > 5 {
-        log.Printf("WebP compression: %d -> %d bytes (%.1fx) for %d users", 
-            len(data), compressedSize, ratio, userCount)
+    return nil
+}
+
+// DropStrategy picks which receivers get a video frame. receivers excludes
+// the sender and spectators; userCount is the room's sender count. Select
+// runs on the hub goroutine, so it may keep state on the room.
+type DropStrategy interface {
+    Name() string
+    Select(room *Room, from string, receivers []*Client, userCount int) []*Client
+}
+
+var dropStrategies = map[string]DropStrategy{
+    "auto":       autoStrategy{},
+    "all":        sendAllStrategy{},
+    "fps-cap":    fpsCapStrategy{},
+    "roundrobin": roundRobinStrategy{},
+    "priority":   priorityStrategy{},
+}
+
+func dropStrategyNames() []string {
+    names := make([]string, 0, len(dropStrategies))
+    for name := range dropStrategies {
+        names = append(names, name)
     }
-    
-    return buf.Bytes()
+    sort.Strings(names)
+    return names
 }
 
-func NewHub() *Hub {
-    return &Hub{
-        Rooms:      make(map[string]*Room),
-        Register:   make(chan *Client, 10),
-        Unregister: make(chan *Client, 10),
-        Broadcast:  make(chan *BroadcastMessage, 100),
+// newDropStrategy resolves a join's dropStrategy, falling back to DROP_STRATEGY
+func newDropStrategy(name string) DropStrategy {
+    if name == "" {
+        name = defaultDropStrategy
+    }
+    if strategy, ok := dropStrategies[name]; ok {
+        return strategy
     }
+    log.Printf("Unknown dropStrategy %q, falling back to %s", name, defaultDropStrategy)
+    return dropStrategies[defaultDropStrategy]
 }
 
-func (h *Hub) Run() {
-    ticker := time.NewTicker(5 * time.Second)
+// autoStrategy sends everything to small rooms, caps fps for mid-sized ones
+// and round-robins beyond that
+type autoStrategy struct{}
+
+func (autoStrategy) Name() string { return "auto" }
+
+func (autoStrategy) Select(room *Room, from string, receivers []*Client, userCount int) []*Client {
+    switch {
+    case userCount <= sendAllMaxUsers:
+        return sendAllStrategy{}.Select(room, from, receivers, userCount)
+    case userCount <= fpsCapMaxUsers:
+        return fpsCapStrategy{}.Select(room, from, receivers, userCount)
+    }
+    return roundRobinStrategy{}.Select(room, from, receivers, userCount)
+}
+
+type sendAllStrategy struct{}
+
+func (sendAllStrategy) Name() string { return "all" }
+
+func (sendAllStrategy) Select(room *Room, from string, receivers []*Client, userCount int) []*Client {
+    return receivers
+}
+
+// fpsCapStrategy shares 30 fps across the room and skips receivers that are
+// busy with audio
+type fpsCapStrategy struct{}
+
+func (fpsCapStrategy) Name() string { return "fps-cap" }
+
+func (fpsCapStrategy) Select(room *Room, from string, receivers []*Client, userCount int) []*Client {
+    targetFPS := 30.0 / float64(userCount)
+    minFrameInterval := time.Duration(1000/targetFPS) * time.Millisecond
+    
+    now := time.Now()
+    if now.Sub(room.LastFrameTime) < minFrameInterval {
+        return nil
+    }
+    room.LastFrameTime = now
+    
+    selected := make([]*Client, 0, len(receivers))
+    for _, client := range receivers {
+        if !client.receivingAudio() {
+            selected = append(selected, client)
+        }
+    }
+    return selected
+}
+
+// markAudio notes that audio was just queued for the client
+func (c *Client) markAudio(now time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.LastAudioTime = now
+}
+
+// hintFPS notes the fps cap the client was last told
+func (c *Client) hintFPS(maxFps int) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.FPSHint = maxFps
+    c.LastFPSHint = time.Now()
+}
+
+// lastVideoAccepted is when the client's last frame was let through
+func (c *Client) lastVideoAccepted() time.Time {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.LastVideoAccepted
+}
+
+// receivingAudio reports whether the client's audio arrived in the last 100ms
+func (c *Client) receivingAudio() bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return time.Since(c.LastAudioTime) < 100*time.Millisecond
+}
+
+// videoCredit caps how many bytes a receiver can fall behind the best-served
+// one. A receiver nothing could go to for a while (it was the only sender, or
+// subscribed to no one) catches up over a few frames instead of taking every
+// frame until it has.
+const videoCredit = 256 << 10
+
+// roundRobinStrategy sends each frame to the two receivers served the fewest
+// video bytes, or one in rooms above roundRobinSingleOver. Choosing the most
+// starved rather than the next in turn keeps every receiver's share even
+// however unevenly the senders send.
+type roundRobinStrategy struct{}
+
+func (roundRobinStrategy) Name() string { return "roundrobin" }
+
+func (roundRobinStrategy) Select(room *Room, from string, receivers []*Client, userCount int) []*Client {
+    sendCount := 2
+    if userCount > roundRobinSingleOver {
+        sendCount = 1
+    }
+    if sendCount > len(receivers) {
+        sendCount = len(receivers)
+    }
+    
+    served := room.fairShare(receivers)
+    sort.Slice(receivers, func(i, j int) bool {
+        a, b := served[receivers[i].ID], served[receivers[j].ID]
+        if a != b {
+            return a < b
+        }
+        return receivers[i].ID < receivers[j].ID
+    })
+    return receivers[:sendCount]
+}
+
+// fairShare returns the room's served bytes per receiver after bringing
+// newcomers level with the least served and the long-idle within videoCredit
+// of the most served
+func (r *Room) fairShare(receivers []*Client) map[string]int64 {
+    if r.VideoServed == nil {
+        r.VideoServed = make(map[string]int64)
+    }
+    var least, most int64
+    known := false
+    for _, client := range receivers {
+        if served, ok := r.VideoServed[client.ID]; ok {
+            if !known || served < least {
+                least = served
+            }
+            if !known || served > most {
+                most = served
+            }
+            known = true
+        }
+    }
+    for _, client := range receivers {
+        served, ok := r.VideoServed[client.ID]
+        if !ok {
+            served = least
+        }
+        r.VideoServed[client.ID] = max(served, most-videoCredit)
+    }
+    return r.VideoServed
+}
+
+// serveVideo charges a frame to the receiver it was handed to
+func (r *Room) serveVideo(id string, size int) {
+    if r.VideoServed == nil {
+        r.VideoServed = make(map[string]int64)
+    }
+    r.VideoServed[id] += int64(size)
+}
+
+// priorityStrategy sends a speaking sender's frames to everyone and
+// round-robins the rest
+type priorityStrategy struct{}
+
+func (priorityStrategy) Name() string { return "priority" }
+
+func (priorityStrategy) Select(room *Room, from string, receivers []*Client, userCount int) []*Client {
+    if sender := room.Clients[from]; sender != nil && time.Since(sender.LastSpokeAt) < time.Second {
+        return receivers
+    }
+    return roundRobinStrategy{}.Select(room, from, receivers, userCount)
+}
+
+// errBadFrame marks a frame the client sent that isn't a decodable image
+var errBadFrame = errors.New("undecodable frame")
+
+// errOversizedFrame marks a bad frame whose header claims too many pixels
+var errOversizedFrame = errors.New("oversized frame")
+
+// checkFrameSize reads only the image header, so a few bytes that claim
+// enormous dimensions are refused before image.Decode allocates for them
+func checkFrameSize(data []byte) error {
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        return fmt.Errorf("%w: %v", errBadFrame, err)
+    }
+    if (maxFrameWidth > 0 && cfg.Width > maxFrameWidth) ||
+        (maxFrameHeight > 0 && cfg.Height > maxFrameHeight) ||
+        (maxFramePixels > 0 && int64(cfg.Width)*int64(cfg.Height) > int64(maxFramePixels)) {
+        return fmt.Errorf("%w: %w: %dx%d", errBadFrame, errOversizedFrame, cfg.Width, cfg.Height)
+    }
+    return nil
+}
+
+// ladderStep is the encode for a room of userCount; the last step covers larger rooms
+func ladderStep(userCount int) QualityStep {
+    if userCount >= 1 && userCount <= len(qualityLadder) {
+        return qualityLadder[userCount-1]
+    }
+    return qualityLadder[len(qualityLadder)-1]
+}
+
+// WebP compression with adaptive quality; a frame that fails to decode or
+// encode is an error, never relayed as-is. layers maps simulcast layers to
+// widths below the ladder's; their smaller variants come from the same decode.
+func webpCompressFrame(data []byte, userCount int, layers map[uint]uint) ([]byte, map[uint][]byte, error) {
+    // Decode the image
+    if err := checkFrameSize(data); err != nil {
+        return nil, nil, err
+    }
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        return nil, nil, fmt.Errorf("%w: %v", errBadFrame, err)
+    }
+    
+    // Adaptive sizing based on user count
+    step := ladderStep(userCount)
+    encoded, err := encodeAtWidth(img, step.Width, step)
+    if err != nil {
+        return nil, nil, err
+    }
+    
+    // A layer only pays off if it is narrower than what was just encoded
+    var variants map[uint][]byte
+    for layer, width := range layers {
+        if width >= step.Width || width >= uint(img.Bounds().Dx()) {
+            continue
+        }
+        variant, err := encodeAtWidth(img, width, step)
+        if err != nil {
+            return nil, nil, err
+        }
+        if variants == nil {
+            variants = make(map[uint][]byte)
+        }
+        variants[layer] = variant
+    }
+    
+    compressedSize := len(encoded)
+    atomic.AddInt64(&hub.CompressedFrames, 1)
+    atomic.AddInt64(&hub.BytesSaved, int64(len(data)-compressedSize))
+    
+    // Log significant compressions
+    ratio := float64(len(data)) / float64(compressedSize)
+    if ratio > 5 {
+        log.Printf("%s compression: %d -> %d bytes (%.1fx) for %d users", 
+            frameCodec.Name(), len(data), compressedSize, ratio, userCount)
+    }
+    
+    return encoded, variants, nil
+}
+
+// encodeAtWidth downscales img to targetWidth if wider and encodes it with the step's quality
+func encodeAtWidth(img image.Image, targetWidth uint, step QualityStep) ([]byte, error) {
+    // Resize if needed
+    var finalImg image.Image
+    if uint(img.Bounds().Dx()) > targetWidth {
+        finalImg = resize.Resize(targetWidth, 0, img, resize.Lanczos3)
+    } else {
+        finalImg = img
+    }
+    
+    // Large rooms go grayscale to save more
+    if step.Grayscale {
+        gray := image.NewGray(finalImg.Bounds())
+        draw.Draw(gray, gray.Bounds(), finalImg, finalImg.Bounds().Min, draw.Src)
+        finalImg = gray
+    }
+    
+    // Encode with the configured codec
+    encoded, err := frameCodec.Encode(finalImg, step.Quality)
+    if err != nil {
+        return nil, fmt.Errorf("%s encode: %v", frameCodec.Name(), err)
+    }
+    return encoded, nil
+}
+
+func NewHub() *Hub {
+    h := &Hub{
+        Rooms:      make(map[string]*Room),
+        Register:   make(chan *Client, 10),
+        Unregister: make(chan *Client, 10),
+        Broadcast:  make(chan *BroadcastMessage, 100),
+        encoded:    make(chan *encodeJob, encodeWorkers*encodeQueueSize),
+        ready:      make(chan chan hubStatus),
+        announcements: make(chan *announcement),
+        operatorActions: make(chan *operatorAction),
+        shutdown:   make(chan chan []*Client),
+        assignedIDs: make(map[string]map[string]bool),
+        metrics:    metrics,
+    }
+    
+    h.encodeQueues = make([]chan *encodeJob, encodeWorkers)
+    for i := range h.encodeQueues {
+        h.encodeQueues[i] = make(chan *encodeJob, encodeQueueSize)
+    }
+    return h
+}
+
+// Run starts the encoder pool and serves the hub loop for good. Should the
+// loop ever end anyway, say by a panic serveOne couldn't contain, it is
+// counted and started again rather than leaving every connection unserved.
+func (h *Hub) Run() {
+    for _, queue := range h.encodeQueues {
+        go h.encodeWorker(queue)
+    }
+    
+    for {
+        func() {
+            defer func() { h.recoverPanic("hub loop", recover()) }()
+            h.loop()
+        }()
+        log.Printf("Hub loop stopped, restarting it")
+    }
+}
+
+func (h *Hub) loop() {
+    ticker := time.NewTicker(5 * time.Second)
     defer ticker.Stop()
     
+    typingTicker := time.NewTicker(time.Second)
+    defer typingTicker.Stop()
+    
     for {
+        h.serveOne(ticker.C, typingTicker.C)
+    }
+}
+
+// recoverPanic logs and counts a panic on the hub goroutine, given what
+// recover returned, instead of letting it end the process; it reports
+// whether there was one. Whatever the panicking handler was doing is
+// abandoned, which is why the handlers release their locks in defers.
+func (h *Hub) recoverPanic(where string, err interface{}) bool {
+    if err == nil {
+        return false
+    }
+    atomic.AddInt64(&h.HubPanics, 1)
+    h.metrics.Count("hub.panics", 1)
+    log.Printf("Recovered panic in %s: %v\n%s", where, err, debug.Stack())
+    return true
+}
+
+// serveOne handles one hub event. A panic in its handler drops that event
+// and the loop carries on with the next; a caller waiting on the handler's
+// answer has its reply channel closed instead.
+func (h *Hub) serveOne(metricsTick, sweepTick <-chan time.Time) {
+    var owed func()
+    defer func() {
+        if h.recoverPanic("hub handler", recover()) && owed != nil {
+            owed()
+        }
+    }()
+    
+    select {
+    case job := <-h.encoded:
+        h.distributeVideo(job)
+        
+    case client := <-h.Register:
+        h.registerClient(client)
+        
+    case client := <-h.Unregister:
+        h.unregisterClient(client)
+        
+    case message := <-h.Broadcast:
+        h.handleBroadcast(message)
+        
+    case <-metricsTick:
+        h.reportMetrics()
+        h.reapIdleRooms()
+        
+    case <-sweepTick:
+        h.expireTyping()
+        h.expireReactions()
+        h.sweepPresence(awayAfter, leaveAfter)
+        h.sweepSources()
+        h.sweepBacklogs(maxBacklogAge)
+        h.sampleRooms()
+        
+    case reply := <-h.ready:
+        owed = func() { close(reply) }
+        reply <- h.status()
+        
+    case a := <-h.announcements:
+        owed = func() { close(a.delivered) }
+        a.delivered <- h.announce(a)
+        
+    case a := <-h.operatorActions:
+        owed = func() { close(a.found) }
+        a.found <- h.operate(a)
+        
+    case done := <-h.shutdown:
+        owed = func() { close(done) }
+        done <- h.closeForRestart()
+    }
+}
+
+// Shutdown closes every client with 1012 so they reconnect elsewhere or
+// after the restart, and returns once their WritePumps have flushed what was
+// queued and the close frame, or after timeout. A hub that doesn't take the
+// request within readyTimeout, or drops it to a panic, closes no one.
+func (h *Hub) Shutdown(timeout time.Duration) {
+    deadline := time.Now().Add(timeout)
+    done := make(chan []*Client, 1)
+    var closed []*Client
+    select {
+    case h.shutdown <- done:
         select {
-        case client := <-h.Register:
-            h.registerClient(client)
-            
-        case client := <-h.Unregister:
-            h.unregisterClient(client)
-            
-        case message := <-h.Broadcast:
-            h.handleBroadcast(message)
-            
-        case <-ticker.C:
-            h.reportMetrics()
+        case closed = <-done:
+        case <-time.After(readyTimeout):
+        }
+    case <-time.After(readyTimeout):
+    }
+    if closed == nil {
+        log.Printf("Hub did not close its clients for the shutdown")
+        return
+    }
+    
+    unflushed := 0
+    for _, client := range closed {
+        if !client.awaitFlush(time.Until(deadline)) {
+            unflushed++
         }
     }
+    if unflushed > 0 {
+        log.Printf("%d clients had not flushed within %s", unflushed, timeout)
+    }
+}
+
+// closeForRestart tells every client when to come back, spread over at least
+// RECONNECT_SPREAD and long enough for ACCEPT_RATE to admit them all, and
+// returns the clients it closed
+func (h *Hub) closeForRestart() []*Client {
+    h.draining = true
+    
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    
+    clients := 0
+    for _, room := range h.Rooms {
+        clients += room.size()
+    }
+    h.restartSpread = reconnectSpread
+    if acceptRate > 0 {
+        h.restartSpread = max(h.restartSpread, time.Duration(float64(clients)/acceptRate*float64(time.Second)))
+    }
+    
+    closed := make([]*Client, 0, clients)
+    for _, room := range h.Rooms {
+        closed = h.restartRoom(room, closed)
+    }
+    log.Printf("Closed %d clients for restart, reconnects spread over %s", clients, h.restartSpread)
+    return closed
+}
+
+// restartRoom empties a room, sending each client its server-restart, and
+// appends them to closed
+func (h *Hub) restartRoom(room *Room, closed []*Client) []*Client {
+    room.mu.Lock()
+    defer room.mu.Unlock()
+    
+    for id, client := range room.Clients {
+        delete(room.Clients, id)
+        h.sendRestart(client)
+        closed = append(closed, client)
+    }
+    return closed
+}
+
+// sendRestart sends a server-restart with a jittered reconnect delay, repeated
+// in the 1012 close reason, and closes the client
+func (h *Hub) sendRestart(client *Client) {
+    after := jitter(h.restartSpread).Milliseconds()
+    client.sendMessage(Message{Type: "server-restart", ReconnectAfterMs: after})
+    client.closeSend(websocket.CloseServiceRestart, fmt.Sprintf("server-restart:%d", after))
+}
+
+// jitter is a uniformly random duration in [0, spread)
+func jitter(spread time.Duration) time.Duration {
+    if spread <= 0 {
+        return 0
+    }
+    return time.Duration(mathrand.Int63n(int64(spread)))
+}
+
+// room looks a room up under the hub lock
+func (h *Hub) room(id string) *Room {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    return h.Rooms[id]
+}
+
+// openRooms lists the rooms under the hub lock
+func (h *Hub) openRooms() []*Room {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    
+    rooms := make([]*Room, 0, len(h.Rooms))
+    for _, room := range h.Rooms {
+        rooms = append(rooms, room)
+    }
+    return rooms
 }
 
 func (h *Hub) registerClient(client *Client) {
+    if h.draining {
+        h.sendRestart(client)
+        return
+    }
+    
+    room := h.openRoom(client)
+    if room == nil {
+        client.sendError(ErrRoomLimit, fmt.Sprintf("server already hosts %d rooms", maxRooms), "join")
+        client.closeSend(CloseRoomLimit, "room-limit")
+        log.Printf("Client %s refused room %s: %d rooms open", client.ID, client.Room, maxRooms)
+        return
+    }
+    
+    refusal, rejoin, previousName := room.seat(client)
+    switch refusal {
+    case "id-in-use":
+        // Keep the established connection, turn the newcomer away
+        if data, err := json.Marshal(Message{Type: "id-in-use", ID: client.ID}); err == nil {
+            select {
+            case client.Send <- data:
+            default:
+            }
+        }
+        client.closeSend(CloseIDInUse, "id-in-use")
+        log.Printf("Client %s rejected from room %s: id already in use", client.ID, client.Room)
+        return
+    case "room-locked":
+        client.sendError(ErrRoomLocked, fmt.Sprintf("room %s is locked by its moderator", client.Room), "join")
+        client.closeSend(CloseRoomLocked, "room-locked")
+        log.Printf("Client %s rejected from room %s: room locked", client.ID, client.Room)
+        return
+    case "room-full":
+        client.sendError(ErrRoomFull, fmt.Sprintf("room %s already has %d participants", client.Room, maxUsersPerRoom), "join")
+        client.closeSend(CloseRoomFull, "room-full")
+        log.Printf("Client %s rejected from room %s: room full", client.ID, client.Room)
+        return
+    }
+    
+    // First participant moderates; a token holder takes over
+    previous, moderator, layout, userCount := room.seatModerator(client)
+    if userCount == 1 && !rejoin {
+        webhooks.emit("first-participant-joined", room.ID, client.ID, "", userCount)
+    }
+    h.metrics.Count("clients.joined", 1)
+    
+    role := "participant"
+    if moderator == client.ID {
+        role = "moderator"
+    } else if client.Spectator {
+        role = "spectator"
+    }
+    
+    // Send welcome with compression info
+    client.sendMessage(Message{
+        Type: "welcome",
+        ID:   client.ID,
+        CompressionType: frameCodec.Name(),
+        AudioOnly: room.AudioOnly,
+        Encrypted: room.Encrypted,
+        EchoDelayMs: room.echoDelayMs(),
+        Role:      role,
+        Moderator: moderator,
+        Hands:     room.raisedHands(),
+        Mutes:     room.muteStates(),
+        Names:     room.displayNames(),
+        Layout:    &layout,
+        Media:     room.mediaProfile(),
+        MsgID:     room.lastMsgID(client.ID),
+    })
+    if !rejoin || client.DisplayName != previousName {
+        h.sendToOthers(room, Message{Type: "participant-joined", From: client.ID, DisplayName: client.DisplayName}, client.ID)
+    }
+    if previous != "" && previous != moderator {
+        h.sendToOthers(room, Message{Type: "moderator-changed", Moderator: moderator}, client.ID)
+    }
+    
+    // A joiner who hasn't consented pauses an ongoing recording
+    if room.Recording != nil {
+        if !client.RecordingConsent {
+            client.sendMessage(Message{Type: "recording-consent-request", Text: room.Recording.id})
+        }
+        h.updateRecording(room)
+    }
+    
+    h.updateDirect(room)
+    
+    if client.Resume {
+        h.resume(room, client)
+    }
+    
+    log.Printf("Client %s joined room %s (total: %d users, using %s)", 
+        client.ID, client.Room, userCount, frameCodec.Name())
+}
+
+// openRoom finds the client's room, creating it if there is room for another,
+// and returns nil when maxRooms are open and none can be evicted
+func (h *Hub) openRoom(client *Client) *Room {
     h.mu.Lock()
+    defer h.mu.Unlock()
+    
     room, exists := h.Rooms[client.Room]
+    if !exists && maxRooms > 0 && len(h.Rooms) >= maxRooms && !h.evictEmptyRoom() {
+        return nil
+    }
     if !exists {
         room = &Room{
-            ID:      client.Room,
-            Clients: make(map[string]*Client),
+            ID:        client.Room,
+            Clients:   make(map[string]*Client),
+            CreatedAt: time.Now(),
+            Layout:    RoomLayout{Mode: "grid"},
+            AudioOnly: client.Mode == "audio-only",
+            Encrypted: client.Mode == "e2ee",
+            Echo:      client.Mode == "echo",
+            Strategy:  newDropStrategy(client.DropStrategy),
         }
         h.Rooms[client.Room] = room
+        webhooks.emit("room-created", room.ID, "", "", 0)
+        h.metrics.Count("rooms.created", 1)
+        if room.AudioOnly {
+            log.Printf("Room %s created audio-only", room.ID)
+        }
+        if room.Encrypted {
+            log.Printf("Room %s created end-to-end encrypted", room.ID)
+        }
+        if room.Echo {
+            log.Printf("Room %s created for an echo test", room.ID)
+        }
+        if client.DropStrategy != "" {
+            log.Printf("Room %s created with %s frame distribution", room.ID, room.Strategy.Name())
+        }
     }
-    h.mu.Unlock()
+    return room
+}
+
+// seat puts the client in the room, unless it is turned away as "id-in-use",
+// "room-locked" or "room-full", and reports whether it takes over an
+// existing participant and that participant's display name
+func (r *Room) seat(client *Client) (refusal string, rejoin bool, previousName string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
     
-    room.mu.Lock()
-    room.Clients[client.ID] = client
-    userCount := len(room.Clients)
-    room.mu.Unlock()
+    if existing, ok := r.Clients[client.ID]; ok && existing != client {
+        if rejectDuplicateJoin {
+            return "id-in-use", false, ""
+        }
+        
+        // Newest connection wins; the old one's unregister will find the slot
+        // taken. The same participant's recording consent and video source
+        // carry over, and a resume keeps what it was watching.
+        client.RecordingConsent = existing.RecordingConsent
+        client.VideoActive = existing.VideoActive
+        client.inherit(existing)
+        existing.closeSend(CloseReplaced, "replaced")
+        log.Printf("Client %s rejoined room %s, closing previous connection", client.ID, client.Room)
+    }
+    existing, rejoin := r.Clients[client.ID]
+    if rejoin {
+        previousName = existing.DisplayName
+    }
+    if !rejoin && r.Locked && !client.ModToken {
+        return "room-locked", false, ""
+    }
+    if !rejoin && maxUsersPerRoom > 0 && len(r.Clients) >= maxUsersPerRoom {
+        return "room-full", false, ""
+    }
+    r.Clients[client.ID] = client
+    r.LastActivity = time.Now()
+    return "", rejoin, previousName
+}
+
+// seatModerator makes a newly seated client moderator if the room has none or
+// it holds a moderator token, returning the moderator before and after, the
+// layout and the head count
+func (r *Room) seatModerator(client *Client) (previous, moderator string, layout RoomLayout, userCount int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
     
-    // Send welcome with compression info
-    welcome := Message{
-        Type: "welcome",
-        ID:   client.ID,
-        CompressionType: "webp",
+    previous = r.Moderator
+    if (r.Moderator == "" && !client.Spectator) || (client.ModToken && r.Moderator != client.ID) {
+        r.Moderator = client.ID
     }
+    return previous, r.Moderator, r.Layout, len(r.Clients)
+}
+
+// inherit carries over what the connection it replaces had accepted and, on a
+// resume, what it was watching
+func (c *Client) inherit(existing *Client) {
+    existing.mu.RLock()
+    defer existing.mu.RUnlock()
     
-    if data, err := json.Marshal(welcome); err == nil {
-        select {
-        case client.Send <- data:
-        default:
-        }
+    c.LastVideoAccepted = existing.LastVideoAccepted
+    if c.Resume {
+        c.Layers = existing.Layers
+        c.VideoSubs = existing.VideoSubs
+    }
+}
+
+func (h *Hub) unregisterClient(client *Client) {
+    room := h.room(client.Room)
+    
+    // A leave message is a clean departure; anything else lost the socket
+    reason := "disconnected"
+    if client.leaving {
+        reason = "left"
+    }
+    if room != nil && h.removeClient(room, client, websocket.CloseNormalClosure, reason) {
+        if client.leaving {
+            log.Printf("Client %s left room %s", client.ID, client.Room)
+        } else {
+            log.Printf("Client %s disconnected from room %s", client.ID, client.Room)
+        }
+    }
+    if client.AssignedID {
+        h.releaseID(client.Room, client.ID)
+    }
+}
+
+// sweepPresence marks clients not heard from for awayAfter as away, back
+// when they are heard from again, and removes them after leaveAfter; Run
+// passes AWAY_AFTER and LEAVE_AFTER. A connection that died without a FIN
+// otherwise lingers in the room until its read deadline.
+func (h *Hub) sweepPresence(awayAfter, leaveAfter time.Duration) {
+    if awayAfter == 0 && leaveAfter == 0 {
+        return
+    }
+    
+    type presenceChange struct {
+        room   *Room
+        client *Client
+        silent time.Duration
+    }
+    var away, back, gone []presenceChange
+    now := time.Now()
+    
+    for _, room := range h.openRooms() {
+        for _, client := range room.members() {
+            change := presenceChange{room, client, now.Sub(client.LastSeen())}
+            switch {
+            case leaveAfter > 0 && change.silent >= leaveAfter:
+                gone = append(gone, change)
+            case awayAfter > 0 && change.silent >= awayAfter:
+                if !client.away {
+                    away = append(away, change)
+                }
+            case client.away:
+                back = append(back, change)
+            }
+        }
+    }
+    
+    for _, change := range away {
+        change.client.away = true
+        h.sendToOthers(change.room, Message{
+            Type:     "participant-away",
+            From:     change.client.ID,
+            LastSeen: change.client.LastSeen().UnixMilli(),
+        }, change.client.ID)
+    }
+    for _, change := range back {
+        change.client.away = false
+        h.sendToOthers(change.room, Message{Type: "participant-back", From: change.client.ID}, change.client.ID)
+    }
+    for _, change := range gone {
+        if h.removeClient(change.room, change.client, ClosePresence, "presence-timeout") {
+            log.Printf("Client %s removed from room %s after %s unheard", change.client.ID, change.room.ID, change.silent.Round(time.Second))
+        }
+    }
+}
+
+// Video sources
+//
+// source-started goes to the rest of the room when a participant's video
+// starts arriving, and source-ended (message "left" or "idle") when it leaves
+// or goes sourceIdleAfter without a frame, so receivers can clear its tile
+// rather than keep showing the last frame.
+
+// sourceIdleAfter is how long a sender can go without a frame and still count as sending
+const sourceIdleAfter = 3 * time.Second
+
+func (h *Hub) startSource(room *Room, sender *Client) {
+    if sender.VideoActive {
+        return
+    }
+    sender.VideoActive = true
+    h.sendToOthers(room, Message{Type: "source-started", SourceID: sender.ID}, sender.ID)
+}
+
+func (h *Hub) endSource(room *Room, sender *Client, reason string) {
+    if !sender.VideoActive {
+        return
+    }
+    sender.VideoActive = false
+    h.sendToOthers(room, Message{Type: "source-ended", SourceID: sender.ID, Text: reason}, sender.ID)
+}
+
+// sweepSources ends the video of senders whose frames stopped
+func (h *Hub) sweepSources() {
+    type idleSource struct {
+        room   *Room
+        client *Client
+    }
+    var idle []idleSource
+    now := time.Now()
+    
+    for _, room := range h.openRooms() {
+        for _, client := range room.members() {
+            if client.VideoActive && now.Sub(client.lastVideoAccepted()) >= sourceIdleAfter {
+                idle = append(idle, idleSource{room, client})
+            }
+        }
+    }
+    
+    for _, source := range idle {
+        h.endSource(source.room, source.client, "idle")
+    }
+}
+
+// backlogMark says that by at, Send had been handed count messages in total
+type backlogMark struct {
+    at    time.Time
+    count int64
+}
+
+// sweepBacklogs disconnects receivers whose send queue stopped moving for
+// maxAge; Run passes MAX_BACKLOG_AGE, and 0 turns it off. Send is FIFO, so
+// once WritePump has taken fewer messages than a mark's count the oldest one
+// waiting was queued before that mark: the oldest surviving mark bounds the
+// backlog's age from below, within one sweep. A client that reads just
+// enough to keep each write inside WRITE_TIMEOUT is caught here, where
+// buffer-full drops would otherwise hide it forever.
+func (h *Hub) sweepBacklogs(maxAge time.Duration) {
+    if maxAge == 0 {
+        return
+    }
+    
+    type stuckClient struct {
+        room   *Room
+        client *Client
+        age    time.Duration
+    }
+    var stuck []stuckClient
+    now := time.Now()
+    
+    for _, room := range h.openRooms() {
+        for _, client := range room.members() {
+            // Taken before the length so a racing write only makes the mark low
+            taken := client.dequeued.Load()
+            queued := int64(len(client.Send))
+            if queued == 0 {
+                client.backlogMarks = client.backlogMarks[:0]
+                continue
+            }
+            
+            marks := client.backlogMarks
+            for len(marks) > 0 && marks[0].count <= taken {
+                marks = marks[1:]
+            }
+            if n := len(marks); n == 0 || marks[n-1].count < taken+queued {
+                marks = append(marks, backlogMark{at: now, count: taken + queued})
+            }
+            client.backlogMarks = marks
+            
+            if age := now.Sub(marks[0].at); age >= maxAge {
+                stuck = append(stuck, stuckClient{room, client, age})
+            }
+        }
+    }
+    
+    for _, s := range stuck {
+        if !h.removeClient(s.room, s.client, CloseBacklog, "backlog") {
+            continue
+        }
+        atomic.AddInt64(&h.BacklogDisconnects, 1)
+        log.Printf("Client %s removed from room %s: %d queued messages, oldest %s old",
+            s.client.ID, s.room.ID, len(s.client.Send), s.age.Round(time.Second))
+        
+        // WritePump would drain the whole backlog first. Closing the socket
+        // ends the write it's stuck in; the close frame only gets through
+        // if the client reads again within WRITE_STALL_TIMEOUT.
+        go func(c *Client) {
+            c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(CloseBacklog, "backlog"), time.Now().Add(writeStallTimeout))
+            c.Conn.Close()
+        }(s.client)
+    }
+}
+
+// Direct two-party relay
+//
+// A room holding exactly two participants who both joined with "direct":true,
+// neither end-to-end encrypted nor being recorded, tells both direct-start
+// with the other's id in target. From then on either may send media as
+// binary WebSocket messages: one kind byte, directAudio or directVideo, then
+// the payload as is, with no JSON or base64. ReadPump hands each one straight
+// to the peer's queue, skipping the hub, sequence numbers, the encoder pool
+// and drop strategies; the peer gets the bytes unchanged and knows who sent
+// them. Mutes still apply and the bandwidth cap still covers video. Anything
+// that ends the pair (a third join, a leave, a recording) sends direct-end
+// with the reason in message; binary media after that is dropped, so clients
+// go back to JSON, which works throughout.
+
+const (
+    directAudio byte = 1
+    directVideo byte = 2
+)
+
+// directRoute is one client's side of a direct pair
+type directRoute struct {
+    room  *Room
+    peer  *Client
+    audio bool // False while the sender is muted, by itself or the moderator
+    video bool
+}
+
+// updateDirect starts, updates or ends direct mode after anything that
+// changes who is in the room or what they may send
+func (h *Hub) updateDirect(room *Room) {
+    clients, routes, reason := room.directRoutes()
+    
+    changed := false
+    for i, client := range clients {
+        previous := client.direct.Swap(routes[i])
+        switch {
+        case routes[i] == nil && previous != nil:
+            changed = true
+            client.sendMessage(Message{Type: "direct-end", Text: reason})
+        case routes[i] != nil && (previous == nil || previous.peer != routes[i].peer):
+            changed = true
+            client.sendMessage(Message{Type: "direct-start", Target: routes[i].peer.ID})
+        }
+    }
+    switch {
+    case changed && reason == "":
+        log.Printf("Room %s: direct relay between %s and %s", room.ID, clients[0].ID, clients[1].ID)
+    case changed:
+        log.Printf("Room %s: direct relay ended (%s)", room.ID, reason)
+    }
+}
+
+// directRoutes works out, under the room lock, each participant's route to
+// the other, or why the room can't relay directly
+func (r *Room) directRoutes() (clients []*Client, routes []*directRoute, reason string) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    
+    clients = make([]*Client, 0, len(r.Clients))
+    for _, client := range r.Clients {
+        clients = append(clients, client)
+    }
+    switch {
+    case len(clients) > 2:
+        reason = "participant-joined"
+    case len(clients) < 2:
+        reason = "participant-left"
+    case r.Encrypted:
+        reason = "encrypted"
+    case r.Recording != nil:
+        reason = "recording"
+    }
+    for _, client := range clients {
+        if reason == "" && (!client.Direct || client.Spectator) {
+            reason = "unsupported"
+        }
+    }
+    
+    routes = make([]*directRoute, len(clients))
+    if reason == "" {
+        for i, client := range clients {
+            mutes := r.Mutes[client.ID]
+            routes[i] = &directRoute{
+                room:  r,
+                peer:  clients[1-i],
+                audio: !client.Muted && !mutes.Audio,
+                video: !r.AudioOnly && !mutes.Video,
+            }
+        }
+    }
+    return clients, routes, reason
+}
+
+// relayDirect pipes one binary media message to the direct peer, on the
+// sender's ReadPump
+func (c *Client) relayDirect(data []byte) {
+    route := c.direct.Load()
+    if route == nil || len(data) < 2 || (data[0] != directAudio && data[0] != directVideo) {
+        atomic.AddInt64(&c.Hub.DirectDropped, 1)
+        return
+    }
+    if (data[0] == directAudio && !route.audio) || (data[0] == directVideo && !route.video) {
+        atomic.AddInt64(&c.Hub.MutedDropped, 1)
+        return
+    }
+    
+    c.mu.Lock()
+    c.LastMeaningfulActivity = time.Now()
+    c.mu.Unlock()
+    
+    if route.peer.pipe(data) {
+        atomic.AddInt64(&c.Hub.DirectMessages, 1)
+        atomic.AddInt64(&route.room.sentBytes, int64(len(data)))
+    } else if data[0] == directVideo {
+        atomic.AddInt64(&c.Hub.DroppedFrames, 1)
+        atomic.AddInt64(&route.room.framesDropped, 1)
+    }
+}
+
+// pipe queues data without blocking from any goroutine but the hub's, such
+// as a peer's ReadPump relaying direct media. Unlike the hub's own sends it
+// checks under sendMu that the hub hasn't closed Send in the meantime.
+func (c *Client) pipe(data []byte) bool {
+    c.sendMu.RLock()
+    defer c.sendMu.RUnlock()
+    if c.sendClosed {
+        return false
+    }
+    select {
+    case c.Send <- data:
+        return true
+    default:
+        return false
+    }
+}
+
+// allocateID returns a random id no other connection in the room holds
+func (h *Hub) allocateID(roomID string) string {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    ids := h.assignedIDs[roomID]
+    if ids == nil {
+        ids = make(map[string]bool)
+        h.assignedIDs[roomID] = ids
+    }
+    
+    buf := make([]byte, 8)
+    for {
+        rand.Read(buf)
+        id := "u-" + hex.EncodeToString(buf)
+        if !ids[id] {
+            ids[id] = true
+            return id
+        }
+    }
+}
+
+func (h *Hub) releaseID(roomID, id string) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    delete(h.assignedIDs[roomID], id)
+    if len(h.assignedIDs[roomID]) == 0 {
+        delete(h.assignedIDs, roomID)
+    }
+}
+
+// removeClient frees the client's slot unless a newer connection has taken it
+// over, handing the moderator role on if it held it, and closes it with code.
+// Reports whether it left.
+func (h *Hub) removeClient(room *Room, client *Client, code int, reason string) bool {
+    left, successor, remaining := room.unseat(client, code, reason)
+    if !left {
+        return false
+    }
+    webhooks.emit("participant-left", room.ID, client.ID, reason, remaining)
+    h.metrics.Count("clients.left", 1)
+    h.sendToOthers(room, Message{Type: "participant-left", From: client.ID, Text: reason}, client.ID)
+    h.endSource(room, client, "left")
+    h.setTyping(room, client.ID, false)
+    h.clearReactions(room, client.ID)
+    
+    // A spotlight on someone who left falls back to the grid
+    if room.forget(client.ID) {
+        h.sendToOthers(room, Message{Type: "layout-changed", Layout: &RoomLayout{Mode: "grid"}}, "")
+    }
+    
+    if successor != "" {
+        log.Printf("Room %s: moderator role passed to %s", room.ID, successor)
+        h.sendToOthers(room, Message{Type: "moderator-changed", Moderator: successor}, "")
+    }
+    if room.Recording != nil {
+        h.updateRecording(room)
+    }
+    h.updateDirect(room)
+    return true
+}
+
+// unseat frees the client's slot under the room lock, closing it with code,
+// and picks the oldest remaining participant as moderator if it was one
+func (r *Room) unseat(client *Client, code int, reason string) (left bool, successor string, remaining int) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    r.LastActivity = time.Now()
+    if current, ok := r.Clients[client.ID]; !ok || current != client {
+        return false, "", len(r.Clients)
+    }
+    delete(r.Clients, client.ID)
+    delete(r.VideoServed, client.ID)
+    client.closeSend(code, reason)
+    
+    if r.Moderator == client.ID {
+        r.Moderator = ""
+        var oldest *Client
+        for _, c := range r.Clients {
+            if c.Spectator && !c.ModToken {
+                continue
+            }
+            if oldest == nil || c.JoinedAt.Before(oldest.JoinedAt) {
+                oldest = c
+            }
+        }
+        if oldest != nil {
+            r.Moderator = oldest.ID
+            successor = oldest.ID
+        }
+    }
+    if len(r.Clients) == 0 {
+        r.Locked = false
+    }
+    return true, successor, len(r.Clients)
+}
+
+// forget drops a departed participant's mute state and reports whether the
+// spotlight was on it, in which case the layout is back to the grid
+func (r *Room) forget(id string) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    delete(r.Mutes, id)
+    if r.Layout.SpotlightID != id {
+        return false
+    }
+    r.Layout = RoomLayout{Mode: "grid"}
+    return true
+}
+
+// moderate runs a mute/unmute/kick/lock/unlock/set-layout command, honoured
+// only from the room's moderator
+func (h *Hub) moderate(room *Room, msg Message, from string) {
+    var sender, target *Client
+    isModerator := false
+    room.withRLock(func() {
+        sender, target = room.Clients[from], room.Clients[msg.Target]
+        isModerator = room.Moderator == from
+    })
+    
+    if sender == nil {
+        return
+    }
+    if !isModerator {
+        sender.sendError(ErrNotModerator, "only the room moderator can "+msg.Type, msg.Type)
+        return
+    }
+    
+    switch msg.Type {
+    case "lock", "unlock":
+        room.withLock(func() { room.Locked = msg.Type == "lock" })
+        log.Printf("Room %s %sed by %s", room.ID, msg.Type, from)
+        h.sendToOthers(room, Message{Type: "room-" + msg.Type + "ed", From: from}, "")
+        
+    case "mute", "unmute", "kick":
+        if target == nil || target == sender {
+            sender.sendError(ErrNoTarget, fmt.Sprintf("no other participant %q in room", msg.Target), msg.Type)
+            return
+        }
+        h.sanction(room, target, msg.Type, from)
+        
+    case "set-layout":
+        // messageRules only catch this while VALIDATE_MESSAGES is on
+        if msg.Layout == nil {
+            sender.sendError(ErrInvalid, "layout is required", msg.Type)
+            return
+        }
+        layout := *msg.Layout
+        if layout.Mode == "grid" {
+            layout.SpotlightID = ""
+        }
+        
+        present := false
+        room.withLock(func() {
+            _, present = room.Clients[layout.SpotlightID]
+            if layout.Mode != "spotlight" || present {
+                room.Layout = layout
+            }
+        })
+        if layout.Mode == "spotlight" && !present {
+            sender.sendError(ErrNoTarget, fmt.Sprintf("no participant %q to spotlight", layout.SpotlightID), msg.Type)
+            return
+        }
+        log.Printf("Room %s layout set to %s by %s", room.ID, layout.Mode, from)
+        h.sendToOthers(room, Message{Type: "layout-changed", From: from, Layout: &layout}, "")
+        
+    case "start-recording":
+        h.startRecording(room, sender)
+        
+    case "stop-recording":
+        h.stopRecording(room)
+    }
+}
+
+// sanction mutes, unmutes or kicks target and tells the room; from is the
+// moderator, or empty when an operator acts through the admin API
+func (h *Hub) sanction(room *Room, target *Client, action, from string) {
+    by := from
+    if by == "" {
+        by = "operator"
+    }
+    
+    if action == "kick" {
+        target.sendMessage(Message{Type: "kicked", From: from})
+        if h.removeClient(room, target, CloseKicked, "kicked") {
+            log.Printf("Client %s kicked from room %s by %s", target.ID, room.ID, by)
+            h.sendToOthers(room, Message{Type: "kicked", From: from, Target: target.ID}, "")
+        }
+        return
+    }
+    
+    target.Muted = action == "mute"
+    log.Printf("Client %s %sd in room %s by %s", target.ID, action, room.ID, by)
+    h.sendToOthers(room, Message{Type: action + "d", From: from, Target: target.ID}, "")
+    h.updateDirect(room)
+}
+
+// Recording consent
+//
+// start-recording from the moderator asks every participant for consent with
+// a recording-consent-request. The room's record log (RECORDINGS_DIR/<id>.jsonl,
+// exportable like any RECORD_LOG file) is only written while every current
+// participant has answered recording-consent with granted:true; otherwise
+// the recording is paused. recording-started and recording-paused announce
+// each transition, recording-stopped the end.
+
+// roomRecording is one room's record log and whether it is being written
+type roomRecording struct {
+    id     string
+    rec    *messageRecorder
+    active bool
+    seen   map[string]bool // Participants with a join line in the log
+}
+
+// recordingID names a room's recording file after the room and start time
+func recordingID(roomID string) string {
+    safe := strings.Map(func(r rune) rune {
+        if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+            return r
+        }
+        return '_'
+    }, roomID)
+    return fmt.Sprintf("%s-%d", safe, time.Now().Unix())
+}
+
+func (h *Hub) startRecording(room *Room, sender *Client) {
+    if recordingsDir == "" {
+        sender.sendError(ErrNoRecording, "server has no RECORDINGS_DIR", "start-recording")
+        return
+    }
+    if room.Recording != nil {
+        return
+    }
+    
+    id := recordingID(room.ID)
+    rec, err := newRecordingFile(filepath.Join(recordingsDir, id+".jsonl"))
+    if err != nil {
+        log.Printf("Room %s: failed to start recording: %v", room.ID, err)
+        sender.sendError(ErrNoRecording, "could not open recording", "start-recording")
+        return
+    }
+    room.Recording = &roomRecording{id: id, rec: rec, seen: make(map[string]bool)}
+    log.Printf("Room %s: recording %s requested by %s", room.ID, id, sender.ID)
+    
+    // Everyone is asked again, even those who consented to an earlier recording
+    for _, client := range room.members() {
+        client.RecordingConsent = false
+    }
+    h.sendToOthers(room, Message{Type: "recording-consent-request", From: sender.ID, Text: id}, "")
+    h.updateRecording(room)
+    h.updateDirect(room)
+}
+
+func (h *Hub) stopRecording(room *Room) {
+    recording := room.Recording
+    if recording == nil {
+        return
+    }
+    room.Recording = nil
+    recording.rec.Close()
+    log.Printf("Room %s: recording %s stopped", room.ID, recording.id)
+    h.sendToOthers(room, Message{Type: "recording-stopped", Text: recording.id}, "")
+    h.updateDirect(room)
+}
+
+func (h *Hub) setConsent(room *Room, from string, granted bool) {
+    client := room.client(from)
+    if client == nil {
+        return
+    }
+    client.RecordingConsent = granted
+    if room.Recording != nil {
+        h.updateRecording(room)
+    }
+}
+
+// updateRecording starts or pauses the recording as consent changes
+func (h *Hub) updateRecording(room *Room) {
+    recording := room.Recording
+    
+    clients := room.members()
+    waiting := 0
+    for _, client := range clients {
+        if !client.RecordingConsent {
+            waiting++
+        }
+    }
+    empty := len(clients) == 0
+    
+    active := waiting == 0 && !empty
+    if active == recording.active {
+        return
+    }
+    recording.active = active
+    
+    if active {
+        log.Printf("Room %s: recording %s started", room.ID, recording.id)
+        h.sendToOthers(room, Message{Type: "recording-started", Text: recording.id}, "")
+        return
+    }
+    log.Printf("Room %s: recording %s paused, %d without consent", room.ID, recording.id, waiting)
+    h.sendToOthers(room, Message{Type: "recording-paused", Text: fmt.Sprintf("waiting for consent from %d participants", waiting)}, "")
+}
+
+// recordMedia writes a relayed media message to the room's recording while
+// it is active, keyed by participant so exports can tell the streams apart
+func (h *Hub) recordMedia(room *Room, from string, data []byte) {
+    recording := room.Recording
+    if recording == nil || !recording.active {
+        return
+    }
+    if !recording.seen[from] {
+        recording.seen[from] = true
+        join, _ := json.Marshal(Message{Type: "join", ID: from, Room: room.ID})
+        recording.rec.write(replayEvent{Conn: from, Data: join})
+    }
+    recording.rec.write(replayEvent{Conn: from, Data: data})
+}
+
+// status counts rooms and clients for a readiness probe
+func (h *Hub) status() hubStatus {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    
+    status := hubStatus{Rooms: len(h.Rooms)}
+    for _, room := range h.Rooms {
+        status.Clients += room.size()
+    }
+    return status
+}
+
+// setTyping records a typing state change and relays it to the rest of the
+// room; repeats of the current state only refresh the expiry
+func (h *Hub) setTyping(room *Room, from string, typing bool) {
+    was := false
+    room.withLock(func() {
+        _, was = room.Typing[from]
+        if typing {
+            if room.Typing == nil {
+                room.Typing = make(map[string]time.Time)
+            }
+            room.Typing[from] = time.Now().Add(typingTimeout)
+        } else {
+            delete(room.Typing, from)
+        }
+    })
+    
+    if was == typing {
+        return
+    }
+    
+    msgType := "typing-stop"
+    if typing {
+        msgType = "typing-start"
+    }
+    h.sendToOthers(room, Message{Type: msgType, From: from, Timestamp: time.Now().UnixMilli()}, from)
+}
+
+// expireTyping stops indicators whose client went quiet
+func (h *Hub) expireTyping() {
+    now := time.Now()
+    for _, room := range h.openRooms() {
+        var expired []string
+        room.withRLock(func() {
+            for id, until := range room.Typing {
+                if now.After(until) {
+                    expired = append(expired, id)
+                }
+            }
+        })
+        
+        for _, id := range expired {
+            h.setTyping(room, id, false)
+        }
+    }
+}
+
+// activeReaction is a client's current emoji and how often it was repeated
+// within reactionTTL
+type activeReaction struct {
+    Kind  string
+    Count int
+    Until time.Time
+}
+
+// react applies a reaction message: hands are room state every participant
+// is told about once per change, emoji are relayed once per TTL window
+func (h *Hub) react(room *Room, from, kind string) {
+    switch {
+    case kind == "raise-hand" || kind == "lower-hand":
+        h.setHand(room, from, kind == "raise-hand")
+        
+    case reactions[kind]:
+        now := time.Now()
+        repeat := false
+        room.withLock(func() {
+            if room.Reactions == nil {
+                room.Reactions = make(map[string]*activeReaction)
+            }
+            active := room.Reactions[from]
+            repeat = active != nil && active.Kind == kind && now.Before(active.Until)
+            if repeat {
+                active.Count++
+            } else {
+                active = &activeReaction{Kind: kind, Count: 1}
+                room.Reactions[from] = active
+            }
+            active.Until = now.Add(reactionTTL)
+        })
+        
+        if !repeat {
+            h.sendToOthers(room, Message{Type: "reaction", From: from, Reaction: kind, Timestamp: now.UnixMilli()}, from)
+        }
+        
+    default:
+        if sender := room.client(from); sender != nil {
+            sender.sendError(ErrBadReaction, fmt.Sprintf("reaction %q is not raise-hand, lower-hand or a known emoji", kind), "reaction")
+        }
+    }
+}
+
+// setHand raises or lowers a hand and relays the change to everyone,
+// including the sender so their own UI follows the server
+func (h *Hub) setHand(room *Room, from string, raised bool) {
+    was := false
+    room.withLock(func() {
+        _, was = room.Hands[from]
+        if raised && !was {
+            if room.Hands == nil {
+                room.Hands = make(map[string]time.Time)
+            }
+            room.Hands[from] = time.Now()
+        } else if !raised {
+            delete(room.Hands, from)
+        }
+    })
+    
+    if was == raised {
+        return
+    }
+    
+    kind := "lower-hand"
+    if raised {
+        kind = "raise-hand"
+    }
+    h.sendToOthers(room, Message{Type: "reaction", From: from, Reaction: kind, Timestamp: time.Now().UnixMilli()}, "")
+}
+
+// clearReactions drops a leaving client's hand and emoji
+func (h *Hub) clearReactions(room *Room, id string) {
+    h.setHand(room, id, false)
+    room.withLock(func() { delete(room.Reactions, id) })
+}
+
+// expireReactions lowers hands left up past handTimeout and forgets
+// emoji past their TTL
+func (h *Hub) expireReactions() {
+    now := time.Now()
+    for _, room := range h.openRooms() {
+        var expired []string
+        room.withLock(func() {
+            for id, raised := range room.Hands {
+                if now.Sub(raised) > handTimeout {
+                    expired = append(expired, id)
+                }
+            }
+            for id, active := range room.Reactions {
+                if now.After(active.Until) {
+                    delete(room.Reactions, id)
+                }
+            }
+        })
+        
+        for _, id := range expired {
+            h.setHand(room, id, false)
+        }
+    }
+}
+
+// setMuteState records what a client says it muted and relays the full state
+// to everyone, the sender included, whenever it changes
+func (h *Hub) setMuteState(room *Room, from string, msg Message) {
+    var was, state MuteState
+    room.withLock(func() {
+        was = room.Mutes[from]
+        state = was
+        if msg.Audio != nil {
+            state.Audio = *msg.Audio
+        }
+        if msg.Video != nil {
+            state.Video = *msg.Video
+        }
+        if state.Audio || state.Video {
+            if room.Mutes == nil {
+                room.Mutes = make(map[string]MuteState)
+            }
+            room.Mutes[from] = state
+        } else {
+            delete(room.Mutes, from)
+        }
+    })
+    
+    if state == was {
+        return
+    }
+    h.sendToOthers(room, Message{Type: "mute-state", From: from, Audio: &state.Audio, Video: &state.Video, Timestamp: time.Now().UnixMilli()}, "")
+    h.updateDirect(room)
+}
+
+// muteStates copies the room's self-reported mutes for a welcome
+func (r *Room) muteStates() map[string]MuteState {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    
+    if len(r.Mutes) == 0 {
+        return nil
+    }
+    mutes := make(map[string]MuteState, len(r.Mutes))
+    for id, state := range r.Mutes {
+        mutes[id] = state
+    }
+    return mutes
+}
+
+// displayNames maps each participant who gave a display name to it
+func (r *Room) displayNames() map[string]string {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    
+    var names map[string]string
+    for id, client := range r.Clients {
+        if client.DisplayName == "" {
+            continue
+        }
+        if names == nil {
+            names = make(map[string]string)
+        }
+        names[id] = client.DisplayName
+    }
+    return names
+}
+
+// raisedHands lists raised hands oldest first, the order they'd be called on
+func (r *Room) raisedHands() []string {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    
+    hands := make([]string, 0, len(r.Hands))
+    for id := range r.Hands {
+        hands = append(hands, id)
+    }
+    sort.Slice(hands, func(i, j int) bool { return r.Hands[hands[i]].Before(r.Hands[hands[j]]) })
+    return hands
+}
+
+// sendToOthers delivers a control message to everyone in the room but from
+func (h *Hub) sendToOthers(room *Room, msg Message, from string) {
+    data, err := json.Marshal(msg)
+    if err != nil {
+        return
+    }
+    
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    
+    for id, client := range room.Clients {
+        if id == from {
+            continue
+        }
+        select {
+        case client.Send <- data:
+        default:
+        }
+    }
+}
+
+// opaqueMedia reports whether media in an e2ee room carries its encryption
+// header; plaintext is refused so it never leaks into the room
+func (h *Hub) opaqueMedia(sender *Client, msg Message) bool {
+    if msg.Encrypted && msg.KeyID != "" {
+        atomic.AddInt64(&h.EncryptedBytes, int64(opaqueSize(msg.Data)))
+        return true
+    }
+    if sender != nil {
+        sender.sendError(ErrNotEncrypted, "media in an e2ee room needs encrypted and keyId", msg.Type)
+    }
+    return false
+}
+
+// opaqueSize is the byte length of base64 data without decoding it
+func opaqueSize(data string) int {
+    return base64.StdEncoding.DecodedLen(len(data)) - (len(data) - len(strings.TrimRight(data, "=")))
+}
+
+// relayOpaqueVideo hands an encrypted frame to the room's drop strategy as is;
+// FrameSize is the ciphertext size so receivers' loss accounting still works
+func (h *Hub) relayOpaqueVideo(room *Room, msg Message, from string, userCount int) {
+    msg.From = from
+    msg.FrameSize = opaqueSize(msg.Data)
+    h.distributeVideo(&encodeJob{room: room, msg: msg, from: from, userCount: userCount})
+}
+
+// relayKeyAnnounce forwards key material to Target, or to everyone without one
+func (h *Hub) relayKeyAnnounce(room *Room, msg Message, from string) {
+    var sender, target *Client
+    hasTarget := false
+    room.withRLock(func() {
+        sender = room.Clients[from]
+        target, hasTarget = room.Clients[msg.Target]
+    })
+    if sender == nil {
+        return
+    }
+    if !room.Encrypted {
+        sender.sendError(ErrNotEncrypted, fmt.Sprintf("room %s is not end-to-end encrypted", room.ID), msg.Type)
+        return
+    }
+    
+    msg.From = from
+    if msg.Target == "" {
+        h.sendToOthers(room, msg, from)
+        return
+    }
+    if !hasTarget {
+        sender.sendError(ErrNoTarget, fmt.Sprintf("no participant %q in room", msg.Target), msg.Type)
+        return
+    }
+    target.sendMessage(msg)
+}
+
+// relayApp passes an app message to its target, or to everyone else when it
+// has none; the server never looks inside the payload
+func (h *Hub) relayApp(room *Room, msg Message, from string) {
+    var sender, target *Client
+    hasTarget := false
+    room.withRLock(func() {
+        sender = room.Clients[from]
+        target, hasTarget = room.Clients[msg.Target]
+    })
+    if sender == nil {
+        return
+    }
+    
+    out := Message{Type: "app", From: from, Channel: msg.Channel, Payload: msg.Payload}
+    if msg.Target == "" {
+        h.sendToOthers(room, out, from)
+        return
+    }
+    if !hasTarget {
+        sender.sendError(ErrNoTarget, fmt.Sprintf("no participant %q in room", msg.Target), msg.Type)
+        return
+    }
+    target.sendMessage(out)
+}
+
+// requestKeyframe forwards a receiver's keyframe-request to the source it
+// lost its place in. Transcoded frames are whole images already, so this is
+// for e2ee rooms and direct relays, where the sender's encoder may send deltas.
+func (h *Hub) requestKeyframe(room *Room, receiver, source string) {
+    var requester, target *Client
+    ok := false
+    room.withRLock(func() {
+        requester = room.Clients[receiver]
+        target, ok = room.Clients[source]
+    })
+    if requester == nil {
+        return
+    }
+    if !ok || source == receiver {
+        requester.sendError(ErrNoTarget, fmt.Sprintf("no participant %q in room", source), "keyframe-request")
+        return
+    }
+    atomic.AddInt64(&h.KeyframeRequests, 1)
+    target.sendMessage(Message{Type: "keyframe-request", From: receiver})
+}
+
+// resume brings a reconnected client's view back in line: each source it
+// watches is asked for a keyframe so its decoders restart on a whole frame,
+// and the room layout and its own fps cap go out again as the events it
+// would have had on the old connection
+func (h *Hub) resume(room *Room, client *Client) {
+    var layout RoomLayout
+    var userCount int
+    var sources []*Client
+    room.withRLock(func() {
+        layout = room.Layout
+        userCount = room.senderCount()
+        if !room.AudioOnly {
+            for id, source := range room.Clients {
+                if id != client.ID && !source.Spectator && client.wantsVideo(id) {
+                    sources = append(sources, source)
+                }
+            }
+        }
+    })
+    
+    for _, source := range sources {
+        source.sendMessage(Message{Type: "keyframe-request", From: client.ID})
+    }
+    atomic.AddInt64(&h.KeyframeRequests, int64(len(sources)))
+    
+    client.sendMessage(Message{Type: "layout-changed", Layout: &layout})
+    if !client.Spectator {
+        maxFps := maxSenderFPS(userCount)
+        client.hintFPS(maxFps)
+        client.sendMessage(Message{Type: "fps-limit", MaxFPS: maxFps})
+    }
+    log.Printf("Client %s resumed in room %s, keyframes requested from %d sources", client.ID, room.ID, len(sources))
+}
+
+// reapIdleRooms drops rooms that have been empty for longer than roomTTL
+func (h *Hub) reapIdleRooms() {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    
+    for id, room := range h.Rooms {
+        expired := false
+        room.withRLock(func() { expired = len(room.Clients) == 0 && time.Since(room.LastActivity) > roomTTL })
+        if expired {
+            h.dropRoom(room, "idle")
+            log.Printf("Room %s reaped after %s idle", id, roomTTL)
+        }
+    }
+}
+
+// evictEmptyRoom drops the oldest-created room nobody is in to make space
+// under MAX_ROOMS; caller holds h.mu. Reports whether one was found.
+func (h *Hub) evictEmptyRoom() bool {
+    var oldest *Room
+    for _, room := range h.Rooms {
+        if room.size() == 0 && (oldest == nil || room.CreatedAt.Before(oldest.CreatedAt)) {
+            oldest = room
+        }
+    }
+    if oldest == nil {
+        return false
+    }
+    h.dropRoom(oldest, "evicted")
+    log.Printf("Room %s evicted: %d rooms open", oldest.ID, maxRooms)
+    return true
+}
+
+// dropRoom forgets an empty room, reason being idle or evicted; caller holds h.mu
+func (h *Hub) dropRoom(room *Room, reason string) {
+    if room.Recording != nil {
+        room.Recording.rec.Close()
+    }
+    delete(h.Rooms, room.ID)
+    webhooks.emit("room-destroyed", room.ID, "", reason, 0)
+    h.metrics.Count("rooms.destroyed", 1)
+}
+
+func (h *Hub) handleBroadcast(bcast *BroadcastMessage) {
+    room := h.room(bcast.Room)
+    if room == nil {
+        return
+    }
+    
+    var msg Message
+    json.Unmarshal(bcast.Message, &msg)
+    
+    atomic.AddInt64(&h.TotalMessages, 1)
+    
+    // ReadPump only relays known types, so the names stay a fixed set
+    h.metrics.Count("messages."+msg.Type, 1)
+    defer func(start time.Time) { h.metrics.Timing("broadcast", time.Since(start)) }(time.Now())
+    
+    var userCount int
+    room.withLock(func() {
+        userCount = room.senderCount()
+        room.LastActivity = time.Now()
+    })
+    
+    // Spectators are served by distributeVideo but never shape the ladder or strategy
+    if userCount == 0 {
+        return
+    }
+    
+    // A control message resent after a reconnect is dropped if it got through before
+    if !room.firstDelivery(bcast.From, msg) {
+        atomic.AddInt64(&h.DuplicateMessages, 1)
+        return
+    }
+    
+    switch msg.Type {
+    case "audio-chunk":
+        // Audio always gets through, unless the moderator muted the sender.
+        // A client that said it muted itself shouldn't be sending any, so
+        // whatever a buggy one still sends goes no further.
+        var sender *Client
+        selfMuted := false
+        room.withRLock(func() {
+            sender = room.Clients[bcast.From]
+            selfMuted = room.Mutes[bcast.From].Audio
+        })
+        if sender != nil && sender.Muted {
+            return
+        }
+        if selfMuted {
+            atomic.AddInt64(&h.MutedDropped, 1)
+            return
+        }
+        if room.Encrypted && !h.opaqueMedia(sender, msg) {
+            return
+        }
+        if sender != nil {
+            sender.LastSpokeAt = time.Now()
+        }
+        h.recordMedia(room, bcast.From, bcast.Message)
+        msg.Seq = room.nextSeq(bcast.From, true)
+        if room.Echo {
+            h.echoBack(room, msg, bcast.From)
+        } else {
+            h.distributeAudio(room, msg, bcast.From)
+        }
+        
+    case "video-frame":
+        // Audio-only rooms never reach the encoder pool
+        if room.AudioOnly {
+            atomic.AddInt64(&room.VideoDropped, 1)
+            room.traceDrop(bcast.From, 0, dropAudioOnly)
+            return
+        }
+        
+        // Camera off by the sender's own mute-state
+        selfMuted := false
+        room.withRLock(func() { selfMuted = room.Mutes[bcast.From].Video })
+        if selfMuted {
+            atomic.AddInt64(&h.MutedDropped, 1)
+            room.traceDrop(bcast.From, 0, dropMuted)
+            return
+        }
+        
+        // Throttle the source before spending any encoder time on it
+        if !h.acceptFrame(room, bcast.From, userCount) {
+            atomic.AddInt64(&h.ThrottledFrames, 1)
+            room.traceDrop(bcast.From, 0, dropThrottled)
+            return
+        }
+        
+        sender := room.client(bcast.From)
+        if sender != nil {
+            h.startSource(room, sender)
+        }
+        
+        h.recordMedia(room, bcast.From, bcast.Message)
+        msg.ServerTime = time.Now().UnixMilli()
+        
+        // Ciphertext can't be decoded, so it skips the encoder pool and layers
+        if room.Encrypted {
+            if h.opaqueMedia(sender, msg) {
+                msg.Seq = room.nextSeq(bcast.From, false)
+                h.relayOpaqueVideo(room, msg, bcast.From, userCount)
+            }
+            return
+        }
+        
+        // Compress with WebP and distribute smartly
+        msg.Seq = room.nextSeq(bcast.From, false)
+        h.distributeVideoWebP(room, msg, bcast.From, userCount)
+        
+    case "feedback":
+        // Loss reports stay on the server
+        if msg.Feedback != nil {
+            room.recordLoss(msg.Feedback)
+        }
+        
+    case "typing-start", "typing-stop":
+        h.setTyping(room, bcast.From, msg.Type == "typing-start")
+        
+    case "layer-request":
+        h.setLayer(room, bcast.From, msg)
+        
+    case "key-announce":
+        h.relayKeyAnnounce(room, msg, bcast.From)
+        
+    case "recording-consent":
+        h.setConsent(room, bcast.From, msg.Granted)
+        
+    case "reaction":
+        h.react(room, bcast.From, msg.Reaction)
+        
+    case "subscribe-video":
+        h.subscribeVideo(room, bcast.From, msg.IDs)
+        
+    case "app":
+        h.relayApp(room, msg, bcast.From)
+        
+    case "keyframe-request":
+        h.requestKeyframe(room, bcast.From, msg.Target)
+        
+    case "mute-state":
+        h.setMuteState(room, bcast.From, msg)
+        
+    case "mute", "unmute", "kick", "lock", "unlock", "start-recording", "stop-recording", "set-layout":
+        h.moderate(room, msg, bcast.From)
+    }
+}
+
+func (h *Hub) distributeAudio(room *Room, msg Message, from string) {
+    // Every receiver gets the same bytes, so marshal once
+    msg.From = from
+    data, err := json.Marshal(msg)
+    if err != nil {
+        return
+    }
+    
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    
+    // Audio goes to everyone except sender
+    now := time.Now()
+    for id, client := range room.Clients {
+        if id == from {
+            continue
+        }
+        
+        // Mark audio priority
+        client.markAudio(now)
+        
+        select {
+        case client.Send <- data:
+            atomic.AddInt64(&room.sentBytes, int64(len(data)))
+        default:
+            // Only drop if buffer truly full
+        }
+    }
+}
+
+// Simulcast layers group receivers' requested tile widths; each layer is
+// encoded at the largest width requested within it, so it satisfies them all
+var layerBuckets = []uint{80, 160, 320, 640, 1280}
+
+// layerFor maps a requested width to its layer, 0 meaning the full-size frame
+func layerFor(maxWidth, fullWidth uint) uint {
+    if maxWidth == 0 || maxWidth >= fullWidth {
+        return 0
+    }
+    for _, bucket := range layerBuckets {
+        if maxWidth <= bucket {
+            return bucket
+        }
+    }
+    return maxWidth
+}
+
+// newEncodeJob records which layer each receiver wants this sender's frame in
+func (h *Hub) newEncodeJob(room *Room, msg Message, from string, userCount int) *encodeJob {
+    job := &encodeJob{room: room, msg: msg, from: from, userCount: userCount}
+    fullWidth := ladderStep(userCount).Width
+    
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    
+    for id, client := range room.Clients {
+        layer := layerFor(client.Layers[from], fullWidth)
+        if id == from || layer == 0 || !client.wantsVideo(from) {
+            continue
+        }
+        if job.layerOf == nil {
+            job.layerOf = make(map[string]uint)
+            job.layers = make(map[uint]uint)
+        }
+        job.layerOf[id] = layer
+        job.layers[layer] = max(job.layers[layer], client.Layers[from])
+    }
+    return job
+}
+
+// subscribeVideo replaces a receiver's video subscriptions; nil ids go back
+// to receiving every source
+func (h *Hub) subscribeVideo(room *Room, receiver string, ids []string) {
+    client := room.client(receiver)
+    if client == nil {
+        return
+    }
+    
+    var subs map[string]bool
+    if ids != nil {
+        subs = make(map[string]bool, len(ids))
+        for _, id := range ids {
+            subs[id] = true
+        }
+    }
+    client.mu.Lock()
+    defer client.mu.Unlock()
+    client.VideoSubs = subs
+}
+
+// wantsVideo reports whether this receiver subscribes to from's video
+func (c *Client) wantsVideo(from string) bool {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    return c.VideoSubs == nil || c.VideoSubs[from]
+}
+
+// videoWanted reports whether anyone besides from subscribes to its video;
+// caller holds r.mu
+func (r *Room) videoWanted(from string) bool {
+    for id, client := range r.Clients {
+        if id != from && client.wantsVideo(from) {
+            return true
+        }
+    }
+    return false
+}
+
+// setLayer stores a receiver's tile width for one source
+func (h *Hub) setLayer(room *Room, receiver string, msg Message) {
+    client := room.client(receiver)
+    if client == nil || msg.SourceID == "" || msg.SourceID == receiver {
+        return
+    }
+    if msg.MaxWidth == 0 {
+        delete(client.Layers, msg.SourceID)
+        return
+    }
+    if client.Layers == nil {
+        client.Layers = make(map[string]uint)
+    }
+    client.Layers[msg.SourceID] = msg.MaxWidth
+}
+
+// distributeVideoWebP hands the frame to an encoder worker without blocking the hub.
+// Frames from one sender always go to the same worker so their order is kept.
+func (h *Hub) distributeVideoWebP(room *Room, msg Message, from string, userCount int) {
+    hash := fnv.New32a()
+    hash.Write([]byte(from))
+    queue := h.encodeQueues[hash.Sum32()%uint32(len(h.encodeQueues))]
+    
+    // Nobody has this source on screen, so don't spend an encode on it
+    wanted := false
+    room.withRLock(func() { wanted = room.Echo || room.videoWanted(from) })
+    if !wanted {
+        room.traceDrop(from, msg.Seq, dropNotSubscribed)
+        return
+    }
+    
+    // Encoder saturated, shed the frame rather than stall audio. Checking
+    // first keeps a full queue from paying for the receiver walk in newEncodeJob.
+    if len(queue) < cap(queue) {
+        select {
+        case queue <- h.newEncodeJob(room, msg, from, userCount):
+            return
+        default:
+        }
+    }
+    atomic.AddInt64(&h.EncodeDropped, 1)
+    room.traceDrop(from, msg.Seq, dropEncoderBusy)
+}
+
+func (h *Hub) encodeWorker(queue chan *encodeJob) {
+    for job := range queue {
+        // Decode and compress with the configured codec
+        frameData, err := base64.StdEncoding.DecodeString(job.msg.Data)
+        var compressed []byte
+        if err == nil {
+            start := time.Now()
+            compressed, job.variants, err = webpCompressFrame(frameData, job.userCount, job.layers)
+            h.metrics.Timing("encode", time.Since(start))
+        } else {
+            err = fmt.Errorf("%w: %v", errBadFrame, err)
+        }
+        h.trackFrame(job, frameData, err)
+        if err != nil {
+            job.room.traceDrop(job.from, job.msg.Seq, dropUndecodable)
+            continue
+        }
+        
+        // Update message with compressed data
+        job.msg.Data = base64.StdEncoding.EncodeToString(compressed)
+        job.msg.FrameSize = len(compressed)
+        job.msg.From = job.from
+        job.msg.CompressionType = frameCodec.Name()
+        
+        h.encoded <- job
+    }
+}
+
+// trackFrame counts a sender's consecutive bad frames and acts on the limit.
+// Encode failures are the server's problem and don't count against the sender.
+func (h *Hub) trackFrame(job *encodeJob, data []byte, err error) {
+    if err != nil && !errors.Is(err, errBadFrame) {
+        atomic.AddInt64(&h.EncodeFailures, 1)
+        log.Printf("Dropping frame from %s: %v", job.from, err)
+        return
+    }
+    
+    sender := job.room.client(job.from)
+    if sender == nil {
+        return
+    }
+    
+    if err == nil {
+        sender.badFrames = 0
+        return
+    }
+    if errors.Is(err, errOversizedFrame) {
+        h.trackOversized(job, sender, data, err)
+        return
+    }
+    
+    atomic.AddInt64(&h.DecodeFailures, 1)
+    sender.badFrames++
+    if sender.badFrames == 1 || sender.badFrames == badFrameLimit {
+        log.Printf("Dropping frame from %s in room %s: %v (detected %s, %d bytes, %d in a row)",
+            job.from, job.room.ID, err, http.DetectContentType(data), len(data), sender.badFrames)
+    }
+    if sender.badFrames != badFrameLimit {
+        return
+    }
+    
+    sender.sendError(ErrBadFrame, fmt.Sprintf("%d consecutive video frames could not be decoded", sender.badFrames), "video-frame")
+    if disconnectOnBadFrames {
+        log.Printf("Disconnecting %s after %d bad frames", job.from, sender.badFrames)
+        disconnectSender(sender, "bad-frames")
+    }
+}
+
+// trackOversized counts a sender's oversized frames, which a working
+// encoder never produces, and disconnects it at the limit
+func (h *Hub) trackOversized(job *encodeJob, sender *Client, data []byte, err error) {
+    atomic.AddInt64(&h.OversizedFrames, 1)
+    sender.oversizedFrames++
+    if sender.oversizedFrames == 1 {
+        log.Printf("Refusing frame from %s in room %s: %v (%d bytes)", job.from, job.room.ID, err, len(data))
+    }
+    if sender.oversizedFrames != badFrameLimit {
+        return
+    }
+    
+    sender.sendError(ErrBadFrame, fmt.Sprintf("%d video frames exceeded the size limit", sender.oversizedFrames), "video-frame")
+    log.Printf("Disconnecting %s after %d oversized frames", job.from, sender.oversizedFrames)
+    disconnectSender(sender, "oversized-frames")
+}
+
+// disconnectSender closes a sender for a policy violation, giving WritePump
+// a moment to deliver the error first
+func disconnectSender(sender *Client, reason string) {
+    time.AfterFunc(time.Second, func() {
+        sender.Conn.WriteControl(websocket.CloseMessage,
+            websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(writeTimeout))
+        sender.Conn.Close()
+    })
+}
+
+// maxSenderFPS splits the room's fps budget across its participants
+func maxSenderFPS(userCount int) int {
+    fps := roomFPSBudget / userCount
+    if fps > 30 {
+        fps = 30
+    }
+    if fps < 2 {
+        fps = 2
+    }
+    return fps
+}
+
+// acceptFrame enforces the per-sender fps cap and tells throttled senders
+// the cap, at most every 5s or whenever it changes
+func (h *Hub) acceptFrame(room *Room, from string, userCount int) bool {
+    sender := room.client(from)
+    if sender == nil {
+        return false
+    }
+    
+    maxFps := maxSenderFPS(userCount)
+    now := time.Now()
+    
+    sender.mu.Lock()
+    defer sender.mu.Unlock()
+    
+    // Allow 10% jitter so a sender exactly at the cap isn't clipped
+    minInterval := time.Second * 9 / time.Duration(maxFps*10)
+    accepted := now.Sub(sender.LastVideoAccepted) >= minInterval
+    if accepted {
+        sender.LastVideoAccepted = now
+    }
+    
+    capChanged := sender.FPSHint != 0 && sender.FPSHint != maxFps
+    if capChanged || (!accepted && now.Sub(sender.LastFPSHint) > 5*time.Second) {
+        sender.FPSHint = maxFps
+        sender.LastFPSHint = now
+        if data, err := json.Marshal(Message{Type: "fps-limit", MaxFPS: maxFps}); err == nil {
+            select {
+            case sender.Send <- data:
+            default:
+            }
+        }
+    }
+    return accepted
+}
+
+// distributeVideo fans an encoded frame out to the room; runs on the hub goroutine
+func (h *Hub) distributeVideo(job *encodeJob) {
+    room, msg, from, userCount := job.room, job.msg, job.from, job.userCount
+    
+    room.mu.RLock()
+    defer room.mu.RUnlock()
+    
+    // The encode is what an echo test checks, so the full frame comes back
+    if room.Echo {
+        if sender := room.Clients[from]; sender != nil {
+            sender.echo(msg)
+        }
+        return
+    }
+    
+    // One marshal per layer, not per receiver
+    encoded := make(map[uint][]byte)
+    frameFor := func(id string) ([]byte, error) {
+        layer := job.layerOf[id]
+        if _, ok := job.variants[layer]; !ok {
+            layer = 0
+        }
+        if data, ok := encoded[layer]; ok {
+            return data, nil
+        }
+        
+        variant := msg
+        if layer != 0 {
+            variant.Data = base64.StdEncoding.EncodeToString(job.variants[layer])
+            variant.FrameSize = len(job.variants[layer])
+        }
+        data, err := json.Marshal(variant)
+        if err == nil {
+            encoded[layer] = data
+        }
+        return data, err
+    }
+    
+    // Only built while the room is traced
+    var entry *traceEntry
+    trace := room.trace.Load()
+    if trace != nil {
+        entry = room.newTraceEntry(from, msg.Seq)
+        defer trace.add(entry)
+    }
+    
+    // Spectators get every frame; the strategy below only splits frames among senders
+    for id, client := range room.Clients {
+        if !client.Spectator || id == from {
+            continue
+        }
+        if !client.wantsVideo(from) {
+            entry.drop(id, dropNotSubscribed)
+            continue
+        }
+        if data, err := frameFor(id); err == nil {
+            select {
+            case client.Send <- data:
+                room.countFrame(len(data))
+                entry.deliver(id)
+            default:
+                atomic.AddInt64(&h.DroppedFrames, 1)
+                atomic.AddInt64(&room.framesDropped, 1)
+                entry.drop(id, dropBufferFull)
+            }
+        }
+    }
+    
+    // The room's strategy splits frames among the other senders that
+    // subscribe to this one; the rest were never meant to get it
+    receivers := make([]*Client, 0, len(room.Clients))
+    for id, client := range room.Clients {
+        if id == from || client.Spectator {
+            continue
+        }
+        if !client.wantsVideo(from) {
+            entry.drop(id, dropNotSubscribed)
+            continue
+        }
+        receivers = append(receivers, client)
+    }
+    if len(receivers) == 0 {
+        return
+    }
+    
+    selected := room.Strategy.Select(room, from, receivers, userCount)
+    sent := make(map[string]bool, len(selected))
+    for _, client := range selected {
+        sent[client.ID] = true
+        if data, err := frameFor(client.ID); err == nil {
+            room.serveVideo(client.ID, len(data))
+            select {
+            case client.Send <- data:
+                room.countFrame(len(data))
+                entry.deliver(client.ID)
+            default:
+                atomic.AddInt64(&h.DroppedFrames, 1)
+                atomic.AddInt64(&room.framesDropped, 1)
+                entry.drop(client.ID, dropBufferFull)
+            }
+        }
+    }
+    
+    // Count unsent as dropped
+    atomic.AddInt64(&h.DroppedFrames, int64(len(receivers)-len(selected)))
+    atomic.AddInt64(&room.framesDropped, int64(len(receivers)-len(selected)))
+    if entry != nil {
+        for _, client := range receivers {
+            if !sent[client.ID] {
+                entry.drop(client.ID, dropFrameSkip)
+            }
+        }
+    }
+}
+
+// countFrame records one video frame queued to a receiver
+func (r *Room) countFrame(size int) {
+    atomic.AddInt64(&r.sentBytes, int64(size))
+    atomic.AddInt64(&r.framesSent, 1)
+}
+
+// seriesLength is how many one-second samples each room keeps, five minutes
+const seriesLength = 300
+
+// roomSample is one second of a room
+type roomSample struct {
+    Time         int64   `json:"time"` // Unix ms
+    Participants int     `json:"participants"`
+    BitrateKbps  float64 `json:"bitrateKbps"` // Audio and video queued to receivers
+    DropRate     float64 `json:"dropRate"`    // Percent of video deliveries dropped
+}
+
+// roomSeries is a fixed ring of a room's recent samples; the hub adds to it
+// and /rooms/{name}/timeseries reads it
+type roomSeries struct {
+    mu      sync.Mutex
+    samples [seriesLength]roomSample
+    next    int
+    count   int
+    
+    // Counter values at the previous sample, to turn totals into rates
+    lastAt      time.Time
+    lastBytes   int64
+    lastSent    int64
+    lastDropped int64
+}
+
+// add appends a sample from the room's running totals; the first call only
+// sets the baseline
+func (s *roomSeries) add(now time.Time, participants int, bytes, sent, dropped int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if !s.lastAt.IsZero() {
+        sample := roomSample{Time: now.UnixMilli(), Participants: participants}
+        if elapsed := now.Sub(s.lastAt).Seconds(); elapsed > 0 {
+            sample.BitrateKbps = float64(bytes-s.lastBytes) * 8 / 1000 / elapsed
+        }
+        if deliveries := (sent - s.lastSent) + (dropped - s.lastDropped); deliveries > 0 {
+            sample.DropRate = 100 * float64(dropped-s.lastDropped) / float64(deliveries)
+        }
+        s.samples[s.next] = sample
+        s.next = (s.next + 1) % seriesLength
+        s.count = min(s.count+1, seriesLength)
+    }
+    s.lastAt, s.lastBytes, s.lastSent, s.lastDropped = now, bytes, sent, dropped
+}
+
+// snapshot returns the samples oldest first
+func (s *roomSeries) snapshot() []roomSample {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    samples := make([]roomSample, 0, s.count)
+    start := (s.next - s.count + seriesLength) % seriesLength
+    for i := 0; i < s.count; i++ {
+        samples = append(samples, s.samples[(start+i)%seriesLength])
+    }
+    return samples
+}
+
+// sampleRooms adds this second to every room's series
+func (h *Hub) sampleRooms() {
+    now := time.Now()
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    
+    for _, room := range h.Rooms {
+        room.Series.add(now, room.size(), atomic.LoadInt64(&room.sentBytes),
+            atomic.LoadInt64(&room.framesSent), atomic.LoadInt64(&room.framesDropped))
+    }
+}
+
+// maxTraceEntries bounds each traced room's ring of routing decisions
+const maxTraceEntries = 256
+
+// Why a traced frame missed a receiver, or the whole room
+const (
+    dropBufferFull    = "buffer-full"    // Receiver's send queue was full
+    dropFrameSkip     = "frame-skip"     // The room's drop strategy picked other receivers
+    dropNotSubscribed = "not-subscribed" // subscribe-video leaves this sender out
+    dropThrottled     = "throttled"      // Over the sender's fps cap
+    dropAudioOnly     = "audio-only"
+    dropMuted         = "muted"          // The sender's mute-state has video muted
+    dropEncoderBusy   = "encoder-busy"
+    dropUndecodable   = "undecodable"
+)
+
+// traceEntry is one video frame's routing: who it was meant for, who got it
+// and why the rest didn't. Reason is set when the frame never reached fan-out.
+type traceEntry struct {
+    Time      int64             `json:"time"`
+    From      string            `json:"from"`
+    Seq       int               `json:"seq,omitempty"`
+    Intended  []string          `json:"intended"`
+    Delivered []string          `json:"delivered"`
+    Dropped   map[string]string `json:"dropped,omitempty"`
+    Reason    string            `json:"reason,omitempty"`
+}
+
+// deliver and drop are no-ops on a nil entry, so untraced rooms pay one check
+func (e *traceEntry) deliver(id string) {
+    if e != nil {
+        e.Delivered = append(e.Delivered, id)
+    }
+}
+
+func (e *traceEntry) drop(id, reason string) {
+    if e == nil {
+        return
+    }
+    if e.Dropped == nil {
+        e.Dropped = make(map[string]string)
+    }
+    e.Dropped[id] = reason
+}
+
+// frameTrace is a ring of a room's most recent traceEntries; the hub and the
+// encoder workers add to it while /debug/trace reads it
+type frameTrace struct {
+    mu      sync.Mutex
+    entries []*traceEntry
+    next    int
+    total   int64
+}
+
+func (t *frameTrace) add(e *traceEntry) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if len(t.entries) < maxTraceEntries {
+        t.entries = append(t.entries, e)
+    } else {
+        t.entries[t.next] = e
+    }
+    t.next = (t.next + 1) % maxTraceEntries
+    t.total++
+}
+
+// snapshot returns the ring oldest first and how many entries were ever added
+func (t *frameTrace) snapshot() ([]*traceEntry, int64) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if len(t.entries) < maxTraceEntries {
+        return append([]*traceEntry(nil), t.entries...), t.total
+    }
+    return append(append([]*traceEntry(nil), t.entries[t.next:]...), t.entries[:t.next]...), t.total
+}
+
+// newTraceEntry starts an entry meant for everyone in the room but from;
+// caller holds r.mu
+func (r *Room) newTraceEntry(from string, seq int) *traceEntry {
+    entry := &traceEntry{Time: time.Now().UnixMilli(), From: from, Seq: seq, Intended: []string{}, Delivered: []string{}}
+    for id := range r.Clients {
+        if id != from {
+            entry.Intended = append(entry.Intended, id)
+        }
+    }
+    sort.Strings(entry.Intended)
+    return entry
+}
+
+// traceDrop records a frame dropped before fan-out, when the room is traced
+func (r *Room) traceDrop(from string, seq int, reason string) {
+    trace := r.trace.Load()
+    if trace == nil {
+        return
+    }
+    var entry *traceEntry
+    r.withRLock(func() { entry = r.newTraceEntry(from, seq) })
+    entry.Reason = reason
+    trace.add(entry)
+}
+
+func (h *Hub) reportMetrics() {
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    
+    totalMsg := atomic.LoadInt64(&h.TotalMessages)
+    dropped := atomic.LoadInt64(&h.DroppedFrames)
+    compressed := atomic.LoadInt64(&h.CompressedFrames)
+    saved := atomic.LoadInt64(&h.BytesSaved)
+    
+    if totalMsg > 0 {
+        dropRate := float64(dropped) / float64(totalMsg) * 100
+        savedMB := float64(saved) / (1024 * 1024)
+        
+        log.Printf("Stats - Messages: %d, Dropped: %.1f%%, WebP frames: %d, Saved: %.1f MB",
+            totalMsg, dropRate, compressed, savedMB)
+    }
+    
+    clients := 0
+    for _, room := range h.Rooms {
+        userCount := room.size()
+        clients += userCount
+        if userCount > 0 {
+            log.Printf("Room %s: %d users active", room.ID, userCount)
+        }
+    }
+    h.metrics.Gauge("rooms", float64(len(h.Rooms)))
+    h.metrics.Gauge("clients", float64(clients))
+}
+
+// Client handlers
+// Application-level fragmentation: a frame over maxMessageSize is sent as
+// frame-chunk slices of its base64 data and rebuilt here before the hub
+// sees it. Each sender may have maxPendingFrames incomplete at once (a new
+// one evicts the oldest), none larger than maxChunkedFrame, and a frame
+// still missing chunks after chunkTimeout is dropped.
+const (
+    maxChunkedFrame   = 16 * 1024 * 1024
+    maxChunksPerFrame = 64
+    maxPendingFrames  = 2
+    chunkTimeout      = 2 * time.Second
+)
+
+type partialFrame struct {
+    header   Message // Everything but data, from chunk 0
+    parts    []string
+    received int
+    size     int
+    started  time.Time
+}
+
+// addChunk stores one chunk and returns the video-frame once every chunk
+// is in; problems go back to the sender
+func (c *Client) addChunk(msg *Message, now time.Time) *Message {
+    // The rule can be switched off, but indexing can't trust the client
+    if msg.Total < 1 || msg.Total > maxChunksPerFrame || msg.Index < 0 || msg.Index >= msg.Total {
+        return nil
+    }
+    
+    frame := c.chunks[msg.FrameID]
+    if frame == nil {
+        if c.chunks == nil {
+            c.chunks = make(map[string]*partialFrame)
+        }
+        if len(c.chunks) >= maxPendingFrames {
+            c.dropOldestChunked()
+        }
+        frame = &partialFrame{parts: make([]string, msg.Total), started: now}
+        c.chunks[msg.FrameID] = frame
+    }
+    if msg.Total != len(frame.parts) {
+        delete(c.chunks, msg.FrameID)
+        c.sendError(ErrInvalid, fmt.Sprintf("frame %s changed total from %d to %d", msg.FrameID, len(frame.parts), msg.Total), msg.Type)
+        return nil
+    }
+    if frame.parts[msg.Index] != "" {
+        return nil // Resent chunk
+    }
+    
+    frame.size += len(msg.Data)
+    if frame.size > maxChunkedFrame {
+        delete(c.chunks, msg.FrameID)
+        c.sendError(ErrTooLarge, fmt.Sprintf("frame %s exceeds %d bytes", msg.FrameID, maxChunkedFrame), msg.Type)
+        return nil
+    }
+    frame.parts[msg.Index] = msg.Data
+    frame.received++
+    if msg.Index == 0 {
+        frame.header = *msg
+        frame.header.Data = ""
+    }
+    if frame.received < len(frame.parts) {
+        return nil
+    }
+    
+    delete(c.chunks, msg.FrameID)
+    whole := frame.header
+    whole.Type = "video-frame"
+    whole.Data = strings.Join(frame.parts, "")
+    whole.FrameID, whole.Index, whole.Total = "", 0, 0
+    return &whole
+}
+
+// expireChunks drops frames that stopped receiving chunks
+func (c *Client) expireChunks(now time.Time) {
+    for id, frame := range c.chunks {
+        if now.Sub(frame.started) > chunkTimeout {
+            delete(c.chunks, id)
+            c.sendError(ErrIncomplete, fmt.Sprintf("frame %s timed out with %d of %d chunks", id, frame.received, len(frame.parts)), "frame-chunk")
+        }
+    }
+}
+
+func (c *Client) dropOldestChunked() {
+    var oldest string
+    for id, frame := range c.chunks {
+        if oldest == "" || frame.started.Before(c.chunks[oldest].started) {
+            oldest = id
+        }
+    }
+    frame := c.chunks[oldest]
+    delete(c.chunks, oldest)
+    c.sendError(ErrIncomplete, fmt.Sprintf("frame %s dropped with %d of %d chunks for a newer frame", oldest, frame.received, len(frame.parts)), "frame-chunk")
+}
+
+func (c *Client) ReadPump() {
+    // Unregistering closes Send; closing the conn ourselves before WritePump
+    // has flushed would cut off what the hub queued last
+    defer func() {
+        c.Hub.Unregister <- c
+        c.awaitFlush(flushTimeout + writeTimeout)
+        c.Conn.Close()
+    }()
+    
+    c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+    c.Conn.SetPongHandler(func(string) error {
+        c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+        c.seen()
+        return nil
+    })
+    
+    // Rate limiting: excess messages within a one-second window are dropped
+    windowStart := time.Now()
+    windowCount := 0
+    
+    for {
+        kind, message, err := c.Conn.ReadMessage()
+        if err != nil {
+            break
+        }
+        c.seen()
+        
+        if len(c.chunks) > 0 {
+            c.expireChunks(time.Now())
+        }
+        
+        if time.Since(windowStart) >= time.Second {
+            windowStart = time.Now()
+            windowCount = 0
+        }
+        windowCount++
+        if windowCount > maxMessagesPerSecond {
+            if windowCount == maxMessagesPerSecond+1 {
+                c.sendError(ErrRateLimited, fmt.Sprintf("more than %d messages per second", maxMessagesPerSecond), "")
+            }
+            continue
+        }
+        
+        if len(message) > maxMessageSize {
+            c.sendError(ErrTooLarge, fmt.Sprintf("message of %d bytes exceeds %d", len(message), maxMessageSize), "")
+            continue
+        }
+        
+        // Binary is only ever direct-mode media, which bypasses the hub
+        if kind == websocket.BinaryMessage {
+            c.relayDirect(message)
+            continue
+        }
+        
+        var msg Message
+        if err := json.Unmarshal(message, &msg); err != nil {
+            c.sendError(ErrMalformed, err.Error(), "")
+            continue
+        }
+        
+        if msg.Type == "join" {
+            continue
+        }
+        if msg.Type == "leave" {
+            c.leaving = true
+            break
+        }
+        if !relayedTypes[msg.Type] {
+            c.sendError(ErrUnknownType, "unsupported message type", msg.Type)
+            continue
+        }
+        if rule := messageRules[msg.Type]; validateMessages && rule != nil {
+            if problem := rule(&msg); problem != "" {
+                c.sendError(ErrInvalid, problem, msg.Type)
+                continue
+            }
+        }
+        
+        // Spectators only watch; their media never reaches the hub
+        if c.Spectator && (msg.Type == "audio-chunk" || msg.Type == "video-frame" || msg.Type == "frame-chunk") {
+            continue
+        }
+        
+        // Chunks wait here until the frame is whole, then carry on as one video-frame
+        if msg.Type == "frame-chunk" {
+            frame := c.addChunk(&msg, time.Now())
+            if frame == nil {
+                continue
+            }
+            data, err := json.Marshal(frame)
+            if err != nil {
+                continue
+            }
+            msg, message = *frame, data
+        }
+        
+        // Typing toggles and reactions get their own small budget and are dropped silently
+        if msg.Type == "typing-start" || msg.Type == "typing-stop" || msg.Type == "reaction" {
+            if time.Since(c.typingWindow) >= time.Second {
+                c.typingWindow = time.Now()
+                c.typingCount = 0
+            }
+            c.typingCount++
+            if c.typingCount > maxTypingPerSecond {
+                continue
+            }
+        }
+        
+        // app messages are up to the application, so say once when they're shed
+        if msg.Type == "app" {
+            if time.Since(c.appWindow) >= time.Second {
+                c.appWindow = time.Now()
+                c.appCount = 0
+            }
+            c.appCount++
+            if c.appCount > maxAppPerSecond {
+                if c.appCount == maxAppPerSecond+1 {
+                    c.sendError(ErrRateLimited, fmt.Sprintf("more than %d app messages per second", maxAppPerSecond), msg.Type)
+                }
+                atomic.AddInt64(&c.Hub.AppDropped, 1)
+                continue
+            }
+        }
+        
+        // Control messages (feedback, layer requests, moderation) don't hold off the idle timeout
+        switch msg.Type {
+        case "audio-chunk", "video-frame", "typing-start", "typing-stop":
+            c.mu.Lock()
+            c.LastMeaningfulActivity = time.Now()
+            c.mu.Unlock()
+        }
+        
+        // Broadcast to room
+        c.Hub.Broadcast <- &BroadcastMessage{
+            Room:    c.Room,
+            Message: message,
+            From:    c.ID,
+        }
+    }
+}
+
+// seen stamps the client as heard from now
+func (c *Client) seen() {
+    c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// LastSeen is when the client was last heard from, pongs included
+func (c *Client) LastSeen() time.Time {
+    return time.Unix(0, c.lastSeen.Load())
+}
+
+// closeSend records the close frame for WritePump and closes Send; the
+// caller must be the one goroutine allowed to close it (the hub)
+func (c *Client) closeSend(code int, reason string) {
+    c.closeCode = code
+    c.closeReason = reason
+    c.sendMu.Lock()
+    c.sendClosed = true
+    close(c.Send)
+    c.sendMu.Unlock()
+}
+
+// awaitFlush waits up to timeout for WritePump to finish after Send is closed,
+// reporting whether it did
+func (c *Client) awaitFlush(timeout time.Duration) bool {
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+    select {
+    case <-c.flushed:
+        return true
+    case <-timer.C:
+        return false
+    }
+}
+
+// finish writes the video the pacer still holds, then the close frame. Send
+// is already drained: a closed channel still yields everything buffered
+// before it reports !ok.
+func (c *Client) finish(pacer *framePacer) {
+    if pacer != nil && len(pacer.queue) > 0 {
+        c.Conn.EnableWriteCompression(false)
+        c.Conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+        for _, msg := range pacer.queue {
+            if !uplink.takeVideo(len(msg), time.Now()) {
+                continue
+            }
+            if err := c.Conn.WriteMessage(frameType(msg), msg); err != nil {
+                return
+            }
+        }
+        pacer.queue = nil
+    }
+    c.writeClose()
+}
+
+// writeClose sends the close frame recorded by closeSend; Send's close
+// orders the fields before this read
+func (c *Client) writeClose() {
+    code := c.closeCode
+    if code == 0 {
+        code = websocket.CloseNormalClosure
+    }
+    writeCloseCode(c.Conn, code, c.closeReason)
+}
+
+func writeCloseCode(conn Conn, code int, reason string) error {
+    return conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeTimeout))
+}
+
+func (c *Client) WritePump() {
+    c.writePump(writeBatch, writeBatchBytes)
+}
+
+// writePump sends at most batchCount queued messages after each one, and
+// stops adding to a batch once it holds batchBytes
+func (c *Client) writePump(batchCount, batchBytes int) {
+    ticker := time.NewTicker(pingInterval)
+    defer func() {
+        ticker.Stop()
+        c.Conn.Close()
+        close(c.flushed)
+    }()
+    
+    // Spectators send nothing meaningful by design, so they never idle out
+    var idleCheck <-chan time.Time
+    if idleTimeout > 0 && !c.Spectator {
+        idleTicker := time.NewTicker(idleCheckInterval)
+        defer idleTicker.Stop()
+        idleCheck = idleTicker.C
+    }
+    warned := false
+    
+    // Paced video waits here for its slot; one timer at a time
+    var pacer *framePacer
+    var paceTimer *time.Timer
+    var paceC <-chan time.Time
+    if framePacing {
+        pacer = &framePacer{}
+        defer func() {
+            if paceTimer != nil {
+                paceTimer.Stop()
+            }
+        }()
+    }
+    
+    for {
+        select {
+        case message, ok := <-c.Send:
+            c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+            if !ok {
+                c.finish(pacer)
+                return
+            }
+            
+            // Batch send queued messages, bounded by count and bytes
+            batch := [][]byte{message}
+            size := len(message)
+            closed := false
+        drain:
+            for len(batch) <= batchCount && size < batchBytes {
+                select {
+                case msg, ok := <-c.Send:
+                    if !ok {
+                        closed = true
+                        break drain
+                    }
+                    batch = append(batch, msg)
+                    size += len(msg)
+                default:
+                    break drain
+                }
+            }
+            c.dequeued.Add(int64(len(batch)))
+            
+            // Audio and control never wait behind video within a batch
+            var video [][]byte
+            c.Conn.EnableWriteCompression(true)
+            for _, msg := range batch {
+                if isVideoMessage(msg) {
+                    if pacer != nil {
+                        video = append(video, pacer.push(msg, time.Now())...)
+                    } else {
+                        video = append(video, msg)
+                    }
+                    continue
+                }
+                if err := c.writeMessage(msg); err != nil {
+                    return
+                }
+            }
+            
+            // Deflate only wins back base64's overhead on WebP/JPEG frames,
+            // at a CPU cost per receiver; PCM audio and JSON still compress
+            c.Conn.EnableWriteCompression(false)
+            for _, msg := range video {
+                if staleVideo(msg, time.Now()) {
+                    atomic.AddInt64(&c.Hub.StaleDropped, 1)
+                    continue
+                }
+                if !c.admitVideo(msg, time.Now()) {
+                    continue
+                }
+                if err := c.writeMessage(msg); err != nil {
+                    return
+                }
+            }
+            
+            if closed {
+                c.finish(pacer)
+                return
+            }
+            if pacer != nil && paceTimer == nil {
+                paceTimer, paceC = pacer.arm(time.Now())
+            }
+            
+        case <-paceC:
+            paceTimer, paceC = nil, nil
+            if n := pacer.dropStale(time.Now()); n > 0 {
+                atomic.AddInt64(&c.Hub.StaleDropped, int64(n))
+            }
+            if len(pacer.queue) == 0 {
+                break
+            }
+            c.Conn.EnableWriteCompression(false)
+            if msg := pacer.pop(time.Now()); c.admitVideo(msg, time.Now()) {
+                if err := c.writeMessage(msg); err != nil {
+                    return
+                }
+            }
+            paceTimer, paceC = pacer.arm(time.Now())
+            
+        case <-ticker.C:
+            c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+            if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                return
+            }
+            
+        case <-idleCheck:
+            c.mu.RLock()
+            idle := time.Since(c.LastMeaningfulActivity)
+            c.mu.RUnlock()
+            
+            c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+            switch {
+            case idle >= idleTimeout+idleGrace:
+                log.Printf("Closing idle client %s in room %s (%s without media)", c.ID, c.Room, idle.Round(time.Second))
+                writeCloseCode(c.Conn, CloseIdle, "idle-timeout")
+                return
+            case idle >= idleTimeout && !warned:
+                warned = true
+                warning, _ := json.Marshal(Message{
+                    Type: "idle-warning",
+                    Text: fmt.Sprintf("no media for %s, disconnecting in %s", idle.Round(time.Second), idleGrace),
+                })
+                c.Conn.WriteMessage(websocket.TextMessage, warning)
+            case idle < idleTimeout:
+                warned = false
+            }
+        }
+    }
+}
+
+// Messages over streamThreshold, in practice 4K frames, go out through
+// NextWriter in streamChunk pieces. Each piece gets WRITE_STALL_TIMEOUT to
+// drain, so a socket that stops accepting data is torn down within that
+// rather than after the whole WRITE_TIMEOUT.
+const (
+    streamThreshold = 256 * 1024
+    streamChunk     = 32 * 1024
+)
+
+// writeMessage writes one queued message as its frameType, streaming large
+// ones, and charges it to the client's bandwidth budget. Video has already
+// taken its uplink tokens in admitVideo; everything else is charged here.
+func (c *Client) writeMessage(msg []byte) error {
+    c.budget.spend(len(msg), time.Now())
+    if !isVideoMessage(msg) {
+        uplink.charge(len(msg), time.Now())
+    }
+    if len(msg) <= streamThreshold {
+        c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+        return c.Conn.WriteMessage(frameType(msg), msg)
+    }
+    
+    start := time.Now()
+    end := start.Add(writeTimeout)
+    progress := func() {
+        deadline := time.Now().Add(writeStallTimeout)
+        if deadline.After(end) {
+            deadline = end
+        }
+        c.Conn.SetWriteDeadline(deadline)
+    }
+    
+    progress()
+    w, err := c.Conn.NextWriter(frameType(msg))
+    sent := 0
+    for err == nil && sent < len(msg) {
+        progress()
+        var n int
+        n, err = w.Write(msg[sent:min(sent+streamChunk, len(msg))])
+        sent += n
+    }
+    if err == nil {
+        progress()
+        err = w.Close()
+    }
+    
+    var netErr net.Error
+    if errors.As(err, &netErr) && netErr.Timeout() {
+        atomic.AddInt64(&c.Hub.StalledWrites, 1)
+        log.Printf("Write to %s stalled at %d/%d bytes after %s, disconnecting",
+            c.ID, sent, len(msg), time.Since(start).Round(time.Millisecond))
+    }
+    return err
+}
+
+// sendBudget caps one receiver's outbound bytes over a sliding second.
+// Every write is charged to it but only video is ever refused, so audio and
+// control still go out once video has used the allowance up.
+type sendBudget struct {
+    limit  int // Bytes per second
+    used   int
+    writes []budgetWrite // Within the last second, oldest first
+}
+
+type budgetWrite struct {
+    at time.Time
+    n  int
+}
+
+// newSendBudget returns nil, which allows everything, for kbps 0
+func newSendBudget(kbps int) *sendBudget {
+    if kbps <= 0 {
+        return nil
+    }
+    return &sendBudget{limit: kbps * 1000 / 8}
+}
+
+// allow reports whether n more bytes fit in the second ending now
+func (b *sendBudget) allow(n int, now time.Time) bool {
+    if b == nil {
+        return true
+    }
+    expired := 0
+    for expired < len(b.writes) && now.Sub(b.writes[expired].at) >= time.Second {
+        b.used -= b.writes[expired].n
+        expired++
+    }
+    b.writes = b.writes[expired:]
+    return b.used+n <= b.limit
+}
+
+func (b *sendBudget) spend(n int, now time.Time) {
+    if b == nil {
+        return
+    }
+    b.writes = append(b.writes, budgetWrite{at: now, n: n})
+    b.used += n
+}
+
+// The uplink bucket holds this much of UPLINK_KBPS, so a quiet quarter
+// second lets through one burst of frames and no more
+const uplinkBurst = 250 * time.Millisecond
+
+// uplinkGovernor is a token bucket shared by every WritePump, capping what
+// the whole process writes to clients at UPLINK_KBPS. Audio and control are
+// charged but never refused, and only they may spend the last reserve
+// tokens, running the bucket into debt if they must; video takes its tokens
+// up front and is dropped when that would dip into the reserve. Nothing
+// waits on the bucket, so a full uplink never stalls a pump.
+type uplinkGovernor struct {
+    rate    float64 // Bytes per second
+    burst   float64
+    reserve float64 // Held for audio and control, UPLINK_AUDIO_KBPS worth of a burst
+    
+    mu     sync.Mutex
+    tokens float64
+    last   time.Time
+    
+    Sent    int64 // Bytes charged
+    Dropped int64 // Video frames refused
+}
+
+// uplink is nil, which refuses nothing, unless UPLINK_KBPS is set
+var uplink *uplinkGovernor
+
+func newUplinkGovernor(kbps, audioKbps int) *uplinkGovernor {
+    if kbps <= 0 {
+        return nil
+    }
+    rate := float64(kbps) * 1000 / 8
+    burst := rate * uplinkBurst.Seconds()
+    return &uplinkGovernor{
+        rate:    rate,
+        burst:   burst,
+        reserve: float64(audioKbps) * 1000 / 8 * uplinkBurst.Seconds(),
+        tokens:  burst,
+        last:    time.Now(),
+    }
+}
+
+// refill must be called with mu held
+func (g *uplinkGovernor) refill(now time.Time) {
+    g.tokens = math.Min(g.burst, g.tokens+now.Sub(g.last).Seconds()*g.rate)
+    g.last = now
+}
+
+// charge takes n bytes of audio or control unconditionally. The debt is
+// floored at one burst so video resumes soon after an audio spike passes.
+func (g *uplinkGovernor) charge(n int, now time.Time) {
+    if g == nil {
+        return
+    }
+    g.mu.Lock()
+    g.refill(now)
+    g.tokens = math.Max(-g.burst, g.tokens-float64(n))
+    g.mu.Unlock()
+    atomic.AddInt64(&g.Sent, int64(n))
+}
+
+// takeVideo reserves n bytes for a video frame if that leaves the audio
+// reserve untouched, and counts the frame as dropped if not
+func (g *uplinkGovernor) takeVideo(n int, now time.Time) bool {
+    if g == nil {
+        return true
+    }
+    g.mu.Lock()
+    g.refill(now)
+    ok := g.tokens-float64(n) >= g.reserve
+    if ok {
+        g.tokens -= float64(n)
+    }
+    g.mu.Unlock()
+    
+    if !ok {
+        atomic.AddInt64(&g.Dropped, 1)
+        return false
+    }
+    atomic.AddInt64(&g.Sent, int64(n))
+    return true
+}
+
+// admitVideo reports whether a video frame may be written now: it has to
+// fit the receiver's own budget and then the process-wide uplink
+func (c *Client) admitVideo(msg []byte, now time.Time) bool {
+    if !c.budget.allow(len(msg), now) {
+        atomic.AddInt64(&c.Hub.BandwidthDropped, 1)
+        return false
+    }
+    return uplink.takeVideo(len(msg), now)
+}
+
+// Frame pacer tuning: the arrival gap EWMA weight, the share of that gap
+// writes are spaced by (under 1 so the queue drains faster than it fills),
+// and the depth past which the oldest frame skips its slot
+const (
+    paceGapWeight = 0.125
+    paceDrain     = 0.9
+    paceMaxGap    = 100 * time.Millisecond
+    paceMaxQueue  = 8
+)
+
+// framePacer is a write-side leaky bucket for one client's video. Bursts
+// from the hub are queued and released one per slot, where the slot is the
+// smoothed gap between arriving frames, so over a frame interval the
+// receiver sees evenly spaced writes rather than a burst and silence.
+// Owned by the client's WritePump.
+type framePacer struct {
+    queue       [][]byte
+    gap         time.Duration // EWMA of inter-arrival time
+    lastArrival time.Time
+    next        time.Time // Earliest time the next frame may go out
+}
+
+// push queues a frame and returns any that must go out now because the
+// queue is full
+func (p *framePacer) push(msg []byte, now time.Time) [][]byte {
+    if !p.lastArrival.IsZero() {
+        gap := now.Sub(p.lastArrival)
+        if gap > paceMaxGap {
+            gap = paceMaxGap
+        }
+        p.gap += time.Duration(paceGapWeight * float64(gap-p.gap))
+    }
+    p.lastArrival = now
+    p.queue = append(p.queue, msg)
+    
+    var overflow [][]byte
+    for len(p.queue) > paceMaxQueue {
+        overflow = append(overflow, p.queue[0])
+        p.queue = p.queue[1:]
+    }
+    return overflow
+}
+
+// arm returns a timer for the next slot, or nil when nothing is queued
+func (p *framePacer) arm(now time.Time) (*time.Timer, <-chan time.Time) {
+    if len(p.queue) == 0 {
+        return nil, nil
+    }
+    t := time.NewTimer(p.next.Sub(now))
+    return t, t.C
+}
+
+// pop releases the oldest frame and books the slot after it
+func (p *framePacer) pop(now time.Time) []byte {
+    msg := p.queue[0]
+    p.queue[0] = nil
+    p.queue = p.queue[1:]
+    p.next = now.Add(time.Duration(paceDrain * float64(p.gap)))
+    return msg
+}
+
+// dropStale removes queued frames that went stale waiting for a slot,
+// returning how many
+func (p *framePacer) dropStale(now time.Time) int {
+    kept := p.queue[:0]
+    for _, msg := range p.queue {
+        if !staleVideo(msg, now) {
+            kept = append(kept, msg)
+        }
+    }
+    dropped := len(p.queue) - len(kept)
+    clear(p.queue[len(kept):])
+    p.queue = kept
+    return dropped
+}
+
+// isVideoMessage peeks the type; Message marshals Type first
+func isVideoMessage(data []byte) bool {
+    return bytes.HasPrefix(data, []byte(`{"type":"video-frame"`)) || (len(data) > 0 && data[0] == directVideo)
+}
+
+// frameType is the WebSocket message type data goes out as: binary for
+// direct-mode media, text for everything else, which is JSON
+func frameType(data []byte) int {
+    if len(data) > 0 && data[0] != '{' {
+        return websocket.BinaryMessage
+    }
+    return websocket.TextMessage
+}
+
+// videoServerTime peeks the serverTime stamped on a video frame, which
+// Message marshals straight after Type
+func videoServerTime(data []byte) (int64, bool) {
+    rest, ok := bytes.CutPrefix(data, []byte(`{"type":"video-frame","serverTime":`))
+    if !ok {
+        return 0, false
+    }
+    var ms int64
+    n := 0
+    for ; n < len(rest) && n < 19 && rest[n] >= '0' && rest[n] <= '9'; n++ {
+        ms = ms*10 + int64(rest[n]-'0')
+    }
+    return ms, n > 0
+}
+
+// staleVideo reports whether a video frame is older than staleVideoAfter;
+// unstamped frames and everything else never are
+func staleVideo(data []byte, now time.Time) bool {
+    if staleVideoAfter <= 0 {
+        return false
+    }
+    stamped, ok := videoServerTime(data)
+    return ok && now.Sub(time.UnixMilli(stamped)) > staleVideoAfter
+}
+
+// sendError tells the client why its message was refused; never blocks
+func (c *Client) sendError(code ErrorCode, text, ref string) {
+    c.sendMessage(Message{Type: "error", Code: code, Text: text, Ref: ref})
+}
+
+// sendMessage queues a control message for this client; never blocks. It
+// goes through pipe because ReadPump and the encoder workers send errors too,
+// and the hub may already have closed Send under them.
+func (c *Client) sendMessage(msg Message) {
+    data, err := json.Marshal(msg)
+    if err != nil {
+        return
+    }
+    c.pipe(data)
+}
+
+// clientIP honours X-Forwarded-For only behind a trusted proxy (TRUST_PROXY=true)
+func clientIP(r *http.Request) string {
+    if trustProxy {
+        if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+            first := strings.TrimSpace(strings.Split(fwd, ",")[0])
+            if net.ParseIP(first) != nil {
+                return first
+            }
+        }
+    }
+    
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// HTTP handlers
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+    // Refuse floods with a plain HTTP status before spending an upgrade,
+    // let alone an authentication and two goroutines, on them
+    ip := clientIP(r)
+    if wait := connLimiter.allow(ip); wait > 0 {
+        atomic.AddInt64(&hub.RejectedConns, 1)
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+        http.Error(w, "too many connections from this address", http.StatusTooManyRequests)
+        return
+    }
+    
+    // A server-wide admission rate sheds a reconnect herd; each refused
+    // client gets its own jittered delay so the retries don't land together
+    if wait := acceptLimiter.allow("*"); wait > 0 {
+        atomic.AddInt64(&hub.RejectedConns, 1)
+        retry := wait + jitter(reconnectSpread)
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+        http.Error(w, "server busy, reconnect later", http.StatusServiceUnavailable)
+        return
+    }
+    
+    // Checked before the upgrade so a refused client gets a plain 401
+    var identity *Identity
+    if authenticator != nil {
+        id, err := authenticator.Authenticate(r.Context(), requestToken(r))
+        if err != nil {
+            atomic.AddInt64(&hub.AuthFailures, 1)
+            log.Printf("Refused WebSocket from %s: %v", ip, err)
+            w.Header().Set("WWW-Authenticate", `Bearer realm="conference"`)
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        identity = id
+    }
+    
+    release, ok := acquireConnSlot()
+    if !ok {
+        atomic.AddInt64(&hub.RejectedConns, 1)
+        http.Error(w, "server at connection capacity", http.StatusServiceUnavailable)
+        return
+    }
+    
+    ws, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        release()
+        return
+    }
+    
+    var conn Conn = ws
+    if recorder != nil {
+        conn = recorder.wrap(ws)
+    }
+    conn = &releasingConn{Conn: conn, release: release}
+    serveConn(conn, r.UserAgent(), ip, identity)
+}
+
+// WebSocket authentication
+//
+// With AUTH_JWT_PUBLIC_KEY or AUTH_URL set, every upgrade must carry a token,
+// as ?token= (browsers can't set headers on a WebSocket) or an Authorization
+// bearer header. A token the authenticator rejects gets a 401 and no upgrade;
+// an accepted one puts its Identity on the Client, whose subject replaces
+// the id the join asks for.
+
+// Identity is who an authenticator says the connection belongs to
+type Identity struct {
+    Subject string
+    Claims  map[string]interface{}
+}
+
+// Authenticator validates an upgrade's token; "" means none was sent
+type Authenticator interface {
+    Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+// authenticator gates /ws; nil leaves it open
+var authenticator Authenticator
+
+// requestToken takes the token from ?token=, else the bearer header
+func requestToken(r *http.Request) string {
+    if token := r.URL.Query().Get("token"); token != "" {
+        return token
+    }
+    token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return token
+}
+
+// Clock skew allowed on exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// jwtAuthenticator verifies compact JWS tokens signed by one key. The
+// algorithm must match the key's type, so a token can't pick "none" or
+// an HMAC keyed with the public key. exp and sub are required; iss and aud
+// are checked when configured.
+type jwtAuthenticator struct {
+    key      crypto.PublicKey
+    issuer   string
+    audience string
+    now      func() time.Time
+}
+
+// loadJWTAuthenticator reads an RSA, ECDSA or Ed25519 public key (PKIX or a
+// certificate) from a PEM file
+func loadJWTAuthenticator(path, issuer, audience string) (*jwtAuthenticator, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("%s: no PEM block", path)
+    }
+    
+    var key crypto.PublicKey
+    switch block.Type {
+    case "CERTIFICATE":
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
+        }
+        key = cert.PublicKey
+    default:
+        if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
+        }
+    }
+    switch key.(type) {
+    case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+    default:
+        return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+    }
+    return &jwtAuthenticator{key: key, issuer: issuer, audience: audience, now: time.Now}, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+    if token == "" {
+        return nil, errors.New("no token")
+    }
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed token")
+    }
+    
+    var header struct {
+        Alg string `json:"alg"`
+    }
+    if err := decodeJWTPart(parts[0], &header); err != nil {
+        return nil, fmt.Errorf("token header: %v", err)
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errors.New("token signature is not base64url")
+    }
+    if err := a.verify(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+        return nil, err
+    }
+    
+    var claims map[string]interface{}
+    if err := decodeJWTPart(parts[1], &claims); err != nil {
+        return nil, fmt.Errorf("token claims: %v", err)
+    }
+    now := a.now()
+    exp, ok := claims["exp"].(float64)
+    switch {
+    case !ok:
+        return nil, errors.New("token has no exp")
+    case now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)):
+        return nil, errors.New("token expired")
+    }
+    if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+        return nil, errors.New("token not valid yet")
+    }
+    if a.issuer != "" && claims["iss"] != a.issuer {
+        return nil, errors.New("token issuer mismatch")
+    }
+    if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+        return nil, errors.New("token audience mismatch")
+    }
+    sub, _ := claims["sub"].(string)
+    if sub == "" || len(sub) > maxIDLength {
+        return nil, errors.New("token sub missing or too long")
+    }
+    return &Identity{Subject: sub, Claims: claims}, nil
+}
+
+// verify checks sig over signed under alg, which must suit the key
+func (a *jwtAuthenticator) verify(alg, signed string, sig []byte) error {
+    var hash crypto.Hash
+    switch alg {
+    case "RS256", "PS256", "ES256":
+        hash = crypto.SHA256
+    case "RS384", "PS384", "ES384":
+        hash = crypto.SHA384
+    case "RS512", "PS512", "ES512":
+        hash = crypto.SHA512
+    case "EdDSA":
+    default:
+        return fmt.Errorf("token algorithm %q not accepted", alg)
+    }
+    
+    var digest []byte
+    switch hash {
+    case crypto.SHA256:
+        sum := sha256.Sum256([]byte(signed))
+        digest = sum[:]
+    case crypto.SHA384:
+        sum := sha512.Sum384([]byte(signed))
+        digest = sum[:]
+    case crypto.SHA512:
+        sum := sha512.Sum512([]byte(signed))
+        digest = sum[:]
+    }
+    
+    valid := false
+    switch key := a.key.(type) {
+    case *rsa.PublicKey:
+        switch alg[:2] {
+        case "RS":
+            valid = rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+        case "PS":
+            valid = rsa.VerifyPSS(key, hash, digest, sig, nil) == nil
+        }
+    case *ecdsa.PublicKey:
+        // JWS carries r||s, each the curve's size
+        size := (key.Curve.Params().BitSize + 7) / 8
+        if alg[:2] == "ES" && len(sig) == 2*size {
+            r := new(big.Int).SetBytes(sig[:size])
+            s := new(big.Int).SetBytes(sig[size:])
+            valid = ecdsa.Verify(key, digest, r, s)
+        }
+    case ed25519.PublicKey:
+        valid = alg == "EdDSA" && ed25519.Verify(key, []byte(signed), sig)
+    }
+    if !valid {
+        return errors.New("token signature invalid")
+    }
+    return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+    data, err := base64.RawURLEncoding.DecodeString(part)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(data, v)
+}
+
+// hasAudience matches aud as a string or a list of them
+func hasAudience(aud interface{}, want string) bool {
+    switch aud := aud.(type) {
+    case string:
+        return aud == want
+    case []interface{}:
+        for _, a := range aud {
+            if a == want {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// Callout authentication: how long AUTH_URL gets to answer
+const authCalloutTimeout = 5 * time.Second
+
+// calloutAuthenticator asks an auth service. The token goes to url as a
+// bearer header; a 2xx answer accepts it and its JSON body holds the
+// claims, with the subject in "sub". Anything else refuses it.
+type calloutAuthenticator struct {
+    url    string
+    client *http.Client
+}
+
+func (a *calloutAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+    if token == "" {
+        return nil, errors.New("no token")
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    
+    res, err := a.client.Do(req)
+    if err != nil {
+        return nil, fmt.Errorf("auth service: %v", err)
+    }
+    defer res.Body.Close()
+    if res.StatusCode < 200 || res.StatusCode > 299 {
+        return nil, fmt.Errorf("auth service answered %s", res.Status)
+    }
+    
+    var claims map[string]interface{}
+    if err := json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&claims); err != nil {
+        return nil, fmt.Errorf("auth service reply: %v", err)
+    }
+    sub, _ := claims["sub"].(string)
+    if sub == "" || len(sub) > maxIDLength {
+        return nil, errors.New("auth service reply has no usable sub")
+    }
+    return &Identity{Subject: sub, Claims: claims}, nil
+}
+
+// newAuthenticator picks the authenticator from the environment, nil when
+// neither AUTH_JWT_PUBLIC_KEY nor AUTH_URL is set
+func newAuthenticator(getenv func(string) string) (Authenticator, error) {
+    keyPath, calloutURL := getenv("AUTH_JWT_PUBLIC_KEY"), getenv("AUTH_URL")
+    switch {
+    case keyPath != "" && calloutURL != "":
+        return nil, errors.New("set AUTH_JWT_PUBLIC_KEY or AUTH_URL, not both")
+    case keyPath != "":
+        return loadJWTAuthenticator(keyPath, getenv("AUTH_JWT_ISSUER"), getenv("AUTH_JWT_AUDIENCE"))
+    case calloutURL != "":
+        if u, err := url.Parse(calloutURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return nil, fmt.Errorf("AUTH_URL %q is not an http(s) URL", calloutURL)
+        }
+        return &calloutAuthenticator{url: calloutURL, client: &http.Client{Timeout: authCalloutTimeout}}, nil
+    }
+    return nil, nil
+}
+
+// How long an upgraded connection may take to send its join
+const joinTimeout = 10 * time.Second
+
+// Accept-layer limits: a token bucket per client IP, one shared by all
+// upgrades (keyed "*"), and a global cap on open connections
+var (
+    connLimiter   = newIPRateLimiter(5, 20)
+    acceptLimiter = newIPRateLimiter(50, 100)
+    connSlots     chan struct{} // nil when MAX_CONNECTIONS is 0
+    
+    // Server-wide upgrades per second, and the window reconnects are
+    // spread over after a restart or refusal
+    acceptRate      = 50.0
+    reconnectSpread = 10 * time.Second
+)
+
+// acquireConnSlot takes a connection slot, returning its release func
+func acquireConnSlot() (func(), bool) {
+    if connSlots == nil {
+        return func() {}, true
+    }
+    select {
+    case connSlots <- struct{}{}:
+        return func() { <-connSlots }, true
+    default:
+        return nil, false
+    }
+}
+
+// releasingConn frees its connection slot on the first Close; both pumps
+// close the connection
+type releasingConn struct {
+    Conn
+    once    sync.Once
+    release func()
+}
+
+func (c *releasingConn) Close() error {
+    c.once.Do(c.release)
+    return c.Conn.Close()
+}
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// ipRateLimiter allows rate connections per second per IP with bursts of burst
+type ipRateLimiter struct {
+    rate    float64
+    burst   float64
+    
+    mu        sync.Mutex
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+func newIPRateLimiter(rate float64, burst int) *ipRateLimiter {
+    return &ipRateLimiter{
+        rate:    rate,
+        burst:   float64(burst),
+        buckets: make(map[string]*tokenBucket),
+    }
+}
+
+// allow takes a token for ip, or reports how long until one is available
+func (l *ipRateLimiter) allow(ip string) time.Duration {
+    if l.rate <= 0 {
+        return 0
+    }
+    now := time.Now()
+    
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    
+    // Buckets that have refilled carry no state worth keeping
+    if now.Sub(l.lastSweep) > time.Minute {
+        for key, b := range l.buckets {
+            if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+                delete(l.buckets, key)
+            }
+        }
+        l.lastSweep = now
+    }
+    
+    b, ok := l.buckets[ip]
+    if !ok {
+        b = &tokenBucket{tokens: l.burst, last: now}
+        l.buckets[ip] = b
+    }
+    b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+    b.last = now
+    
+    if b.tokens < 1 {
+        return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+    }
+    b.tokens--
+    return 0
+}
+
+// Display names longer than this many characters are cut
+const maxDisplayName = 64
+
+// sanitizeDisplayName makes a client's chosen name safe to show: invalid
+// UTF-8, control and formatting characters (bidi overrides included) are
+// removed, runs of whitespace become one space, and the result is trimmed
+// and cut to maxDisplayName characters
+func sanitizeDisplayName(name string) string {
+    var b strings.Builder
+    space := false
+    n := 0
+    for _, r := range strings.ToValidUTF8(name, "") {
+        switch {
+        case unicode.IsSpace(r):
+            space = b.Len() > 0
+            continue
+        case !unicode.IsPrint(r):
+            continue
+        case n == maxDisplayName:
+            return b.String()
+        }
+        if space {
+            if n+1 == maxDisplayName {
+                return b.String()
+            }
+            b.WriteByte(' ')
+            n++
+            space = false
+        }
+        b.WriteRune(r)
+        n++
+    }
+    return b.String()
+}
+
+// serveConn waits for the join message, then hands the connection to the hub
+func serveConn(conn Conn, userAgent, remoteIP string, identity *Identity) {
+    // A connection that never joins must not hold its slot
+    conn.SetReadDeadline(time.Now().Add(joinTimeout))
+    
+    var joinMsg Message
+    _, data, err := conn.ReadMessage()
+    if err != nil || json.Unmarshal(data, &joinMsg) != nil || joinMsg.Type != "join" {
+        conn.Close()
+        return
+    }
+    
+    // Assigned before the client exists, so no goroutine ever sees the old
+    // id; an authenticated subject is the client's id unless the server
+    // assigns them
+    assigned := serverAssignedIDs
+    if assigned {
+        joinMsg.ID = hub.allocateID(joinMsg.Room)
+    } else if identity != nil {
+        joinMsg.ID = identity.Subject
+    }
+    
+    client := &Client{
+        ID:   joinMsg.ID,
+        AssignedID: assigned,
+        Room: joinMsg.Room,
+        Conn: conn,
+        Send: make(chan []byte, 100), // Larger buffer for WebP frames
+        Hub:  hub,
+        UserAgent: userAgent,
+        RemoteIP:  remoteIP,
+        Mode:      joinMsg.Mode,
+        DropStrategy: joinMsg.DropStrategy,
+        Direct:    joinMsg.Direct,
+        Resume:    joinMsg.Resume,
+        DisplayName: sanitizeDisplayName(joinMsg.DisplayName),
+        JoinedAt:  time.Now(),
+        ModToken:  moderatorToken != "" && joinMsg.Token == moderatorToken,
+        Spectator: joinMsg.Role == "spectator",
+        Identity:  identity,
+        LastMeaningfulActivity: time.Now(),
+        flushed:   make(chan struct{}),
+        budget:    newSendBudget(clientBandwidthKbps),
+    }
+    client.seen()
+    
+    // Echo tests never share a room, whatever name was asked for, and a
+    // join naming one is an echo test too rather than a way into someone's
+    if client.Room == "__echo__" || strings.HasPrefix(client.Room, echoRoomPrefix) {
+        client.Mode = "echo"
+    }
+    if client.Mode == "echo" {
+        client.Room = echoRoomPrefix + client.ID
+        client.echoes = make(chan echoItem, echoQueue)
+        go client.echoLoop()
+    }
+    
+    client.Hub.Register <- client
+    
+    go client.WritePump()
+    go client.ReadPump()
+}
+
+// Record and replay
+//
+// RECORD_LOG=path writes one replayEvent per inbound message. REPLAY_LOG=path
+// feeds such a log through the hub over in-memory connections instead of
+// starting the server, then compares what each connection received against
+// REPLAY_EXPECT (or prints the transcript when no expectation is given).
+
+type replayEvent struct {
+    At     int64           `json:"at"`             // ms since recording started
+    Conn   string          `json:"conn"`           // connection key, e.g. conn-3
+    Data   json.RawMessage `json:"data,omitempty"`
+    Close  bool            `json:"close,omitempty"`
+}
+
+// transcriptEntry is the deterministic part of one delivered message
+type transcriptEntry struct {
+    To   string `json:"to"`
+    Type string `json:"type"`
+    From string `json:"from,omitempty"`
+    Seq  int    `json:"seq,omitempty"`
+}
+
+type messageRecorder struct {
+    start  time.Time
+    next   int64
+    file   *os.File
+    enc    *json.Encoder
+    aead   cipher.AEAD // Seals each event when the recording is encrypted
+    sealed uint64      // Events sealed so far
+    mu     sync.Mutex
+}
+
+func newMessageRecorder(path string) (*messageRecorder, error) {
+    f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return nil, err
+    }
+    return &messageRecorder{start: time.Now(), file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *messageRecorder) Close() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return r.file.Close()
+}
+
+func (r *messageRecorder) wrap(conn Conn) Conn {
+    key := fmt.Sprintf("conn-%d", atomic.AddInt64(&r.next, 1))
+    return &recordingConn{Conn: conn, key: key, rec: r}
+}
+
+func (r *messageRecorder) write(ev replayEvent) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    ev.At = time.Since(r.start).Milliseconds()
+    var record interface{} = ev
+    if r.aead != nil {
+        plain, err := json.Marshal(ev)
+        if err != nil {
+            log.Printf("Record failed: %v", err)
+            return
+        }
+        r.sealed++
+        record = sealRecord(r.aead, plain, recordAD(r.sealed))
+    }
+    if err := r.enc.Encode(record); err != nil {
+        log.Printf("Record failed: %v", err)
+    }
+}
+
+// recordingConn logs each message read from the wrapped connection
+type recordingConn struct {
+    Conn
+    key    string
+    rec    *messageRecorder
+    closed sync.Once
+}
+
+func (c *recordingConn) ReadMessage() (int, []byte, error) {
+    mt, data, err := c.Conn.ReadMessage()
+    if err != nil {
+        c.closed.Do(func() { c.rec.write(replayEvent{Conn: c.key, Close: true}) })
+        return mt, data, err
+    }
+    if mt == websocket.TextMessage && json.Valid(data) {
+        c.rec.write(replayEvent{Conn: c.key, Data: data})
+    }
+    return mt, data, err
+}
+
+// memConn is an in-memory Conn fed by the replay driver
+type memConn struct {
+    key    string
+    in     chan []byte
+    closed chan struct{}
+    once   sync.Once
+    
+    mu     sync.Mutex
+    out    []transcriptEntry
+    last   time.Time
+}
+
+func newMemConn(key string) *memConn {
+    return &memConn{
+        key:    key,
+        in:     make(chan []byte, 256),
+        closed: make(chan struct{}),
+    }
+}
+
+func (c *memConn) ReadMessage() (int, []byte, error) {
+    select {
+    case data := <-c.in:
+        if data == nil { // Recorded disconnect
+            return 0, nil, io.EOF
+        }
+        return websocket.TextMessage, data, nil
+    case <-c.closed:
+        return 0, nil, io.EOF
+    }
+}
+
+func (c *memConn) WriteMessage(messageType int, data []byte) error {
+    if messageType != websocket.TextMessage {
+        return nil
+    }
+    
+    var msg Message
+    if err := json.Unmarshal(data, &msg); err != nil {
+        return nil
+    }
+    
+    c.mu.Lock()
+    c.out = append(c.out, transcriptEntry{To: c.key, Type: msg.Type, From: msg.From, Seq: msg.Seq})
+    c.last = time.Now()
+    c.mu.Unlock()
+    return nil
+}
+
+// NextWriter buffers the message and records it on Close
+func (c *memConn) NextWriter(messageType int) (io.WriteCloser, error) {
+    return &memWriter{conn: c, messageType: messageType}, nil
+}
+
+type memWriter struct {
+    bytes.Buffer
+    conn        *memConn
+    messageType int
+}
+
+func (w *memWriter) Close() error {
+    return w.conn.WriteMessage(w.messageType, w.Bytes())
+}
+
+func (c *memConn) Close() error {
+    c.once.Do(func() { close(c.closed) })
+    return nil
+}
+
+func (c *memConn) SetReadDeadline(time.Time) error   { return nil }
+func (c *memConn) SetWriteDeadline(time.Time) error  { return nil }
+func (c *memConn) SetPongHandler(func(string) error) {}
+func (c *memConn) EnableWriteCompression(bool)       {}
+func (c *memConn) WriteControl(int, []byte, time.Time) error { return nil }
+
+// runReplay drives the hub from a recorded log at its original pace
+func runReplay(logPath, expectPath string) error {
+    var events []replayEvent
+    if err := readJSONLines(logPath, func(line []byte) error {
+        var ev replayEvent
+        if err := json.Unmarshal(line, &ev); err != nil {
+            return err
+        }
+        events = append(events, ev)
+        return nil
+    }); err != nil {
+        return err
+    }
+    
+    // Transcripts are keyed by the recorded ids
+    serverAssignedIDs = false
+    
+    hub = NewHub()
+    go hub.Run()
+    
+    conns := make(map[string]*memConn)
+    var order []*memConn
+    start := time.Now()
+    
+    for _, ev := range events {
+        if wait := time.Until(start.Add(time.Duration(ev.At) * time.Millisecond)); wait > 0 {
+            time.Sleep(wait)
+        }
+        
+        conn, ok := conns[ev.Conn]
+        if !ok {
+            conn = newMemConn(ev.Conn)
+            conns[ev.Conn] = conn
+            order = append(order, conn)
+            go serveConn(conn, "replay", ev.Conn, nil)
+        }
+        
+        if ev.Close {
+            // Unregister would race queued broadcasts and frames still in the
+            // encoder pool, so let the hub settle before disconnecting
+            for len(conn.in) > 0 || !hub.idle() {
+                time.Sleep(time.Millisecond)
+            }
+            time.Sleep(20 * time.Millisecond)
+            conn.in <- nil
+            continue
+        }
+        conn.in <- ev.Data
+    }
+    
+    // Let in-flight frames drain: stop once nothing has been written for a second
+    for quiet := false; !quiet; {
+        time.Sleep(250 * time.Millisecond)
+        quiet = true
+        for _, conn := range order {
+            conn.mu.Lock()
+            if time.Since(conn.last) < time.Second {
+                quiet = false
+            }
+            conn.mu.Unlock()
+        }
+    }
+    
+    var transcript []transcriptEntry
+    for _, conn := range order {
+        conn.mu.Lock()
+        transcript = append(transcript, conn.out...)
+        conn.mu.Unlock()
+    }
+    
+    // Ordering is only guaranteed per sender stream (video goes through the
+    // encoder pool), so compare per receiver, sender and message type
+    sort.SliceStable(transcript, func(i, j int) bool {
+        a, b := transcript[i], transcript[j]
+        if a.To != b.To {
+            return a.To < b.To
+        }
+        if a.From != b.From {
+            return a.From < b.From
+        }
+        return a.Type < b.Type
+    })
+    
+    if expectPath == "" {
+        enc := json.NewEncoder(os.Stdout)
+        for _, entry := range transcript {
+            enc.Encode(entry)
+        }
+        return nil
+    }
+    
+    var expected []transcriptEntry
+    if err := readJSONLines(expectPath, func(line []byte) error {
+        var entry transcriptEntry
+        if err := json.Unmarshal(line, &entry); err != nil {
+            return err
+        }
+        expected = append(expected, entry)
+        return nil
+    }); err != nil {
+        return err
+    }
+    
+    for i := range expected {
+        if i >= len(transcript) || !reflect.DeepEqual(expected[i], transcript[i]) {
+            got := "nothing"
+            if i < len(transcript) {
+                got = fmt.Sprintf("%+v", transcript[i])
+            }
+            return fmt.Errorf("replay differs from %s at message %d: expected %+v, got %s", expectPath, i+1, expected[i], got)
+        }
+    }
+    if len(transcript) > len(expected) {
+        return fmt.Errorf("replay produced %d unexpected extra messages, first %+v", len(transcript)-len(expected), transcript[len(expected)])
+    }
+    
+    log.Printf("Replay matched %s (%d messages)", expectPath, len(transcript))
+    return nil
+}
+
+// idle reports whether no broadcast or video frame is waiting in the hub
+func (h *Hub) idle() bool {
+    if len(h.Broadcast) > 0 || len(h.encoded) > 0 {
+        return false
+    }
+    for _, queue := range h.encodeQueues {
+        if len(queue) > 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// readJSONLines calls fn for every non-empty line of the file
+func readJSONLines(path string, fn func(line []byte) error) error {
+    f, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), maxMessageSize+1024)
+    for n := 1; scanner.Scan(); n++ {
+        line := bytes.TrimSpace(scanner.Bytes())
+        if len(line) == 0 {
+            continue
+        }
+        if err := fn(line); err != nil {
+            return fmt.Errorf("%s:%d: %v", path, n, err)
+        }
+    }
+    return scanner.Err()
+}
+
+
+func handleStats(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(statsSnapshot())
+}
+
+// statsSnapshot reads the hub's counters for /stats and /ws/stats
+func statsSnapshot() map[string]interface{} {
+    totalMsg := atomic.LoadInt64(&hub.TotalMessages)
+    dropped := atomic.LoadInt64(&hub.DroppedFrames)
+    compressed := atomic.LoadInt64(&hub.CompressedFrames)
+    saved := atomic.LoadInt64(&hub.BytesSaved)
+    encodeDropped := atomic.LoadInt64(&hub.EncodeDropped)
+    throttled := atomic.LoadInt64(&hub.ThrottledFrames)
+    decodeFailures := atomic.LoadInt64(&hub.DecodeFailures)
+    oversizedFrames := atomic.LoadInt64(&hub.OversizedFrames)
+    rejectedConns := atomic.LoadInt64(&hub.RejectedConns)
+    encodeFailures := atomic.LoadInt64(&hub.EncodeFailures)
+    encryptedBytes := atomic.LoadInt64(&hub.EncryptedBytes)
+    stalledWrites := atomic.LoadInt64(&hub.StalledWrites)
+    duplicates := atomic.LoadInt64(&hub.DuplicateMessages)
+    bandwidthDropped := atomic.LoadInt64(&hub.BandwidthDropped)
+    staleDropped := atomic.LoadInt64(&hub.StaleDropped)
+    appDropped := atomic.LoadInt64(&hub.AppDropped)
+    mutedDropped := atomic.LoadInt64(&hub.MutedDropped)
+    keyframeRequests := atomic.LoadInt64(&hub.KeyframeRequests)
+    hubPanics := atomic.LoadInt64(&hub.HubPanics)
+    echoed := atomic.LoadInt64(&hub.Echoed)
+    echoDropped := atomic.LoadInt64(&hub.EchoDropped)
+    backlogDisconnects := atomic.LoadInt64(&hub.BacklogDisconnects)
+    directMessages := atomic.LoadInt64(&hub.DirectMessages)
+    directDropped := atomic.LoadInt64(&hub.DirectDropped)
+    authFailures := atomic.LoadInt64(&hub.AuthFailures)
+    
+    stats := map[string]interface{}{
+        "messages":       totalMsg,
+        "droppedFrames":  dropped,
+        "dropRate":       float64(dropped) / float64(totalMsg+1) * 100,
+        "webpFrames":     compressed,
+        "bytesSaved":     saved,
+        "mbSaved":        float64(saved) / (1024 * 1024),
+        "encodeDropped":  encodeDropped,
+        "throttled":      throttled,
+        "decodeFailures": decodeFailures,
+        "oversizedFrames": oversizedFrames,
+        "rejectedConns":  rejectedConns,
+        "encodeFailures": encodeFailures,
+        "encryptedBytes": encryptedBytes,
+        "stalledWrites":  stalledWrites,
+        "duplicates":     duplicates,
+        "bandwidthDropped": bandwidthDropped,
+        "staleDropped":   staleDropped,
+        "appDropped":     appDropped,
+        "mutedDropped":   mutedDropped,
+        "keyframeRequests": keyframeRequests,
+        "hubPanics":      hubPanics,
+        "echoed":         echoed,
+        "echoDropped":    echoDropped,
+        "backlogDisconnects": backlogDisconnects,
+        "directMessages": directMessages,
+        "directDropped":  directDropped,
+        "authFailures":   authFailures,
+        "encodeWorkers":  encodeWorkers,
+    }
+    if uplink != nil {
+        stats["uplink"] = map[string]int64{
+            "kbps":    int64(uplink.rate * 8 / 1000),
+            "bytes":   atomic.LoadInt64(&uplink.Sent),
+            "dropped": atomic.LoadInt64(&uplink.Dropped),
+        }
+    }
+    if webhooks != nil {
+        stats["webhooks"] = map[string]int64{
+            "sent":    atomic.LoadInt64(&webhooks.Sent),
+            "failed":  atomic.LoadInt64(&webhooks.Failed),
+            "dropped": atomic.LoadInt64(&webhooks.Dropped),
+        }
+    }
+    return stats
+}
+
+// Stats push interval bounds for /ws/stats?interval=
+const (
+    statsPushDefault = time.Second
+    statsPushMin     = 500 * time.Millisecond
+    statsPushMax     = time.Minute
+)
+
+// handleStatsStream pushes a stats snapshot every interval. Subscribers never
+// become hub clients, so no room media can reach them.
+func handleStatsStream(w http.ResponseWriter, r *http.Request) {
+    interval := statsPushDefault
+    if d, err := time.ParseDuration(r.URL.Query().Get("interval")); err == nil {
+        interval = min(max(d, statsPushMin), statsPushMax)
+    }
+    
+    ws, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    defer ws.Close()
+    
+    // Inbound messages are ignored; reading notices the close and answers pings
+    closed := make(chan struct{})
+    go func() {
+        defer close(closed)
+        for {
+            if _, _, err := ws.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+    
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    
+    for {
+        snapshot := statsSnapshot()
+        status := hub.status()
+        snapshot["type"] = "stats"
+        snapshot["timestamp"] = time.Now().UnixMilli()
+        snapshot["rooms"] = status.Rooms
+        snapshot["clients"] = status.Clients
+        
+        ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+        if err := ws.WriteJSON(snapshot); err != nil {
+            return
+        }
+        
+        select {
+        case <-ticker.C:
+        case <-closed:
+            return
+        }
+    }
+}
+
+// handleReady answers 200 only if the hub loop itself responds in time,
+// unlike /health which only proves the process is up
+func handleReady(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    
+    timeout := time.After(readyTimeout)
+    reply := make(chan hubStatus, 1)
+    
+    select {
+    case hub.ready <- reply:
+        select {
+        case status, ok := <-reply:
+            if !ok {
+                break // The status handler panicked
+            }
+            json.NewEncoder(w).Encode(map[string]interface{}{
+                "status": "ready",
+                "hub":    status,
+            })
+            return
+        case <-timeout:
+        }
+    case <-timeout:
+    }
+    
+    w.WriteHeader(http.StatusServiceUnavailable)
+    json.NewEncoder(w).Encode(map[string]string{
+        "status": "hub not responding",
+    })
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{
+        "status": "healthy",
+    })
+}
+
+// newTLSConfig restricts WSS to TLS 1.2+ with forward-secret AEAD suites
+func newTLSConfig() *tls.Config {
+    return &tls.Config{
+        MinVersion: tls.VersionTLS12,
+        CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+        CipherSuites: []uint16{
+            tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+            tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+            tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+            tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+            tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+            tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+        },
+    }
+}
+
+// resourceUsage is the process's footprint for /status, refreshed at most
+// once per resourceSampleEvery so polling it stays cheap
+type resourceUsage struct {
+    Goroutines int     `json:"goroutines"`
+    HeapAlloc  uint64  `json:"heapAllocBytes"`
+    HeapSys    uint64  `json:"heapSysBytes"`
+    NumGC      uint32  `json:"numGC"`
+    CPUPercent float64 `json:"cpuPercent"` // Smoothed, 100 is one core busy
+    NumCPU     int     `json:"numCPU"`
+}
+
+const resourceSampleEvery = time.Second
+
+var resources struct {
+    mu      sync.Mutex
+    usage   resourceUsage
+    sampled time.Time
+    cpuTime time.Duration // Process user+system time at sampled
+}
+
+// sampleResources returns the cached usage, resampling when it's stale. CPU
+// is the process time used since the last sample over the wall time between,
+// averaged with the previous estimate.
+func sampleResources() resourceUsage {
+    resources.mu.Lock()
+    defer resources.mu.Unlock()
+    
+    now := time.Now()
+    if now.Sub(resources.sampled) < resourceSampleEvery {
+        return resources.usage
+    }
+    
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+    
+    var cpuTime time.Duration
+    var ru syscall.Rusage
+    if syscall.Getrusage(syscall.RUSAGE_SELF, &ru) == nil {
+        cpuTime = time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+    }
+    
+    usage := &resources.usage
+    if !resources.sampled.IsZero() {
+        percent := 100 * float64(cpuTime-resources.cpuTime) / float64(now.Sub(resources.sampled))
+        usage.CPUPercent = math.Round((usage.CPUPercent+percent)/2*10) / 10
+    }
+    usage.Goroutines = runtime.NumGoroutine()
+    usage.HeapAlloc = mem.HeapAlloc
+    usage.HeapSys = mem.HeapSys
+    usage.NumGC = mem.NumGC
+    usage.NumCPU = runtime.NumCPU()
+    
+    resources.sampled = now
+    resources.cpuTime = cpuTime
+    return *usage
+}
+
+// handleStatus is the public /status: rooms and participant ids only
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+    writeStatus(w, false)
+}
+
+// handleAdminStatus adds each participant's IP and User-Agent for the console
+func handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+    writeStatus(w, true)
+}
+
+func writeStatus(w http.ResponseWriter, identify bool) {
+    open := hub.openRooms()
+    rooms := make([]map[string]interface{}, 0, len(open))
+    for _, room := range open {
+        room.withRLock(func() {
+            clients := make([]map[string]interface{}, 0, len(room.Clients))
+            for _, client := range room.Clients {
+                entry := map[string]interface{}{"id": client.ID}
+                if identify {
+                    entry["userAgent"] = client.UserAgent
+                    entry["ip"] = client.RemoteIP
+                }
+                clients = append(clients, entry)
+            }
+            rooms = append(rooms, map[string]interface{}{
+                "name":           room.ID,
+                "createdAt":      room.CreatedAt.UnixMilli(),
+                "participants":   len(room.Clients),
+                "audioOnly":      room.AudioOnly,
+                "videoDropped":   atomic.LoadInt64(&room.VideoDropped),
+                "clients":        clients,
+                "audioLossRate":  lossRate(room.AudioReceived, room.AudioLost),
+                "videoLossRate":  lossRate(room.VideoReceived, room.VideoLost),
+                "audioReported":  room.AudioReceived + room.AudioLost,
+                "videoReported":  room.VideoReceived + room.VideoLost,
+            })
+        })
+    }
+    
+    status := map[string]interface{}{
+        "rooms":     len(rooms),
+        "details":   rooms,
+        "resources": sampleResources(),
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
+
+// Operator announcements (POST /admin/announce, ADMIN_TOKEN): the text is
+// stripped of control characters and cut to maxAnnouncementLength runes
+const maxAnnouncementLength = 280
+
+var announcementLevels = map[string]bool{"info": true, "warning": true, "critical": true}
+
+type announcement struct {
+    Room      string `json:"room"`
+    Text      string `json:"text"`
+    Level     string `json:"level"`
+    delivered chan int // Recipients, or -1 when the room doesn't exist
+}
+
+// announce sends the banner to everyone in the room, spectators included
+func (h *Hub) announce(a *announcement) int {
+    room := h.room(a.Room)
+    if room == nil {
+        return -1
+    }
+    recipients := room.size()
+    
+    h.sendToOthers(room, Message{
+        Type:      "announcement",
+        Room:      a.Room,
+        Text:      a.Text,
+        Level:     a.Level,
+        Timestamp: time.Now().UnixMilli(),
+    }, "")
+    log.Printf("Announcement (%s) to %d clients in room %s: %q", a.Level, recipients, a.Room, a.Text)
+    return recipients
+}
+
+// sanitizeAnnouncement drops invalid UTF-8 and control characters, folds
+// whitespace runs into one space and truncates on a rune boundary
+func sanitizeAnnouncement(text string) string {
+    var b strings.Builder
+    runes, space := 0, false
+    for _, ch := range strings.ToValidUTF8(text, "") {
+        if unicode.IsSpace(ch) {
+            space = b.Len() > 0
+            continue
+        }
+        if unicode.IsControl(ch) || ch == utf8.RuneError {
+            continue
+        }
+        if space {
+            if runes+1 >= maxAnnouncementLength {
+                break
+            }
+            b.WriteByte(' ')
+            runes++
+            space = false
+        }
+        if runes >= maxAnnouncementLength {
+            break
+        }
+        b.WriteRune(ch)
+        runes++
+    }
+    return b.String()
+}
+
+// authorizedAdmin checks the bearer token in constant time. The admin
+// console's browser sends it as the Basic auth password instead, accepted
+// only from the console's own origin so other pages can't ride the cached login.
+func authorizedAdmin(r *http.Request) bool {
+    token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+    if !ok {
+        origin := r.Header.Get("Origin")
+        if origin != "" && origin != "http://"+r.Host && origin != "https://"+r.Host {
+            return false
+        }
+        _, token, ok = r.BasicAuth()
+    }
+    return ok && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+func handleAnnounce(w http.ResponseWriter, r *http.Request) {
+    if !authorizedAdmin(r) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    
+    var a announcement
+    if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&a); err != nil {
+        http.Error(w, "invalid announcement", http.StatusBadRequest)
+        return
+    }
+    a.Text = sanitizeAnnouncement(a.Text)
+    if a.Level == "" {
+        a.Level = "info"
+    }
+    switch {
+    case a.Room == "":
+        http.Error(w, "room is required", http.StatusBadRequest)
+        return
+    case a.Text == "":
+        http.Error(w, "text is required", http.StatusBadRequest)
+        return
+    case !announcementLevels[a.Level]:
+        http.Error(w, "level must be info, warning or critical", http.StatusBadRequest)
+        return
+    }
+    
+    // Run owns the rooms; a wedged hub gets a 503 rather than a hung request
+    a.delivered = make(chan int, 1)
+    delivered, ok := 0, false
+    select {
+    case hub.announcements <- &a:
+        select {
+        case delivered, ok = <-a.delivered:
+        case <-time.After(readyTimeout):
+        }
+    case <-time.After(readyTimeout):
+    }
+    if !ok {
+        http.Error(w, "hub not responding", http.StatusServiceUnavailable)
+        return
+    }
+    if delivered < 0 {
+        http.Error(w, "room not found", http.StatusNotFound)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "room":      a.Room,
+        "level":     a.Level,
+        "text":      a.Text,
+        "delivered": delivered,
+    })
+}
+
+// operatorAction is a mute, unmute or kick from the admin API, applied by Run
+type operatorAction struct {
+    Room   string
+    Target string
+    Action string
+    found  chan bool // false when the room or participant is gone
+}
+
+// operate applies an operator's action like the moderator's, minus the role check
+func (h *Hub) operate(a *operatorAction) bool {
+    room := h.room(a.Room)
+    if room == nil {
+        return false
+    }
+    target := room.client(a.Target)
+    if target == nil {
+        return false
+    }
+    h.sanction(room, target, a.Action, "")
+    return true
+}
+
+// handleOperatorAction serves POST /admin/rooms/{room}/participants/{id}/{action}
+// for mute, unmute and kick
+func handleOperatorAction(w http.ResponseWriter, r *http.Request) {
+    if !authorizedAdmin(r) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    
+    a := operatorAction{
+        Room:   r.PathValue("room"),
+        Target: r.PathValue("id"),
+        Action: r.PathValue("action"),
+        found:  make(chan bool, 1),
+    }
+    if a.Action != "mute" && a.Action != "unmute" && a.Action != "kick" {
+        http.Error(w, "action must be mute, unmute or kick", http.StatusBadRequest)
+        return
+    }
+    
+    found, ok := false, false
+    select {
+    case hub.operatorActions <- &a:
+        select {
+        case found, ok = <-a.found:
+        case <-time.After(readyTimeout):
+        }
+    case <-time.After(readyTimeout):
+    }
+    if !ok {
+        http.Error(w, "hub not responding", http.StatusServiceUnavailable)
+        return
+    }
+    if !found {
+        http.Error(w, "participant not found", http.StatusNotFound)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "room":   a.Room,
+        "id":     a.Target,
+        "action": a.Action,
+    })
+}
+
+// handleDrain serves POST /admin/drain: every client is closed with a
+// reconnect delay and new joins are turned away, as on SIGTERM, but the
+// process keeps running until the operator restarts it
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+    if !authorizedAdmin(r) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    
+    log.Printf("Drain requested through the admin API")
+    hub.Shutdown(flushTimeout + time.Second)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"draining": true})
+}
+
+// handleTrace turns a room's video routing trace on or off with POST
+// {"enabled": bool}, and returns the recorded decisions on GET
+func handleTrace(w http.ResponseWriter, r *http.Request) {
+    if !authorizedAdmin(r) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    
+    room := hub.room(r.PathValue("room"))
+    if room == nil {
+        http.Error(w, "no such room", http.StatusNotFound)
+        return
+    }
+    
+    if r.Method == http.MethodPost {
+        var req struct {
+            Enabled bool `json:"enabled"`
+        }
+        if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+            http.Error(w, "invalid trace request", http.StatusBadRequest)
+            return
+        }
+        switch {
+        case req.Enabled && room.trace.Load() == nil:
+            room.trace.CompareAndSwap(nil, &frameTrace{})
+            log.Printf("Frame trace enabled for room %s", room.ID)
+        case !req.Enabled && room.trace.Swap(nil) != nil:
+            log.Printf("Frame trace disabled for room %s", room.ID)
+        }
+    }
+    
+    trace := room.trace.Load()
+    entries := []*traceEntry{}
+    var total int64
+    if trace != nil {
+        entries, total = trace.snapshot()
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "room":    room.ID,
+        "enabled": trace != nil,
+        "total":   total,
+        "entries": entries,
+    })
+}
+
+// handleTimeseries returns the room's last five minutes, one sample a second
+func handleTimeseries(w http.ResponseWriter, r *http.Request) {
+    room := hub.room(r.PathValue("name"))
+    if room == nil {
+        http.Error(w, "no such room", http.StatusNotFound)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "room":       room.ID,
+        "intervalMs": time.Second.Milliseconds(),
+        "samples":    room.Series.snapshot(),
+    })
+}
+
+// handleParticipants serves GET /rooms/{name}/participants: who is in the
+// room, whose hand is up and the emoji currently showing
+func handleParticipants(w http.ResponseWriter, r *http.Request) {
+    room := hub.room(r.PathValue("name"))
+    if room == nil {
+        http.Error(w, "no such room", http.StatusNotFound)
+        return
+    }
+    
+    now := time.Now()
+    var participants []map[string]interface{}
+    var totals map[string]int
+    var layout RoomLayout
+    room.withRLock(func() {
+        participants = make([]map[string]interface{}, 0, len(room.Clients))
+        totals = make(map[string]int)
+        for id, client := range room.Clients {
+            lastSeen := client.LastSeen()
+            p := map[string]interface{}{
+                "id":         id,
+                "displayName": client.DisplayName,
+                "spectator":  client.Spectator,
+                "moderator":  id == room.Moderator,
+                "handRaised": false,
+                "audioMuted": room.Mutes[id].Audio,
+                "videoMuted": room.Mutes[id].Video,
+                "lastSeen":   lastSeen.UnixMilli(),
+                "away":       awayAfter > 0 && now.Sub(lastSeen) >= awayAfter,
+            }
+            if raised, ok := room.Hands[id]; ok {
+                p["handRaised"] = true
+                p["handRaisedAt"] = raised.UnixMilli()
+            }
+            if active := room.Reactions[id]; active != nil && now.Before(active.Until) {
+                p["reaction"] = active.Kind
+                totals[active.Kind] += active.Count
+            }
+            participants = append(participants, p)
+        }
+        layout = room.Layout
+    })
+    sort.Slice(participants, func(i, j int) bool {
+        return participants[i]["id"].(string) < participants[j]["id"].(string)
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "room":         room.ID,
+        "participants": participants,
+        "hands":        room.raisedHands(),
+        "layout":       layout,
+        "reactions":    totals,
+    })
+}
+
+// Echo test rooms
+//
+// A join with mode "echo", or to the room "__echo__", gets a room of its
+// own, named echoRoomPrefix plus its id, where its audio and video come back to it echoDelay after the
+// server took them in. Video goes through the encoder first, so a client can
+// check capture, the server's encode and the round trip before joining a
+// real call. Nothing is ever echoed outside these rooms.
+
+const (
+    echoRoomPrefix = "__echo__/"
+    echoDelay      = 1500 * time.Millisecond
+    echoQueue      = 256 // Held messages per client, a few seconds of media
+)
+
+type echoItem struct {
+    due time.Time
+    msg Message
+}
+
+// echoDelayMs is what the welcome reports, 0 outside echo rooms
+func (r *Room) echoDelayMs() int64 {
+    if !r.Echo {
+        return 0
+    }
+    return echoDelay.Milliseconds()
+}
+
+// echoBack holds an audio chunk for its own sender
+func (h *Hub) echoBack(room *Room, msg Message, from string) {
+    if sender := room.client(from); sender != nil {
+        msg.From = from
+        sender.echo(msg)
+    }
+}
+
+// echo queues msg to come back after echoDelay, dropping it if the buffer
+// is full rather than holding up the hub
+func (c *Client) echo(msg Message) {
+    select {
+    case c.echoes <- echoItem{due: time.Now().Add(echoDelay), msg: msg}:
+    default:
+        atomic.AddInt64(&c.Hub.EchoDropped, 1)
+    }
+}
+
+// echoLoop releases held media in order as each one's delay runs out. Video
+// is restamped on release so STALE_VIDEO_AFTER measures the trip back, not
+// the deliberate wait.
+func (c *Client) echoLoop() {
+    timer := time.NewTimer(0)
+    <-timer.C
+    defer timer.Stop()
+    
+    for {
+        var item echoItem
+        select {
+        case item = <-c.echoes:
+        case <-c.flushed:
+            return
+        }
+        
+        timer.Reset(time.Until(item.due))
+        select {
+        case <-timer.C:
+        case <-c.flushed:
+            return
+        }
+        
+        if item.msg.Type == "video-frame" {
+            item.msg.ServerTime = time.Now().UnixMilli()
+        }
+        data, err := json.Marshal(item.msg)
+        if err != nil {
+            continue
+        }
+        if c.pipe(data) {
+            atomic.AddInt64(&c.Hub.Echoed, 1)
+        } else {
+            atomic.AddInt64(&c.Hub.EchoDropped, 1)
+        }
+    }
+}
+
+// Room lifecycle webhooks
+//
+// With WEBHOOK_URL set, the server POSTs a JSON event for room-created,
+// first-participant-joined, participant-left and room-destroyed. Events wait
+// in a bounded queue drained by one goroutine, so they arrive in order and a
+// slow or failing endpoint costs dropped events, never hub time. With
+// WEBHOOK_SECRET set, X-Webhook-Signature carries "sha256=" and the hex
+// HMAC-SHA256 of the body.
+
+const (
+    webhookQueue    = 256
+    webhookAttempts = 4
+    webhookBackoff  = 500 * time.Millisecond // Doubled after each failed attempt
+    webhookTimeout  = 5 * time.Second
+)
+
+// webhookEvent is one delivery's body. Retries repeat ID so the receiver
+// can tell them apart from new events.
+type webhookEvent struct {
+    ID           string `json:"id"`
+    Event        string `json:"event"`
+    Room         string `json:"room"`
+    Participant  string `json:"participant,omitempty"`
+    Reason       string `json:"reason,omitempty"` // participant-left's close reason, room-destroyed's idle or evicted
+    Participants int    `json:"participants"`     // Room size after the event
+    Timestamp    int64  `json:"timestamp"`
+}
+
+// webhookSender queues events for WEBHOOK_URL; a nil sender drops them
+type webhookSender struct {
+    url    string
+    secret []byte
+    client *http.Client
+    queue  chan webhookEvent
+    
+    Sent    int64
+    Failed  int64 // Gave up after webhookAttempts
+    Dropped int64 // Queue was full
+}
+
+// webhooks is nil unless WEBHOOK_URL is set
+var webhooks *webhookSender
+
+func newWebhookSender(target, secret string) (*webhookSender, error) {
+    if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return nil, fmt.Errorf("WEBHOOK_URL %q is not an http(s) URL", target)
+    }
+    return &webhookSender{
+        url:    target,
+        secret: []byte(secret),
+        client: &http.Client{Timeout: webhookTimeout},
+        queue:  make(chan webhookEvent, webhookQueue),
+    }, nil
+}
+
+// emit queues an event without ever blocking the caller
+func (w *webhookSender) emit(event, room, participant, reason string, participants int) {
+    if w == nil {
+        return
+    }
+    buf := make([]byte, 8)
+    rand.Read(buf)
+    
+    select {
+    case w.queue <- webhookEvent{
+        ID:           hex.EncodeToString(buf),
+        Event:        event,
+        Room:         room,
+        Participant:  participant,
+        Reason:       reason,
+        Participants: participants,
+        Timestamp:    time.Now().UnixMilli(),
+    }:
+    default:
+        atomic.AddInt64(&w.Dropped, 1)
+    }
+}
+
+// run delivers queued events until the process exits, retrying each with
+// backoff while the endpoint fails with a network error, 429 or 5xx
+func (w *webhookSender) run() {
+    for event := range w.queue {
+        body, err := json.Marshal(event)
+        if err != nil {
+            continue
+        }
+        
+        backoff := webhookBackoff
+        for attempt := 1; ; attempt++ {
+            retry, err := w.deliver(body)
+            if err == nil {
+                atomic.AddInt64(&w.Sent, 1)
+                break
+            }
+            if !retry || attempt == webhookAttempts {
+                atomic.AddInt64(&w.Failed, 1)
+                log.Printf("Webhook %s for room %s failed after %d attempts: %v", event.Event, event.Room, attempt, err)
+                break
+            }
+            time.Sleep(backoff)
+            backoff *= 2
+        }
+    }
+}
+
+// deliver posts one body, reporting whether a failure is worth retrying
+func (w *webhookSender) deliver(body []byte) (bool, error) {
+    req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+    if err != nil {
+        return false, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if len(w.secret) > 0 {
+        mac := hmac.New(sha256.New, w.secret)
+        mac.Write(body)
+        req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+    
+    resp, err := w.client.Do(req)
+    if err != nil {
+        return true, err
+    }
+    io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+    resp.Body.Close()
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, fmt.Errorf("endpoint answered %s", resp.Status)
+    }
+    return false, nil
+}
+
+// Metrics sinks
+//
+// Besides the /stats snapshot, hub lifecycle and broadcast metrics can be
+// pushed out through a MetricsSink picked by METRICS_SINK: "statsd" sends
+// UDP lines to STATSD_ADDR, "otlp" posts OTLP/HTTP JSON to OTLP_ENDPOINT
+// every metricsInterval. Names are dotted and start with METRICS_PREFIX.
+// Sinks are called from the hub and encoder goroutines, so none may block.
+
+// MetricsSink receives counter increments, gauge readings and timings
+type MetricsSink interface {
+    Count(name string, delta int64)
+    Gauge(name string, value float64)
+    Timing(name string, d time.Duration)
+}
+
+// metrics is where the hub reports; a noopSink unless METRICS_SINK is set
+var metrics MetricsSink = noopSink{}
+
+type noopSink struct{}
+
+func (noopSink) Count(string, int64)          {}
+func (noopSink) Gauge(string, float64)        {}
+func (noopSink) Timing(string, time.Duration) {}
+
+const (
+    metricsInterval = 10 * time.Second // OTLP push period
+    statsdQueue     = 4096             // Lines waiting to be packed
+    statsdPacket    = 1432             // Datagram payload that fits common MTUs
+    statsdFlush     = 100 * time.Millisecond
+)
+
+// newMetricsSink builds the sink named by METRICS_SINK
+func newMetricsSink(kind, prefix string) (MetricsSink, error) {
+    switch kind {
+    case "", "none":
+        return noopSink{}, nil
+    case "statsd":
+        addr := os.Getenv("STATSD_ADDR")
+        if addr == "" {
+            addr = "127.0.0.1:8125"
+        }
+        return newStatsdSink(addr, prefix)
+    case "otlp":
+        endpoint := os.Getenv("OTLP_ENDPOINT")
+        if endpoint == "" {
+            endpoint = "http://localhost:4318/v1/metrics"
+        }
+        return newOTLPSink(endpoint, prefix)
+    }
+    return nil, fmt.Errorf("METRICS_SINK %q is not none, statsd or otlp", kind)
+}
+
+// statsdSink formats each call as a statsd line and packs queued lines
+// into datagrams; lines that find the queue full are dropped
+type statsdSink struct {
+    prefix string
+    conn   net.Conn
+    lines  chan string
+    
+    Dropped int64
+}
+
+func newStatsdSink(addr, prefix string) (*statsdSink, error) {
+    conn, err := net.Dial("udp", addr)
+    if err != nil {
+        return nil, fmt.Errorf("STATSD_ADDR %q: %v", addr, err)
+    }
+    s := &statsdSink{prefix: prefix, conn: conn, lines: make(chan string, statsdQueue)}
+    go s.run()
+    return s, nil
+}
+
+// statsdLine is one metric in the statsd text format, e.g.
+// "conference.clients.joined:1|c"
+func statsdLine(prefix, name, value, kind string) string {
+    return prefix + name + ":" + value + "|" + kind
+}
+
+func (s *statsdSink) Count(name string, delta int64) {
+    s.send(statsdLine(s.prefix, name, strconv.FormatInt(delta, 10), "c"))
+}
+
+func (s *statsdSink) Gauge(name string, value float64) {
+    s.send(statsdLine(s.prefix, name, strconv.FormatFloat(value, 'f', -1, 64), "g"))
+}
+
+func (s *statsdSink) Timing(name string, d time.Duration) {
+    ms := float64(d.Microseconds()) / 1000
+    s.send(statsdLine(s.prefix, name, strconv.FormatFloat(ms, 'f', -1, 64), "ms"))
+}
+
+func (s *statsdSink) send(line string) {
+    select {
+    case s.lines <- line:
+    default:
+        atomic.AddInt64(&s.Dropped, 1)
+    }
+}
+
+// run writes a datagram whenever the next line wouldn't fit, and whatever
+// is pending every statsdFlush
+func (s *statsdSink) run() {
+    ticker := time.NewTicker(statsdFlush)
+    defer ticker.Stop()
+    
+    var packet []byte
+    flush := func() {
+        if len(packet) > 0 {
+            s.conn.Write(packet)
+            packet = packet[:0]
+        }
+    }
+    for {
+        select {
+        case line := <-s.lines:
+            if len(packet) > 0 && len(packet)+1+len(line) > statsdPacket {
+                flush()
+            }
+            if len(packet) > 0 {
+                packet = append(packet, '\n')
+            }
+            packet = append(packet, line...)
+        case <-ticker.C:
+            flush()
+        }
+    }
+}
+
+// Timing histogram buckets for OTLP, in milliseconds
+var otlpTimingBounds = []float64{0.1, 0.5, 1, 2, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// otlpSink aggregates in memory and posts cumulative totals every
+// metricsInterval: counters as monotonic sums, gauges as their last
+// reading, timings as histograms
+type otlpSink struct {
+    endpoint string
+    prefix   string
+    client   *http.Client
+    start    time.Time
+    
+    mu       sync.Mutex
+    counters map[string]int64
+    gauges   map[string]float64
+    timings  map[string]*otlpHistogram
+    
+    Failed   int64 // Pushes the collector didn't accept
+}
+
+type otlpHistogram struct {
+    count   uint64
+    sum     float64
+    buckets []uint64 // len(otlpTimingBounds)+1, the last for anything above
+}
+
+func newOTLPSink(endpoint, prefix string) (*otlpSink, error) {
+    if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return nil, fmt.Errorf("OTLP_ENDPOINT %q is not an http(s) URL", endpoint)
+    }
+    s := &otlpSink{
+        endpoint: endpoint,
+        prefix:   prefix,
+        client:   &http.Client{Timeout: 5 * time.Second},
+        start:    time.Now(),
+        counters: make(map[string]int64),
+        gauges:   make(map[string]float64),
+        timings:  make(map[string]*otlpHistogram),
+    }
+    go s.run()
+    return s, nil
+}
+
+func (s *otlpSink) Count(name string, delta int64) {
+    s.mu.Lock()
+    s.counters[name] += delta
+    s.mu.Unlock()
+}
+
+func (s *otlpSink) Gauge(name string, value float64) {
+    s.mu.Lock()
+    s.gauges[name] = value
+    s.mu.Unlock()
+}
+
+func (s *otlpSink) Timing(name string, d time.Duration) {
+    ms := float64(d.Microseconds()) / 1000
+    bucket := sort.SearchFloat64s(otlpTimingBounds, ms)
+    
+    s.mu.Lock()
+    h := s.timings[name]
+    if h == nil {
+        h = &otlpHistogram{buckets: make([]uint64, len(otlpTimingBounds)+1)}
+        s.timings[name] = h
+    }
+    h.count++
+    h.sum += ms
+    h.buckets[bucket]++
+    s.mu.Unlock()
+}
+
+func (s *otlpSink) run() {
+    ticker := time.NewTicker(metricsInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        body, err := json.Marshal(s.export(time.Now()))
+        if err != nil {
+            continue
+        }
+        resp, err := s.client.Post(s.endpoint, "application/json", bytes.NewReader(body))
+        if err == nil {
+            io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+            resp.Body.Close()
+            if resp.StatusCode < 200 || resp.StatusCode > 299 {
+                err = fmt.Errorf("collector answered %s", resp.Status)
+            }
+        }
+        if err != nil {
+            if atomic.AddInt64(&s.Failed, 1) == 1 {
+                log.Printf("OTLP metrics push to %s failed: %v", s.endpoint, err)
+            }
+        }
+    }
+}
+
+// export builds an ExportMetricsServiceRequest in OTLP's JSON encoding,
+// where 64-bit integers are strings
+func (s *otlpSink) export(now time.Time) map[string]interface{} {
+    start := strconv.FormatInt(s.start.UnixNano(), 10)
+    at := strconv.FormatInt(now.UnixNano(), 10)
+    
+    s.mu.Lock()
+    var list []map[string]interface{}
+    for name, total := range s.counters {
+        list = append(list, map[string]interface{}{
+            "name": s.prefix + name,
+            "sum": map[string]interface{}{
+                "aggregationTemporality": 2, // Cumulative
+                "isMonotonic":            true,
+                "dataPoints": []map[string]interface{}{{
+                    "startTimeUnixNano": start,
+                    "timeUnixNano":      at,
+                    "asInt":             strconv.FormatInt(total, 10),
+                }},
+            },
+        })
+    }
+    for name, value := range s.gauges {
+        list = append(list, map[string]interface{}{
+            "name": s.prefix + name,
+            "gauge": map[string]interface{}{
+                "dataPoints": []map[string]interface{}{{
+                    "timeUnixNano": at,
+                    "asDouble":     value,
+                }},
+            },
+        })
+    }
+    for name, h := range s.timings {
+        buckets := make([]string, len(h.buckets))
+        for i, n := range h.buckets {
+            buckets[i] = strconv.FormatUint(n, 10)
+        }
+        list = append(list, map[string]interface{}{
+            "name": s.prefix + name,
+            "unit": "ms",
+            "histogram": map[string]interface{}{
+                "aggregationTemporality": 2,
+                "dataPoints": []map[string]interface{}{{
+                    "startTimeUnixNano": start,
+                    "timeUnixNano":      at,
+                    "count":             strconv.FormatUint(h.count, 10),
+                    "sum":               h.sum,
+                    "bucketCounts":      buckets,
+                    "explicitBounds":    otlpTimingBounds,
+                }},
+            },
+        })
+    }
+    s.mu.Unlock()
+    
+    return map[string]interface{}{
+        "resourceMetrics": []map[string]interface{}{{
+            "resource": map[string]interface{}{
+                "attributes": []map[string]interface{}{{
+                    "key":   "service.name",
+                    "value": map[string]string{"stringValue": "conference-webp"},
+                }},
+            },
+            "scopeMetrics": []map[string]interface{}{{
+                "scope":   map[string]string{"name": "conference"},
+                "metrics": list,
+            }},
+        }},
+    }
+}
+
+// Region steering
+//
+// GET /join?room=X tells a client which server to open its WebSocket on. Each
+// server posts its load to every PEERS entry, so every server holds the same
+// table and can answer /join. A room already hosted somewhere wins, so a call
+// never splits across servers; otherwise the least loaded server in the
+// client's REGION_CIDRS region is chosen, and this server when none fits.
+
+const (
+    heartbeatInterval = 10 * time.Second
+    peerExpiry        = 3 * heartbeatInterval // Missed heartbeats before a peer is ignored
+)
+
+// regionRange maps one client network to a region name
+type regionRange struct {
+    network *net.IPNet
+    region  string
+}
+
+// serverLoad is what each server reports in its heartbeat
+type serverLoad struct {
+    URL     string    `json:"url"`
+    Region  string    `json:"region"`
+    Clients int       `json:"clients"`
+    Rooms   []string  `json:"rooms"`
+    seen    time.Time
+}
+
+var (
+    serverRegion = os.Getenv("SERVER_REGION")
+    publicURL    = os.Getenv("PUBLIC_URL")  // wss:// URL clients are sent to for this server
+    peerToken    = os.Getenv("PEER_TOKEN")  // Shared bearer token for heartbeats, optional
+    adminToken   = os.Getenv("ADMIN_TOKEN") // Bearer token for /admin routes, which are off without it
+    regionRanges []regionRange
+    
+    peerMu    sync.RWMutex
+    peerLoads = make(map[string]*serverLoad)
+)
+
+// parseRegionCIDRs reads "10.0.0.0/8=eu-central,198.51.100.0/24=us-east",
+// most specific network first so lookups take the longest match
+func parseRegionCIDRs(spec string) ([]regionRange, error) {
+    var ranges []regionRange
+    for _, entry := range strings.Split(spec, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        cidr, region, ok := strings.Cut(entry, "=")
+        if !ok || region == "" {
+            return nil, fmt.Errorf("region entry %q: want CIDR=region", entry)
+        }
+        _, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+        if err != nil {
+            return nil, fmt.Errorf("region entry %q: %v", entry, err)
+        }
+        ranges = append(ranges, regionRange{network: network, region: strings.TrimSpace(region)})
+    }
+    
+    sort.SliceStable(ranges, func(i, j int) bool {
+        a, _ := ranges[i].network.Mask.Size()
+        b, _ := ranges[j].network.Mask.Size()
+        return a > b
+    })
+    return ranges, nil
+}
+
+// regionFor returns the region of the first matching range, "" if none
+func regionFor(ranges []regionRange, ip string) string {
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return ""
+    }
+    for _, r := range ranges {
+        if r.network.Contains(addr) {
+            return r.region
+        }
+    }
+    return ""
+}
+
+// localLoad snapshots this server for a heartbeat or a /join decision
+func localLoad(url string) *serverLoad {
+    hub.mu.RLock()
+    defer hub.mu.RUnlock()
+    
+    load := &serverLoad{URL: url, Region: serverRegion, Rooms: make([]string, 0, len(hub.Rooms))}
+    for id, room := range hub.Rooms {
+        load.Clients += room.size()
+        load.Rooms = append(load.Rooms, id)
+    }
+    return load
+}
+
+// sendHeartbeats posts this server's load to every peer until the process exits
+func sendHeartbeats(peers []string) {
+    client := &http.Client{Timeout: 2 * time.Second}
+    ticker := time.NewTicker(heartbeatInterval)
+    defer ticker.Stop()
+    
+    for ; true; <-ticker.C {
+        body, err := json.Marshal(localLoad(publicURL))
+        if err != nil {
+            continue
+        }
+        for _, peer := range peers {
+            req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(peer, "/")+"/heartbeat", bytes.NewReader(body))
+            if err != nil {
+                continue
+            }
+            req.Header.Set("Content-Type", "application/json")
+            if peerToken != "" {
+                req.Header.Set("Authorization", "Bearer "+peerToken)
+            }
+            resp, err := client.Do(req)
+            if err != nil {
+                log.Printf("Heartbeat to %s failed: %v", peer, err)
+                continue
+            }
+            resp.Body.Close()
+        }
+    }
+}
+
+func handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+    if peerToken != "" && r.Header.Get("Authorization") != "Bearer "+peerToken {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    
+    var load serverLoad
+    if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&load); err != nil || load.URL == "" {
+        http.Error(w, "invalid heartbeat", http.StatusBadRequest)
+        return
+    }
+    load.seen = time.Now()
+    
+    peerMu.Lock()
+    peerLoads[load.URL] = &load
+    peerMu.Unlock()
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// handleJoin picks a server for the room without proxying any media
+func handleJoin(w http.ResponseWriter, r *http.Request) {
+    roomID := r.URL.Query().Get("room")
+    if roomID == "" {
+        http.Error(w, "room is required", http.StatusBadRequest)
+        return
+    }
+    
+    url := publicURL
+    if url == "" {
+        scheme := "ws"
+        if r.TLS != nil || (trustProxy && r.Header.Get("X-Forwarded-Proto") == "https") {
+            scheme = "wss"
+        }
+        url = scheme + "://" + r.Host + "/ws"
+    }
+    
+    // This server goes first so ties stay local
+    candidates := []*serverLoad{localLoad(url)}
+    peerMu.RLock()
+    for _, load := range peerLoads {
+        if load.URL != publicURL && time.Since(load.seen) < peerExpiry {
+            candidates = append(candidates, load)
+        }
+    }
+    peerMu.RUnlock()
+    
+    clientRegion := regionFor(regionRanges, clientIP(r))
+    best, reason := candidates[0], "local"
+    
+hosted:
+    for _, load := range candidates {
+        for _, id := range load.Rooms {
+            if id == roomID {
+                best, reason = load, "room"
+                break hosted
+            }
+        }
+    }
+    if reason == "local" && clientRegion != "" {
+        var nearest *serverLoad
+        for _, load := range candidates {
+            if load.Region == clientRegion && (nearest == nil || load.Clients < nearest.Clients) {
+                nearest = load
+            }
+        }
+        if nearest != nil {
+            best, reason = nearest, "region"
+        }
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "url":          best.URL,
+        "region":       best.Region,
+        "clientRegion": clientRegion,
+        "reason":       reason,
+        "local":        best == candidates[0],
+    })
+}
+
+// Recording encryption
+//
+// RECORDING_ENCRYPT=true seals room recordings with AES-256-GCM. Each
+// recording gets a random data key, kept in the file's first line sealed
+// under RECORDING_KEY (32 bytes, hex or base64); every later line is one
+// event sealed under the data key, with its position in the file as
+// additional data so events can't be reordered or spliced in from another
+// recording. Exports decrypt as they read, so an encrypted recording
+// exports like a plain one as long as RECORDING_KEY is set.
+
+const recordingCipher = "aes-256-gcm"
+
+var (
+    recordingEncrypt bool
+    recordingKey     []byte // Master key; also needed to export with encryption off
+)
+
+// recordingHeader opens an encrypted recording
+type recordingHeader struct {
+    Encryption string `json:"encryption"`
+    Key        []byte `json:"key"` // Data key sealed under the master key
+}
+
+func parseRecordingKey(s string) ([]byte, error) {
+    s = strings.TrimSpace(s)
+    if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+        return key, nil
+    }
+    if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+        return key, nil
+    }
+    return nil, errors.New("RECORDING_KEY must be 32 bytes, hex or base64 encoded")
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// sealRecord encrypts plain under a fresh nonce, which it prepends
+func sealRecord(aead cipher.AEAD, plain, ad []byte) []byte {
+    nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+    rand.Read(nonce)
+    return aead.Seal(nonce, nonce, plain, ad)
+}
+
+func openRecord(aead cipher.AEAD, sealed, ad []byte) ([]byte, error) {
+    if len(sealed) < aead.NonceSize() {
+        return nil, errors.New("truncated record")
+    }
+    return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], ad)
+}
+
+// recordAD binds a sealed event to its position after the header
+func recordAD(n uint64) []byte {
+    return binary.BigEndian.AppendUint64(nil, n)
+}
+
+// newRecordingFile opens a room recording, encrypted when RECORDING_ENCRYPT is on
+func newRecordingFile(path string) (*messageRecorder, error) {
+    rec, err := newMessageRecorder(path)
+    if err != nil || !recordingEncrypt {
+        return rec, err
+    }
+    
+    dataKey := make([]byte, 32)
+    if _, err := rand.Read(dataKey); err != nil {
+        rec.Close()
+        return nil, err
+    }
+    master, err := newGCM(recordingKey)
+    if err == nil {
+        rec.aead, err = newGCM(dataKey)
+    }
+    if err == nil {
+        err = rec.enc.Encode(recordingHeader{
+            Encryption: recordingCipher,
+            Key:        sealRecord(master, dataKey, []byte(recordingCipher)),
+        })
+    }
+    if err != nil {
+        rec.Close()
+        return nil, err
+    }
+    return rec, nil
+}
+
+// readRecordingLines is readJSONLines for recordings, decrypting sealed
+// events with the data key from the header before them
+func readRecordingLines(path string, fn func(line []byte) error) error {
+    var aead cipher.AEAD
+    var n uint64
+    return readJSONLines(path, func(line []byte) error {
+        if line[0] == '"' {
+            if aead == nil {
+                return errors.New("encrypted event before a recording header")
+            }
+            var sealed []byte
+            if err := json.Unmarshal(line, &sealed); err != nil {
+                return err
+            }
+            n++
+            plain, err := openRecord(aead, sealed, recordAD(n))
+            if err != nil {
+                return fmt.Errorf("decrypting event: %v", err)
+            }
+            return fn(plain)
+        }
+        if !bytes.HasPrefix(line, []byte(`{"encryption"`)) {
+            return fn(line)
+        }
+        
+        var header recordingHeader
+        if err := json.Unmarshal(line, &header); err != nil {
+            return err
+        }
+        if header.Encryption != recordingCipher {
+            return fmt.Errorf("unsupported recording encryption %q", header.Encryption)
+        }
+        if recordingKey == nil {
+            return errors.New("recording is encrypted and RECORDING_KEY is not set")
+        }
+        master, err := newGCM(recordingKey)
+        if err != nil {
+            return err
+        }
+        dataKey, err := openRecord(master, header.Key, []byte(recordingCipher))
+        if err != nil {
+            return errors.New("recording was encrypted under a different RECORDING_KEY")
+        }
+        // A recording reopened in the same second appends a second header
+        n = 0
+        aead, err = newGCM(dataKey)
+        return err
+    })
+}
+
+// Recording export
+//
+// RECORDINGS_DIR holds RECORD_LOG files (<id>.jsonl). POST
+// /recordings/{id}/export muxes one participant's frames and PCM into WebM
+// with ffmpeg in the background; poll /recordings/exports/{job} for the
+// download URL. Frame durations come from the recorded arrival times, so
+// playback keeps the live call's variable frame rate. Recording ids are
+// only a room name and a timestamp and the exports are plaintext, so all
+// three routes need the admin token. A finished job and its file are kept
+// for exportJobTTL, and at most maxExportJobs are tracked at once.
+
+const (
+    exportSampleRate = 48000 // audio-chunk payloads are 16-bit mono PCM
+    exportTimeout    = 10 * time.Minute
+    exportJobTTL     = time.Hour
+    maxExportJobs    = 64
+)
+
+var (
+    recordingsDir = os.Getenv("RECORDINGS_DIR")
+    
+    exportMu   sync.Mutex
+    exportJobs = make(map[string]*exportJob)
+    exportNext int
+    exportSlot = make(chan struct{}, 1) // One ffmpeg at a time
+)
+
+type exportJob struct {
+    ID          string `json:"id"`
+    Recording   string `json:"recording"`
+    Participant string `json:"participant,omitempty"`
+    Status      string `json:"status"` // queued, running, done, failed
+    Error       string `json:"error,omitempty"`
+    URL         string `json:"url,omitempty"`
+    
+    finished time.Time // When it was done or failed, zero until then
+}
+
+// recordedMedia is one participant's stream pulled out of a record log
+type recordedMedia struct {
+    frames  [][]byte
+    frameAt []int64
+    audio   [][]byte
+    audioAt []int64
+}
+
+func exportsDir() string {
+    return filepath.Join(recordingsDir, "exports")
+}
+
+func setExportJob(job *exportJob, update func(*exportJob)) {
+    exportMu.Lock()
+    update(job)
+    exportMu.Unlock()
+}
+
+// prepareExports checks what exports need before the server takes requests
+func prepareExports() error {
+    if _, err := exec.LookPath("ffmpeg"); err != nil {
+        return fmt.Errorf("RECORDINGS_DIR is set but ffmpeg is not available: %v", err)
+    }
+    if err := os.MkdirAll(exportsDir(), 0755); err != nil {
+        return fmt.Errorf("failed to create exports directory: %v", err)
+    }
+    return nil
+}
+
+// pruneExportJobs forgets finished jobs older than exportJobTTL, then the
+// oldest finished while the map is full, removing their files. It reports
+// whether there is room for another job; callers hold exportMu.
+func pruneExportJobs(now time.Time) bool {
+    drop := func(job *exportJob) {
+        delete(exportJobs, job.ID)
+        os.Remove(filepath.Join(exportsDir(), job.ID+".webm"))
+    }
+    for _, job := range exportJobs {
+        if !job.finished.IsZero() && now.Sub(job.finished) >= exportJobTTL {
+            drop(job)
+        }
+    }
+    for len(exportJobs) >= maxExportJobs {
+        var oldest *exportJob
+        for _, job := range exportJobs {
+            if !job.finished.IsZero() && (oldest == nil || job.finished.Before(oldest.finished)) {
+                oldest = job
+            }
+        }
+        if oldest == nil {
+            return false
+        }
+        drop(oldest)
+    }
+    return true
+}
+
+func handleExportStart(w http.ResponseWriter, r *http.Request) {
+    id := r.PathValue("id")
+    if id == "" || filepath.Base(id) != id {
+        http.Error(w, "invalid recording id", http.StatusBadRequest)
+        return
+    }
+    path := filepath.Join(recordingsDir, id+".jsonl")
+    if _, err := os.Stat(path); err != nil {
+        http.Error(w, "recording not found", http.StatusNotFound)
+        return
+    }
+    
+    exportMu.Lock()
+    if !pruneExportJobs(time.Now()) {
+        exportMu.Unlock()
+        http.Error(w, "too many exports in progress", http.StatusServiceUnavailable)
+        return
+    }
+    exportNext++
+    job := &exportJob{
+        ID:          fmt.Sprintf("export-%d-%d", time.Now().Unix(), exportNext),
+        Recording:   id,
+        Participant: r.URL.Query().Get("participant"),
+        Status:      "queued",
+    }
+    exportJobs[job.ID] = job
+    snapshot := *job
+    exportMu.Unlock()
+    
+    go runExport(job, path)
+    
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(snapshot)
+}
+
+// handleExportFile serves one finished export; never a directory listing
+func handleExportFile(w http.ResponseWriter, r *http.Request) {
+    name := r.PathValue("name")
+    if name == "" || filepath.Base(name) != name {
+        http.Error(w, "invalid export name", http.StatusBadRequest)
+        return
+    }
+    path := filepath.Join(exportsDir(), name)
+    if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+        http.Error(w, "export not found", http.StatusNotFound)
+        return
+    }
+    http.ServeFile(w, r, path)
+}
+
+func handleExportStatus(w http.ResponseWriter, r *http.Request) {
+    exportMu.Lock()
+    job, ok := exportJobs[r.PathValue("job")]
+    var snapshot exportJob
+    if ok {
+        snapshot = *job
+    }
+    exportMu.Unlock()
+    
+    if !ok {
+        http.Error(w, "export job not found", http.StatusNotFound)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(snapshot)
+}
+
+func runExport(job *exportJob, path string) {
+    exportSlot <- struct{}{}
+    defer func() { <-exportSlot }()
+    
+    setExportJob(job, func(j *exportJob) { j.Status = "running" })
+    
+    out := filepath.Join(exportsDir(), job.ID+".webm")
+    err := exportRecording(path, job.Participant, out)
+    
+    setExportJob(job, func(j *exportJob) {
+        j.finished = time.Now()
+        if err != nil {
+            j.Status = "failed"
+            j.Error = err.Error()
+            return
+        }
+        j.Status = "done"
+        j.URL = "/recordings/files/" + job.ID + ".webm"
+    })
+    
+    if err != nil {
+        log.Printf("Export %s of %s failed: %v", job.ID, job.Recording, err)
+    } else {
+        log.Printf("Export %s of %s written to %s", job.ID, job.Recording, out)
+    }
+}
+
+// loadRecordedMedia collects one participant's frames and audio; with no
+// participant given it takes the first connection that sent video
+func loadRecordedMedia(path, participant string) (*recordedMedia, error) {
+    owners := make(map[string]string) // conn key -> client id
+    streams := make(map[string]*recordedMedia)
+    var videoOrder []string
+    
+    err := readRecordingLines(path, func(line []byte) error {
+        var ev replayEvent
+        if err := json.Unmarshal(line, &ev); err != nil {
+            return err
+        }
+        if ev.Close || len(ev.Data) == 0 {
+            return nil
+        }
+        
+        var msg Message
+        if err := json.Unmarshal(ev.Data, &msg); err != nil {
+            return nil
+        }
+        if msg.Type == "join" {
+            owners[ev.Conn] = msg.ID
+            return nil
+        }
+        if msg.Type != "video-frame" && msg.Type != "audio-chunk" {
+            return nil
+        }
+        
+        payload, err := base64.StdEncoding.DecodeString(msg.Data)
+        if err != nil {
+            return nil
+        }
+        
+        media := streams[ev.Conn]
+        if media == nil {
+            media = &recordedMedia{}
+            streams[ev.Conn] = media
+        }
+        if msg.Type == "video-frame" {
+            if len(media.frames) == 0 {
+                videoOrder = append(videoOrder, ev.Conn)
+            }
+            media.frames = append(media.frames, payload)
+            media.frameAt = append(media.frameAt, ev.At)
+        } else {
+            media.audio = append(media.audio, payload)
+            media.audioAt = append(media.audioAt, ev.At)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    if participant == "" {
+        if len(videoOrder) == 0 {
+            return nil, fmt.Errorf("recording has no video frames")
+        }
+        return streams[videoOrder[0]], nil
+    }
+    for conn, id := range owners {
+        if id == participant && streams[conn] != nil && len(streams[conn].frames) > 0 {
+            return streams[conn], nil
+        }
+    }
+    return nil, fmt.Errorf("no video from participant %q in recording", participant)
+}
+
+// exportRecording stages frames, a concat list with recorded durations and a
+// gap-padded PCM track, then hands them to ffmpeg
+func exportRecording(path, participant, out string) error {
+    media, err := loadRecordedMedia(path, participant)
+    if err != nil {
+        return err
+    }
+    
+    work, err := os.MkdirTemp("", "export-*")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(work)
+    
+    origin := media.frameAt[0]
+    if len(media.audioAt) > 0 && media.audioAt[0] < origin {
+        origin = media.audioAt[0]
+    }
+    
+    // Each frame stays up until the next one arrived
+    var list bytes.Buffer
+    var name string
+    for i, frame := range media.frames {
+        ext := ".jpg"
+        switch http.DetectContentType(frame) {
+        case "image/png":
+            ext = ".png"
+        case "image/webp":
+            ext = ".webp"
+        }
+        name = fmt.Sprintf("frame-%06d%s", i, ext)
+        if err := os.WriteFile(filepath.Join(work, name), frame, 0644); err != nil {
+            return err
+        }
+        
+        start := media.frameAt[i]
+        if i == 0 {
+            start = origin
+        }
+        end := start + 100
+        if i+1 < len(media.frames) {
+            end = media.frameAt[i+1]
+        }
+        fmt.Fprintf(&list, "file '%s'\nduration %.3f\n", name, float64(end-start)/1000)
+    }
+    // The concat demuxer ignores the last duration unless the file repeats
+    fmt.Fprintf(&list, "file '%s'\n", name)
+    
+    listPath := filepath.Join(work, "frames.txt")
+    if err := os.WriteFile(listPath, list.Bytes(), 0644); err != nil {
+        return err
+    }
+    
+    args := []string{"-y", "-f", "concat", "-safe", "0", "-i", listPath}
+    
+    if len(media.audio) > 0 {
+        // Pad silence wherever chunks arrived later than the samples so far cover
+        var pcm bytes.Buffer
+        for i, chunk := range media.audio {
+            due := (media.audioAt[i] - origin) * exportSampleRate / 1000 * 2
+            if gap := due - int64(pcm.Len()); gap > 0 {
+                pcm.Write(make([]byte, gap&^1))
+            }
+            pcm.Write(chunk)
+        }
+        
+        pcmPath := filepath.Join(work, "audio.pcm")
+        if err := os.WriteFile(pcmPath, pcm.Bytes(), 0644); err != nil {
+            return err
+        }
+        args = append(args, "-f", "s16le", "-ar", strconv.Itoa(exportSampleRate), "-ac", "1", "-i", pcmPath, "-c:a", "libopus")
+    }
+    
+    args = append(args, "-c:v", "libvpx-vp9", "-vsync", "vfr", "-pix_fmt", "yuv420p", out)
+    
+    ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+    defer cancel()
+    
+    if output, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+        tail := output
+        if len(tail) > 500 {
+            tail = tail[len(tail)-500:]
+        }
+        return fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(tail))
+    }
+    return nil
+}
+
+// registerPprof mounts the profiler under /debug/pprof/. Importing net/http/pprof
+// also registers it on http.DefaultServeMux, so public routes live on their own mux.
+func registerPprof(mux *http.ServeMux) {
+    mux.HandleFunc("/debug/pprof/", pprof.Index)
+    mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+    mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+    mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+    mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// apiPrefixes are server routes; unmatched paths under them 404 instead of
+// falling back to the frontend (e.g. /recordings/ with recording disabled)
+var apiPrefixes = []string{"/ws", "/stats", "/status", "/health", "/ready", "/join", "/heartbeat", "/rooms", "/recordings", "/admin", "/debug"}
+
+// spaHandler serves files from dir, answering any other non-API path with
+// index.html so client-side routes survive a reload
+func spaHandler(dir string) http.Handler {
+    root := http.Dir(dir)
+    files := http.FileServer(root)
+    index := filepath.Join(dir, "index.html")
+    
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        for _, prefix := range apiPrefixes {
+            if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+                http.NotFound(w, r)
+                return
+            }
+        }
+        
+        // http.Dir rejects .. so the path can't leave dir
+        if f, err := root.Open(r.URL.Path); err == nil {
+            info, err := f.Stat()
+            f.Close()
+            if err == nil && !info.IsDir() {
+                files.ServeHTTP(w, r)
+                return
+            }
+        }
+        
+        // Directories and unknown paths get the app, never a listing
+        w.Header().Set("Cache-Control", "no-cache")
+        http.ServeFile(w, r, index)
+    })
+}
+
+// registerAdminAPI mounts the ADMIN_TOKEN routes: announcements, frame
+// traces, operator moderation and drain
+func registerAdminAPI(mux *http.ServeMux) {
+    mux.HandleFunc("POST /admin/announce", handleAnnounce)
+    mux.HandleFunc("GET /debug/trace/{room}", handleTrace)
+    mux.HandleFunc("POST /debug/trace/{room}", handleTrace)
+    mux.HandleFunc("POST /admin/rooms/{room}/participants/{id}/{action}", handleOperatorAction)
+    mux.HandleFunc("POST /admin/drain", handleDrain)
+    if recordingsDir != "" {
+        mux.HandleFunc("POST /recordings/{id}/export", requireAdmin(handleExportStart))
+        mux.HandleFunc("GET /recordings/exports/{job}", requireAdmin(handleExportStatus))
+        mux.HandleFunc("GET /recordings/files/{name}", requireAdmin(handleExportFile))
+    }
+}
+
+// requireAdmin guards a console route, asking the browser to log in with the
+// admin token as the password
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if !authorizedAdmin(r) {
+            w.Header().Set("WWW-Authenticate", `Basic realm="conference admin"`)
+            http.Error(w, "unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next(w, r)
+    }
+}
+
+// registerConsole mounts the admin console and everything it calls. They all
+// need the token, including the status and stats feeds that are open on the
+// public port.
+func registerConsole(mux *http.ServeMux) {
+    registerAdminAPI(mux)
+    mux.HandleFunc("GET /admin/{$}", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/html; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-store")
+        io.WriteString(w, adminConsoleHTML)
+    }))
+    mux.HandleFunc("GET /admin/status", requireAdmin(handleAdminStatus))
+    mux.HandleFunc("GET /admin/ws/stats", requireAdmin(handleStatsStream))
+}
+
+// startAdmin serves the operator listener on ADMIN_ADDR: the profiler when
+// ENABLE_PPROF=true and the admin console when ADMIN_TOKEN is set. Without
+// ADMIN_ADDR the profiler falls back to the public port; the console never does.
+func startAdmin(public *http.ServeMux) {
+    profile := os.Getenv("ENABLE_PPROF") == "true"
+    adminAddr := os.Getenv("ADMIN_ADDR")
+    if adminAddr == "" {
+        if profile {
+            registerPprof(public)
+            log.Printf("pprof enabled on the public listener at /debug/pprof/")
+        }
+        return
+    }
+    if !profile && adminToken == "" {
+        return
+    }
+    
+    admin := http.NewServeMux()
+    if profile {
+        registerPprof(admin)
+        log.Printf("pprof enabled on %s/debug/pprof/", adminAddr)
+    }
+    if adminToken != "" {
+        registerConsole(admin)
+        log.Printf("Admin console on http://%s/admin/", adminAddr)
+    }
+    go func() {
+        if err := http.ListenAndServe(adminAddr, admin); err != nil {
+            log.Printf("Admin listener failed: %v", err)
+        }
+    }()
+}
+
+// adminConsoleHTML lists live rooms and participants with mute, unmute and
+// kick buttons, an announcement form and a drain button. It refreshes the
+// rooms on every /admin/ws/stats push. Participant ids come from clients, so
+// they only ever go in through textContent.
+const adminConsoleHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Conference Admin</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h1 { font-size: 1.4em; }
+table { border-collapse: collapse; margin: 1em 0; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+#stats span { margin-right: 1.5em; }
+#drain { background: #c0392b; color: white; }
+#notice.error { color: #c0392b; }
+</style>
+</head>
+<body>
+<h1>Conference Admin</h1>
+<div id="stats">Connecting...</div>
+<p id="notice"></p>
+
+<h2>Rooms</h2>
+<table>
+<thead><tr><th>Room</th><th>Participant</th><th>IP</th><th></th></tr></thead>
+<tbody id="rooms"></tbody>
+</table>
+
+<h2>Announce</h2>
+<form id="announce">
+<input id="room" placeholder="room" required>
+<input id="text" placeholder="message" size="50" maxlength="280" required>
+<select id="level"><option>info</option><option>warning</option><option>critical</option></select>
+<button>Send</button>
+</form>
+
+<h2>Restart</h2>
+<button id="drain">Drain server</button>
+<span>Closes every client with a reconnect delay and refuses new joins until restarted.</span>
+
+<script>
+const $ = id => document.getElementById(id);
+
+function notify(text, failed) {
+    $("notice").textContent = text;
+    $("notice").className = failed ? "error" : "";
+}
+
+async function post(path, body) {
+    const res = await fetch(path, {
+        method: "POST",
+        headers: {"Content-Type": "application/json"},
+        body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!res.ok) {
+        notify(path + ": " + (await res.text()).trim(), true);
+        return null;
+    }
+    notify("");
+    return res.json();
+}
+
+function cell(row, text) {
+    const td = row.insertCell();
+    td.textContent = text;
+    return td;
+}
+
+function button(td, label, action) {
+    const b = document.createElement("button");
+    b.textContent = label;
+    b.onclick = action;
+    td.appendChild(b);
+}
+
+async function refreshRooms() {
+    const res = await fetch("/admin/status");
+    if (!res.ok) {
+        notify("status: " + res.status, true);
+        return;
+    }
+    const status = await res.json();
+    const body = $("rooms");
+    body.replaceChildren();
+    for (const room of status.details) {
+        if (room.clients.length === 0) {
+            const row = body.insertRow();
+            cell(row, room.name);
+            cell(row, "(empty)");
+            cell(row, "");
+            cell(row, "");
+        }
+        for (const client of room.clients) {
+            const row = body.insertRow();
+            cell(row, room.name);
+            cell(row, client.id);
+            cell(row, client.ip);
+            const actions = cell(row, "");
+            const path = "/admin/rooms/" + encodeURIComponent(room.name) +
+                "/participants/" + encodeURIComponent(client.id) + "/";
+            button(actions, "Mute", () => post(path + "mute"));
+            button(actions, "Unmute", () => post(path + "unmute"));
+            button(actions, "Kick", () => post(path + "kick").then(refreshRooms));
+        }
+    }
+}
+
+function connectStats() {
+    const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+    const ws = new WebSocket(scheme + location.host + "/admin/ws/stats?interval=2s");
+    ws.onmessage = event => {
+        const stats = JSON.parse(event.data);
+        const panel = $("stats");
+        panel.replaceChildren();
+        for (const key of ["messages", "droppedFrames", "webpFrames", "throttled", "stalledWrites", "rejectedConns"]) {
+            const span = document.createElement("span");
+            span.textContent = key + ": " + stats[key];
+            panel.appendChild(span);
+        }
+        refreshRooms();
+    };
+    ws.onclose = () => {
+        $("stats").textContent = "Stats feed lost, reconnecting...";
+        setTimeout(connectStats, 3000);
+    };
+}
+
+$("announce").onsubmit = async event => {
+    event.preventDefault();
+    const reply = await post("/admin/announce", {room: $("room").value, text: $("text").value, level: $("level").value});
+    if (reply) {
+        $("text").value = "";
+        notify("Announcement delivered to " + reply.delivered + " clients");
+    }
+};
+
+$("drain").onclick = async () => {
+    if (confirm("Disconnect everyone and refuse new joins until the server restarts?")) {
+        await post("/admin/drain");
+        refreshRooms();
+    }
+};
+
+connectStats();
+refreshRooms();
+</script>
+</body>
+</html>
+`
+
+// Configuration
+//
+// CONFIG_FILE=path loads a JSON Config over the built-in defaults; the
+// environment variables documented in the README then override individual
+// fields. Feature switches and secrets (RECORD_LOG, PEERS, tokens, ...) stay
+// env-only. Anything invalid stops the server before it listens.
+
+// Duration reads "30s"-style strings from JSON
+type Duration struct{ time.Duration }
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("duration must be a string like \"30s\"")
+    }
+    parsed, err := time.ParseDuration(s)
+    if err != nil {
+        return err
     }
-    
-    log.Printf("Client %s joined room %s (total: %d users, using WebP)", 
-        client.ID, client.Room, userCount)
+    d.Duration = parsed
+    return nil
 }
 
-func (h *Hub) unregisterClient(client *Client) {
-    h.mu.RLock()
-    room := h.Rooms[client.Room]
-    h.mu.RUnlock()
-    
-    if room != nil {
-        room.mu.Lock()
-        if _, ok := room.Clients[client.ID]; ok {
-            delete(room.Clients, client.ID)
-            close(client.Send)
-            log.Printf("Client %s left room %s", client.ID, client.Room)
-        }
-        room.mu.Unlock()
-    }
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(d.String())
 }
 
-func (h *Hub) handleBroadcast(bcast *BroadcastMessage) {
-    h.mu.RLock()
-    room := h.Rooms[bcast.Room]
-    h.mu.RUnlock()
+// QualityStep is the video encode for one room size; the last step covers
+// every larger room
+type QualityStep struct {
+    Width     uint    `json:"width"`
+    Quality   float32 `json:"quality"` // 0-100
+    Grayscale bool    `json:"grayscale,omitempty"`
+}
+
+type Config struct {
+    Port            int           `json:"port"`
+    TLSCert         string        `json:"tlsCert,omitempty"`
+    TLSKey          string        `json:"tlsKey,omitempty"`
+    AllowedOrigins  []string      `json:"allowedOrigins,omitempty"` // Empty allows any origin
+    Compression     bool          `json:"compression"`              // Offer permessage-deflate (never applied to video frames)
+    StaticDir       string        `json:"staticDir,omitempty"`      // Frontend served from disk instead of the inline page
+    ValidateMessages bool         `json:"validateMessages"`         // Reject relayed messages missing required fields
+    FramePacing     bool          `json:"framePacing"`              // Space video writes across the frame interval
+    WriteBufferPool bool          `json:"writeBufferPool"`          // Share write buffers between connections instead of one each
     
-    if room == nil {
-        return
-    }
+    // Upgrades per second and burst per client IP (0 rate disables), and
+    // open connections overall (0 is unlimited)
+    ConnRate        float64       `json:"connRate"`
+    ConnBurst       int           `json:"connBurst"`
+    MaxConnections  int           `json:"maxConnections"`
     
-    var msg Message
-    json.Unmarshal(bcast.Message, &msg)
+    // Upgrades per second and burst server-wide (0 rate disables), and the
+    // window restart and refusal reconnect delays are jittered over
+    AcceptRate      float64       `json:"acceptRate"`
+    AcceptBurst     int           `json:"acceptBurst"`
+    ReconnectSpread Duration      `json:"reconnectSpread"`
     
-    atomic.AddInt64(&h.TotalMessages, 1)
+    MaxUsersPerRoom int           `json:"maxUsersPerRoom"`
+    MaxRooms        int           `json:"maxRooms"`  // 0 is unlimited
+    RoomTTL         Duration      `json:"roomTTL"`
+    IdleTimeout     Duration      `json:"idleTimeout"`
+    AwayAfter       Duration      `json:"awayAfter"`  // Without any read, pongs included
+    LeaveAfter      Duration      `json:"leaveAfter"`
+    ReadTimeout     Duration      `json:"readTimeout"`  // Without a pong or message
+    PingInterval    Duration      `json:"pingInterval"`
+    WriteTimeout    Duration      `json:"writeTimeout"`
+    WriteStallTimeout Duration    `json:"writeStallTimeout"` // Per streamed chunk of a large message
+    ClientBandwidthKbps int       `json:"clientBandwidthKbps"` // Outbound cap per receiver, 0 for none
+    UplinkKbps      int           `json:"uplinkKbps"`      // Outbound cap for the whole process, 0 for none
+    UplinkAudioKbps int           `json:"uplinkAudioKbps"` // Share of it video can't take
+    StaleVideoAfter Duration      `json:"staleVideoAfter"` // Queued video older than this is dropped, 0 never
+    MaxBacklogAge   Duration      `json:"maxBacklogAge"`   // Oldest queued message older than this disconnects, 0 never
     
-    room.mu.RLock()
-    userCount := len(room.Clients)
-    room.mu.RUnlock()
+    VideoCodec      string        `json:"videoCodec"`
+    WebPEffort      int           `json:"webpEffort"` // libwebp method, 0 (fast) to 6 (small)
+    QualityLadder   []QualityStep `json:"qualityLadder"`
+    RoomFPSBudget   int           `json:"roomFpsBudget"`
     
-    if userCount == 0 {
-        return
-    }
+    // Default per-room frame distribution and the auto strategy's size
+    // thresholds; round-robin sends one target per frame above the last
+    DropStrategy         string   `json:"dropStrategy"`
+    SendAllMaxUsers      int      `json:"sendAllMaxUsers"`
+    FPSCapMaxUsers       int      `json:"fpsCapMaxUsers"`
+    RoundRobinSingleOver int      `json:"roundRobinSingleOver"`
     
-    switch msg.Type {
-    case "audio-chunk":
-        // Audio always gets through
-        h.distributeAudio(room, msg, bcast.From)
-        
-    case "video-frame":
-        // Compress with WebP and distribute smartly
-        h.distributeVideoWebP(room, msg, bcast.From, userCount)
+    BadFrameLimit   int           `json:"badFrameLimit"`
+    MaxFrameWidth   int           `json:"maxFrameWidth"`  // Declared dimensions past these are refused, 0 no limit
+    MaxFrameHeight  int           `json:"maxFrameHeight"`
+    MaxFramePixels  int           `json:"maxFramePixels"`
+    EncodeWorkers   int           `json:"encodeWorkers"`
+    EncodeQueue     int           `json:"encodeQueue"`
+    WriteBatch      int           `json:"writeBatch"`
+    WriteBatchBytes int           `json:"writeBatchBytes"`
+}
+
+func defaultConfig() *Config {
+    return &Config{
+        Port:            3001,
+        ConnRate:        5,
+        ConnBurst:       20,
+        MaxConnections:  10000,
+        AcceptRate:      50,
+        AcceptBurst:     100,
+        ReconnectSpread: Duration{10 * time.Second},
+        RoomTTL:         Duration{30 * time.Second},
+        ReadTimeout:     Duration{60 * time.Second},
+        PingInterval:    Duration{54 * time.Second},
+        WriteTimeout:    Duration{10 * time.Second},
+        WriteStallTimeout: Duration{2 * time.Second},
+        ClientBandwidthKbps: 1200,
+        UplinkAudioKbps: 64,
+        StaleVideoAfter: Duration{500 * time.Millisecond},
+        MaxBacklogAge:   Duration{5 * time.Second},
+        VideoCodec:      "webp",
+        WebPEffort:      defaultWebPEffort,
+        ValidateMessages: true,
+        WriteBufferPool: true,
+        QualityLadder: []QualityStep{
+            {Width: 320, Quality: 75},                  // Good quality for single user
+            {Width: 240, Quality: 65},
+            {Width: 180, Quality: 55},
+            {Width: 120, Quality: 45},
+            {Width: 100, Quality: 35, Grayscale: true},
+            {Width: 80, Quality: 25, Grayscale: true},  // Ultra tiny for 6+
+        },
+        RoomFPSBudget:   60,
+        DropStrategy:    "auto",
+        SendAllMaxUsers: 2,
+        FPSCapMaxUsers:  4,
+        RoundRobinSingleOver: 8,
+        BadFrameLimit:   5,
+        MaxFrameWidth:   3840,
+        MaxFrameHeight:  3840,
+        MaxFramePixels:  3840 * 2160,
+        EncodeWorkers:   runtime.NumCPU(),
+        EncodeQueue:     8,
+        WriteBatch:      10,
+        WriteBatchBytes: 1024 * 1024,
     }
 }
 
-func (h *Hub) distributeAudio(room *Room, msg Message, from string) {
-    room.mu.RLock()
-    defer room.mu.RUnlock()
-    
-    // Audio goes to everyone except sender
-    for id, client := range room.Clients {
-        if id == from {
-            continue
+// loadConfig reads path (if any) over the defaults, applies env overrides
+// and validates the result
+func loadConfig(path string) (*Config, error) {
+    cfg := defaultConfig()
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, err
         }
-        
-        // Mark audio priority
-        client.mu.Lock()
-        client.LastAudioTime = time.Now()
-        client.mu.Unlock()
-        
-        msg.From = from
-        if data, err := json.Marshal(msg); err == nil {
-            select {
-            case client.Send <- data:
-            default:
-                // Only drop if buffer truly full
-            }
+        decoder := json.NewDecoder(bytes.NewReader(data))
+        decoder.DisallowUnknownFields()
+        if err := decoder.Decode(cfg); err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
         }
     }
+    if err := cfg.applyEnv(os.Getenv); err != nil {
+        return nil, err
+    }
+    if err := cfg.validate(); err != nil {
+        return nil, err
+    }
+    return cfg, nil
 }
 
-func (h *Hub) distributeVideoWebP(room *Room, msg Message, from string, userCount int) {
-    // Decode and compress with WebP
-    frameData, _ := base64.StdEncoding.DecodeString(msg.Data)
-    compressed := webpCompressFrame(frameData, userCount)
-    
-    // Update message with compressed data
-    msg.Data = base64.StdEncoding.EncodeToString(compressed)
-    msg.FrameSize = len(compressed)
-    msg.From = from
-    msg.CompressionType = "webp"
-    
-    room.mu.RLock()
-    defer room.mu.RUnlock()
-    
-    // Calculate frame distribution strategy
-    targetFPS := 30.0 / float64(userCount) // Distribute FPS among users
-    
-    if userCount <= 2 {
-        // 1-2 users: Send all frames
-        for id, client := range room.Clients {
-            if id == from {
-                continue
+// applyEnv overrides fields from the environment; a set but unparsable
+// variable is an error rather than silently ignored
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+    ints := map[string]*int{
+        "PORT":               &cfg.Port,
+        "CONN_BURST":         &cfg.ConnBurst,
+        "ACCEPT_BURST":       &cfg.AcceptBurst,
+        "MAX_CONNECTIONS":    &cfg.MaxConnections,
+        "MAX_USERS_PER_ROOM": &cfg.MaxUsersPerRoom,
+        "MAX_ROOMS":          &cfg.MaxRooms,
+        "ROOM_FPS_BUDGET":    &cfg.RoomFPSBudget,
+        "SEND_ALL_MAX_USERS": &cfg.SendAllMaxUsers,
+        "FPS_CAP_MAX_USERS":  &cfg.FPSCapMaxUsers,
+        "ROUND_ROBIN_SINGLE_OVER": &cfg.RoundRobinSingleOver,
+        "BAD_FRAME_LIMIT":    &cfg.BadFrameLimit,
+        "MAX_FRAME_WIDTH":    &cfg.MaxFrameWidth,
+        "MAX_FRAME_HEIGHT":   &cfg.MaxFrameHeight,
+        "MAX_FRAME_PIXELS":   &cfg.MaxFramePixels,
+        "ENCODE_WORKERS":     &cfg.EncodeWorkers,
+        "ENCODE_QUEUE":       &cfg.EncodeQueue,
+        "WRITE_BATCH":        &cfg.WriteBatch,
+        "WRITE_BATCH_BYTES":  &cfg.WriteBatchBytes,
+        "WEBP_EFFORT":        &cfg.WebPEffort,
+        "CLIENT_BANDWIDTH_KBPS": &cfg.ClientBandwidthKbps,
+        "UPLINK_KBPS":        &cfg.UplinkKbps,
+        "UPLINK_AUDIO_KBPS":  &cfg.UplinkAudioKbps,
+    }
+    for name, field := range ints {
+        if v := getenv(name); v != "" {
+            n, err := strconv.Atoi(v)
+            if err != nil {
+                return fmt.Errorf("%s: %v", name, err)
             }
-            
-            if data, err := json.Marshal(msg); err == nil {
-                select {
-                case client.Send <- data:
-                default:
-                    atomic.AddInt64(&h.DroppedFrames, 1)
-                }
+            *field = n
+        }
+    }
+    
+    durations := map[string]*Duration{
+        "ROOM_TTL":      &cfg.RoomTTL,
+        "IDLE_TIMEOUT":  &cfg.IdleTimeout,
+        "AWAY_AFTER":    &cfg.AwayAfter,
+        "LEAVE_AFTER":   &cfg.LeaveAfter,
+        "READ_TIMEOUT":  &cfg.ReadTimeout,
+        "PING_INTERVAL": &cfg.PingInterval,
+        "WRITE_TIMEOUT": &cfg.WriteTimeout,
+        "WRITE_STALL_TIMEOUT": &cfg.WriteStallTimeout,
+        "RECONNECT_SPREAD": &cfg.ReconnectSpread,
+        "STALE_VIDEO_AFTER": &cfg.StaleVideoAfter,
+        "MAX_BACKLOG_AGE": &cfg.MaxBacklogAge,
+    }
+    for name, field := range durations {
+        if v := getenv(name); v != "" {
+            d, err := time.ParseDuration(v)
+            if err != nil {
+                return fmt.Errorf("%s: %v", name, err)
             }
+            field.Duration = d
         }
-        
-    } else if userCount <= 4 {
-        // 3-4 users: Adaptive frame skipping
-        now := time.Now()
-        minFrameInterval := time.Duration(1000/targetFPS) * time.Millisecond
-        
-        if now.Sub(room.LastFrameTime) < minFrameInterval {
-            atomic.AddInt64(&h.DroppedFrames, int64(userCount-1))
-            return
+    }
+    
+    if v := getenv("WS_COMPRESSION"); v != "" {
+        enabled, err := strconv.ParseBool(v)
+        if err != nil {
+            return fmt.Errorf("WS_COMPRESSION: %v", err)
         }
-        room.LastFrameTime = now
-        
-        for id, client := range room.Clients {
-            if id == from {
-                continue
-            }
-            
-            // Skip if client is receiving audio
-            client.mu.RLock()
-            receivingAudio := time.Since(client.LastAudioTime) < 100*time.Millisecond
-            client.mu.RUnlock()
-            
-            if !receivingAudio {
-                if data, err := json.Marshal(msg); err == nil {
-                    select {
-                    case client.Send <- data:
-                    default:
-                        atomic.AddInt64(&h.DroppedFrames, 1)
-                    }
-                }
-            }
+        cfg.Compression = enabled
+    }
+    if v := getenv("VALIDATE_MESSAGES"); v != "" {
+        enabled, err := strconv.ParseBool(v)
+        if err != nil {
+            return fmt.Errorf("VALIDATE_MESSAGES: %v", err)
         }
-        
-    } else {
-        // 5+ users: Round-robin with priority
-        targets := make([]*Client, 0, userCount-1)
-        for id, client := range room.Clients {
-            if id != from {
-                targets = append(targets, client)
-            }
+        cfg.ValidateMessages = enabled
+    }
+    if v := getenv("FRAME_PACING"); v != "" {
+        enabled, err := strconv.ParseBool(v)
+        if err != nil {
+            return fmt.Errorf("FRAME_PACING: %v", err)
         }
-        
-        if len(targets) > 0 {
-            // Send to 2 targets per frame for better coverage
-            sendCount := 2
-            if userCount > 8 {
-                sendCount = 1
+        cfg.FramePacing = enabled
+    }
+    if v := getenv("WRITE_BUFFER_POOL"); v != "" {
+        enabled, err := strconv.ParseBool(v)
+        if err != nil {
+            return fmt.Errorf("WRITE_BUFFER_POOL: %v", err)
+        }
+        cfg.WriteBufferPool = enabled
+    }
+    for name, field := range map[string]*float64{"CONN_RATE": &cfg.ConnRate, "ACCEPT_RATE": &cfg.AcceptRate} {
+        if v := getenv(name); v != "" {
+            rate, err := strconv.ParseFloat(v, 64)
+            if err != nil {
+                return fmt.Errorf("%s: %v", name, err)
             }
-            
-            for i := 0; i < sendCount && i < len(targets); i++ {
-                targetIdx := (room.NextVideoTarget + i) % len(targets)
-                target := targets[targetIdx]
-                
-                if data, err := json.Marshal(msg); err == nil {
-                    select {
-                    case target.Send <- data:
-                    default:
-                        atomic.AddInt64(&h.DroppedFrames, 1)
-                    }
-                }
+            *field = rate
+        }
+    }
+    if v := getenv("TLS_CERT"); v != "" {
+        cfg.TLSCert = v
+    }
+    if v := getenv("TLS_KEY"); v != "" {
+        cfg.TLSKey = v
+    }
+    if v := getenv("STATIC_DIR"); v != "" {
+        cfg.StaticDir = v
+    }
+    if v := getenv("VIDEO_CODEC"); v != "" {
+        cfg.VideoCodec = v
+    }
+    if v := getenv("DROP_STRATEGY"); v != "" {
+        cfg.DropStrategy = v
+    }
+    if v := getenv("ALLOWED_ORIGINS"); v != "" {
+        cfg.AllowedOrigins = nil
+        for _, origin := range strings.Split(v, ",") {
+            if origin = strings.TrimSpace(origin); origin != "" {
+                cfg.AllowedOrigins = append(cfg.AllowedOrigins, origin)
             }
-            room.NextVideoTarget = (room.NextVideoTarget + sendCount) % len(targets)
-            
-            // Count unsent as dropped
-            atomic.AddInt64(&h.DroppedFrames, int64(len(targets)-sendCount))
         }
     }
+    return nil
 }
 
-func (h *Hub) reportMetrics() {
-    h.mu.RLock()
-    defer h.mu.RUnlock()
-    
-    totalMsg := atomic.LoadInt64(&h.TotalMessages)
-    dropped := atomic.LoadInt64(&h.DroppedFrames)
-    compressed := atomic.LoadInt64(&h.CompressedFrames)
-    saved := atomic.LoadInt64(&h.BytesSaved)
+func (cfg *Config) validate() error {
+    var problems []string
+    check := func(ok bool, format string, args ...interface{}) {
+        if !ok {
+            problems = append(problems, fmt.Sprintf(format, args...))
+        }
+    }
     
-    if totalMsg > 0 {
-        dropRate := float64(dropped) / float64(totalMsg) * 100
-        savedMB := float64(saved) / (1024 * 1024)
-        
-        log.Printf("Stats - Messages: %d, Dropped: %.1f%%, WebP frames: %d, Saved: %.1f MB",
-            totalMsg, dropRate, compressed, savedMB)
+    check(cfg.Port > 0 && cfg.Port < 65536, "port %d out of range", cfg.Port)
+    check((cfg.TLSCert == "") == (cfg.TLSKey == ""), "tlsCert and tlsKey must be set together")
+    if cfg.StaticDir != "" {
+        _, err := os.Stat(filepath.Join(cfg.StaticDir, "index.html"))
+        check(err == nil, "staticDir %q has no index.html", cfg.StaticDir)
+    }
+    check(cfg.ConnRate >= 0, "connRate must not be negative")
+    check(cfg.ConnRate == 0 || cfg.ConnBurst >= 1, "connBurst must be at least 1 when connRate is set")
+    check(cfg.MaxConnections >= 0, "maxConnections must not be negative")
+    check(cfg.AcceptRate >= 0, "acceptRate must not be negative")
+    check(cfg.AcceptRate == 0 || cfg.AcceptBurst >= 1, "acceptBurst must be at least 1 when acceptRate is set")
+    check(cfg.ReconnectSpread.Duration >= 0, "reconnectSpread must not be negative")
+    check(cfg.MaxUsersPerRoom >= 0, "maxUsersPerRoom must not be negative")
+    check(cfg.MaxRooms >= 0, "maxRooms must not be negative")
+    check(cfg.RoomTTL.Duration >= 0, "roomTTL must not be negative")
+    check(cfg.IdleTimeout.Duration >= 0, "idleTimeout must not be negative")
+    check(cfg.ReadTimeout.Duration > 0, "readTimeout must be positive")
+    check(cfg.PingInterval.Duration > 0 && cfg.PingInterval.Duration < cfg.ReadTimeout.Duration,
+        "pingInterval must be positive and shorter than readTimeout (%s)", cfg.ReadTimeout.Duration)
+    check(cfg.WriteTimeout.Duration > 0, "writeTimeout must be positive")
+    check(cfg.WriteStallTimeout.Duration > 0 && cfg.WriteStallTimeout.Duration <= cfg.WriteTimeout.Duration,
+        "writeStallTimeout must be positive and at most writeTimeout (%s)", cfg.WriteTimeout.Duration)
+    check(cfg.ClientBandwidthKbps >= 0, "clientBandwidthKbps must not be negative")
+    check(cfg.UplinkKbps >= 0, "uplinkKbps must not be negative")
+    check(cfg.UplinkAudioKbps >= 0 && (cfg.UplinkKbps == 0 || cfg.UplinkAudioKbps < cfg.UplinkKbps),
+        "uplinkAudioKbps must not be negative and must be below uplinkKbps (%d)", cfg.UplinkKbps)
+    check(cfg.StaleVideoAfter.Duration >= 0, "staleVideoAfter must not be negative")
+    // The sweep runs once a second, so shorter ages can't be told apart
+    check(cfg.MaxBacklogAge.Duration == 0 || cfg.MaxBacklogAge.Duration >= time.Second,
+        "maxBacklogAge must be 0 or at least 1s")
+    // Quiet but healthy clients are only heard from once per ping
+    check(cfg.AwayAfter.Duration == 0 || cfg.AwayAfter.Duration > cfg.PingInterval.Duration,
+        "awayAfter must be 0 or longer than pingInterval (%s)", cfg.PingInterval.Duration)
+    check(cfg.LeaveAfter.Duration == 0 || cfg.LeaveAfter.Duration > max(cfg.AwayAfter.Duration, cfg.PingInterval.Duration),
+        "leaveAfter must be 0 or longer than awayAfter and pingInterval")
+    check(cfg.VideoCodec == "webp" || cfg.VideoCodec == "jpeg", "videoCodec %q is not webp or jpeg", cfg.VideoCodec)
+    check(cfg.WebPEffort >= 0 && cfg.WebPEffort <= 6, "webpEffort must be between 0 and 6")
+    check(len(cfg.QualityLadder) > 0, "qualityLadder needs at least one step")
+    for i, step := range cfg.QualityLadder {
+        check(step.Width > 0, "qualityLadder[%d]: width must be positive", i)
+        check(step.Quality > 0 && step.Quality <= 100, "qualityLadder[%d]: quality %.0f outside 1-100", i, step.Quality)
+    }
+    check(cfg.RoomFPSBudget > 0, "roomFpsBudget must be positive")
+    _, known := dropStrategies[cfg.DropStrategy]
+    check(known, "dropStrategy %q is not one of %s", cfg.DropStrategy, strings.Join(dropStrategyNames(), ", "))
+    check(cfg.SendAllMaxUsers >= 1, "sendAllMaxUsers must be at least 1")
+    check(cfg.FPSCapMaxUsers >= cfg.SendAllMaxUsers, "fpsCapMaxUsers must be at least sendAllMaxUsers (%d)", cfg.SendAllMaxUsers)
+    check(cfg.RoundRobinSingleOver >= 1, "roundRobinSingleOver must be at least 1")
+    check(cfg.BadFrameLimit > 0, "badFrameLimit must be positive")
+    check(cfg.MaxFrameWidth >= 0, "maxFrameWidth must not be negative")
+    check(cfg.MaxFrameHeight >= 0, "maxFrameHeight must not be negative")
+    check(cfg.MaxFramePixels >= 0, "maxFramePixels must not be negative")
+    check(cfg.EncodeWorkers > 0, "encodeWorkers must be positive")
+    check(cfg.EncodeQueue > 0, "encodeQueue must be positive")
+    check(cfg.WriteBatch >= 0, "writeBatch must not be negative")
+    check(cfg.WriteBatchBytes > 0, "writeBatchBytes must be positive")
+    for _, origin := range cfg.AllowedOrigins {
+        u, err := url.Parse(origin)
+        check(err == nil && u.Scheme != "" && u.Host != "", "allowed origin %q is not scheme://host", origin)
     }
     
-    for _, room := range h.Rooms {
-        room.mu.RLock()
-        userCount := len(room.Clients)
-        room.mu.RUnlock()
-        
-        if userCount > 0 {
-            log.Printf("Room %s: %d users active", room.ID, userCount)
-        }
+    if len(problems) > 0 {
+        return fmt.Errorf("invalid config: %s", strings.Join(problems, "; "))
     }
+    return nil
 }
 
-// Client handlers
-func (c *Client) ReadPump() {
-    defer func() {
-        c.Hub.Unregister <- c
-        c.Conn.Close()
-    }()
-    
-    c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-    c.Conn.SetPongHandler(func(string) error {
-        c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-        return nil
-    })
+// apply copies the config into the package settings the server reads
+func (cfg *Config) apply() {
+    frameCodec = newFrameCodec(cfg.VideoCodec, cfg.WebPEffort)
+    maxUsersPerRoom = cfg.MaxUsersPerRoom
+    maxRooms = cfg.MaxRooms
+    roomTTL = cfg.RoomTTL.Duration
+    validateMessages = cfg.ValidateMessages
+    framePacing = cfg.FramePacing
+    idleTimeout = cfg.IdleTimeout.Duration
+    awayAfter = cfg.AwayAfter.Duration
+    leaveAfter = cfg.LeaveAfter.Duration
+    readTimeout = cfg.ReadTimeout.Duration
+    pingInterval = cfg.PingInterval.Duration
+    writeTimeout = cfg.WriteTimeout.Duration
+    writeStallTimeout = cfg.WriteStallTimeout.Duration
+    clientBandwidthKbps = cfg.ClientBandwidthKbps
+    staleVideoAfter = cfg.StaleVideoAfter.Duration
+    maxBacklogAge = cfg.MaxBacklogAge.Duration
+    qualityLadder = cfg.QualityLadder
+    roomFPSBudget = cfg.RoomFPSBudget
+    defaultDropStrategy = cfg.DropStrategy
+    sendAllMaxUsers = cfg.SendAllMaxUsers
+    fpsCapMaxUsers = cfg.FPSCapMaxUsers
+    roundRobinSingleOver = cfg.RoundRobinSingleOver
+    badFrameLimit = cfg.BadFrameLimit
+    maxFrameWidth = cfg.MaxFrameWidth
+    maxFrameHeight = cfg.MaxFrameHeight
+    maxFramePixels = cfg.MaxFramePixels
+    encodeWorkers = cfg.EncodeWorkers
+    encodeQueueSize = cfg.EncodeQueue
+    writeBatch = cfg.WriteBatch
+    writeBatchBytes = cfg.WriteBatchBytes
     
-    // Rate limiting
-    limiter := time.NewTicker(10 * time.Millisecond) // 100 msg/sec max
-    defer limiter.Stop()
+    upgrader.EnableCompression = cfg.Compression
+    upgrader.WriteBufferPool = nil
+    if cfg.WriteBufferPool {
+        upgrader.WriteBufferPool = &sync.Pool{}
+    }
+    connLimiter = newIPRateLimiter(cfg.ConnRate, cfg.ConnBurst)
+    acceptLimiter = newIPRateLimiter(cfg.AcceptRate, cfg.AcceptBurst)
+    uplink = newUplinkGovernor(cfg.UplinkKbps, cfg.UplinkAudioKbps)
+    acceptRate = cfg.AcceptRate
+    reconnectSpread = cfg.ReconnectSpread.Duration
+    if cfg.MaxConnections > 0 {
+        connSlots = make(chan struct{}, cfg.MaxConnections)
+    }
     
-    for {
-        _, message, err := c.Conn.ReadMessage()
-        if err != nil {
-            break
+    if len(cfg.AllowedOrigins) > 0 {
+        allowed := make(map[string]bool, len(cfg.AllowedOrigins))
+        for _, origin := range cfg.AllowedOrigins {
+            allowed[origin] = true
         }
-        
-        <-limiter.C // Rate limit
-        
-        var msg Message
-        if err := json.Unmarshal(message, &msg); err == nil {
-            if msg.Type == "join" {
-                continue
-            }
-            
-            // Broadcast to room
-            c.Hub.Broadcast <- &BroadcastMessage{
-                Room:    c.Room,
-                Message: message,
-                From:    c.ID,
-            }
+        // Non-browser clients send no Origin and are let through
+        upgrader.CheckOrigin = func(r *http.Request) bool {
+            origin := r.Header.Get("Origin")
+            return origin == "" || allowed[origin]
         }
     }
 }
 
-func (c *Client) WritePump() {
-    ticker := time.NewTicker(54 * time.Second)
-    defer func() {
-        ticker.Stop()
-        c.Conn.Close()
-    }()
+func main() {
+    cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+    if err != nil {
+        log.Fatal(err)
+    }
+    cfg.apply()
     
-    for {
-        select {
-        case message, ok := <-c.Send:
-            c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-            if !ok {
-                c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-                return
-            }
-            
-            c.Conn.WriteMessage(websocket.TextMessage, message)
-            
-            // Batch send queued messages
-            n := len(c.Send)
-            if n > 10 {
-                n = 10
-            }
-            for i := 0; i < n; i++ {
-                if msg, ok := <-c.Send; ok {
-                    c.Conn.WriteMessage(websocket.TextMessage, msg)
-                }
-            }
-            
-        case <-ticker.C:
-            c.Conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-            if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-                return
-            }
+    if dir := os.Getenv("EFFORT_BENCH"); dir != "" {
+        if err := runEffortBench(dir); err != nil {
+            log.Fatal(err)
         }
-    }
-}
-
-// HTTP handlers
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
-    conn, err := upgrader.Upgrade(w, r, nil)
-    if err != nil {
         return
     }
-    
-    var joinMsg Message
-    if err := conn.ReadJSON(&joinMsg); err != nil || joinMsg.Type != "join" {
-        conn.Close()
+    if path := os.Getenv("REPLAY_LOG"); path != "" {
+        if err := runReplay(path, os.Getenv("REPLAY_EXPECT")); err != nil {
+            log.Fatal(err)
+        }
         return
     }
+    if path := os.Getenv("RECORD_LOG"); path != "" {
+        rec, err := newMessageRecorder(path)
+        if err != nil {
+            log.Fatal("Failed to open record log: ", err)
+        }
+        recorder = rec
+        log.Printf("Recording inbound messages to %s", path)
+    }
+    if spec := os.Getenv("RECORDING_KEY"); spec != "" {
+        key, err := parseRecordingKey(spec)
+        if err != nil {
+            log.Fatal(err)
+        }
+        recordingKey = key
+    }
+    if os.Getenv("RECORDING_ENCRYPT") == "true" {
+        if recordingKey == nil {
+            log.Fatal("RECORDING_ENCRYPT is set but RECORDING_KEY is not")
+        }
+        recordingEncrypt = true
+        log.Printf("Room recordings are encrypted with %s", recordingCipher)
+    }
+    if recordingsDir != "" {
+        if err := prepareExports(); err != nil {
+            log.Fatal(err)
+        }
+    }
     
-    client := &Client{
-        ID:   joinMsg.ID,
-        Room: joinMsg.Room,
-        Conn: conn,
-        Send: make(chan []byte, 100), // Larger buffer for WebP frames
-        Hub:  hub,
+    if spec := os.Getenv("REGION_CIDRS"); spec != "" {
+        ranges, err := parseRegionCIDRs(spec)
+        if err != nil {
+            log.Fatal("Invalid REGION_CIDRS: ", err)
+        }
+        regionRanges = ranges
+    }
+    var peers []string
+    if list := os.Getenv("PEERS"); list != "" {
+        if publicURL == "" {
+            log.Fatal("PEERS is set but PUBLIC_URL is not")
+        }
+        for _, peer := range strings.Split(list, ",") {
+            if peer = strings.TrimSpace(peer); peer != "" {
+                peers = append(peers, peer)
+            }
+        }
     }
     
-    client.Hub.Register <- client
+    if authenticator, err = newAuthenticator(os.Getenv); err != nil {
+        log.Fatal("Invalid WebSocket authentication: ", err)
+    }
+    switch authenticator.(type) {
+    case *jwtAuthenticator:
+        log.Printf("WebSocket upgrades require a JWT signed by AUTH_JWT_PUBLIC_KEY")
+    case *calloutAuthenticator:
+        log.Printf("WebSocket upgrades require a token AUTH_URL accepts")
+    }
     
-    go client.WritePump()
-    go client.ReadPump()
-}
-
-func handleStats(w http.ResponseWriter, r *http.Request) {
-    totalMsg := atomic.LoadInt64(&hub.TotalMessages)
-    dropped := atomic.LoadInt64(&hub.DroppedFrames)
-    compressed := atomic.LoadInt64(&hub.CompressedFrames)
-    saved := atomic.LoadInt64(&hub.BytesSaved)
+    if kind := os.Getenv("METRICS_SINK"); kind != "" {
+        prefix, ok := os.LookupEnv("METRICS_PREFIX")
+        if !ok {
+            prefix = "conference."
+        }
+        if metrics, err = newMetricsSink(kind, prefix); err != nil {
+            log.Fatal("Invalid metrics configuration: ", err)
+        }
+        log.Printf("Pushing metrics to %s", kind)
+    }
     
-    stats := map[string]interface{}{
-        "messages":       totalMsg,
-        "droppedFrames":  dropped,
-        "dropRate":       float64(dropped) / float64(totalMsg+1) * 100,
-        "webpFrames":     compressed,
-        "bytesSaved":     saved,
-        "mbSaved":        float64(saved) / (1024 * 1024),
+    if target := os.Getenv("WEBHOOK_URL"); target != "" {
+        if webhooks, err = newWebhookSender(target, os.Getenv("WEBHOOK_SECRET")); err != nil {
+            log.Fatal("Invalid webhook configuration: ", err)
+        }
+        go webhooks.run()
+        if len(webhooks.secret) > 0 {
+            log.Printf("Posting room events to %s, signed", target)
+        } else {
+            log.Printf("Posting room events to %s, unsigned: WEBHOOK_SECRET is not set", target)
+        }
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(stats)
-}
-
-func main() {
     hub = NewHub()
     go hub.Run()
     
-    http.HandleFunc("/ws", handleWebSocket)
-    http.HandleFunc("/stats", handleStats)
-    http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        fmt.Fprintf(w, `<!DOCTYPE html>
+    if len(peers) > 0 {
+        go sendHeartbeats(peers)
+        log.Printf("Reporting load to %d peers as %s (region %q)", len(peers), publicURL, serverRegion)
+    }
+    
+    mux := http.NewServeMux()
+    mux.HandleFunc("/ws", handleWebSocket)
+    mux.HandleFunc("/stats", handleStats)
+    mux.HandleFunc("/ws/stats", handleStatsStream)
+    mux.HandleFunc("/status", handleStatus)
+    mux.HandleFunc("GET /rooms/{name}/participants", handleParticipants)
+    mux.HandleFunc("GET /rooms/{name}/timeseries", handleTimeseries)
+    mux.HandleFunc("/health", handleHealth)
+    mux.HandleFunc("/ready", handleReady)
+    mux.HandleFunc("GET /join", handleJoin)
+    mux.HandleFunc("POST /heartbeat", handleHeartbeat)
+    if adminToken != "" {
+        registerAdminAPI(mux)
+    }
+    if recordingsDir != "" {
+        if adminToken != "" {
+            log.Printf("Recording exports enabled from %s", recordingsDir)
+        } else {
+            log.Printf("Recording exports are off until ADMIN_TOKEN is set")
+        }
+    }
+    startAdmin(mux)
+    if cfg.StaticDir != "" {
+        // "/" is the least specific pattern, so the routes above still win
+        mux.Handle("/", spaHandler(cfg.StaticDir))
+        log.Printf("Serving frontend from %s", cfg.StaticDir)
+    } else {
+        mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+            fmt.Fprint(w, `<!DOCTYPE html>
 <html>
 <head><title>WebP Conference Server</title></head>
 <body>
@@ -607,13 +8007,56 @@ func main() {
 </ul>
 </body>
 </html>`)
-    })
+        })
+    }
+    
+    addr := fmt.Sprintf(":%d", cfg.Port)
+    if !webpcodec.Available && cfg.VideoCodec != "jpeg" {
+        log.Printf("Built without cgo, so no WebP encoder: relaying video as jpeg")
+    }
+    log.Printf("Features: %s compression | Smart distribution | Audio priority", frameCodec.Name())
     
-    addr := ":3001"
-    log.Printf("Starting WebP-optimized server on %s", addr)
-    log.Printf("Features: WebP compression | Smart distribution | Audio priority")
+    server := &http.Server{
+        Addr:    addr,
+        Handler: mux,
+    }
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        log.Fatal(err)
+    }
+    stopped := make(chan struct{})
+    go drainOnSignal(server, stopped)
     
-    if err := http.ListenAndServe(addr, nil); err != nil {
+    if err := serve(server, ln, cfg.TLSCert, cfg.TLSKey); err != http.ErrServerClosed {
         log.Fatal(err)
     }
+    <-stopped
+}
+
+// serve runs server on ln: WSS directly when a cert pair is provided, plain
+// HTTP otherwise
+func serve(server *http.Server, ln net.Listener, certFile, keyFile string) error {
+    if certFile != "" && keyFile != "" {
+        server.TLSConfig = newTLSConfig()
+        log.Printf("Starting WebP-optimized server on %s (TLS: %s)", ln.Addr(), certFile)
+        return server.ServeTLS(ln, certFile, keyFile)
+    }
+    log.Printf("Starting WebP-optimized server on %s", ln.Addr())
+    return server.Serve(ln)
+}
+
+// drainOnSignal stops accepting on SIGINT/SIGTERM, closes clients with 1012
+// and waits for their WritePumps to flush and send the close frame
+func drainOnSignal(server *http.Server, stopped chan struct{}) {
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    sig := <-signals
+    log.Printf("Received %s, shutting down", sig)
+    
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    server.Shutdown(ctx)
+    
+    hub.Shutdown(flushTimeout + time.Second)
+    close(stopped)
 }
\ No newline at end of file
@@ -0,0 +1,5372 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/ed25519"
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "image"
+    "image/color"
+    "io"
+    "math/big"
+    "math/rand"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "reflect"
+    "runtime"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+    "unicode/utf8"
+
+    "conference/framecodec"
+    "conference/webpcodec"
+    "github.com/gorilla/websocket"
+)
+
+// startHub swaps in a fresh hub for one test. Like main's its loop never
+// returns, so an earlier test's hub just goes quiet.
+func startHub(t *testing.T) *Hub {
+    t.Helper()
+    hub = NewHub()
+    go hub.Run()
+    return hub
+}
+
+// joinAs connects an in-memory client and waits for its welcome
+func joinAs(t *testing.T, room, id string) *memConn {
+    t.Helper()
+    conn := newMemConn(id)
+    go serveConn(conn, "test", "127.0.0.1", nil)
+    send(t, conn, Message{Type: "join", Room: room, ID: id})
+    waitFor(t, "welcome for "+id, func() bool { return len(received(conn, "welcome", "")) > 0 })
+    return conn
+}
+
+func send(t *testing.T, conn *memConn, msg Message) {
+    t.Helper()
+    data, err := json.Marshal(msg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    conn.in <- data
+}
+
+// received is what conn has been written of one type, from one sender
+// unless from is ""
+func received(conn *memConn, kind, from string) []transcriptEntry {
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+
+    var entries []transcriptEntry
+    for _, entry := range conn.out {
+        if entry.Type == kind && (from == "" || entry.From == from) {
+            entries = append(entries, entry)
+        }
+    }
+    return entries
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(2 * time.Second)
+    for !done() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func seqs(entries []transcriptEntry) []int {
+    out := make([]int, len(entries))
+    for i, entry := range entries {
+        out[i] = entry.Seq
+    }
+    return out
+}
+
+func equalInts(a, b []int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+func TestNextSeqCountsPerSenderAndStream(t *testing.T) {
+    room := &Room{Clients: map[string]*Client{"alice": {ID: "alice"}, "bob": {ID: "bob"}}}
+
+    for want := 1; want <= 3; want++ {
+        if got := room.nextSeq("alice", true); got != want {
+            t.Fatalf("alice audio seq = %d, want %d", got, want)
+        }
+    }
+    if got := room.nextSeq("alice", false); got != 1 {
+        t.Errorf("alice video seq = %d, want 1: video has its own counter", got)
+    }
+    if got := room.nextSeq("bob", true); got != 1 {
+        t.Errorf("bob audio seq = %d, want 1: every sender has its own counter", got)
+    }
+    if got := room.nextSeq("carol", true); got != 0 {
+        t.Errorf("seq for a sender not in the room = %d, want 0", got)
+    }
+}
+
+func TestRelaySeqRestartsOnRejoin(t *testing.T) {
+    startHub(t)
+    alice := joinAs(t, "seq", "alice")
+    bob := joinAs(t, "seq", "bob")
+
+    // Whatever the client stamps, the server's count is what gets relayed
+    for _, seq := range []int{7, 7, 40} {
+        send(t, alice, Message{Type: "audio-chunk", Data: "AAAA", Seq: seq})
+    }
+    waitFor(t, "alice's audio", func() bool { return len(received(bob, "audio-chunk", "alice")) == 3 })
+    if got := seqs(received(bob, "audio-chunk", "alice")); !equalInts(got, []int{1, 2, 3}) {
+        t.Fatalf("bob got alice's audio with seq %v, want [1 2 3]", got)
+    }
+
+    // A new connection with the same id starts a new stream
+    alice = joinAs(t, "seq", "alice")
+    send(t, alice, Message{Type: "audio-chunk", Data: "AAAA"})
+    send(t, alice, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "alice's audio after rejoining", func() bool { return len(received(bob, "audio-chunk", "alice")) == 5 })
+    if got := seqs(received(bob, "audio-chunk", "alice")[3:]); !equalInts(got, []int{1, 2}) {
+        t.Errorf("after alice rejoined bob got seq %v, want [1 2]", got)
+    }
+
+    send(t, bob, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "bob's audio", func() bool { return len(received(alice, "audio-chunk", "bob")) == 1 })
+    if got := received(alice, "audio-chunk", "bob")[0].Seq; got != 1 {
+        t.Errorf("bob's first audio has seq %d, want 1", got)
+    }
+}
+
+// testFrame stands in for a camera frame: gradients under a little noise,
+// so neither codec is handed a flat image
+func testFrame(width, height int) image.Image {
+    img := image.NewRGBA(image.Rect(0, 0, width, height))
+    rng := rand.New(rand.NewSource(1))
+    for y := 0; y < height; y++ {
+        for x := 0; x < width; x++ {
+            noise := rng.Intn(24)
+            img.SetRGBA(x, y, color.RGBA{
+                R: uint8(min(255, x*232/width+noise)),
+                G: uint8(min(255, y*232/height+noise)),
+                B: uint8(min(255, (x+y)*232/(width+height)+noise)),
+                A: 255,
+            })
+        }
+    }
+    return img
+}
+
+// testCodecs is every codec this build can run, webp at both ends of its
+// effort range and the default
+func testCodecs() []framecodec.Codec {
+    codecs := []framecodec.Codec{framecodec.JPEG{}}
+    if webpcodec.Available {
+        for _, effort := range []int{webpcodec.MinEffort, defaultWebPEffort, webpcodec.MaxEffort} {
+            codecs = append(codecs, framecodec.WebP{Effort: effort})
+        }
+    }
+    return codecs
+}
+
+func codecLabel(codec framecodec.Codec) string {
+    if c, ok := codec.(framecodec.WebP); ok {
+        return fmt.Sprintf("webp-effort%d", c.Effort)
+    }
+    return codec.Name()
+}
+
+func TestFrameCodecsEncodeWhatTheyName(t *testing.T) {
+    frame := testFrame(320, 180)
+    for _, codec := range testCodecs() {
+        name := codecLabel(codec)
+        data, err := codec.Encode(frame, qualityLadder[0].Quality)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+        if err != nil {
+            t.Fatalf("%s output doesn't decode: %v", name, err)
+        }
+        if format != codec.Name() || cfg.Width != 320 || cfg.Height != 180 {
+            t.Errorf("%s encoded a %dx%d %s, want a 320x180 %s", name, cfg.Width, cfg.Height, format, codec.Name())
+        }
+    }
+
+    if got := newFrameCodec("jpeg", defaultWebPEffort).Name(); got != "jpeg" {
+        t.Errorf("VIDEO_CODEC=jpeg selected %s", got)
+    }
+    want := "webp"
+    if !webpcodec.Available {
+        want = "jpeg"
+    }
+    if got := newFrameCodec("avif", defaultWebPEffort).Name(); got != want {
+        t.Errorf("an unknown VIDEO_CODEC selected %s, want %s", got, want)
+    }
+}
+
+func TestWebPEffortTradesSizeAndIsConfigurable(t *testing.T) {
+    t.Setenv("WEBP_EFFORT", "1")
+    if cfg, err := loadConfig(""); err != nil || cfg.WebPEffort != 1 {
+        t.Errorf("WEBP_EFFORT=1 loaded as %+v, %v", cfg, err)
+    } else if codec := newFrameCodec("webp", cfg.WebPEffort); webpcodec.Available && codec != (framecodec.WebP{Effort: 1}) {
+        t.Errorf("WEBP_EFFORT=1 selected %#v", codec)
+    }
+    t.Setenv("WEBP_EFFORT", "7")
+    if _, err := loadConfig(""); err == nil || !strings.Contains(err.Error(), "webpEffort") {
+        t.Errorf("WEBP_EFFORT=7 gave %v, want it out of range", err)
+    }
+    t.Setenv("WEBP_EFFORT", "")
+    if !webpcodec.Available {
+        t.Skip("no webp encoder in this build")
+    }
+
+    // Every effort decodes, and each really is a different encode: libwebp's
+    // slowest method costs several times its fastest (sizes aren't monotonic
+    // at a fixed quality, see BenchmarkFrameCodecs)
+    frame := testFrame(320, 180)
+    encodes := make(map[string]int)
+    took := make([]time.Duration, webpcodec.MaxEffort+1)
+    for effort := webpcodec.MinEffort; effort <= webpcodec.MaxEffort; effort++ {
+        for i := 0; i < 3; i++ {
+            start := time.Now()
+            data, err := framecodec.WebP{Effort: effort}.Encode(frame, qualityLadder[0].Quality)
+            if elapsed := time.Since(start); i == 0 || elapsed < took[effort] {
+                took[effort] = elapsed
+            }
+            if err != nil {
+                t.Fatalf("effort %d: %v", effort, err)
+            }
+            if cfg, format, err := image.DecodeConfig(bytes.NewReader(data)); err != nil || format != "webp" || cfg.Width != 320 {
+                t.Fatalf("effort %d encoded a %dpx %s: %v", effort, cfg.Width, format, err)
+            }
+            encodes[string(data)] = effort
+        }
+    }
+    if len(encodes) < 3 {
+        t.Errorf("%d distinct encodes across efforts %d-%d, want the effort to change the output", len(encodes), webpcodec.MinEffort, webpcodec.MaxEffort)
+    }
+    if took[webpcodec.MaxEffort] < 2*took[webpcodec.MinEffort] {
+        t.Errorf("effort %d took %s a frame against %s at effort %d, want it well slower",
+            webpcodec.MaxEffort, took[webpcodec.MaxEffort], took[webpcodec.MinEffort], webpcodec.MinEffort)
+    }
+}
+
+// BenchmarkFrameCodecs compares encode time and, as bytes/frame, size at the
+// ladder's top quality for a small tile and a 720p frame
+func BenchmarkFrameCodecs(b *testing.B) {
+    quality := qualityLadder[0].Quality
+    for _, width := range []int{320, 1280} {
+        frame := testFrame(width, width*9/16)
+        for _, codec := range testCodecs() {
+            b.Run(fmt.Sprintf("%s/%dpx", codecLabel(codec), width), func(b *testing.B) {
+                size := 0
+                for i := 0; i < b.N; i++ {
+                    data, err := codec.Encode(frame, quality)
+                    if err != nil {
+                        b.Fatal(err)
+                    }
+                    size = len(data)
+                }
+                b.ReportMetric(float64(size), "bytes/frame")
+            })
+        }
+    }
+}
+
+func probe(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+    rec := httptest.NewRecorder()
+    handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+    return rec
+}
+
+func TestReadyReportsAStalledHub(t *testing.T) {
+    h := startHub(t)
+    joinAs(t, "ready", "alice")
+
+    rec := probe(handleReady, "/ready")
+    var body struct {
+        Status string
+        Hub    hubStatus
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+        t.Fatal(err)
+    }
+    if rec.Code != http.StatusOK || body.Hub.Rooms != 1 || body.Hub.Clients != 1 {
+        t.Fatalf("/ready on a working hub = %d %s", rec.Code, rec.Body)
+    }
+
+    // An operator action whose answer nobody collects holds the hub loop
+    stuck := &operatorAction{Room: "ready", Target: "alice", Action: "mute", found: make(chan bool)}
+    h.operatorActions <- stuck
+
+    start := time.Now()
+    if rec := probe(handleReady, "/ready"); rec.Code != http.StatusServiceUnavailable {
+        t.Errorf("/ready on a stalled hub = %d %s, want 503", rec.Code, rec.Body)
+    }
+    if waited := time.Since(start); waited < readyTimeout || waited > 2*readyTimeout {
+        t.Errorf("/ready gave up after %s, want about %s", waited, readyTimeout)
+    }
+    if rec := probe(handleHealth, "/health"); rec.Code != http.StatusOK {
+        t.Errorf("/health on a stalled hub = %d, want 200: the process is still up", rec.Code)
+    }
+
+    <-stuck.found
+    if rec := probe(handleReady, "/ready"); rec.Code != http.StatusOK {
+        t.Errorf("/ready once the hub moved on = %d %s", rec.Code, rec.Body)
+    }
+}
+
+// withAcceptLimits swaps in the accept-layer limits for one test
+func withAcceptLimits(t *testing.T, conns, accepts *ipRateLimiter, slots chan struct{}) {
+    t.Helper()
+    prevConns, prevAccepts, prevSlots := connLimiter, acceptLimiter, connSlots
+    connLimiter, acceptLimiter, connSlots = conns, accepts, slots
+    t.Cleanup(func() { connLimiter, acceptLimiter, connSlots = prevConns, prevAccepts, prevSlots })
+}
+
+// upgradeFrom makes a /ws request from ip. It isn't a real WebSocket
+// handshake, so one the limits let through fails the upgrade with a 400.
+func upgradeFrom(ip string) *httptest.ResponseRecorder {
+    rec := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+    req.RemoteAddr = ip + ":40000"
+    handleWebSocket(rec, req)
+    return rec
+}
+
+func TestUpgradeBurstGets429(t *testing.T) {
+    h := startHub(t)
+    withAcceptLimits(t, newIPRateLimiter(1, 3), newIPRateLimiter(0, 0), nil)
+
+    for i := 0; i < 3; i++ {
+        if rec := upgradeFrom("198.51.100.7"); rec.Code != http.StatusBadRequest {
+            t.Fatalf("upgrade %d within the burst = %d %s, want it let through", i+1, rec.Code, rec.Body)
+        }
+    }
+    rec := upgradeFrom("198.51.100.7")
+    if rec.Code != http.StatusTooManyRequests {
+        t.Fatalf("upgrade past the burst = %d, want 429", rec.Code)
+    }
+    if got := rec.Header().Get("Retry-After"); got != "1" {
+        t.Errorf("Retry-After = %q, want 1 at one upgrade a second", got)
+    }
+
+    // The bucket is per address
+    if rec := upgradeFrom("198.51.100.8"); rec.Code != http.StatusBadRequest {
+        t.Errorf("another address was refused with %d", rec.Code)
+    }
+    if got := atomic.LoadInt64(&h.RejectedConns); got != 1 {
+        t.Errorf("RejectedConns = %d, want 1", got)
+    }
+}
+
+func TestReconnectHerdGets503WithSpreadRetries(t *testing.T) {
+    startHub(t)
+    withAcceptLimits(t, newIPRateLimiter(0, 0), newIPRateLimiter(1, 5), nil)
+
+    admitted := 0
+    retries := make(map[int]bool)
+    for i := 0; i < 50; i++ {
+        rec := upgradeFrom(fmt.Sprintf("203.0.113.%d", i))
+        switch rec.Code {
+        case http.StatusBadRequest:
+            admitted++
+        case http.StatusServiceUnavailable:
+            retry, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+            if err != nil || retry < 1 || time.Duration(retry)*time.Second > reconnectSpread+2*time.Second {
+                t.Fatalf("Retry-After = %q, want whole seconds within the reconnect spread", rec.Header().Get("Retry-After"))
+            }
+            retries[retry] = true
+        default:
+            t.Fatalf("herd upgrade got %d %s", rec.Code, rec.Body)
+        }
+    }
+    if admitted != 5 {
+        t.Errorf("%d of the herd admitted, want the burst of 5", admitted)
+    }
+    if len(retries) < 2 {
+        t.Errorf("every refused client was told the same Retry-After %v, so they'd all return together", retries)
+    }
+}
+
+func TestUpgradeAtCapacityGets503(t *testing.T) {
+    startHub(t)
+    slots := make(chan struct{}, 1)
+    withAcceptLimits(t, newIPRateLimiter(0, 0), newIPRateLimiter(0, 0), slots)
+
+    // A failed upgrade gives its slot back
+    if rec := upgradeFrom("198.51.100.7"); rec.Code != http.StatusBadRequest || len(slots) != 0 {
+        t.Fatalf("upgrade with a free slot = %d, %d slots still held", rec.Code, len(slots))
+    }
+
+    slots <- struct{}{}
+    if rec := upgradeFrom("198.51.100.7"); rec.Code != http.StatusServiceUnavailable {
+        t.Errorf("upgrade with every slot taken = %d, want 503", rec.Code)
+    }
+}
+
+func chunk(frameID string, index, total int, data string) *Message {
+    return &Message{Type: "frame-chunk", FrameID: frameID, Index: index, Total: total, Data: data}
+}
+
+// queuedErrors drains Send, returning the codes of the errors in it
+func queuedErrors(t *testing.T, c *Client) []ErrorCode {
+    t.Helper()
+    var codes []ErrorCode
+    for {
+        select {
+        case data, ok := <-c.Send:
+            if !ok {
+                return codes
+            }
+            var msg Message
+            if err := json.Unmarshal(data, &msg); err != nil {
+                t.Fatal(err)
+            }
+            if msg.Type == "error" {
+                codes = append(codes, msg.Code)
+            }
+        default:
+            return codes
+        }
+    }
+}
+
+func TestChunksReassembleInAnyOrder(t *testing.T) {
+    c := &Client{ID: "alice", Send: make(chan []byte, 8)}
+    now := time.Now()
+
+    first := chunk("f1", 0, 3, "AAAA")
+    first.Timestamp, first.FrameSize = 1234, 9
+    for _, msg := range []*Message{chunk("f1", 2, 3, "CC=="), first, chunk("f1", 2, 3, "CC==")} {
+        if frame := c.addChunk(msg, now); frame != nil {
+            t.Fatalf("frame complete after chunk %d of 3", msg.Index)
+        }
+    }
+    frame := c.addChunk(chunk("f1", 1, 3, "BBBB"), now)
+    if frame == nil {
+        t.Fatal("frame not rebuilt once every chunk was in")
+    }
+    if frame.Type != "video-frame" || frame.Data != "AAAABBBBCC==" || frame.Timestamp != 1234 || frame.FrameSize != 9 {
+        t.Errorf("rebuilt %+v, want chunk 0's header over the joined data", frame)
+    }
+    if frame.FrameID != "" || frame.Total != 0 || len(c.chunks) != 0 {
+        t.Errorf("chunking left behind in the frame (%+v) or the client (%d pending)", frame, len(c.chunks))
+    }
+    if codes := queuedErrors(t, c); len(codes) != 0 {
+        t.Errorf("a resent chunk was reported: %v", codes)
+    }
+
+    // A total that changes mid-frame, or an index outside it, is refused
+    c.addChunk(chunk("f2", 0, 3, "AAAA"), now)
+    if c.addChunk(chunk("f2", 1, 2, "BBBB"), now) != nil || c.addChunk(chunk("f3", 5, 3, "AAAA"), now) != nil {
+        t.Error("a bad chunk completed a frame")
+    }
+    if codes := queuedErrors(t, c); len(codes) != 1 || codes[0] != ErrInvalid || len(c.chunks) != 0 {
+        t.Errorf("errors %v and %d frames pending, want one invalid-message and none", codes, len(c.chunks))
+    }
+}
+
+func TestIncompleteFramesAreBounded(t *testing.T) {
+    c := &Client{ID: "alice", Send: make(chan []byte, 8)}
+    now := time.Now()
+
+    // A new frame past maxPendingFrames evicts the oldest
+    for i := 0; i <= maxPendingFrames; i++ {
+        c.addChunk(chunk(fmt.Sprintf("f%d", i), 0, 2, "AAAA"), now.Add(time.Duration(i)*time.Millisecond))
+    }
+    if len(c.chunks) != maxPendingFrames || c.chunks["f0"] != nil {
+        t.Errorf("pending %d frames, f0 among them: %v", len(c.chunks), c.chunks["f0"] != nil)
+    }
+
+    c.expireChunks(now.Add(chunkTimeout / 2))
+    if len(c.chunks) != maxPendingFrames {
+        t.Errorf("frames expired within chunkTimeout")
+    }
+    c.expireChunks(now.Add(chunkTimeout + time.Second))
+    if len(c.chunks) != 0 {
+        t.Errorf("%d frames survived chunkTimeout", len(c.chunks))
+    }
+    codes := queuedErrors(t, c)
+    if len(codes) != 1+maxPendingFrames {
+        t.Fatalf("errors %v, want one per dropped frame", codes)
+    }
+    for _, code := range codes {
+        if code != ErrIncomplete {
+            t.Errorf("dropped frame reported as %s, want %s", code, ErrIncomplete)
+        }
+    }
+
+    big := strings.Repeat("A", maxChunkedFrame/2+4)
+    c.addChunk(chunk("huge", 0, 2, big), now)
+    if c.addChunk(chunk("huge", 1, 2, big), now) != nil || len(c.chunks) != 0 {
+        t.Error("a frame over maxChunkedFrame was kept")
+    }
+    if codes := queuedErrors(t, c); len(codes) != 1 || codes[0] != ErrTooLarge {
+        t.Errorf("errors %v, want payload-too-large", codes)
+    }
+}
+
+// ReadPump expires chunks and reports them on its own goroutine, so the
+// hub may have closed Send first
+func TestChunkErrorsAfterCloseSend(t *testing.T) {
+    c := &Client{ID: "alice", Send: make(chan []byte, 8)}
+    now := time.Now()
+    c.addChunk(chunk("f1", 0, 2, "AAAA"), now)
+    c.closeSend(websocket.CloseNormalClosure, "")
+
+    c.expireChunks(now.Add(2 * chunkTimeout))
+    c.addChunk(chunk("f2", 0, 2, "AAAA"), now)
+    c.addChunk(chunk("f2", 0, 3, "AAAA"), now)
+}
+
+// signJWT makes a compact EdDSA token over claims
+func signJWT(t *testing.T, key ed25519.PrivateKey, alg string, claims map[string]interface{}) string {
+    t.Helper()
+    part := func(v interface{}) string {
+        data, err := json.Marshal(v)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return base64.RawURLEncoding.EncodeToString(data)
+    }
+    signed := part(map[string]string{"alg": alg, "typ": "JWT"}) + "." + part(claims)
+    return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(signed)))
+}
+
+// testJWTKey writes a fresh Ed25519 public key where AUTH_JWT_PUBLIC_KEY
+// would point, returning the private half and the path
+func testJWTKey(t *testing.T) (ed25519.PrivateKey, string) {
+    t.Helper()
+    pub, priv, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    der, err := x509.MarshalPKIXPublicKey(pub)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "jwt.pem")
+    if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return priv, path
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+    key, path := testJWTKey(t)
+    env := map[string]string{"AUTH_JWT_PUBLIC_KEY": path, "AUTH_JWT_ISSUER": "https://auth.example"}
+    auth, err := newAuthenticator(func(name string) string { return env[name] })
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, forger, _ := ed25519.GenerateKey(nil)
+
+    now := time.Now()
+    claims := func(change func(map[string]interface{})) map[string]interface{} {
+        c := map[string]interface{}{"sub": "alice", "iss": "https://auth.example", "exp": now.Add(time.Hour).Unix()}
+        if change != nil {
+            change(c)
+        }
+        return c
+    }
+    valid := signJWT(t, key, "EdDSA", claims(nil))
+    parts := strings.Split(valid, ".")
+
+    id, err := auth.Authenticate(context.Background(), valid)
+    if err != nil || id.Subject != "alice" {
+        t.Fatalf("valid token: %v, %v", id, err)
+    }
+    if _, err := auth.Authenticate(context.Background(), signJWT(t, key, "EdDSA", claims(func(c map[string]interface{}) {
+        c["exp"] = now.Add(-jwtLeeway / 2).Unix()
+    }))); err != nil {
+        t.Errorf("token expired within jwtLeeway refused: %v", err)
+    }
+
+    swapped := strings.Split(signJWT(t, key, "EdDSA", claims(func(c map[string]interface{}) { c["sub"] = "bob" })), ".")
+    unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+    refused := map[string]string{
+        "no token":      "",
+        "malformed":     "not.a-token",
+        "expired":       signJWT(t, key, "EdDSA", claims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Hour).Unix() })),
+        "no exp":        signJWT(t, key, "EdDSA", claims(func(c map[string]interface{}) { delete(c, "exp") })),
+        "not yet valid": signJWT(t, key, "EdDSA", claims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Hour).Unix() })),
+        "other issuer":  signJWT(t, key, "EdDSA", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" })),
+        "no sub":        signJWT(t, key, "EdDSA", claims(func(c map[string]interface{}) { delete(c, "sub") })),
+        "forged":        signJWT(t, forger, "EdDSA", claims(nil)),
+        "sub swapped":   parts[0] + "." + swapped[1] + "." + parts[2],
+        "alg none":      unsigned + "." + parts[1] + ".",
+        "alg not EdDSA": signJWT(t, key, "RS256", claims(nil)),
+    }
+    for name, token := range refused {
+        if id, err := auth.Authenticate(context.Background(), token); err == nil {
+            t.Errorf("%s: accepted as %s", name, id.Subject)
+        }
+    }
+}
+
+func TestUpgradeWithoutAValidTokenGets401(t *testing.T) {
+    h := startHub(t)
+    withAcceptLimits(t, newIPRateLimiter(0, 0), newIPRateLimiter(0, 0), nil)
+    key, path := testJWTKey(t)
+    auth, err := loadJWTAuthenticator(path, "", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    prev := authenticator
+    authenticator = auth
+    t.Cleanup(func() { authenticator = prev })
+
+    _, forger, _ := ed25519.GenerateKey(nil)
+    claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+    upgrade := func(token string) *httptest.ResponseRecorder {
+        rec := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+        if token != "" {
+            req.Header.Set("Authorization", "Bearer "+token)
+        }
+        handleWebSocket(rec, req)
+        return rec
+    }
+
+    for name, token := range map[string]string{"no token": "", "forged": signJWT(t, forger, "EdDSA", claims)} {
+        rec := upgrade(token)
+        if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+            t.Errorf("%s: upgrade = %d, want 401 with a WWW-Authenticate challenge", name, rec.Code)
+        }
+    }
+    if got := atomic.LoadInt64(&h.AuthFailures); got != 2 {
+        t.Errorf("AuthFailures = %d, want 2", got)
+    }
+    if rec := upgrade(signJWT(t, key, "EdDSA", claims)); rec.Code != http.StatusBadRequest {
+        t.Errorf("a valid token's upgrade = %d, want it past authentication", rec.Code)
+    }
+}
+
+func TestHubSurvivesAHandlerPanic(t *testing.T) {
+    h := startHub(t)
+    alice := joinAs(t, "panic", "alice")
+    bob := joinAs(t, "panic", "bob")
+
+    // distributeVideo dereferences its job before taking any lock
+    h.encoded <- nil
+    waitFor(t, "the panic to be recovered", func() bool { return atomic.LoadInt64(&h.HubPanics) == 1 })
+
+    send(t, alice, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "alice's audio after the panic", func() bool { return len(received(bob, "audio-chunk", "alice")) == 1 })
+    carol := joinAs(t, "panic", "carol")
+    send(t, carol, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "a client joining after the panic to be heard", func() bool { return len(received(alice, "audio-chunk", "carol")) == 1 })
+}
+
+// connectAs starts a client and sends its join without waiting for a welcome
+func connectAs(room, id string) *memConn {
+    conn := newMemConn(id)
+    go serveConn(conn, "test", "127.0.0.1", nil)
+    data, _ := json.Marshal(Message{Type: "join", Room: room, ID: id})
+    conn.in <- data
+    return conn
+}
+
+func TestHubPanicReleasesLocksAndOwedReplies(t *testing.T) {
+    h := startHub(t)
+    alice := joinAs(t, "ghost", "alice")
+    room := h.room("ghost")
+    panics := func() int64 { return atomic.LoadInt64(&h.HubPanics) }
+
+    // A nil participant panics sendToOthers with the announcement's reply owed
+    room.withLock(func() { room.Clients["carol"] = nil })
+    a := &announcement{Room: "ghost", Text: "hello", Level: "info", delivered: make(chan int, 1)}
+    h.announcements <- a
+    select {
+    case n, ok := <-a.delivered:
+        if ok {
+            t.Errorf("the announcement panicked but reported %d delivered", n)
+        }
+    case <-time.After(readyTimeout):
+        t.Fatal("the announcement's reply was never answered after the panic")
+    }
+
+    // and carol rejoining over it panics while seating her under the room lock
+    before := panics()
+    connectAs("ghost", "carol")
+    waitFor(t, "carol's join to panic", func() bool { return panics() > before })
+    if !room.mu.TryLock() {
+        t.Fatal("the room is still locked after the panic")
+    }
+    delete(room.Clients, "carol")
+    room.mu.Unlock()
+
+    // A nil room panics status with /ready's reply owed
+    h.mu.Lock()
+    h.Rooms["nil"] = nil
+    h.mu.Unlock()
+    start := time.Now()
+    if rec := probe(handleReady, "/ready"); rec.Code != http.StatusServiceUnavailable {
+        t.Errorf("/ready with its status panicking = %d %s, want 503", rec.Code, rec.Body)
+    }
+    if waited := time.Since(start); waited >= readyTimeout {
+        t.Errorf("/ready waited %s for a reply the panic had dropped", waited)
+    }
+
+    // and, at the room limit, opening another panics evicting under the hub lock
+    prevMaxRooms := maxRooms
+    maxRooms = 2
+    t.Cleanup(func() { maxRooms = prevMaxRooms })
+    before = panics()
+    connectAs("elsewhere", "dave")
+    waitFor(t, "dave's join to panic", func() bool { return panics() > before })
+    if !h.mu.TryLock() {
+        t.Fatal("the hub is still locked after the panic")
+    }
+    delete(h.Rooms, "nil")
+    h.mu.Unlock()
+
+    bob := joinAs(t, "ghost", "bob")
+    send(t, bob, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "bob's audio after the panics", func() bool { return len(received(alice, "audio-chunk", "bob")) == 1 })
+
+    // Shutdown gives up on a hub that panics closing its clients
+    h.mu.Lock()
+    h.Rooms["nil"] = nil
+    h.mu.Unlock()
+    start = time.Now()
+    h.Shutdown(time.Minute)
+    if waited := time.Since(start); waited >= readyTimeout {
+        t.Errorf("Shutdown waited %s for a reply the panic had dropped", waited)
+    }
+}
+
+func TestSetLayoutWithoutALayoutUnvalidated(t *testing.T) {
+    prevValidate := validateMessages
+    validateMessages = false
+    t.Cleanup(func() { validateMessages = prevValidate })
+
+    h := startHub(t)
+    alice := joinAs(t, "layout", "alice")
+    bob := joinAs(t, "layout", "bob")
+
+    send(t, alice, Message{Type: "set-layout"})
+    waitFor(t, "alice's error", func() bool { return len(received(alice, "error", "")) == 1 })
+    if n := atomic.LoadInt64(&h.HubPanics); n != 0 {
+        t.Fatalf("a set-layout without a layout panicked the hub %d times", n)
+    }
+
+    send(t, alice, Message{Type: "set-layout", Layout: &RoomLayout{Mode: "spotlight", SpotlightID: "bob"}})
+    waitFor(t, "the layout change", func() bool { return len(received(bob, "layout-changed", "alice")) == 1 })
+}
+
+// withAdminToken sets ADMIN_TOKEN for one test
+func withAdminToken(t *testing.T, token string) {
+    t.Helper()
+    prev := adminToken
+    adminToken = token
+    t.Cleanup(func() { adminToken = prev })
+}
+
+// announceAs posts an announcement with authorization as its Authorization header
+func announceAs(authorization string, a map[string]string) *httptest.ResponseRecorder {
+    body, _ := json.Marshal(a)
+    req := httptest.NewRequest(http.MethodPost, "/admin/announce", bytes.NewReader(body))
+    if authorization != "" {
+        req.Header.Set("Authorization", authorization)
+    }
+    rec := httptest.NewRecorder()
+    handleAnnounce(rec, req)
+    return rec
+}
+
+func TestAnnounceReachesEveryoneInTheRoom(t *testing.T) {
+    withAdminToken(t, "secret")
+    startHub(t)
+    alice := joinAs(t, "town-hall", "alice")
+    bob := joinAs(t, "town-hall", "bob")
+    viewer := newMemConn("viewer")
+    go serveConn(viewer, "test", "127.0.0.1", nil)
+    send(t, viewer, Message{Type: "join", Room: "town-hall", ID: "viewer", Role: "spectator"})
+    waitFor(t, "the spectator's welcome", func() bool { return len(received(viewer, "welcome", "")) > 0 })
+    other := joinAs(t, "elsewhere", "carol")
+
+    a := map[string]string{"room": "town-hall", "text": "Back in five", "level": "warning"}
+    for name, authorization := range map[string]string{
+        "no token":    "",
+        "wrong token": "Bearer guess",
+        "wrong basic": "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:guess")),
+    } {
+        if rec := announceAs(authorization, a); rec.Code != http.StatusUnauthorized {
+            t.Errorf("announcement with %s = %d, want 401", name, rec.Code)
+        }
+    }
+    if rec := announceAs("Bearer secret", map[string]string{"room": "nowhere", "text": "hi"}); rec.Code != http.StatusNotFound {
+        t.Errorf("announcement to an unknown room = %d %s, want 404", rec.Code, rec.Body)
+    }
+
+    rec := announceAs("Bearer secret", a)
+    var reply struct{ Delivered int }
+    if err := json.Unmarshal(rec.Body.Bytes(), &reply); err != nil || rec.Code != http.StatusOK {
+        t.Fatalf("announcement = %d %s", rec.Code, rec.Body)
+    }
+    if reply.Delivered != 3 {
+        t.Errorf("announcement delivered to %d, want alice, bob and the spectator", reply.Delivered)
+    }
+    for id, conn := range map[string]*memConn{"alice": alice, "bob": bob, "viewer": viewer} {
+        waitFor(t, "the announcement for "+id, func() bool { return len(received(conn, "announcement", "")) == 1 })
+    }
+    if got := received(other, "announcement", ""); len(got) != 0 {
+        t.Errorf("a client in another room got %d announcements", len(got))
+    }
+}
+
+func TestSanitizeAnnouncement(t *testing.T) {
+    for in, want := range map[string]string{
+        "Back in\tfive\r\n minutes":  "Back in five minutes",
+        "  padded  ":                   "padded",
+        "bell\x07 and\x1b[31m escape": "bell and[31m escape",
+        "bad \xff\xfe utf-8":          "bad utf-8",
+    } {
+        if got := sanitizeAnnouncement(in); got != want {
+            t.Errorf("sanitizeAnnouncement(%q) = %q, want %q", in, got, want)
+        }
+    }
+
+    // Cut on a rune boundary at maxAnnouncementLength, never mid-character
+    long := strings.Repeat("é", maxAnnouncementLength+10)
+    got := sanitizeAnnouncement(long)
+    if n := utf8.RuneCountInString(got); n != maxAnnouncementLength || !utf8.ValidString(got) {
+        t.Errorf("a %d-rune announcement came back %d runes, valid UTF-8 %v", maxAnnouncementLength+10, n, utf8.ValidString(got))
+    }
+    words := strings.Repeat("ab ", maxAnnouncementLength)
+    if got := sanitizeAnnouncement(words); utf8.RuneCountInString(got) > maxAnnouncementLength || strings.HasSuffix(got, " ") {
+        t.Errorf("a long run of words came back %d runes ending %q", utf8.RuneCountInString(got), got[len(got)-3:])
+    }
+}
+
+// adminGet serves a GET on mux with the given Authorization and Origin
+func adminGet(mux *http.ServeMux, path, authorization, origin string) *httptest.ResponseRecorder {
+    req := httptest.NewRequest(http.MethodGet, path, nil)
+    if authorization != "" {
+        req.Header.Set("Authorization", authorization)
+    }
+    if origin != "" {
+        req.Header.Set("Origin", origin)
+    }
+    rec := httptest.NewRecorder()
+    mux.ServeHTTP(rec, req)
+    return rec
+}
+
+func TestAdminConsoleNeedsTheToken(t *testing.T) {
+    withAdminToken(t, "secret")
+    startHub(t)
+    admin := http.NewServeMux()
+    registerConsole(admin)
+    login := "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+
+    for _, path := range []string{"/admin/", "/admin/status", "/admin/ws/stats"} {
+        rec := adminGet(admin, path, "", "")
+        if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+            t.Errorf("GET %s without credentials = %d, want 401 with a login prompt", path, rec.Code)
+        }
+        if rec := adminGet(admin, path, "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:guess")), ""); rec.Code != http.StatusUnauthorized {
+            t.Errorf("GET %s with the wrong password = %d, want 401", path, rec.Code)
+        }
+    }
+    for _, path := range []string{"/admin/", "/admin/status"} {
+        if rec := adminGet(admin, path, login, ""); rec.Code != http.StatusOK {
+            t.Errorf("GET %s logged in = %d, want 200", path, rec.Code)
+        }
+        if rec := adminGet(admin, path, login, "http://example.com"); rec.Code != http.StatusOK {
+            t.Errorf("GET %s logged in from the console's own origin = %d, want 200", path, rec.Code)
+        }
+    }
+
+    // A browser sends the saved login along with any page's request
+    for _, path := range []string{"/admin/status", "/admin/ws/stats"} {
+        if rec := adminGet(admin, path, login, "https://evil.example"); rec.Code != http.StatusUnauthorized {
+            t.Errorf("GET %s with the login from a foreign origin = %d, want 401", path, rec.Code)
+        }
+    }
+    req := httptest.NewRequest(http.MethodPost, "/admin/drain", nil)
+    req.Header.Set("Authorization", login)
+    req.Header.Set("Origin", "https://evil.example")
+    rec := httptest.NewRecorder()
+    admin.ServeHTTP(rec, req)
+    if rec.Code != http.StatusUnauthorized {
+        t.Errorf("cross-origin drain with the login = %d, want 401", rec.Code)
+    }
+
+    // Without ADMIN_ADDR the console stays off the public port
+    t.Setenv("ADMIN_ADDR", "")
+    public := http.NewServeMux()
+    registerAdminAPI(public)
+    startAdmin(public)
+    for _, path := range []string{"/admin/", "/admin/status", "/admin/ws/stats"} {
+        if rec := adminGet(public, path, login, ""); rec.Code != http.StatusNotFound {
+            t.Errorf("GET %s on the public mux = %d, want 404", path, rec.Code)
+        }
+    }
+}
+
+// meteredConn is a memConn that also notes when each message went out, how
+// big it was and whether it was video
+type meteredConn struct {
+    *memConn
+    mu     sync.Mutex
+    writes []meteredWrite
+}
+
+type meteredWrite struct {
+    at    time.Time
+    n     int
+    video bool
+}
+
+func (c *meteredConn) WriteMessage(messageType int, data []byte) error {
+    c.mu.Lock()
+    c.writes = append(c.writes, meteredWrite{time.Now(), len(data), isVideoMessage(data)})
+    c.mu.Unlock()
+    return c.memConn.WriteMessage(messageType, data)
+}
+
+func (c *meteredConn) NextWriter(messageType int) (io.WriteCloser, error) {
+    return &meteredWriter{conn: c, messageType: messageType}, nil
+}
+
+type meteredWriter struct {
+    bytes.Buffer
+    conn        *meteredConn
+    messageType int
+}
+
+func (w *meteredWriter) Close() error {
+    return w.conn.WriteMessage(w.messageType, w.Bytes())
+}
+
+func TestSendBudgetCapsVideoButNotAudio(t *testing.T) {
+    prevKbps := clientBandwidthKbps
+    clientBandwidthKbps = 320
+    t.Cleanup(func() { clientBandwidthKbps = prevKbps })
+    limit := clientBandwidthKbps * 1000 / 8
+
+    h := startHub(t)
+    alice := joinAs(t, "capped", "alice")
+    bob := &meteredConn{memConn: newMemConn("bob")}
+    go serveConn(bob, "test", "127.0.0.1", nil)
+    send(t, bob.memConn, Message{Type: "join", Room: "capped", ID: "bob"})
+    waitFor(t, "bob's welcome", func() bool { return len(received(bob.memConn, "welcome", "")) > 0 })
+
+    frame, err := framecodec.JPEG{}.Encode(testFrame(160, 90), 90)
+    if err != nil {
+        t.Fatal(err)
+    }
+    video := Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString(frame)}
+    audio := Message{Type: "audio-chunk", Data: base64.StdEncoding.EncodeToString(make([]byte, 64))}
+
+    // Twice the cap in video, with an audio chunk alongside every frame
+    chunks := 0
+    for start := time.Now(); time.Since(start) < 3*time.Second; chunks++ {
+        send(t, alice, video)
+        send(t, alice, audio)
+        time.Sleep(40 * time.Millisecond)
+    }
+    waitFor(t, "all of alice's audio", func() bool { return len(received(bob.memConn, "audio-chunk", "alice")) == chunks })
+    if atomic.LoadInt64(&h.BandwidthDropped) == 0 {
+        t.Fatal("no video was dropped: the flood never reached the cap")
+    }
+
+    bob.mu.Lock()
+    defer bob.mu.Unlock()
+    frames, peak := 0, 0
+    for i, w := range bob.writes {
+        if !w.video {
+            continue
+        }
+        frames++
+        // Metered after the write, so a little short of the budget's second
+        window := 0
+        for _, prev := range bob.writes[:i+1] {
+            if prev.video && w.at.Sub(prev.at) < time.Second-10*time.Millisecond {
+                window += prev.n
+            }
+        }
+        peak = max(peak, window)
+    }
+    if frames == 0 {
+        t.Fatal("no video got through under the cap")
+    }
+    if peak > limit {
+        t.Errorf("bob was sent %d bytes of video in a second, over the %d byte cap", peak, limit)
+    }
+}
+
+func TestMessageRules(t *testing.T) {
+    yes := true
+    long := strings.Repeat("x", maxIDLength+1)
+    fb := func(f ClientFeedback) *Message { return &Message{Feedback: &f} }
+    type cases struct {
+        valid   []*Message
+        invalid []*Message
+    }
+    targeted := cases{
+        valid:   []*Message{{Target: "bob"}},
+        invalid: []*Message{{}, {Target: long}},
+    }
+    table := map[string]cases{
+        "audio-chunk": {
+            valid:   []*Message{{Data: "AAAA"}, {Data: "AAAA", Seq: 7}},
+            invalid: []*Message{{}, {Data: strings.Repeat("A", maxAudioData+1)}, {Data: "AAAA", Seq: -1}},
+        },
+        "video-frame": {
+            valid:   []*Message{{Data: "AAAA"}},
+            invalid: []*Message{{}, {Data: "AAAA", Seq: -1}},
+        },
+        "feedback": {
+            valid: []*Message{fb(ClientFeedback{Sender: "bob", Stream: "audio", Received: 10, Lost: 1}), fb(ClientFeedback{Sender: "bob", Stream: "video"})},
+            invalid: []*Message{
+                {},
+                fb(ClientFeedback{Stream: "audio"}),
+                fb(ClientFeedback{Sender: long, Stream: "audio"}),
+                fb(ClientFeedback{Sender: "bob", Stream: "screen"}),
+                fb(ClientFeedback{Sender: "bob", Stream: "video", Lost: -1}),
+                fb(ClientFeedback{Sender: "bob", Stream: "video", Received: -1}),
+            },
+        },
+        "layer-request": {
+            valid:   []*Message{{SourceID: "bob", MaxWidth: 320}, {SourceID: "bob"}},
+            invalid: []*Message{{MaxWidth: 320}, {SourceID: long}, {SourceID: "bob", MaxWidth: 4097}},
+        },
+        "key-announce": {
+            valid: []*Message{{Data: "a2V5", KeyID: "k1"}, {Data: "a2V5", KeyID: "k1", Target: "bob"}},
+            invalid: []*Message{
+                {KeyID: "k1"},
+                {Data: strings.Repeat("A", maxKeyData+1), KeyID: "k1"},
+                {Data: "a2V5"},
+                {Data: "a2V5", KeyID: long},
+                {Data: "a2V5", KeyID: "k1", Target: long},
+            },
+        },
+        "reaction": {
+            valid:   []*Message{{Reaction: "raise-hand"}},
+            invalid: []*Message{{}, {Reaction: strings.Repeat("x", 33)}},
+        },
+        "subscribe-video": {
+            valid:   []*Message{{}, {IDs: []string{}}, {IDs: []string{"bob", "carol"}}},
+            invalid: []*Message{{IDs: make([]string, maxSubscriptions+1)}, {IDs: []string{"bob", ""}}, {IDs: []string{long}}},
+        },
+        "mute-state": {
+            valid:   []*Message{{Audio: &yes}, {Video: &yes}},
+            invalid: []*Message{{}},
+        },
+        "set-layout": {
+            valid: []*Message{{Layout: &RoomLayout{Mode: "grid"}}, {Layout: &RoomLayout{Mode: "spotlight", SpotlightID: "bob"}}},
+            invalid: []*Message{
+                {},
+                {Layout: &RoomLayout{}},
+                {Layout: &RoomLayout{Mode: "gallery"}},
+                {Layout: &RoomLayout{Mode: "spotlight"}},
+            },
+        },
+        "frame-chunk": {
+            valid: []*Message{{FrameID: "f1", Total: 2, Index: 1, Data: "AAAA"}, {FrameID: "f1", Total: maxChunksPerFrame, Data: "AAAA"}},
+            invalid: []*Message{
+                {Total: 2, Data: "AAAA"},
+                {FrameID: long, Total: 2, Data: "AAAA"},
+                {FrameID: "f1", Data: "AAAA"},
+                {FrameID: "f1", Total: maxChunksPerFrame + 1, Data: "AAAA"},
+                {FrameID: "f1", Total: 2, Index: 2, Data: "AAAA"},
+                {FrameID: "f1", Total: 2, Index: -1, Data: "AAAA"},
+                {FrameID: "f1", Total: 2},
+            },
+        },
+        "app": {
+            valid: []*Message{{Channel: "poll", Payload: json.RawMessage(`{"q":1}`)}, {Channel: "poll", Payload: json.RawMessage(`1`), Target: "bob"}},
+            invalid: []*Message{
+                {Payload: json.RawMessage(`1`)},
+                {Channel: strings.Repeat("c", maxChannelLength+1), Payload: json.RawMessage(`1`)},
+                {Channel: "poll"},
+                {Channel: "poll", Payload: json.RawMessage(strconv.Quote(strings.Repeat("p", maxAppPayload)))},
+                {Channel: "poll", Payload: json.RawMessage(`1`), Target: long},
+            },
+        },
+        "keyframe-request": targeted,
+        "mute":             targeted,
+        "unmute":           targeted,
+        "kick":             targeted,
+    }
+
+    for kind, rule := range messageRules {
+        c, ok := table[kind]
+        if !ok {
+            t.Errorf("no cases for the %s rule", kind)
+            continue
+        }
+        for _, m := range c.valid {
+            if problem := rule(m); problem != "" {
+                data, _ := json.Marshal(m)
+                t.Errorf("valid %s %s refused: %s", kind, data, problem)
+            }
+        }
+        for _, m := range c.invalid {
+            if rule(m) == "" {
+                data, _ := json.Marshal(m)
+                t.Errorf("invalid %s %.200s passed", kind, data)
+            }
+        }
+    }
+}
+
+func TestInvalidMessagesAreRefusedNotRelayed(t *testing.T) {
+    startHub(t)
+    alice := joinAs(t, "rules", "alice")
+    bob := joinAs(t, "rules", "bob")
+
+    send(t, alice, Message{Type: "audio-chunk"})
+    send(t, alice, Message{Type: "app", Channel: "poll"})
+    waitFor(t, "errors for both", func() bool { return len(received(alice, "error", "")) == 2 })
+    send(t, alice, Message{Type: "audio-chunk", Data: "AAAA"})
+    send(t, alice, Message{Type: "app", Channel: "poll", Payload: json.RawMessage(`1`)})
+    waitFor(t, "the valid app message", func() bool { return len(received(bob, "app", "alice")) > 0 })
+
+    // The hub keeps order, so anything relayed before it is here by now
+    if audio, app := len(received(bob, "audio-chunk", "alice")), len(received(bob, "app", "alice")); audio != 1 || app != 1 {
+        t.Errorf("bob got %d audio-chunks and %d app messages, want only the valid one of each", audio, app)
+    }
+}
+
+// withRecordingKey sets the recording encryption globals for one test
+func withRecordingKey(t *testing.T, encrypt bool, key []byte) {
+    t.Helper()
+    prevEncrypt, prevKey := recordingEncrypt, recordingKey
+    recordingEncrypt, recordingKey = encrypt, key
+    t.Cleanup(func() { recordingEncrypt, recordingKey = prevEncrypt, prevKey })
+}
+
+// writeTestRecording records alice joining and sending one frame and one
+// audio chunk, returning the file and the frame
+func writeTestRecording(t *testing.T) (string, []byte) {
+    t.Helper()
+    frame, err := framecodec.JPEG{}.Encode(testFrame(64, 36), 80)
+    if err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "room-1.jsonl")
+    rec, err := newRecordingFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, msg := range []Message{
+        {Type: "join", Room: "room", ID: "alice"},
+        {Type: "video-frame", Data: base64.StdEncoding.EncodeToString(frame)},
+        {Type: "audio-chunk", Data: base64.StdEncoding.EncodeToString(make([]byte, 1920))},
+    } {
+        data, err := json.Marshal(msg)
+        if err != nil {
+            t.Fatal(err)
+        }
+        rec.write(replayEvent{Conn: "conn-1", Data: data})
+        time.Sleep(time.Millisecond) // Distinct arrival times
+    }
+    if err := rec.Close(); err != nil {
+        t.Fatal(err)
+    }
+    return path, frame
+}
+
+func TestEncryptedRecordingNeedsTheKey(t *testing.T) {
+    key := bytes.Repeat([]byte{7}, 32)
+    withRecordingKey(t, true, key)
+    path, frame := writeTestRecording(t)
+
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, plain := range []string{"alice", "video-frame", "conn-1", base64.StdEncoding.EncodeToString(frame[:32])} {
+        if bytes.Contains(raw, []byte(plain)) {
+            t.Errorf("%q is readable in the encrypted recording", plain)
+        }
+    }
+
+    media, err := loadRecordedMedia(path, "alice")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(media.frames) != 1 || !bytes.Equal(media.frames[0], frame) || len(media.audio) != 1 {
+        t.Errorf("decrypted %d frames and %d audio chunks, want alice's one of each intact", len(media.frames), len(media.audio))
+    }
+
+    recordingKey = bytes.Repeat([]byte{8}, 32)
+    if _, err := loadRecordedMedia(path, "alice"); err == nil {
+        t.Error("the recording loaded under a different RECORDING_KEY")
+    }
+    recordingKey = nil
+    if _, err := loadRecordedMedia(path, "alice"); err == nil {
+        t.Error("the recording loaded with no RECORDING_KEY")
+    }
+
+    // Each event is sealed to its place in the file
+    recordingKey = key
+    lines := bytes.SplitAfter(raw, []byte("\n"))
+    lines[2], lines[3] = lines[3], lines[2]
+    spliced := filepath.Join(t.TempDir(), "spliced.jsonl")
+    if err := os.WriteFile(spliced, bytes.Join(lines, nil), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := loadRecordedMedia(spliced, "alice"); err == nil {
+        t.Error("a recording with two events swapped decrypted")
+    }
+}
+
+func TestPlainRecordingLoadsWithTheKeySet(t *testing.T) {
+    // With encryption off RECORDING_KEY can stay set for older encrypted
+    // recordings, and plain ones must keep loading beside them
+    withRecordingKey(t, false, bytes.Repeat([]byte{7}, 32))
+    path, frame := writeTestRecording(t)
+
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Contains(raw, []byte("alice")) {
+        t.Fatal("a plain recording doesn't hold its events in the clear")
+    }
+    media, err := loadRecordedMedia(path, "alice")
+    if err != nil || len(media.frames) != 1 || !bytes.Equal(media.frames[0], frame) {
+        t.Errorf("plain recording loaded %v, %v", media, err)
+    }
+}
+
+func TestExportEncryptedRecording(t *testing.T) {
+    if _, err := exec.LookPath("ffmpeg"); err != nil {
+        t.Skip("export needs ffmpeg")
+    }
+    withRecordingKey(t, true, bytes.Repeat([]byte{7}, 32))
+    path, _ := writeTestRecording(t)
+
+    out := filepath.Join(t.TempDir(), "alice.webm")
+    if err := exportRecording(path, "alice", out); err != nil {
+        t.Fatal(err)
+    }
+    if info, err := os.Stat(out); err != nil || info.Size() == 0 {
+        t.Errorf("export wrote nothing: %v", err)
+    }
+}
+
+// fakeFFmpeg puts a shell script first on PATH as ffmpeg. The default copies
+// the concat list to the output and the PCM beside it as <output>.pcm.
+func fakeFFmpeg(t *testing.T, script string) {
+    t.Helper()
+    if script == "" {
+        script = `for arg; do
+    if [ "$prev" = "-i" ]; then
+        if [ -z "$list" ]; then list=$arg; else pcm=$arg; fi
+    fi
+    prev=$arg
+done
+cp "$list" "$arg"
+if [ -n "$pcm" ]; then cp "$pcm" "$arg.pcm"; fi`
+    }
+    dir := t.TempDir()
+    if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// withExports points RECORDINGS_DIR at a fresh directory with no jobs
+func withExports(t *testing.T) {
+    t.Helper()
+    prevDir, prevJobs := recordingsDir, exportJobs
+    recordingsDir = t.TempDir()
+    exportJobs = make(map[string]*exportJob)
+    t.Cleanup(func() {
+        exportMu.Lock()
+        recordingsDir, exportJobs = prevDir, prevJobs
+        exportMu.Unlock()
+    })
+}
+
+func startExport(t *testing.T, id string) (int, exportJob) {
+    t.Helper()
+    req := httptest.NewRequest(http.MethodPost, "/recordings/"+id+"/export", nil)
+    req.SetPathValue("id", id)
+    rec := httptest.NewRecorder()
+    handleExportStart(rec, req)
+    var job exportJob
+    if rec.Code == http.StatusAccepted {
+        if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return rec.Code, job
+}
+
+func exportStatus(t *testing.T, id string) (int, exportJob) {
+    t.Helper()
+    req := httptest.NewRequest(http.MethodGet, "/recordings/exports/"+id, nil)
+    req.SetPathValue("job", id)
+    rec := httptest.NewRecorder()
+    handleExportStatus(rec, req)
+    var job exportJob
+    if rec.Code == http.StatusOK {
+        if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return rec.Code, job
+}
+
+func waitForExport(t *testing.T, id string) exportJob {
+    t.Helper()
+    var job exportJob
+    waitFor(t, "export "+id, func() bool {
+        _, job = exportStatus(t, id)
+        return job.Status == "done" || job.Status == "failed"
+    })
+    return job
+}
+
+func TestExportsNeedFFmpegAtStartup(t *testing.T) {
+    withExports(t)
+    t.Setenv("PATH", t.TempDir())
+    if err := prepareExports(); err == nil || !strings.Contains(err.Error(), "ffmpeg") {
+        t.Errorf("with no ffmpeg on PATH prepareExports = %v, want it refused", err)
+    }
+
+    fakeFFmpeg(t, "exit 0")
+    if err := prepareExports(); err != nil {
+        t.Fatal(err)
+    }
+    if info, err := os.Stat(exportsDir()); err != nil || !info.IsDir() {
+        t.Errorf("prepareExports left no exports directory: %v", err)
+    }
+}
+
+func TestExportKeepsRecordedFrameTimings(t *testing.T) {
+    withExports(t)
+    fakeFFmpeg(t, "")
+    if err := prepareExports(); err != nil {
+        t.Fatal(err)
+    }
+
+    // Audio from 0ms, frames arriving unevenly from 20ms
+    chunk := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 1920))
+    var recording bytes.Buffer
+    for _, ev := range []struct {
+        at  int64
+        msg Message
+    }{
+        {0, Message{Type: "join", Room: "vfr", ID: "alice"}},
+        {0, Message{Type: "audio-chunk", Data: chunk}},
+        {20, Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString([]byte("frame 0"))}},
+        {60, Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString([]byte("frame 1"))}},
+        {100, Message{Type: "audio-chunk", Data: chunk}},
+        {160, Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString([]byte("frame 2"))}},
+        {170, Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString([]byte("frame 3"))}},
+    } {
+        data, err := json.Marshal(ev.msg)
+        if err != nil {
+            t.Fatal(err)
+        }
+        line, _ := json.Marshal(replayEvent{At: ev.at, Conn: "conn-1", Data: data})
+        recording.Write(append(line, '\n'))
+    }
+    if err := os.WriteFile(filepath.Join(recordingsDir, "vfr-1.jsonl"), recording.Bytes(), 0o600); err != nil {
+        t.Fatal(err)
+    }
+
+    code, started := startExport(t, "vfr-1")
+    if code != http.StatusAccepted || started.Status != "queued" {
+        t.Fatalf("starting the export = %d %+v", code, started)
+    }
+    job := waitForExport(t, started.ID)
+    if job.Status != "done" || job.URL != "/recordings/files/"+job.ID+".webm" {
+        t.Fatalf("export finished as %+v", job)
+    }
+
+    // Each frame lasts until the next arrived, the first from the audio's
+    // start and the last the default 100ms
+    out := filepath.Join(exportsDir(), job.ID+".webm")
+    list, err := os.ReadFile(out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := "file 'frame-000000.jpg'\nduration 0.060\n" +
+        "file 'frame-000001.jpg'\nduration 0.100\n" +
+        "file 'frame-000002.jpg'\nduration 0.010\n" +
+        "file 'frame-000003.jpg'\nduration 0.100\n" +
+        "file 'frame-000003.jpg'\n"
+    if string(list) != want {
+        t.Errorf("ffmpeg was given the frame list\n%s\nwant\n%s", list, want)
+    }
+    // The second chunk arrived at 100ms, so silence pads the 80ms between
+    pcm, err := os.ReadFile(out + ".pcm")
+    if err != nil {
+        t.Fatal(err)
+    }
+    gap := 100*exportSampleRate/1000*2 - 1920
+    if len(pcm) != 2*1920+gap || !bytes.Equal(pcm[1920:1920+gap], make([]byte, gap)) || pcm[1920+gap] != 1 {
+        t.Errorf("the audio track is %d bytes, want two chunks with %d bytes of silence between", len(pcm), gap)
+    }
+
+    // ffmpeg failing fails the job with what it said
+    fakeFFmpeg(t, "echo 'Unknown encoder libvpx-vp9' >&2; exit 1")
+    _, started = startExport(t, "vfr-1")
+    if job := waitForExport(t, started.ID); job.Status != "failed" || !strings.Contains(job.Error, "Unknown encoder libvpx-vp9") {
+        t.Errorf("an export ffmpeg refused finished as %+v", job)
+    }
+}
+
+func TestExportJobsExpireAndAreCapped(t *testing.T) {
+    withExports(t)
+    fakeFFmpeg(t, `for arg; do :; done; echo webm > "$arg"`)
+    if err := prepareExports(); err != nil {
+        t.Fatal(err)
+    }
+    path, _ := writeTestRecording(t)
+    if err := os.Rename(path, filepath.Join(recordingsDir, "room-1.jsonl")); err != nil {
+        t.Fatal(err)
+    }
+
+    // A job finished exportJobTTL ago is forgotten, and its file removed
+    _, started := startExport(t, "room-1")
+    old := waitForExport(t, started.ID)
+    file := filepath.Join(exportsDir(), old.ID+".webm")
+    if _, err := os.Stat(file); err != nil {
+        t.Fatal(err)
+    }
+    exportMu.Lock()
+    exportJobs[old.ID].finished = time.Now().Add(-exportJobTTL)
+    exportMu.Unlock()
+    _, started = startExport(t, "room-1")
+    waitForExport(t, started.ID)
+    if code, _ := exportStatus(t, old.ID); code != http.StatusNotFound {
+        t.Errorf("a job finished exportJobTTL ago still answers %d", code)
+    }
+    if _, err := os.Stat(file); !os.IsNotExist(err) {
+        t.Errorf("an expired job's file is still there: %v", err)
+    }
+
+    // Full of jobs still going, the next is refused; once one is finished
+    // it makes way, the oldest finished first
+    exportMu.Lock()
+    delete(exportJobs, started.ID)
+    for i := 0; len(exportJobs) < maxExportJobs; i++ {
+        id := fmt.Sprintf("running-%d", i)
+        exportJobs[id] = &exportJob{ID: id, Status: "running"}
+    }
+    exportMu.Unlock()
+    if code, _ := startExport(t, "room-1"); code != http.StatusServiceUnavailable {
+        t.Errorf("with %d jobs running another export got %d, want 503", maxExportJobs, code)
+    }
+    exportMu.Lock()
+    exportJobs["running-2"].finished = time.Now().Add(-time.Minute)
+    exportJobs["running-3"].finished = time.Now()
+    exportMu.Unlock()
+    code, latest := startExport(t, "room-1")
+    if code != http.StatusAccepted {
+        t.Fatalf("with two jobs finished another export got %d", code)
+    }
+    waitForExport(t, latest.ID)
+    exportMu.Lock()
+    _, oldest := exportJobs["running-2"]
+    _, newer := exportJobs["running-3"]
+    tracked := len(exportJobs)
+    exportMu.Unlock()
+    if oldest || !newer || tracked != maxExportJobs {
+        t.Errorf("after making way %d jobs are tracked, running-2 kept %v and running-3 %v; want %d, the older dropped", tracked, oldest, newer, maxExportJobs)
+    }
+}
+
+// Image headers that declare width x height and stop there
+func craftedPNG(width, height uint32) []byte {
+    ihdr := binary.BigEndian.AppendUint32([]byte("IHDR"), width)
+    ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+    ihdr = append(ihdr, 8, 2, 0, 0, 0) // 8-bit RGB
+    data := append([]byte("\x89PNG\r\n\x1a\n"), 0, 0, 0, 13)
+    data = append(data, ihdr...)
+    return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func craftedJPEG(width, height uint16) []byte {
+    // A JFIF marker first, or the decoder reads on looking for an Adobe one
+    sof := append([]byte{0xff, 0xd8, 0xff, 0xe0, 0, 16}, "JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"...)
+    sof = append(sof, 0xff, 0xc0, 0, 11, 8)
+    sof = binary.BigEndian.AppendUint16(sof, height)
+    sof = binary.BigEndian.AppendUint16(sof, width)
+    return append(sof, 1, 1, 0x11, 0) // One grayscale component
+}
+
+func TestCheckFrameSizeReadsOnlyTheHeader(t *testing.T) {
+    real, err := framecodec.JPEG{}.Encode(testFrame(320, 180), 80)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := checkFrameSize(real); err != nil {
+        t.Errorf("a 320x180 frame was refused: %v", err)
+    }
+
+    oversized := map[string][]byte{
+        "png 100000x100000":   craftedPNG(100000, 100000),
+        "png wider than max":  craftedPNG(uint32(maxFrameWidth)+1, 1),
+        "png over max pixels": craftedPNG(uint32(maxFrameWidth), uint32(maxFramePixels/maxFrameWidth)+1),
+        "jpeg 65535x65535":    craftedJPEG(65535, 65535),
+    }
+    for name, data := range oversized {
+        err := checkFrameSize(data)
+        if !errors.Is(err, errOversizedFrame) || !errors.Is(err, errBadFrame) {
+            t.Errorf("%s (%d bytes): err = %v, want an oversized bad frame", name, len(data), err)
+        }
+    }
+    if err := checkFrameSize(craftedPNG(64, 64)[:20]); !errors.Is(err, errBadFrame) || errors.Is(err, errOversizedFrame) {
+        t.Errorf("a truncated header: err = %v, want a bad frame that isn't oversized", err)
+    }
+}
+
+func TestOversizedFramesDisconnectAtTheLimit(t *testing.T) {
+    h := NewHub()
+    conn := newMemConn("alice")
+    alice := &Client{ID: "alice", Conn: conn, Send: make(chan []byte, 16)}
+    job := &encodeJob{room: &Room{ID: "big", Clients: map[string]*Client{"alice": alice}}, from: "alice"}
+    crafted := craftedPNG(100000, 100000)
+
+    // A good frame in between doesn't reset the count, as it would for bad ones
+    for i := 1; i < badFrameLimit; i++ {
+        h.trackFrame(job, crafted, checkFrameSize(crafted))
+        h.trackFrame(job, nil, nil)
+    }
+    if codes := queuedErrors(t, alice); len(codes) != 0 {
+        t.Fatalf("errors %v before the limit", codes)
+    }
+    h.trackFrame(job, crafted, checkFrameSize(crafted))
+
+    if got := atomic.LoadInt64(&h.OversizedFrames); got != int64(badFrameLimit) {
+        t.Errorf("OversizedFrames = %d, want %d", got, badFrameLimit)
+    }
+    if atomic.LoadInt64(&h.DecodeFailures) != 0 {
+        t.Error("oversized frames counted as decode failures")
+    }
+    if codes := queuedErrors(t, alice); len(codes) != 1 || codes[0] != ErrBadFrame {
+        t.Errorf("errors %v at the limit, want one bad-frame", codes)
+    }
+    select {
+    case <-conn.closed:
+    case <-time.After(3 * time.Second):
+        t.Error("alice wasn't disconnected after badFrameLimit oversized frames")
+    }
+}
+
+// selfSignedCert writes a pair for 127.0.0.1 under dir and returns the
+// paths, with a pool trusting it
+func selfSignedCert(t *testing.T, dir string) (certFile, keyFile string, roots *x509.CertPool) {
+    t.Helper()
+    pub, priv, err := ed25519.GenerateKey(nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "conference test"},
+        IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    der, err := x509.CreateCertificate(nil, template, template, pub, priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+        t.Fatal(err)
+    }
+    roots = x509.NewCertPool()
+    roots.AppendCertsFromPEM(certPEM)
+    return certFile, keyFile, roots
+}
+
+func TestServeWSSWithACertPair(t *testing.T) {
+    startHub(t)
+    certFile, keyFile, roots := selfSignedCert(t, t.TempDir())
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/ws", handleWebSocket)
+    server := &http.Server{Handler: mux}
+    served := make(chan error, 1)
+    go func() { served <- serve(server, ln, certFile, keyFile) }()
+    t.Cleanup(func() {
+        server.Close()
+        if err := <-served; err != http.ErrServerClosed {
+            t.Errorf("serve returned %v, want ErrServerClosed", err)
+        }
+    })
+    url := "wss://" + ln.Addr().String() + "/ws"
+
+    dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}, HandshakeTimeout: 2 * time.Second}
+    conn, _, err := dialer.Dial(url, nil)
+    if err != nil {
+        t.Fatalf("dialing %s: %v", url, err)
+    }
+    defer conn.Close()
+    tlsConn, ok := conn.UnderlyingConn().(*tls.Conn)
+    if !ok {
+        t.Fatalf("upgraded over a %T, want TLS", conn.UnderlyingConn())
+    }
+    if state := tlsConn.ConnectionState(); state.Version < tls.VersionTLS12 {
+        t.Errorf("negotiated %s, want TLS 1.2 or later", tls.VersionName(state.Version))
+    }
+
+    if err := conn.WriteJSON(Message{Type: "join", Room: "main", ID: "alice"}); err != nil {
+        t.Fatal(err)
+    }
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        var msg Message
+        if err := conn.ReadJSON(&msg); err != nil {
+            t.Fatalf("reading the welcome over wss: %v", err)
+        }
+        if msg.Type == "welcome" {
+            break
+        }
+    }
+
+    // newTLSConfig's floor: a TLS 1.1 client gets no handshake, and a TLS
+    // 1.2 one offering only CBC suites gets none either
+    for name, config := range map[string]*tls.Config{
+        "TLS 1.1":        {RootCAs: roots, MaxVersion: tls.VersionTLS11},
+        "CBC suite only": {RootCAs: roots, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}},
+    } {
+        weak := websocket.Dialer{TLSClientConfig: config, HandshakeTimeout: 2 * time.Second}
+        if conn, _, err := weak.Dial(url, nil); err == nil {
+            conn.Close()
+            t.Errorf("a %s client completed the handshake", name)
+        }
+    }
+
+}
+
+func TestClientIP(t *testing.T) {
+    for _, tc := range []struct {
+        name   string
+        trust  bool
+        remote string
+        fwd    string
+        want   string
+    }{
+        {"no proxy trusted ignores the header", false, "203.0.113.7:50000", "198.51.100.1", "203.0.113.7"},
+        {"no header", true, "203.0.113.7:50000", "", "203.0.113.7"},
+        {"behind a proxy takes the client it saw", true, "10.0.0.2:50000", "198.51.100.1", "198.51.100.1"},
+        {"the left-most of a chain", true, "10.0.0.2:50000", " 198.51.100.1 , 10.0.0.9, 10.0.0.2", "198.51.100.1"},
+        {"IPv6", true, "10.0.0.2:50000", "2001:db8::1, 10.0.0.2", "2001:db8::1"},
+        {"an unparseable entry falls back", true, "10.0.0.2:50000", "unknown, 198.51.100.1", "10.0.0.2"},
+        {"a port is not an address", true, "10.0.0.2:50000", "198.51.100.1:443", "10.0.0.2"},
+        {"a remote with no port", false, "pipe", "", "pipe"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            old := trustProxy
+            trustProxy = tc.trust
+            t.Cleanup(func() { trustProxy = old })
+
+            r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+            r.RemoteAddr = tc.remote
+            if tc.fwd != "" {
+                r.Header.Set("X-Forwarded-For", tc.fwd)
+            }
+            if got := clientIP(r); got != tc.want {
+                t.Errorf("clientIP with RemoteAddr %q and X-Forwarded-For %q = %q, want %q", tc.remote, tc.fwd, got, tc.want)
+            }
+        })
+    }
+}
+
+func TestEmptyRoomOutlivesABriefDisconnect(t *testing.T) {
+    prev := roomTTL
+    roomTTL = time.Minute
+    t.Cleanup(func() { roomTTL = prev })
+
+    h := startHub(t)
+    alice := joinAs(t, "ttl", "alice")
+    room := h.room("ttl")
+    alice.Close()
+    waitFor(t, "alice to leave", func() bool { return room.size() == 0 })
+
+    // Empty but only just: a reconnect lands in the same room
+    h.reapIdleRooms()
+    alice = joinAs(t, "ttl", "alice")
+    if h.room("ttl") != room {
+        t.Fatal("alice came back to a new room after a brief disconnect")
+    }
+
+    // Occupied rooms are never reaped, however quiet
+    room.withLock(func() { room.LastActivity = time.Now().Add(-2 * roomTTL) })
+    h.reapIdleRooms()
+    if h.room("ttl") != room {
+        t.Fatal("a room with alice in it was reaped")
+    }
+
+    alice.Close()
+    waitFor(t, "alice to leave again", func() bool { return room.size() == 0 })
+    room.withLock(func() { room.LastActivity = time.Now().Add(-roomTTL + time.Second) })
+    h.reapIdleRooms()
+    if h.room("ttl") == nil {
+        t.Fatal("a room empty for less than the TTL was reaped")
+    }
+    room.withLock(func() { room.LastActivity = time.Now().Add(-roomTTL - time.Second) })
+    h.reapIdleRooms()
+    if h.room("ttl") != nil {
+        t.Error("a room empty for longer than the TTL survived the sweep")
+    }
+}
+
+func TestDuplicateJoinKeepsTheNewestConnection(t *testing.T) {
+    h := startHub(t)
+    bob := joinAs(t, "dup", "bob")
+    first := joinAs(t, "dup", "alice")
+    room := h.room("dup")
+    seated := room.client("alice")
+
+    // A racy reconnect: the second join closes the first connection, whose
+    // unregister then arrives after the new client holds the slot
+    second := joinAs(t, "dup", "alice")
+    select {
+    case <-first.closed:
+    case <-time.After(2 * time.Second):
+        t.Fatal("the replaced connection was never closed")
+    }
+    // Give the old connection's unregister time to land
+    time.Sleep(50 * time.Millisecond)
+    if current := room.client("alice"); current == nil || current == seated {
+        t.Fatalf("alice's slot after the old connection unregistered = %v, want the new client", current)
+    }
+
+    send(t, bob, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "bob's audio on alice's new connection", func() bool { return len(received(second, "audio-chunk", "bob")) == 1 })
+    if got := received(first, "audio-chunk", "bob"); len(got) != 0 {
+        t.Errorf("the replaced connection still got %d audio chunks", len(got))
+    }
+}
+
+func TestDuplicateJoinRejectedByPolicy(t *testing.T) {
+    prev := rejectDuplicateJoin
+    rejectDuplicateJoin = true
+    t.Cleanup(func() { rejectDuplicateJoin = prev })
+
+    h := startHub(t)
+    bob := joinAs(t, "dup", "bob")
+    first := joinAs(t, "dup", "alice")
+    seated := h.room("dup").client("alice")
+
+    second := connectAs("dup", "alice")
+    waitFor(t, "id-in-use for the second alice", func() bool { return len(received(second, "id-in-use", "")) == 1 })
+    select {
+    case <-second.closed:
+    case <-time.After(2 * time.Second):
+        t.Fatal("the refused connection was left open")
+    }
+    if len(received(second, "welcome", "")) != 0 {
+        t.Error("the refused connection was welcomed")
+    }
+
+    // Its unregister must not free the established client's slot either
+    time.Sleep(50 * time.Millisecond)
+    if got := h.room("dup").client("alice"); got != seated {
+        t.Fatalf("alice's slot after the refused join = %v, want the established client", got)
+    }
+    send(t, bob, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "bob's audio on the established connection", func() bool { return len(received(first, "audio-chunk", "bob")) == 1 })
+}
+
+func withEncodePool(t testing.TB, workers, queue int) {
+    prevWorkers, prevQueue := encodeWorkers, encodeQueueSize
+    encodeWorkers, encodeQueueSize = workers, queue
+    t.Cleanup(func() { encodeWorkers, encodeQueueSize = prevWorkers, prevQueue })
+}
+
+// videoFrame is a video-frame message carrying a jpeg of testFrame
+func videoFrame(t testing.TB, width, height int) Message {
+    t.Helper()
+    frame, err := framecodec.JPEG{}.Encode(testFrame(width, height), 90)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString(frame)}
+}
+
+// encodeRoom is n participants, user0 up, for driving the encoder pool
+// without a hub loop
+func encodeRoom(n int) *Room {
+    room := &Room{ID: "encode", Clients: make(map[string]*Client)}
+    for i := 0; i < n; i++ {
+        id := fmt.Sprintf("user%d", i)
+        room.Clients[id] = &Client{ID: id, Room: room.ID, Send: make(chan []byte, 64)}
+    }
+    return room
+}
+
+func TestEncoderPoolShedsFramesRatherThanBlock(t *testing.T) {
+    withEncodePool(t, 1, 1)
+    h := NewHub() // No Run, so no worker drains the queue
+    room := encodeRoom(3)
+    frame := videoFrame(t, 160, 90)
+
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 0; i < 5; i++ {
+            h.distributeVideoWebP(room, frame, "user0", 3)
+        }
+    }()
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("handing frames to a full encoder queue blocked the hub")
+    }
+    if got := atomic.LoadInt64(&h.EncodeDropped); got != 4 {
+        t.Errorf("EncodeDropped = %d with a queue of one and five frames, want 4", got)
+    }
+
+    // A frame nobody watches never takes a queue slot
+    <-h.encodeQueues[0]
+    for _, client := range room.Clients {
+        client.VideoSubs = map[string]bool{}
+    }
+    h.distributeVideoWebP(room, frame, "user0", 3)
+    if len(h.encodeQueues[0]) != 0 {
+        t.Error("a frame with no subscriber was queued for encoding")
+    }
+}
+
+func TestEncoderPoolKeepsEachSenderOnOneWorker(t *testing.T) {
+    withEncodePool(t, 4, 8)
+    h := NewHub()
+    room := encodeRoom(6)
+    frame := videoFrame(t, 160, 90)
+
+    // A worker takes its queue in order, so one sender's frames all in one
+    // queue can't overtake each other
+    for i := 0; i < 4; i++ {
+        for id := range room.Clients {
+            h.distributeVideoWebP(room, frame, id, 6)
+        }
+    }
+    senders := make(map[string]int)
+    used := 0
+    for i, queue := range h.encodeQueues {
+        if len(queue) > 0 {
+            used++
+        }
+        for len(queue) > 0 {
+            job := <-queue
+            if q, ok := senders[job.from]; ok && q != i {
+                t.Fatalf("%s's frames went to workers %d and %d", job.from, q, i)
+            }
+            senders[job.from] = i
+        }
+    }
+    if len(senders) != 6 || used < 2 {
+        t.Errorf("6 senders' frames were queued for %d senders on %d of %d workers", len(senders), used, len(h.encodeQueues))
+    }
+}
+
+// BenchmarkEncodeBurst times six participants' frames arriving at once,
+// from the first handed over until the last is ready to distribute, encoded
+// inline as handleBroadcast once did and through the pool
+func BenchmarkEncodeBurst(b *testing.B) {
+    const users = 6
+    hub = NewHub() // webpCompressFrame counts into it
+    frame := videoFrame(b, 640, 360)
+    data, err := base64.StdEncoding.DecodeString(frame.Data)
+    if err != nil {
+        b.Fatal(err)
+    }
+
+    b.Run("inline", func(b *testing.B) {
+        for i := 0; i < b.N; i++ {
+            for j := 0; j < users; j++ {
+                if _, _, err := webpCompressFrame(data, users, nil); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        }
+    })
+    for _, workers := range []int{1, max(2, runtime.NumCPU())} {
+        b.Run(fmt.Sprintf("pool-%d", workers), func(b *testing.B) {
+            withEncodePool(b, workers, users)
+            h := NewHub()
+            for _, queue := range h.encodeQueues {
+                go h.encodeWorker(queue)
+                defer close(queue)
+            }
+            room := encodeRoom(users)
+
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                for id := range room.Clients {
+                    h.distributeVideoWebP(room, frame, id, users)
+                }
+                for range room.Clients {
+                    <-h.encoded
+                }
+            }
+            if dropped := atomic.LoadInt64(&h.EncodeDropped); dropped != 0 {
+                b.Fatalf("%d frames shed: the burst didn't fit the queues", dropped)
+            }
+        })
+    }
+}
+
+// tapConn is a memConn that keeps every JSON message whole, for tests that
+// look past the type and sender
+type tapConn struct {
+    *memConn
+    mu   sync.Mutex
+    msgs []Message
+}
+
+func (c *tapConn) WriteMessage(messageType int, data []byte) error {
+    var msg Message
+    if messageType == websocket.TextMessage && json.Unmarshal(data, &msg) == nil {
+        c.mu.Lock()
+        c.msgs = append(c.msgs, msg)
+        c.mu.Unlock()
+    }
+    return c.memConn.WriteMessage(messageType, data)
+}
+
+func (c *tapConn) NextWriter(messageType int) (io.WriteCloser, error) {
+    return &tapWriter{conn: c, messageType: messageType}, nil
+}
+
+type tapWriter struct {
+    bytes.Buffer
+    conn        *tapConn
+    messageType int
+}
+
+func (w *tapWriter) Close() error {
+    return w.conn.WriteMessage(w.messageType, w.Bytes())
+}
+
+// got is what conn has been sent of one type
+func (c *tapConn) got(kind string) []Message {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    var msgs []Message
+    for _, msg := range c.msgs {
+        if msg.Type == kind {
+            msgs = append(msgs, msg)
+        }
+    }
+    return msgs
+}
+
+// tapJoin connects a tapConn that joins room as id with join's other
+// fields, and hands it back once the join is answered
+func tapJoin(t *testing.T, room, id string, join Message) *tapConn {
+    t.Helper()
+    conn := &tapConn{memConn: newMemConn(id)}
+    go serveConn(conn, "test", "127.0.0.1", nil)
+    join.Type, join.Room, join.ID = "join", room, id
+    send(t, conn.memConn, join)
+    waitFor(t, "an answer to "+id+"'s join", func() bool {
+        return len(conn.got("welcome"))+len(conn.got("error")) > 0
+    })
+    return conn
+}
+
+// errorsFor is the codes of the errors conn was sent about messages of type ref
+func errorsFor(conn *tapConn, ref string) []ErrorCode {
+    var codes []ErrorCode
+    for _, msg := range conn.got("error") {
+        if msg.Ref == ref {
+            codes = append(codes, msg.Code)
+        }
+    }
+    return codes
+}
+
+func TestRefusalsCarryAnErrorCode(t *testing.T) {
+    prev := maxUsersPerRoom
+    maxUsersPerRoom = 2
+    t.Cleanup(func() { maxUsersPerRoom = prev })
+
+    startHub(t)
+    alice := tapJoin(t, "errors", "alice", Message{})
+    tapJoin(t, "errors", "bob", Message{})
+    for name, tc := range map[string]struct {
+        data []byte
+        want ErrorCode
+        ref  string
+    }{
+        "malformed JSON": {[]byte(`{"type":`), ErrMalformed, ""},
+        "unknown type":   {[]byte(`{"type":"teleport"}`), ErrUnknownType, "teleport"},
+        "oversized":      {append([]byte(`{"type":"app","text":"`), make([]byte, maxMessageSize)...), ErrTooLarge, ""},
+    } {
+        before := len(alice.got("error"))
+        alice.in <- tc.data
+        waitFor(t, "an error for the "+name+" message", func() bool { return len(alice.got("error")) > before })
+        if got := alice.got("error")[before]; got.Code != tc.want || got.Ref != tc.ref || got.Text == "" {
+            t.Errorf("%s message: error %+v, want code %s ref %q with a reason", name, got, tc.want, tc.ref)
+        }
+    }
+
+    // Two is the limit, and a full room refuses the third at its join
+    carol := tapJoin(t, "errors", "carol", Message{})
+    if got := errorsFor(carol, "join"); len(got) != 1 || got[0] != ErrRoomFull {
+        t.Errorf("joining a full room: errors %v, want [%s]", got, ErrRoomFull)
+    }
+
+    // The first in moderates, and a locked room refuses newcomers the same way
+    maxUsersPerRoom = 0
+    send(t, alice.memConn, Message{Type: "lock"})
+    waitFor(t, "the room to lock", func() bool { return len(alice.got("room-locked")) == 1 })
+    dave := tapJoin(t, "errors", "dave", Message{})
+    if got := errorsFor(dave, "join"); len(got) != 1 || got[0] != ErrRoomLocked {
+        t.Errorf("joining a locked room: errors %v, want [%s]", got, ErrRoomLocked)
+    }
+
+    // A burst over the rate limit is told once, not per message dropped
+    for i := 0; i < maxMessagesPerSecond+20; i++ {
+        send(t, alice.memConn, Message{Type: "typing-stop"})
+    }
+    limited := func() int {
+        n := 0
+        for _, code := range errorsFor(alice, "") {
+            if code == ErrRateLimited {
+                n++
+            }
+        }
+        return n
+    }
+    waitFor(t, "the rate limit", func() bool { return limited() > 0 })
+    time.Sleep(50 * time.Millisecond)
+    if limited := limited(); limited != 1 {
+        t.Errorf("a burst of %d messages got %d rate-limited errors, want 1", maxMessagesPerSecond+20, limited)
+    }
+}
+
+func TestAudioOnlyRoomDropsVideoUnencoded(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "radio", "alice", Message{Mode: "audio-only"})
+    bob := tapJoin(t, "radio", "bob", Message{}) // Only the creating join sets the mode
+    for name, conn := range map[string]*tapConn{"alice": alice, "bob": bob} {
+        if welcome := conn.got("welcome"); len(welcome) != 1 || !welcome[0].AudioOnly {
+            t.Errorf("%s's welcome %+v doesn't tell them to leave the camera off", name, welcome)
+        }
+    }
+
+    encoded := atomic.LoadInt64(&h.CompressedFrames)
+    frame := videoFrame(t, 160, 90)
+    for i := 0; i < 3; i++ {
+        send(t, alice.memConn, frame)
+        send(t, alice.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    }
+    waitFor(t, "alice's audio", func() bool { return len(received(bob.memConn, "audio-chunk", "alice")) == 3 })
+    room := h.room("radio")
+    waitFor(t, "alice's video to be counted", func() bool { return atomic.LoadInt64(&room.VideoDropped) == 3 })
+    if got := received(bob.memConn, "video-frame", "alice"); len(got) != 0 {
+        t.Errorf("bob got %d video frames in an audio-only room", len(got))
+    }
+    if got := atomic.LoadInt64(&h.CompressedFrames) - encoded; got != 0 {
+        t.Errorf("%d frames were encoded for an audio-only room", got)
+    }
+
+    // The same frames reach the other side of an ordinary room
+    carol := joinAs(t, "tv", "carol")
+    dave := joinAs(t, "tv", "dave")
+    send(t, carol, frame)
+    waitFor(t, "carol's video", func() bool { return len(received(dave, "video-frame", "carol")) == 1 })
+}
+
+func TestTypingIndicatorExpiresWithoutAStop(t *testing.T) {
+    h := startHub(t)
+    alice := joinAs(t, "chat", "alice")
+    bob := joinAs(t, "chat", "bob")
+
+    // Repeats only refresh the expiry; the sender isn't told about itself
+    for i := 0; i < 3; i++ {
+        send(t, alice, Message{Type: "typing-start"})
+    }
+    waitFor(t, "alice typing at bob", func() bool { return len(received(bob, "typing-start", "alice")) == 1 })
+    time.Sleep(50 * time.Millisecond)
+    if got := len(received(bob, "typing-start", "alice")); got != 1 {
+        t.Errorf("bob was told alice started typing %d times, want once", got)
+    }
+    if got := len(received(alice, "typing-start", "alice")); got != 0 {
+        t.Errorf("alice was told about her own typing %d times", got)
+    }
+
+    // Alice's client dies mid-word: no stop, but the sweep clears her
+    room := h.room("chat")
+    room.withLock(func() { room.Typing["alice"] = time.Now().Add(-time.Millisecond) })
+    waitFor(t, "alice's indicator to expire", func() bool { return len(received(bob, "typing-stop", "alice")) == 1 })
+    typing := false
+    room.withRLock(func() { _, typing = room.Typing["alice"] })
+    if typing {
+        t.Error("alice is still in the room's typing set after expiring")
+    }
+
+    // Until then it holds, however long the sweep runs
+    send(t, alice, Message{Type: "typing-start"})
+    waitFor(t, "alice typing again", func() bool { return len(received(bob, "typing-start", "alice")) == 2 })
+    time.Sleep(1500 * time.Millisecond)
+    if got := len(received(bob, "typing-stop", "alice")); got != 1 {
+        t.Errorf("alice's indicator was stopped %d times within %s of her typing", got, typingTimeout)
+    }
+}
+
+func TestTypingEventsAreCappedPerSender(t *testing.T) {
+    startHub(t)
+    alice := joinAs(t, "chat", "alice")
+    bob := joinAs(t, "chat", "bob")
+
+    for i := 0; i < 4*maxTypingPerSecond; i++ {
+        kind := "typing-start"
+        if i%2 == 1 {
+            kind = "typing-stop"
+        }
+        send(t, alice, Message{Type: kind})
+    }
+    send(t, alice, Message{Type: "audio-chunk", Data: "AAAA"}) // Anything else still goes
+    waitFor(t, "alice's audio", func() bool { return len(received(bob, "audio-chunk", "alice")) == 1 })
+    got := len(received(bob, "typing-start", "alice")) + len(received(bob, "typing-stop", "alice"))
+    if got == 0 || got > maxTypingPerSecond {
+        t.Errorf("bob got %d of alice's %d typing toggles in a second, want 1 to %d", got, 4*maxTypingPerSecond, maxTypingPerSecond)
+    }
+}
+
+func TestSixtyFPSSenderIsThrottledToTheCap(t *testing.T) {
+    startHub(t)
+    alice := tapJoin(t, "fps", "alice", Message{})
+    bob := joinAs(t, "fps", "bob")
+    capFPS := maxSenderFPS(2)
+
+    frame := videoFrame(t, 160, 90)
+    start := time.Now()
+    sent := 0
+    for time.Since(start) < time.Second {
+        send(t, alice.memConn, frame)
+        sent++
+        time.Sleep(time.Second / 60)
+    }
+    elapsed := time.Since(start)
+    time.Sleep(100 * time.Millisecond)
+
+    // The cap allows 10% jitter, so up to about 1.1x
+    got := len(received(bob, "video-frame", "alice"))
+    limit := int(float64(capFPS)*1.1*elapsed.Seconds()) + 1
+    if got > limit || got < capFPS/2 {
+        t.Errorf("bob got %d of %d frames sent in %s, want about %d at the %dfps cap", got, sent, elapsed.Round(time.Millisecond), capFPS, capFPS)
+    }
+    hints := alice.got("fps-limit")
+    if len(hints) != 1 || hints[0].MaxFPS != capFPS {
+        t.Errorf("alice got fps-limit hints %+v, want one of %dfps", hints, capFPS)
+    }
+
+    // A third participant shrinks everyone's share, and the sender hears so at once
+    joinAs(t, "fps", "carol")
+    time.Sleep(50 * time.Millisecond)
+    send(t, alice.memConn, frame)
+    waitFor(t, "a new fps-limit", func() bool { return len(alice.got("fps-limit")) == 2 })
+    if hint := alice.got("fps-limit")[1]; hint.MaxFPS != maxSenderFPS(3) {
+        t.Errorf("with three in the room the hint is %dfps, want %d", hint.MaxFPS, maxSenderFPS(3))
+    }
+}
+
+func TestWriteBatchesPutAudioAheadOfAVideoBacklog(t *testing.T) {
+    video, _ := json.Marshal(Message{Type: "video-frame", Data: strings.Repeat("A", 1000)})
+    audio, _ := json.Marshal(Message{Type: "audio-chunk", Data: "AAAA"})
+
+    // audioAt queues the backlog before the WritePump starts and reports
+    // how many video frames went out ahead of the audio
+    audioAt := func(before, after, batchCount, batchBytes int) int {
+        t.Helper()
+        conn := &meteredConn{memConn: newMemConn("bob")}
+        c := &Client{ID: "bob", Conn: conn, Send: make(chan []byte, before+after+1), Hub: NewHub(), flushed: make(chan struct{})}
+        for i := 0; i < before; i++ {
+            c.Send <- video
+        }
+        c.Send <- audio
+        for i := 0; i < after; i++ {
+            c.Send <- video
+        }
+        close(c.Send)
+        c.writePump(batchCount, batchBytes)
+
+        conn.mu.Lock()
+        defer conn.mu.Unlock()
+        for i, w := range conn.writes {
+            if !w.video {
+                return i
+            }
+        }
+        t.Fatal("the audio was never written")
+        return 0
+    }
+
+    // Everything queued fits one batch, and audio goes out first
+    if got := audioAt(30, 5, 100, 1<<20); got != 0 {
+        t.Errorf("with one batch %d video frames went ahead of the audio, want none", got)
+    }
+
+    // Five a batch: the audio is in the third and leads it
+    if got := audioAt(12, 5, 4, 1<<20); got != 10 {
+        t.Errorf("five to a batch, %d of 12 earlier frames went ahead of the audio, want the first two batches' 10", got)
+    }
+
+    // Three frames' bytes a batch, audio counting for next to nothing
+    if got := audioAt(10, 5, 100, 3*len(video)-1); got != 9 {
+        t.Errorf("three frames' bytes to a batch, %d of 10 earlier frames went ahead of the audio, want 9", got)
+    }
+}
+
+func TestControlOnlyClientIdlesOutButASenderDoesNot(t *testing.T) {
+    prevTimeout, prevGrace, prevCheck := idleTimeout, idleGrace, idleCheckInterval
+    idleTimeout, idleGrace, idleCheckInterval = 300*time.Millisecond, 200*time.Millisecond, 20*time.Millisecond
+    t.Cleanup(func() { idleTimeout, idleGrace, idleCheckInterval = prevTimeout, prevGrace, prevCheck })
+
+    startHub(t)
+    lurker := tapJoin(t, "idle", "lurker", Message{})
+    talker := tapJoin(t, "idle", "talker", Message{})
+
+    // The lurker keeps the connection busy with feedback, which is control
+    // traffic, while the talker sends audio
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        tick := time.NewTicker(50 * time.Millisecond)
+        defer tick.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-tick.C:
+                send(t, lurker.memConn, Message{Type: "feedback", Feedback: &ClientFeedback{Sender: "talker", Stream: "audio", Received: 1}})
+                send(t, talker.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+            }
+        }
+    }()
+
+    waitFor(t, "the lurker to be closed", func() bool {
+        select {
+        case <-lurker.closed:
+            return true
+        default:
+            return false
+        }
+    })
+    if len(lurker.got("idle-warning")) != 1 {
+        t.Errorf("the lurker was closed after %d idle-warnings, want 1", len(lurker.got("idle-warning")))
+    }
+
+    // Hold the talker on well past the timeout and grace
+    time.Sleep(idleTimeout + idleGrace)
+    if len(talker.got("idle-warning")) != 0 {
+        t.Error("the talker was warned while sending audio")
+    }
+    select {
+    case <-talker.closed:
+        t.Error("the talker was closed while sending audio")
+    default:
+    }
+
+    // Its write pump reads the timeouts until it has hung up
+    close(stop)
+    <-done
+    send(t, talker.memConn, Message{Type: "leave"})
+    waitFor(t, "the talker to hang up", func() bool {
+        select {
+        case <-talker.closed:
+            return true
+        default:
+            return false
+        }
+    })
+}
+
+func TestRegionForTakesTheLongestMatch(t *testing.T) {
+    // Listed broadest first, so a first-match lookup would get it wrong
+    ranges, err := parseRegionCIDRs(" 10.0.0.0/8=eu-central , 10.20.0.0/16=eu-west,,2001:db8::/32=us-east")
+    if err != nil {
+        t.Fatal(err)
+    }
+    for ip, want := range map[string]string{
+        "10.1.2.3":    "eu-central",
+        "10.20.30.40": "eu-west",
+        "10.21.0.1":   "eu-central",
+        "2001:db8::1": "us-east",
+        "192.0.2.1":   "",
+        "not-an-ip":   "",
+        "":            "",
+    } {
+        if got := regionFor(ranges, ip); got != want {
+            t.Errorf("regionFor(%q) = %q, want %q", ip, got, want)
+        }
+    }
+
+    for _, spec := range []string{"10.0.0.0/8", "10.0.0.0/8=", "10.0.0.0/33=eu", "eu=10.0.0.0/8"} {
+        if _, err := parseRegionCIDRs(spec); err == nil {
+            t.Errorf("parseRegionCIDRs(%q) accepted", spec)
+        }
+    }
+}
+
+func TestJoinSteersToTheHostOrTheNearestServer(t *testing.T) {
+    prevRanges, prevURL, prevRegion := regionRanges, publicURL, serverRegion
+    regionRanges, _ = parseRegionCIDRs("198.51.100.0/24=us-east")
+    publicURL, serverRegion = "wss://eu.example/ws", "eu-central"
+    t.Cleanup(func() { regionRanges, publicURL, serverRegion = prevRanges, prevURL, prevRegion })
+
+    peerMu.Lock()
+    prevLoads := peerLoads
+    peerLoads = map[string]*serverLoad{
+        "wss://us1.example/ws":   {URL: "wss://us1.example/ws", Region: "us-east", Clients: 40, seen: time.Now()},
+        "wss://us2.example/ws":   {URL: "wss://us2.example/ws", Region: "us-east", Clients: 10, Rooms: []string{"standup"}, seen: time.Now()},
+        "wss://stale.example/ws": {URL: "wss://stale.example/ws", Region: "us-east", Clients: 0, seen: time.Now().Add(-2 * peerExpiry)},
+    }
+    peerMu.Unlock()
+    t.Cleanup(func() {
+        peerMu.Lock()
+        peerLoads = prevLoads
+        peerMu.Unlock()
+    })
+    startHub(t)
+
+    for _, tc := range []struct {
+        name, room, remote, url, reason string
+    }{
+        {"a hosted room wins over the region", "standup", "203.0.113.7:5000", "wss://us2.example/ws", "room"},
+        {"the least loaded live server in the region", "new", "198.51.100.9:5000", "wss://us2.example/ws", "region"},
+        {"no region stays local", "new", "203.0.113.7:5000", "wss://eu.example/ws", "local"},
+    } {
+        r := httptest.NewRequest(http.MethodGet, "/join?room="+tc.room, nil)
+        r.RemoteAddr = tc.remote
+        rec := httptest.NewRecorder()
+        handleJoin(rec, r)
+
+        var got struct{ URL, Reason string }
+        if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+            t.Fatalf("%s: %v (%s)", tc.name, err, rec.Body)
+        }
+        if got.URL != tc.url || got.Reason != tc.reason {
+            t.Errorf("%s: sent to %s for %q, want %s for %q", tc.name, got.URL, got.Reason, tc.url, tc.reason)
+        }
+    }
+}
+
+func TestUndecodableFramesAreNotRelayed(t *testing.T) {
+    prevLimit, prevDisconnect := badFrameLimit, disconnectOnBadFrames
+    badFrameLimit, disconnectOnBadFrames = 3, true
+    t.Cleanup(func() { badFrameLimit, disconnectOnBadFrames = prevLimit, prevDisconnect })
+
+    h := startHub(t)
+    alice := tapJoin(t, "garbage", "alice", Message{})
+    bob := tapJoin(t, "garbage", "bob", Message{})
+
+    // Spaced out so the fps cap lets each one through to the encoder
+    bad := []Message{
+        {Type: "video-frame", Data: base64.StdEncoding.EncodeToString([]byte("this is not an image"))},
+        {Type: "video-frame", Data: base64.StdEncoding.EncodeToString(make([]byte, 512))},
+        {Type: "video-frame", Data: base64.StdEncoding.EncodeToString(craftedPNG(64, 64)[:20])},
+    }
+    for i, frame := range bad {
+        send(t, alice.memConn, frame)
+        waitFor(t, fmt.Sprintf("bad frame %d to be counted", i+1), func() bool {
+            return atomic.LoadInt64(&h.DecodeFailures) == int64(i+1)
+        })
+        time.Sleep(50 * time.Millisecond)
+    }
+    if got := bob.got("video-frame"); len(got) != 0 {
+        t.Errorf("bob was relayed %d undecodable frames", len(got))
+    }
+    if codes := errorsFor(alice, "video-frame"); len(codes) != 1 || codes[0] != ErrBadFrame {
+        t.Errorf("alice was sent %v after %d bad frames, want one %s", codes, badFrameLimit, ErrBadFrame)
+    }
+
+    // BAD_FRAME_POLICY=disconnect hangs up once the error has had time to go out
+    select {
+    case <-alice.closed:
+        t.Fatal("alice was closed before her error could be delivered")
+    default:
+    }
+    waitFor(t, "alice to be disconnected", func() bool {
+        select {
+        case <-alice.closed:
+            return true
+        default:
+            return false
+        }
+    })
+}
+
+func TestAGoodFrameResetsTheBadFrameCount(t *testing.T) {
+    prev := badFrameLimit
+    badFrameLimit = 2
+    t.Cleanup(func() { badFrameLimit = prev })
+
+    h := startHub(t)
+    alice := tapJoin(t, "flaky", "alice", Message{})
+    bob := tapJoin(t, "flaky", "bob", Message{})
+
+    // Ending on a good frame, whose relay to bob orders the last check of
+    // the limit before the cleanup restores it
+    bad, good := Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString([]byte("corrupt"))}, videoFrame(t, 160, 90)
+    for i, frame := range []Message{bad, good, bad, good} {
+        send(t, alice.memConn, frame)
+        waitFor(t, fmt.Sprintf("frame %d to be handled", i+1), func() bool {
+            return atomic.LoadInt64(&h.DecodeFailures)+int64(len(bob.got("video-frame"))) == int64(i+1)
+        })
+        time.Sleep(50 * time.Millisecond)
+    }
+    if codes := errorsFor(alice, "video-frame"); len(codes) != 0 {
+        t.Errorf("alice was sent %v for bad frames that weren't consecutive", codes)
+    }
+}
+
+func TestModeratorRoleIsEnforcedAndPassedOn(t *testing.T) {
+    startHub(t)
+    alice := tapJoin(t, "mod", "alice", Message{})
+    bob := tapJoin(t, "mod", "bob", Message{})
+    carol := tapJoin(t, "mod", "carol", Message{})
+    for conn, want := range map[*tapConn]string{alice: "moderator", bob: "participant", carol: "participant"} {
+        if welcome := conn.got("welcome")[0]; welcome.Role != want || welcome.Moderator != "alice" {
+            t.Errorf("%s was welcomed as %q under %q, want %q under alice", conn.key, welcome.Role, welcome.Moderator, want)
+        }
+    }
+
+    // Only the moderator's commands are honoured
+    send(t, bob.memConn, Message{Type: "kick", Target: "carol"})
+    send(t, bob.memConn, Message{Type: "lock"})
+    waitFor(t, "bob's refusals", func() bool { return len(bob.got("error")) == 2 })
+    for _, ref := range []string{"kick", "lock"} {
+        if codes := errorsFor(bob, ref); len(codes) != 1 || codes[0] != ErrNotModerator {
+            t.Errorf("bob's %s got %v, want %s", ref, codes, ErrNotModerator)
+        }
+    }
+    if len(carol.got("kicked")) != 0 || len(alice.got("room-locked")) != 0 {
+        t.Error("a participant's kick or lock was carried out")
+    }
+
+    send(t, alice.memConn, Message{Type: "mute", Target: "carol"})
+    send(t, alice.memConn, Message{Type: "lock"})
+    waitFor(t, "alice's mute and lock", func() bool {
+        return len(bob.got("muted")) == 1 && len(bob.got("room-locked")) == 1
+    })
+    if codes := errorsFor(tapJoin(t, "mod", "dave", Message{}), "join"); len(codes) != 1 || codes[0] != ErrRoomLocked {
+        t.Errorf("joining a locked room got %v, want %s", codes, ErrRoomLocked)
+    }
+
+    // The moderator leaving hands the role to the oldest participant left
+    send(t, alice.memConn, Message{Type: "leave"})
+    waitFor(t, "the role to pass on", func() bool { return len(carol.got("moderator-changed")) == 1 })
+    if changed := carol.got("moderator-changed")[0]; changed.Moderator != "bob" {
+        t.Errorf("the role went to %q, want bob who joined before carol", changed.Moderator)
+    }
+    send(t, bob.memConn, Message{Type: "kick", Target: "carol"})
+    waitFor(t, "carol to be kicked", func() bool { return len(carol.got("kicked")) == 1 })
+    if got := errorsFor(bob, "kick"); len(got) != 1 {
+        t.Errorf("bob's kick as moderator was refused: %v", got)
+    }
+}
+
+func TestModeratorTokenTakesTheRole(t *testing.T) {
+    prev := moderatorToken
+    moderatorToken = "host-secret"
+    t.Cleanup(func() { moderatorToken = prev })
+
+    startHub(t)
+    alice := tapJoin(t, "hosted", "alice", Message{})
+    tapJoin(t, "hosted", "bob", Message{Token: "wrong"})
+    host := tapJoin(t, "hosted", "host", Message{Token: "host-secret"})
+    if welcome := host.got("welcome")[0]; welcome.Role != "moderator" {
+        t.Errorf("the token holder was welcomed as %q", welcome.Role)
+    }
+    waitFor(t, "alice to hear of the new moderator", func() bool { return len(alice.got("moderator-changed")) == 1 })
+    if changed := alice.got("moderator-changed"); len(changed) != 1 || changed[0].Moderator != "host" {
+        t.Errorf("alice was told %+v, want the role passed to host alone", changed)
+    }
+}
+
+func TestStatsStreamPushesSnapshotsAndNoMedia(t *testing.T) {
+    h := startHub(t)
+    alice := joinAs(t, "busy", "alice")
+    joinAs(t, "busy", "bob")
+
+    srv := httptest.NewServer(http.HandlerFunc(handleStatsStream))
+    t.Cleanup(srv.Close)
+    // An interval under the floor is raised to it rather than honoured
+    ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?interval=1ms", nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ws.Close()
+
+    // The room talks throughout, none of which the subscriber may see
+    stop := make(chan struct{})
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for {
+            select {
+            case <-stop:
+                return
+            case <-time.After(10 * time.Millisecond):
+                send(t, alice, Message{Type: "audio-chunk", Data: "AAAA"})
+            }
+        }
+    }()
+    defer func() { close(stop); <-done }()
+
+    var stamps []int64
+    ws.SetReadDeadline(time.Now().Add(3 * statsPushMin))
+    for len(stamps) < 3 {
+        var snapshot map[string]interface{}
+        if err := ws.ReadJSON(&snapshot); err != nil {
+            t.Fatalf("after %d snapshots: %v", len(stamps), err)
+        }
+        if snapshot["type"] != "stats" {
+            t.Fatalf("the subscriber was sent a %v", snapshot["type"])
+        }
+        if snapshot["rooms"] != float64(1) || snapshot["clients"] != float64(2) {
+            t.Errorf("snapshot counts %v rooms and %v clients, want 1 and 2", snapshot["rooms"], snapshot["clients"])
+        }
+        stamps = append(stamps, int64(snapshot["timestamp"].(float64)))
+    }
+    for i := 1; i < len(stamps); i++ {
+        if gap := time.Duration(stamps[i]-stamps[i-1]) * time.Millisecond; gap < statsPushMin-50*time.Millisecond {
+            t.Errorf("snapshots %d and %d came %s apart, want at least %s", i-1, i, gap, statsPushMin)
+        }
+    }
+    if got := h.status().Clients; got != 2 {
+        t.Errorf("the subscriber took a hub seat: %d clients", got)
+    }
+}
+
+func TestServerAssignedIDsIgnoreTheRequestedOne(t *testing.T) {
+    prev := serverAssignedIDs
+    serverAssignedIDs = true
+    t.Cleanup(func() { serverAssignedIDs = prev })
+
+    h := startHub(t)
+    first := tapJoin(t, "ids", "alice", Message{})
+    second := tapJoin(t, "ids", "alice", Message{})
+    a, b := first.got("welcome")[0].ID, second.got("welcome")[0].ID
+    if a == "alice" || b == "alice" || a == b || !strings.HasPrefix(a, "u-") || !strings.HasPrefix(b, "u-") {
+        t.Fatalf("two joins as alice were welcomed as %q and %q, want distinct assigned ids", a, b)
+    }
+    if size := h.room("ids").size(); size != 2 {
+        t.Errorf("the room holds %d participants, want both", size)
+    }
+
+    // Leaving frees the id
+    send(t, first.memConn, Message{Type: "leave"})
+    waitFor(t, "the first id to be released", func() bool {
+        h.mu.RLock()
+        defer h.mu.RUnlock()
+        return !h.assignedIDs["ids"][a] && h.assignedIDs["ids"][b]
+    })
+}
+
+func TestLoadConfig(t *testing.T) {
+    cfg, err := loadConfig("config.example.json")
+    if err != nil {
+        t.Fatalf("the example config: %v", err)
+    }
+    if cfg.MaxUsersPerRoom != 10 || cfg.IdleTimeout.Duration != 5*time.Minute || len(cfg.QualityLadder) != 6 || !cfg.QualityLadder[5].Grayscale {
+        t.Errorf("the example config loaded as %+v", cfg)
+    }
+    // Left out of the file, so still the default
+    if cfg.EncodeWorkers != runtime.NumCPU() {
+        t.Errorf("encodeWorkers = %d, want the default %d", cfg.EncodeWorkers, runtime.NumCPU())
+    }
+
+    // The environment wins over the file
+    t.Setenv("MAX_USERS_PER_ROOM", "3")
+    t.Setenv("IDLE_TIMEOUT", "90s")
+    if cfg, err = loadConfig("config.example.json"); err != nil || cfg.MaxUsersPerRoom != 3 || cfg.IdleTimeout.Duration != 90*time.Second {
+        t.Errorf("with env overrides got %+v, %v", cfg, err)
+    }
+    t.Setenv("IDLE_TIMEOUT", "soon")
+    if _, err := loadConfig("config.example.json"); err == nil || !strings.Contains(err.Error(), "IDLE_TIMEOUT") {
+        t.Errorf("an unparsable IDLE_TIMEOUT gave %v", err)
+    }
+    t.Setenv("IDLE_TIMEOUT", "")
+}
+
+func TestLoadConfigRejectsAnInvalidOne(t *testing.T) {
+    dir := t.TempDir()
+    for _, tc := range []struct{ name, json, problem string }{
+        {"unknown field", `{"maxUser": 5}`, "unknown field"},
+        {"port", `{"port": 70000}`, "port 70000 out of range"},
+        {"half a TLS pair", `{"tlsCert": "cert.pem"}`, "tlsCert and tlsKey"},
+        {"ping after the read deadline", `{"pingInterval": "90s"}`, "pingInterval"},
+        {"codec", `{"videoCodec": "gif"}`, `videoCodec "gif"`},
+        {"empty ladder", `{"qualityLadder": []}`, "qualityLadder needs"},
+        {"ladder step", `{"qualityLadder": [{"width": 320, "quality": 150}]}`, "qualityLadder[0]"},
+        {"not a duration", `{"roomTTL": "a while"}`, `invalid duration "a while"`},
+    } {
+        path := filepath.Join(dir, strings.ReplaceAll(tc.name, " ", "-")+".json")
+        if err := os.WriteFile(path, []byte(tc.json), 0o600); err != nil {
+            t.Fatal(err)
+        }
+        if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), tc.problem) {
+            t.Errorf("%s: loadConfig(%s) = %v, want an error about %s", tc.name, tc.json, err, tc.problem)
+        }
+    }
+    if _, err := loadConfig(filepath.Join(dir, "missing.json")); err == nil {
+        t.Error("a missing config file loaded")
+    }
+}
+
+// frameWidth is the width of the image a relayed video-frame carries
+func frameWidth(t *testing.T, msg Message) int {
+    t.Helper()
+    data, err := base64.StdEncoding.DecodeString(msg.Data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return cfg.Width
+}
+
+func TestLayerRequestsPickTheFrameWidth(t *testing.T) {
+    prev := qualityLadder
+    qualityLadder = []QualityStep{{Width: 640, Quality: 75}}
+    t.Cleanup(func() { qualityLadder = prev })
+
+    h := startHub(t)
+    alice := tapJoin(t, "tiles", "alice", Message{})
+    thumb := tapJoin(t, "tiles", "thumb", Message{})
+    stage := tapJoin(t, "tiles", "stage", Message{})
+    send(t, thumb.memConn, Message{Type: "layer-request", SourceID: "alice", MaxWidth: 160})
+    send(t, stage.memConn, Message{Type: "layer-request", SourceID: "alice", MaxWidth: 640})
+    // A typing-stop relayed after each request means the hub has applied it
+    for _, conn := range []*tapConn{thumb, stage} {
+        send(t, conn.memConn, Message{Type: "typing-start"})
+        send(t, conn.memConn, Message{Type: "typing-stop"})
+        waitFor(t, conn.key+"'s layer request", func() bool { return len(received(alice.memConn, "typing-stop", conn.key)) == 1 })
+    }
+
+    // Requests don't answer, so keep sending until both tiles have a frame
+    frame := videoFrame(t, 640, 360)
+    sent := int64(0)
+    waitFor(t, "alice's video on both tiles", func() bool {
+        send(t, alice.memConn, frame)
+        sent++
+        time.Sleep(60 * time.Millisecond)
+        return len(thumb.got("video-frame")) > 0 && len(stage.got("video-frame")) > 0
+    })
+    // Every frame is through the ladder before the cleanup restores it
+    waitFor(t, "alice's frames to be encoded or shed", func() bool {
+        return atomic.LoadInt64(&h.CompressedFrames)+atomic.LoadInt64(&h.EncodeDropped)+atomic.LoadInt64(&h.ThrottledFrames) == sent
+    })
+    if got := frameWidth(t, thumb.got("video-frame")[0]); got != 160 {
+        t.Errorf("the 160px tile was sent a %dpx frame", got)
+    }
+    if got := frameWidth(t, stage.got("video-frame")[0]); got != 640 {
+        t.Errorf("the 640px tile was sent a %dpx frame, want full size", got)
+    }
+}
+
+// deflateConn is a memConn that notes whether per-message compression was on
+// for each message written
+type deflateConn struct {
+    *memConn
+    compress   bool
+    compressed map[string][]bool // Per message type
+}
+
+func (c *deflateConn) EnableWriteCompression(enable bool) { c.compress = enable }
+
+func (c *deflateConn) WriteMessage(messageType int, data []byte) error {
+    var msg Message
+    json.Unmarshal(data, &msg)
+    c.compressed[msg.Type] = append(c.compressed[msg.Type], c.compress)
+    return c.memConn.WriteMessage(messageType, data)
+}
+
+func (c *deflateConn) NextWriter(messageType int) (io.WriteCloser, error) {
+    return &memWriter{conn: c.memConn, messageType: messageType}, nil
+}
+
+func TestVideoIsWrittenWithoutDeflate(t *testing.T) {
+    conn := &deflateConn{memConn: newMemConn("bob"), compressed: make(map[string][]bool)}
+    c := &Client{ID: "bob", Conn: conn, Send: make(chan []byte, 8), Hub: NewHub(), flushed: make(chan struct{})}
+    for _, msg := range []Message{
+        {Type: "video-frame", Data: "AAAA"},
+        {Type: "audio-chunk", Data: "AAAA"},
+        {Type: "chat", Text: "hello"},
+        {Type: "video-frame", Data: "AAAA"},
+    } {
+        data, _ := json.Marshal(msg)
+        c.Send <- data
+    }
+    close(c.Send)
+    c.WritePump()
+
+    for kind, want := range map[string]bool{"video-frame": false, "audio-chunk": true, "chat": true} {
+        if len(conn.compressed[kind]) == 0 {
+            t.Errorf("no %s was written", kind)
+        }
+        for _, got := range conn.compressed[kind] {
+            if got != want {
+                t.Errorf("a %s was written with compression %v, want %v", kind, got, want)
+            }
+        }
+    }
+}
+
+// BenchmarkDeflateVideo writes a room's worth of WebP frames over a real
+// permessage-deflate connection with compression on, as every frame was
+// before, and off, as WritePump now writes them
+func BenchmarkDeflateVideo(b *testing.B) {
+    hub = NewHub()
+    encoded, _, err := webpCompressFrame(mustDecode(b, videoFrame(b, 640, 360)), 1, nil)
+    if err != nil {
+        b.Fatal(err)
+    }
+    frame, _ := json.Marshal(Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString(encoded)})
+
+    up := websocket.Upgrader{EnableCompression: true}
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        conn, err := up.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        for {
+            if _, _, err := conn.NextReader(); err != nil {
+                return
+            }
+        }
+    }))
+    defer srv.Close()
+
+    for _, deflate := range []bool{true, false} {
+        b.Run(fmt.Sprintf("deflate=%v", deflate), func(b *testing.B) {
+            dialer := websocket.Dialer{EnableCompression: true}
+            conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+            if err != nil {
+                b.Fatal(err)
+            }
+            defer conn.Close()
+            conn.EnableWriteCompression(deflate)
+
+            b.SetBytes(int64(len(frame)))
+            b.ReportAllocs()
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+// mustDecode is the image bytes a video-frame message carries
+func mustDecode(t testing.TB, msg Message) []byte {
+    t.Helper()
+    data, err := base64.StdEncoding.DecodeString(msg.Data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return data
+}
+
+func TestSpectatorsWatchButNeverSend(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "webinar", "alice", Message{})
+    bob := tapJoin(t, "webinar", "bob", Message{})
+    var spectators []*tapConn
+    for i := 0; i < 3; i++ {
+        spectator := tapJoin(t, "webinar", fmt.Sprintf("viewer%d", i), Message{Role: "spectator"})
+        if role := spectator.got("welcome")[0].Role; role != "spectator" {
+            t.Errorf("viewer%d was welcomed as %q", i, role)
+        }
+        spectators = append(spectators, spectator)
+    }
+    room := h.room("webinar")
+    senders := 0
+    room.withRLock(func() { senders = room.senderCount() })
+    if senders != 2 {
+        t.Errorf("the room counts %d senders, want alice and bob only", senders)
+    }
+
+    // A spectator's media goes nowhere, though it may still type in the chat
+    frame := videoFrame(t, 640, 360)
+    send(t, spectators[0].memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    send(t, spectators[0].memConn, frame)
+    send(t, spectators[0].memConn, Message{Type: "typing-start"})
+    waitFor(t, "the spectator typing", func() bool { return len(received(alice.memConn, "typing-start", "viewer0")) == 1 })
+
+    // Everyone gets alice's, at the two-sender ladder width
+    send(t, alice.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    send(t, alice.memConn, frame)
+    for _, conn := range append([]*tapConn{bob}, spectators...) {
+        waitFor(t, conn.key+" to get alice's media", func() bool {
+            return len(received(conn.memConn, "audio-chunk", "alice")) == 1 && len(received(conn.memConn, "video-frame", "alice")) == 1
+        })
+        for _, msg := range conn.got("video-frame") {
+            if got := frameWidth(t, msg); got != int(ladderStep(2).Width) {
+                t.Errorf("%s got alice's frame %dpx wide, want the %dpx of a two-sender room", conn.key, got, ladderStep(2).Width)
+            }
+        }
+    }
+    for _, conn := range []*tapConn{alice, bob} {
+        if n := len(received(conn.memConn, "audio-chunk", "viewer0")) + len(received(conn.memConn, "video-frame", "viewer0")); n != 0 {
+            t.Errorf("%s was sent %d of the spectator's media messages", conn.key, n)
+        }
+    }
+}
+
+// runStrategy feeds frames from user0 through strategy, charging each
+// delivery as distributeVideo does, and returns who got each frame
+func runStrategy(strategy DropStrategy, room *Room, frames, userCount int) [][]string {
+    var got [][]string
+    for i := 0; i < frames; i++ {
+        receivers := make([]*Client, 0, len(room.Clients))
+        for id, client := range room.Clients {
+            if id != "user0" {
+                receivers = append(receivers, client)
+            }
+        }
+        var ids []string
+        for _, client := range strategy.Select(room, "user0", receivers, userCount) {
+            room.serveVideo(client.ID, 1000)
+            ids = append(ids, client.ID)
+        }
+        sort.Strings(ids)
+        got = append(got, ids)
+    }
+    return got
+}
+
+func TestDropStrategies(t *testing.T) {
+    everyone := []string{"user1", "user2", "user3", "user4", "user5"}
+
+    t.Run("all", func(t *testing.T) {
+        for i, ids := range runStrategy(sendAllStrategy{}, encodeRoom(6), 3, 6) {
+            if !reflect.DeepEqual(ids, everyone) {
+                t.Errorf("frame %d went to %v, want everyone", i, ids)
+            }
+        }
+    })
+
+    t.Run("roundrobin", func(t *testing.T) {
+        // Two a frame, least served first, so five frames reach everyone twice
+        want := [][]string{{"user1", "user2"}, {"user3", "user4"}, {"user1", "user5"}, {"user2", "user3"}, {"user4", "user5"}}
+        if got := runStrategy(roundRobinStrategy{}, encodeRoom(6), 5, 6); !reflect.DeepEqual(got, want) {
+            t.Errorf("frames went to %v, want %v", got, want)
+        }
+        // One a frame past roundRobinSingleOver
+        for i, ids := range runStrategy(roundRobinStrategy{}, encodeRoom(6), 5, roundRobinSingleOver+1) {
+            if len(ids) != 1 || ids[0] != everyone[i] {
+                t.Errorf("in a big room frame %d went to %v, want %s alone", i, ids, everyone[i])
+            }
+        }
+    })
+
+    t.Run("fps-cap", func(t *testing.T) {
+        room := encodeRoom(4)
+        room.Clients["user2"].markAudio(time.Now())
+        if got := runStrategy(fpsCapStrategy{}, room, 2, 4); !reflect.DeepEqual(got, [][]string{{"user1", "user3"}, nil}) {
+            t.Errorf("back-to-back frames went to %v, want the first to all but user2, who is busy with audio, and the second to no one", got)
+        }
+        room.LastFrameTime = time.Now().Add(-time.Second)
+        if got := runStrategy(fpsCapStrategy{}, room, 1, 4); len(got[0]) != 2 {
+            t.Errorf("a frame after the interval went to %v", got[0])
+        }
+    })
+
+    t.Run("priority", func(t *testing.T) {
+        room := encodeRoom(6)
+        room.Clients["user0"].LastSpokeAt = time.Now()
+        if got := runStrategy(priorityStrategy{}, room, 2, 6); !reflect.DeepEqual(got, [][]string{everyone, everyone}) {
+            t.Errorf("a speaker's frames went to %v, want everyone", got)
+        }
+        room.Clients["user0"].LastSpokeAt = time.Now().Add(-time.Minute)
+        if got := runStrategy(priorityStrategy{}, room, 1, 6); len(got[0]) != 2 {
+            t.Errorf("a quiet sender's frame went to %v, want a round-robin pair", got[0])
+        }
+    })
+
+    t.Run("auto", func(t *testing.T) {
+        for _, tc := range []struct {
+            userCount, want int
+        }{{sendAllMaxUsers, 5}, {fpsCapMaxUsers, 5}, {fpsCapMaxUsers + 1, 2}} {
+            if got := runStrategy(autoStrategy{}, encodeRoom(6), 1, tc.userCount); len(got[0]) != tc.want {
+                t.Errorf("with %d senders a frame went to %v, want %d receivers", tc.userCount, got[0], tc.want)
+            }
+        }
+    })
+}
+
+// codeConn is a tapConn that also keeps the first close frame it was sent,
+// the one a client acts on
+type codeConn struct {
+    *tapConn
+    closeMu sync.Mutex
+    code    int
+    reason  string
+}
+
+func (c *codeConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+    c.closeMu.Lock()
+    defer c.closeMu.Unlock()
+    if messageType == websocket.CloseMessage && len(data) >= 2 && c.code == 0 {
+        c.code, c.reason = int(binary.BigEndian.Uint16(data)), string(data[2:])
+    }
+    return nil
+}
+
+// closedWith waits for conn's close frame and returns its code and reason
+func (c *codeConn) closedWith(t *testing.T) (int, string) {
+    t.Helper()
+    waitFor(t, c.key+"'s close frame", func() bool {
+        c.closeMu.Lock()
+        defer c.closeMu.Unlock()
+        return c.code != 0
+    })
+    c.closeMu.Lock()
+    defer c.closeMu.Unlock()
+    return c.code, c.reason
+}
+
+// codeJoin is tapJoin over a codeConn
+func codeJoin(t *testing.T, room, id string, join Message) *codeConn {
+    t.Helper()
+    conn := &codeConn{tapConn: &tapConn{memConn: newMemConn(id)}}
+    go serveConn(conn, "test", "127.0.0.1", nil)
+    join.Type, join.Room, join.ID = "join", room, id
+    send(t, conn.memConn, join)
+    waitFor(t, "an answer to "+id+"'s join", func() bool {
+        return len(conn.got("welcome"))+len(conn.got("error"))+len(conn.got("id-in-use")) > 0
+    })
+    return conn
+}
+
+func TestServerClosesCarryTheirCode(t *testing.T) {
+    for _, tc := range []struct {
+        name   string
+        code   int
+        reason string // Prefix, as a restart's carries its reconnect delay
+        setup  func(t *testing.T)
+        close  func(t *testing.T, h *Hub) *codeConn
+    }{
+        {"kicked", CloseKicked, "kicked", nil, func(t *testing.T, h *Hub) *codeConn {
+            alice := codeJoin(t, "close", "alice", Message{})
+            bob := codeJoin(t, "close", "bob", Message{})
+            send(t, alice.memConn, Message{Type: "kick", Target: "bob"})
+            return bob
+        }},
+        {"room full", CloseRoomFull, "room-full", func(t *testing.T) {
+            prev := maxUsersPerRoom
+            maxUsersPerRoom = 1
+            t.Cleanup(func() { maxUsersPerRoom = prev })
+        }, func(t *testing.T, h *Hub) *codeConn {
+            codeJoin(t, "close", "alice", Message{})
+            return codeJoin(t, "close", "bob", Message{})
+        }},
+        {"room locked", CloseRoomLocked, "room-locked", nil, func(t *testing.T, h *Hub) *codeConn {
+            alice := codeJoin(t, "close", "alice", Message{})
+            send(t, alice.memConn, Message{Type: "lock"})
+            waitFor(t, "the lock", func() bool {
+                locked := false
+                room := h.room("close")
+                room.withRLock(func() { locked = room.Locked })
+                return locked
+            })
+            return codeJoin(t, "close", "bob", Message{})
+        }},
+        {"id in use", CloseIDInUse, "id-in-use", func(t *testing.T) {
+            prev := rejectDuplicateJoin
+            rejectDuplicateJoin = true
+            t.Cleanup(func() { rejectDuplicateJoin = prev })
+        }, func(t *testing.T, h *Hub) *codeConn {
+            codeJoin(t, "close", "alice", Message{})
+            return codeJoin(t, "close", "alice", Message{})
+        }},
+        {"replaced", CloseReplaced, "replaced", nil, func(t *testing.T, h *Hub) *codeConn {
+            first := codeJoin(t, "close", "alice", Message{})
+            codeJoin(t, "close", "alice", Message{})
+            return first
+        }},
+        {"room limit", CloseRoomLimit, "room-limit", func(t *testing.T) {
+            prev := maxRooms
+            maxRooms = 1
+            t.Cleanup(func() { maxRooms = prev })
+        }, func(t *testing.T, h *Hub) *codeConn {
+            codeJoin(t, "close", "alice", Message{})
+            return codeJoin(t, "other", "bob", Message{})
+        }},
+        {"idle", CloseIdle, "idle-timeout", func(t *testing.T) {
+            prevTimeout, prevGrace, prevCheck := idleTimeout, idleGrace, idleCheckInterval
+            idleTimeout, idleGrace, idleCheckInterval = 100*time.Millisecond, 100*time.Millisecond, 20*time.Millisecond
+            t.Cleanup(func() { idleTimeout, idleGrace, idleCheckInterval = prevTimeout, prevGrace, prevCheck })
+        }, func(t *testing.T, h *Hub) *codeConn {
+            return codeJoin(t, "close", "alice", Message{})
+        }},
+        {"bad frames", websocket.ClosePolicyViolation, "bad-frames", func(t *testing.T) {
+            prevLimit, prevDisconnect := badFrameLimit, disconnectOnBadFrames
+            badFrameLimit, disconnectOnBadFrames = 1, true
+            t.Cleanup(func() { badFrameLimit, disconnectOnBadFrames = prevLimit, prevDisconnect })
+        }, func(t *testing.T, h *Hub) *codeConn {
+            alice := codeJoin(t, "close", "alice", Message{})
+            codeJoin(t, "close", "bob", Message{})
+            send(t, alice.memConn, Message{Type: "video-frame", Data: base64.StdEncoding.EncodeToString([]byte("garbage"))})
+            return alice
+        }},
+        {"restart", websocket.CloseServiceRestart, "server-restart:", nil, func(t *testing.T, h *Hub) *codeConn {
+            alice := codeJoin(t, "close", "alice", Message{})
+            go h.Shutdown(time.Second)
+            return alice
+        }},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            if tc.setup != nil {
+                tc.setup(t)
+            }
+            h := startHub(t)
+            conn := tc.close(t, h)
+            if code, reason := conn.closedWith(t); code != tc.code || !strings.HasPrefix(reason, tc.reason) {
+                t.Errorf("closed with %d %q, want %d %q", code, reason, tc.code, tc.reason)
+            }
+            // The hub loop is through with the close, and with the settings
+            // the cleanup restores, once it has hung up and answered /ready
+            waitFor(t, conn.key+" to be hung up", func() bool {
+                select {
+                case <-conn.closed:
+                    return true
+                default:
+                    return false
+                }
+            })
+            probe(handleReady, "/ready")
+        })
+    }
+}
+
+func TestEncryptedRoomRelaysMediaVerbatim(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "secret", "alice", Message{Mode: "e2ee"})
+    bob := tapJoin(t, "secret", "bob", Message{})
+    carol := tapJoin(t, "secret", "carol", Message{})
+    if !bob.got("welcome")[0].Encrypted {
+        t.Error("bob's welcome doesn't tell him to encrypt")
+    }
+
+    // Key material goes where it's addressed
+    send(t, alice.memConn, Message{Type: "key-announce", Target: "bob", KeyID: "k1", Data: "a2V5"})
+    waitFor(t, "alice's key at bob", func() bool { return len(bob.got("key-announce")) == 1 })
+    if got := bob.got("key-announce")[0]; got.From != "alice" || got.KeyID != "k1" || got.Data != "a2V5" {
+        t.Errorf("bob got key-announce %+v", got)
+    }
+
+    // Ciphertext isn't an image; it must come out exactly as it went in
+    encoded := atomic.LoadInt64(&h.CompressedFrames)
+    ciphertext := make([]byte, 700)
+    rand.Read(ciphertext)
+    data := base64.StdEncoding.EncodeToString(ciphertext)
+    send(t, alice.memConn, Message{Type: "video-frame", Data: data, Encrypted: true, KeyID: "k1"})
+    send(t, alice.memConn, Message{Type: "audio-chunk", Data: data, Encrypted: true, KeyID: "k1"})
+    waitFor(t, "alice's media at bob", func() bool {
+        return len(bob.got("video-frame")) == 1 && len(bob.got("audio-chunk")) == 1
+    })
+    for _, msg := range append(bob.got("video-frame"), bob.got("audio-chunk")...) {
+        if msg.Data != data || !msg.Encrypted || msg.KeyID != "k1" {
+            t.Errorf("a %s reached bob changed: encrypted %v, key %q, same data %v", msg.Type, msg.Encrypted, msg.KeyID, msg.Data == data)
+        }
+    }
+    if msg := bob.got("video-frame")[0]; msg.FrameSize != len(ciphertext) {
+        t.Errorf("the frame reached bob sized %d, want the ciphertext's %d", msg.FrameSize, len(ciphertext))
+    }
+    if got := atomic.LoadInt64(&h.CompressedFrames) - encoded; got != 0 {
+        t.Errorf("%d ciphertext frames went through the encoder", got)
+    }
+    if len(carol.got("key-announce")) != 0 {
+        t.Error("carol got a key announced to bob")
+    }
+
+    // Plaintext in an e2ee room is refused rather than leaked
+    time.Sleep(50 * time.Millisecond)
+    send(t, alice.memConn, videoFrame(t, 160, 90))
+    waitFor(t, "the plaintext frame's refusal", func() bool { return len(errorsFor(alice, "video-frame")) == 1 })
+    if codes := errorsFor(alice, "video-frame"); codes[0] != ErrNotEncrypted {
+        t.Errorf("plaintext video was refused with %s, want %s", codes[0], ErrNotEncrypted)
+    }
+    if got := len(bob.got("video-frame")); got != 1 {
+        t.Errorf("bob got %d frames, want only the encrypted one", got)
+    }
+
+    // And key material has no business in an ordinary room
+    dave := tapJoin(t, "open", "dave", Message{})
+    send(t, dave.memConn, Message{Type: "key-announce", KeyID: "k1", Data: "a2V5"})
+    waitFor(t, "dave's refusal", func() bool { return len(errorsFor(dave, "key-announce")) == 1 })
+}
+
+func TestRecordingWaitsForEveryonesConsent(t *testing.T) {
+    prev := recordingsDir
+    recordingsDir = t.TempDir()
+    t.Cleanup(func() { recordingsDir = prev })
+
+    startHub(t)
+    alice := tapJoin(t, "court", "alice", Message{})
+    bob := tapJoin(t, "court", "bob", Message{})
+    speak := func(text string) {
+        send(t, alice.memConn, Message{Type: "audio-chunk", Data: base64.StdEncoding.EncodeToString([]byte(text))})
+        n := len(received(bob.memConn, "audio-chunk", "alice"))
+        waitFor(t, "alice's "+text, func() bool { return len(received(bob.memConn, "audio-chunk", "alice")) > n })
+    }
+
+    send(t, alice.memConn, Message{Type: "start-recording"})
+    waitFor(t, "the consent requests", func() bool {
+        return len(alice.got("recording-consent-request")) == 1 && len(bob.got("recording-consent-request")) == 1
+    })
+    send(t, alice.memConn, Message{Type: "recording-consent", Granted: true})
+    speak("before bob agreed")
+    if len(alice.got("recording-started")) != 0 {
+        t.Fatal("recording started with bob's consent outstanding")
+    }
+
+    send(t, bob.memConn, Message{Type: "recording-consent", Granted: true})
+    waitFor(t, "the recording to start", func() bool { return len(alice.got("recording-started")) == 1 })
+    speak("on the record")
+
+    // A joiner who hasn't consented pauses it straight away
+    carol := tapJoin(t, "court", "carol", Message{})
+    waitFor(t, "the recording to pause", func() bool { return len(alice.got("recording-paused")) == 1 })
+    if len(carol.got("recording-consent-request")) != 1 {
+        t.Error("carol wasn't asked for her consent")
+    }
+    speak("after carol joined")
+
+    send(t, alice.memConn, Message{Type: "stop-recording"})
+    waitFor(t, "the recording to stop", func() bool { return len(alice.got("recording-stopped")) == 1 })
+
+    files, _ := filepath.Glob(filepath.Join(recordingsDir, "court-*.jsonl"))
+    if len(files) != 1 {
+        t.Fatalf("recordings on disk: %v", files)
+    }
+    var recorded []string
+    if err := readJSONLines(files[0], func(line []byte) error {
+        var ev replayEvent
+        var msg Message
+        if json.Unmarshal(line, &ev) == nil && json.Unmarshal(ev.Data, &msg) == nil && msg.Type == "audio-chunk" {
+            text, _ := base64.StdEncoding.DecodeString(msg.Data)
+            recorded = append(recorded, string(text))
+        }
+        return nil
+    }); err != nil {
+        t.Fatal(err)
+    }
+    if !reflect.DeepEqual(recorded, []string{"on the record"}) {
+        t.Errorf("recorded %q, want only what was said while everyone consented", recorded)
+    }
+}
+
+func TestStaticDirFallsBackToIndexButNotForRoutes(t *testing.T) {
+    startHub(t)
+    dir := t.TempDir()
+    for name, body := range map[string]string{
+        "index.html":    "<title>app</title>",
+        "assets/app.js": "console.log('app')",
+    } {
+        path := filepath.Join(dir, name)
+        if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // Routed as main does it, with the frontend on the catch-all pattern
+    mux := http.NewServeMux()
+    mux.HandleFunc("/status", handleStatus)
+    mux.HandleFunc("/health", handleHealth)
+    mux.Handle("/", spaHandler(dir))
+    get := func(path string) *httptest.ResponseRecorder {
+        rec := httptest.NewRecorder()
+        mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+        return rec
+    }
+
+    for _, path := range []string{"/", "/room/standup", "/assets/", "/assets/missing.js"} {
+        if rec := get(path); rec.Code != http.StatusOK || rec.Body.String() != "<title>app</title>" {
+            t.Errorf("GET %s = %d %q, want index.html", path, rec.Code, rec.Body)
+        }
+    }
+    if rec := get("/assets/app.js"); rec.Body.String() != "console.log('app')" {
+        t.Errorf("GET /assets/app.js = %d %q, want the file", rec.Code, rec.Body)
+    }
+
+    for _, path := range []string{"/status", "/health"} {
+        rec := get(path)
+        var body map[string]interface{}
+        if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &body) != nil {
+            t.Errorf("GET %s = %d %q, want its JSON rather than the frontend", path, rec.Code, rec.Body)
+        }
+    }
+    // Unregistered API paths, e.g. with recording off, stay 404s
+    for _, path := range []string{"/recordings/files/a.webm", "/stats/extra", "/ws"} {
+        if rec := get(path); rec.Code != http.StatusNotFound {
+            t.Errorf("GET %s = %d %q, want 404", path, rec.Code, rec.Body)
+        }
+    }
+}
+
+func TestRaisedHandsShowInTheParticipantSnapshot(t *testing.T) {
+    startHub(t)
+    alice := tapJoin(t, "hands", "alice", Message{})
+    bob := tapJoin(t, "hands", "bob", Message{})
+    var snapshot struct {
+        Hands        []string
+        Reactions    map[string]int
+        Participants []struct {
+            ID         string
+            HandRaised bool
+            Reaction   string
+        }
+    }
+    snap := func() {
+        t.Helper()
+        req := httptest.NewRequest(http.MethodGet, "/rooms/hands/participants", nil)
+        req.SetPathValue("name", "hands")
+        rec := httptest.NewRecorder()
+        handleParticipants(rec, req)
+        snapshot.Hands, snapshot.Reactions, snapshot.Participants = nil, nil, nil
+        if err := json.Unmarshal(rec.Body.Bytes(), &snapshot); err != nil {
+            t.Fatalf("%v: %s", err, rec.Body)
+        }
+    }
+    reactions := func(conn *tapConn, from, kind string) int {
+        n := 0
+        for _, msg := range conn.got("reaction") {
+            if msg.From == from && msg.Reaction == kind {
+                n++
+            }
+        }
+        return n
+    }
+
+    send(t, alice.memConn, Message{Type: "reaction", Reaction: "raise-hand"})
+    send(t, alice.memConn, Message{Type: "reaction", Reaction: "raise-hand"})
+    waitFor(t, "alice's hand at bob", func() bool { return reactions(bob, "alice", "raise-hand") > 0 })
+    snap()
+    if !reflect.DeepEqual(snapshot.Hands, []string{"alice"}) || !snapshot.Participants[0].HandRaised || snapshot.Participants[1].HandRaised {
+        t.Errorf("snapshot after alice raised her hand: %+v", snapshot)
+    }
+    if carol := tapJoin(t, "hands", "carol", Message{}); !reflect.DeepEqual(carol.got("welcome")[0].Hands, []string{"alice"}) {
+        t.Errorf("a late joiner was welcomed with hands %q, want alice's", carol.got("welcome")[0].Hands)
+    }
+
+    // Emoji repeated within the TTL are counted, not relayed again
+    send(t, bob.memConn, Message{Type: "reaction", Reaction: "clap"})
+    send(t, bob.memConn, Message{Type: "reaction", Reaction: "clap"})
+    send(t, bob.memConn, Message{Type: "reaction", Reaction: "lower-hand"})
+    waitFor(t, "bob's clap at alice", func() bool { return reactions(alice, "bob", "clap") > 0 })
+    snap()
+    if snapshot.Reactions["clap"] != 2 || snapshot.Participants[1].Reaction != "clap" {
+        t.Errorf("snapshot after bob clapped twice: %+v", snapshot)
+    }
+    send(t, bob.memConn, Message{Type: "reaction", Reaction: "fireworks"})
+    waitFor(t, "bob's unknown reaction refused", func() bool { return len(errorsFor(bob, "reaction")) > 0 })
+    if got := errorsFor(bob, "reaction"); got[0] != ErrBadReaction {
+        t.Errorf("an unknown reaction got %q, want %q", got, ErrBadReaction)
+    }
+
+    send(t, alice.memConn, Message{Type: "reaction", Reaction: "lower-hand"})
+    waitFor(t, "alice's hand lowered at bob", func() bool { return reactions(bob, "alice", "lower-hand") > 0 })
+    snap()
+    if len(snapshot.Hands) != 0 || snapshot.Participants[0].HandRaised {
+        t.Errorf("snapshot after alice lowered her hand: %+v", snapshot)
+    }
+    if got := reactions(bob, "alice", "raise-hand") + reactions(alice, "bob", "clap"); got != 2 {
+        t.Errorf("%d raise-hand and clap relays, want one each", got)
+    }
+
+    // A hand left up past handTimeout is lowered by the sweep
+    send(t, bob.memConn, Message{Type: "reaction", Reaction: "raise-hand"})
+    waitFor(t, "bob's hand at alice", func() bool { return reactions(alice, "bob", "raise-hand") > 0 })
+    hub.mu.RLock()
+    room := hub.Rooms["hands"]
+    hub.mu.RUnlock()
+    room.mu.Lock()
+    room.Hands["bob"] = time.Now().Add(-handTimeout - time.Second)
+    room.mu.Unlock()
+    deadline := time.Now().Add(2 * time.Second)
+    for reactions(alice, "bob", "lower-hand") == 0 && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+    }
+    snap()
+    if reactions(alice, "bob", "lower-hand") != 1 || len(snapshot.Hands) != 0 {
+        t.Errorf("bob's hand after timing out: %d lowers relayed, hands %q", reactions(alice, "bob", "lower-hand"), snapshot.Hands)
+    }
+}
+
+func TestSilentClientGoesAwayThenIsRemoved(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "presence", "alice", Message{})
+    bob := tapJoin(t, "presence", "bob", Message{})
+    carol := codeJoin(t, "presence", "carol", Message{})
+    room := h.room("presence")
+    silence := func(id string, d time.Duration) time.Time {
+        at := time.Now().Add(-d)
+        room.client(id).lastSeen.Store(at.UnixNano())
+        return at
+    }
+    lastSeen := func(id string) int64 {
+        t.Helper()
+        req := httptest.NewRequest(http.MethodGet, "/rooms/presence/participants", nil)
+        req.SetPathValue("name", "presence")
+        rec := httptest.NewRecorder()
+        handleParticipants(rec, req)
+        var snapshot struct {
+            Participants []struct {
+                ID       string
+                LastSeen int64
+            }
+        }
+        if err := json.Unmarshal(rec.Body.Bytes(), &snapshot); err != nil {
+            t.Fatalf("%v: %s", err, rec.Body)
+        }
+        for _, p := range snapshot.Participants {
+            if p.ID == id {
+                return p.LastSeen
+            }
+        }
+        return 0
+    }
+
+    // carol's connection goes quiet: no messages, no pongs
+    quiet := silence("carol", 2*time.Second)
+    if got := lastSeen("carol"); got != quiet.UnixMilli() {
+        t.Errorf("participants has carol last seen at %d, want %d", got, quiet.UnixMilli())
+    }
+    h.sweepPresence(0, 0)
+    h.sweepPresence(time.Second, time.Minute)
+    h.sweepPresence(time.Second, time.Minute)
+    for _, conn := range []*tapConn{alice, bob} {
+        waitFor(t, "carol away at "+conn.key, func() bool { return len(conn.got("participant-away")) > 0 })
+    }
+
+    // Heard from again she is back until the next silence, and silent past
+    // leaveAfter she is removed
+    send(t, carol.memConn, Message{Type: "typing-start"})
+    waitFor(t, "carol to be heard", func() bool { return time.Since(room.client("carol").LastSeen()) < time.Second })
+    h.sweepPresence(time.Second, time.Minute)
+    waitFor(t, "carol back at bob", func() bool { return len(bob.got("participant-back")) == 1 })
+    quiet = silence("carol", 2*time.Second)
+    h.sweepPresence(time.Second, time.Minute)
+
+    silence("carol", 2*time.Minute)
+    h.sweepPresence(time.Second, time.Minute)
+    if code, reason := carol.closedWith(t); code != ClosePresence || reason != "presence-timeout" {
+        t.Errorf("carol was closed with %d %q, want %d presence-timeout", code, reason, ClosePresence)
+    }
+    for _, conn := range []*tapConn{alice, bob} {
+        waitFor(t, "carol gone at "+conn.key, func() bool { return len(conn.got("participant-left")) > 0 })
+        // Everything sent before the leave has been written by now
+        away, left := conn.got("participant-away"), conn.got("participant-left")
+        if len(away) != 2 || away[1].From != "carol" || away[1].LastSeen != quiet.UnixMilli() {
+            t.Errorf("%s was sent %+v, want carol away once each silence, last seen at %d", conn.key, away, quiet.UnixMilli())
+        }
+        if len(left) != 1 || left[0].From != "carol" || left[0].Text != "presence-timeout" {
+            t.Errorf("%s was sent %+v, want carol left for presence-timeout", conn.key, left)
+        }
+    }
+    if len(carol.got("participant-away")) != 0 {
+        t.Error("carol was told she is away")
+    }
+    if room.client("carol") != nil || room.client("alice") == nil || room.client("bob") == nil {
+        t.Error("the sweep removed someone other than carol")
+    }
+}
+
+func TestVideoGoesOnlyToSubscribersButAudioToAll(t *testing.T) {
+    h := startHub(t)
+    // Sending every frame keeps the fps cap out of what each receiver gets
+    alice := tapJoin(t, "grid", "alice", Message{DropStrategy: "all"})
+    bob := tapJoin(t, "grid", "bob", Message{})
+    carol := tapJoin(t, "grid", "carol", Message{})
+    frame := videoFrame(t, 640, 360)
+    // subscribe sends ids for conn and waits until the hub has applied them,
+    // as it has once a later message of conn's is relayed
+    typed := map[*tapConn]int{}
+    subscribe := func(conn *tapConn, ids []string) {
+        t.Helper()
+        send(t, conn.memConn, Message{Type: "subscribe-video", IDs: ids})
+        send(t, conn.memConn, Message{Type: "typing-start"})
+        send(t, conn.memConn, Message{Type: "typing-stop"})
+        typed[conn]++
+        other := alice
+        if conn == alice {
+            other = bob
+        }
+        waitFor(t, conn.key+"'s subscription", func() bool { return len(received(other.memConn, "typing-stop", conn.key)) == typed[conn] })
+    }
+
+    // bob's frames are spaced past the sender fps cap so none is throttled
+    bobFrame := func() {
+        time.Sleep(time.Second / time.Duration(maxSenderFPS(3)))
+        send(t, bob.memConn, frame)
+    }
+    media := func(conn *tapConn, kind, from string) int { return len(received(conn.memConn, kind, from)) }
+
+    // carol's grid shows alice only
+    subscribe(carol, []string{"alice"})
+    send(t, bob.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    bobFrame()
+    send(t, alice.memConn, frame)
+    waitFor(t, "alice and bob's media", func() bool {
+        return media(alice, "video-frame", "bob") == 1 && media(carol, "video-frame", "alice") == 1 &&
+            media(carol, "audio-chunk", "bob") == 1
+    })
+    if got := media(carol, "video-frame", "bob"); got != 0 {
+        t.Errorf("carol got %d of bob's frames without subscribing to him", got)
+    }
+
+    // With nobody subscribed, bob's frame isn't even encoded
+    subscribe(alice, []string{"carol"})
+    encoded := atomic.LoadInt64(&h.CompressedFrames)
+    bobFrame()
+    send(t, bob.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "bob's second audio", func() bool { return media(alice, "audio-chunk", "bob") == 2 && media(carol, "audio-chunk", "bob") == 2 })
+
+    // Back to every source, so bob's next frame is the only one encoded
+    subscribe(carol, nil)
+    bobFrame()
+    waitFor(t, "bob's frame at carol", func() bool { return media(carol, "video-frame", "bob") == 1 })
+    if got := atomic.LoadInt64(&h.CompressedFrames) - encoded; got != 1 {
+        t.Errorf("%d of bob's frames encoded, want only the one carol resubscribed for", got)
+    }
+    if got := atomic.LoadInt64(&h.ThrottledFrames); got != 0 {
+        t.Errorf("%d of bob's frames throttled, so what was encoded says nothing", got)
+    }
+    if got := media(alice, "video-frame", "bob"); got != 1 {
+        t.Errorf("alice got %d of bob's frames, want only the one from before she unsubscribed", got)
+    }
+}
+
+func TestRoomLimitEvictsTheOldestEmptyRoom(t *testing.T) {
+    prev := maxRooms
+    maxRooms = 3
+    t.Cleanup(func() { maxRooms = prev })
+    h := startHub(t)
+    rooms := func() []string {
+        h.mu.RLock()
+        defer h.mu.RUnlock()
+        var ids []string
+        for id := range h.Rooms {
+            ids = append(ids, id)
+        }
+        sort.Strings(ids)
+        return ids
+    }
+    leave := func(conn *tapConn, room string) {
+        t.Helper()
+        send(t, conn.memConn, Message{Type: "leave"})
+        waitFor(t, conn.key+" to leave "+room, func() bool {
+            n := -1
+            r := h.room(room)
+            r.withRLock(func() { n = len(r.Clients) })
+            return n == 0
+        })
+    }
+
+    alice := tapJoin(t, "a", "alice", Message{})
+    bob := tapJoin(t, "b", "bob", Message{})
+    tapJoin(t, "c", "carol", Message{})
+
+    // a was created first, so it goes even though b emptied before it
+    leave(bob, "b")
+    leave(alice, "a")
+    tapJoin(t, "d", "dave", Message{})
+    if got := rooms(); !reflect.DeepEqual(got, []string{"b", "c", "d"}) {
+        t.Errorf("rooms after d past the cap: %q, want a evicted", got)
+    }
+    tapJoin(t, "e", "erin", Message{})
+    if got := rooms(); !reflect.DeepEqual(got, []string{"c", "d", "e"}) {
+        t.Errorf("rooms after e past the cap: %q, want b evicted", got)
+    }
+
+    // With every room occupied the new one is refused
+    frank := tapJoin(t, "f", "frank", Message{})
+    if codes := errorsFor(frank, "join"); !reflect.DeepEqual(codes, []ErrorCode{ErrRoomLimit}) {
+        t.Errorf("joining past the cap with no empty room got %v, want %s", codes, ErrRoomLimit)
+    }
+    if got := rooms(); !reflect.DeepEqual(got, []string{"c", "d", "e"}) {
+        t.Errorf("rooms after a refused join: %q", got)
+    }
+    // An existing room still takes joiners
+    if codes := errorsFor(tapJoin(t, "c", "grace", Message{}), "join"); len(codes) != 0 {
+        t.Errorf("joining an open room at the cap got %v", codes)
+    }
+    probe(handleReady, "/ready") // The hub is done reading maxRooms
+}
+
+func TestStatusReportsResourceUsage(t *testing.T) {
+    startHub(t)
+    status := func() map[string]interface{} {
+        t.Helper()
+        var body struct{ Resources map[string]interface{} }
+        rec := probe(handleStatus, "/status")
+        if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+            t.Fatalf("%v: %s", err, rec.Body)
+        }
+        return body.Resources
+    }
+
+    // Sampled fresh, whatever an earlier poll left cached
+    resources.mu.Lock()
+    resources.sampled = time.Time{}
+    resources.mu.Unlock()
+    first := status()
+    for _, field := range []string{"goroutines", "heapAllocBytes", "heapSysBytes", "numGC", "cpuPercent", "numCPU"} {
+        v, ok := first[field].(float64)
+        if !ok || v < 0 {
+            t.Errorf("resources.%s = %v, want a number", field, first[field])
+        }
+    }
+    if first["goroutines"].(float64) < 1 || first["heapAllocBytes"].(float64) <= 0 || first["numCPU"].(float64) < 1 {
+        t.Errorf("resources %v, want goroutines, heap and CPUs all counted", first)
+    }
+
+    // Polled again within the second the cached sample is served as is
+    stop := make(chan struct{})
+    for i := 0; i < 10; i++ {
+        go func() { <-stop }()
+    }
+    if again := status(); !reflect.DeepEqual(again, first) {
+        t.Errorf("resources resampled straight away: %v then %v", first, again)
+    }
+    close(stop)
+
+    // A stale sample is refreshed, with the CPU spent since in the estimate
+    resources.mu.Lock()
+    resources.sampled = resources.sampled.Add(-resourceSampleEvery)
+    resources.mu.Unlock()
+    for start := time.Now(); time.Since(start) < 200*time.Millisecond; {
+    }
+    if cpu := status()["cpuPercent"].(float64); cpu <= 0 {
+        t.Errorf("cpuPercent %v after spinning a core", cpu)
+    }
+}
+
+func TestFramePacingSpacesVideoButNotAudio(t *testing.T) {
+    prev := framePacing
+    t.Cleanup(func() { framePacing = prev })
+    video, _ := json.Marshal(Message{Type: "video-frame", Data: strings.Repeat("A", 1000)})
+    audio, _ := json.Marshal(Message{Type: "audio-chunk", Data: "AAAA"})
+    const (
+        bursts   = 12
+        perBurst = 3
+        interval = 99 * time.Millisecond // A 30fps source's frames, three at a time
+    )
+
+    // run feeds the hub's bursts through a WritePump and returns the gaps
+    // between video writes once the pacer has learnt the rate, and how long
+    // each burst's audio waited
+    run := func(pacing bool) (gaps, audioWaits []time.Duration) {
+        t.Helper()
+        framePacing = pacing
+        conn := &meteredConn{memConn: newMemConn("bob")}
+        c := &Client{ID: "bob", Conn: conn, Send: make(chan []byte, 64), Hub: NewHub(), flushed: make(chan struct{})}
+        done := make(chan struct{})
+        go func() {
+            c.WritePump()
+            close(done)
+        }()
+
+        var queued []time.Time
+        for i := 0; i < bursts; i++ {
+            for j := 0; j < perBurst; j++ {
+                c.Send <- video
+            }
+            queued = append(queued, time.Now())
+            c.Send <- audio
+            time.Sleep(interval)
+        }
+        close(c.Send)
+        <-done
+
+        conn.mu.Lock()
+        defer conn.mu.Unlock()
+        var last time.Time
+        for i, w := range conn.writes {
+            switch {
+            case !w.video:
+                audioWaits = append(audioWaits, w.at.Sub(queued[len(audioWaits)]))
+            case i >= len(conn.writes)/2:
+                gaps = append(gaps, w.at.Sub(last))
+                last = w.at
+            default:
+                last = w.at
+            }
+        }
+        return gaps, audioWaits
+    }
+    median := func(d []time.Duration) time.Duration {
+        sorted := append([]time.Duration(nil), d...)
+        sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+        return sorted[len(sorted)/2]
+    }
+    target := interval / perBurst
+
+    // Unpaced, each burst goes out back-to-back
+    gaps, _ := run(false)
+    if m := median(gaps); m > target/4 {
+        t.Fatalf("unpaced video writes %s apart, want bursts to compare pacing against", m)
+    }
+
+    gaps, audioWaits := run(true)
+    if m := median(gaps); m < target/2 || m > target*4/3 {
+        t.Errorf("paced video writes %s apart, want about the %s frame interval", m, target)
+    }
+    for _, gap := range gaps {
+        if gap < target/3 {
+            t.Errorf("paced video writes only %s apart: %s", gap, gaps)
+            break
+        }
+    }
+    if len(audioWaits) != bursts {
+        t.Fatalf("%d of %d audio chunks written", len(audioWaits), bursts)
+    }
+    if m := median(audioWaits); m > target/4 {
+        t.Errorf("audio waited %s behind paced video", m)
+    }
+}
+
+// slowConn is a memConn that takes a millisecond a message and notes, in
+// order, each message type written, the close frame and the conn first
+// closing (ReadPump closes it again on its way out). Like a real one it
+// writes nothing once closed.
+type slowConn struct {
+    *memConn
+    mu     sync.Mutex
+    events []string
+    closed bool
+}
+
+func (c *slowConn) note(event string) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closed {
+        return websocket.ErrCloseSent
+    }
+    c.events = append(c.events, event)
+    return nil
+}
+
+func (c *slowConn) WriteMessage(messageType int, data []byte) error {
+    time.Sleep(time.Millisecond)
+    var msg Message
+    if json.Unmarshal(data, &msg) == nil {
+        if err := c.note(msg.Type); err != nil {
+            return err
+        }
+    }
+    return c.memConn.WriteMessage(messageType, data)
+}
+
+func (c *slowConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+    if messageType == websocket.CloseMessage {
+        return c.note("close frame")
+    }
+    return nil
+}
+
+func (c *slowConn) Close() error {
+    c.mu.Lock()
+    if !c.closed {
+        c.closed = true
+        c.events = append(c.events, "conn closed")
+    }
+    c.mu.Unlock()
+    return c.memConn.Close()
+}
+
+func TestQueuedMessagesGoOutBeforeTheCloseFrame(t *testing.T) {
+    h := startHub(t)
+    join := func(id string) *slowConn {
+        conn := &slowConn{memConn: newMemConn(id)}
+        go serveConn(conn, "test", "127.0.0.1", nil)
+        send(t, conn.memConn, Message{Type: "join", Room: "flush", ID: id})
+        waitFor(t, "welcome for "+id, func() bool { return len(received(conn.memConn, "welcome", "")) > 0 })
+        return conn
+    }
+    alice, bob, carol, dave := join("alice"), join("bob"), join("carol"), join("dave")
+
+    // backlog queues n messages for id faster than its conn writes them
+    const n = 30
+    backlog := func(id string) {
+        client := h.room("flush").client(id)
+        data, _ := json.Marshal(Message{Type: "typing-start", From: "alice"})
+        for i := 0; i < n; i++ {
+            if !client.pipe(data) {
+                t.Fatalf("%s's queue refused message %d", id, i)
+            }
+        }
+    }
+    // tail checks what conn wrote after its backlog ended in last, the close
+    // frame and the conn closing
+    tail := func(conn *slowConn, last string) {
+        t.Helper()
+        conn.mu.Lock()
+        defer conn.mu.Unlock()
+        typed := 0
+        for _, event := range conn.events {
+            if event == "typing-start" {
+                typed++
+            }
+        }
+        end := conn.events[max(0, len(conn.events)-3):]
+        if typed != n || !reflect.DeepEqual(end, []string{last, "close frame", "conn closed"}) {
+            t.Errorf("%s got %d of %d queued messages, ending %q", conn.key, typed, n, end)
+        }
+    }
+
+    // A kick closes bob's queue with the backlog still in it
+    backlog("bob")
+    send(t, alice.memConn, Message{Type: "kick", Target: "bob"})
+    waitFor(t, "bob's conn to close", func() bool {
+        bob.mu.Lock()
+        defer bob.mu.Unlock()
+        return bob.closed
+    })
+    tail(bob, "kicked")
+
+    // and so does dave leaving, though his ReadPump is done at once
+    backlog("dave")
+    send(t, dave.memConn, Message{Type: "leave"})
+    waitFor(t, "dave's conn to close", func() bool {
+        dave.mu.Lock()
+        defer dave.mu.Unlock()
+        return dave.closed
+    })
+    tail(dave, "typing-start")
+
+    // Shutdown returns only once carol's backlog and close frame are out
+    backlog("carol")
+    h.Shutdown(time.Second)
+    tail(carol, "server-restart")
+}
+
+func TestTraceRecordsWhyAFrameWasDropped(t *testing.T) {
+    withAdminToken(t, "secret")
+    startHub(t)
+    alice := tapJoin(t, "traced", "alice", Message{DropStrategy: "all"})
+    bob := tapJoin(t, "traced", "bob", Message{})
+    carol := tapJoin(t, "traced", "carol", Message{})
+    type trace struct {
+        Enabled bool
+        Entries []traceEntry
+    }
+    call := func(method, token, body string) (int, trace) {
+        t.Helper()
+        req := httptest.NewRequest(method, "/debug/trace/traced", strings.NewReader(body))
+        req.SetPathValue("room", "traced")
+        if token != "" {
+            req.Header.Set("Authorization", "Bearer "+token)
+        }
+        rec := httptest.NewRecorder()
+        handleTrace(rec, req)
+        var got trace
+        if rec.Code == http.StatusOK {
+            if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+                t.Fatal(err)
+            }
+        }
+        return rec.Code, got
+    }
+    frame := videoFrame(t, 640, 360)
+
+    // Off by default, and only for admins
+    send(t, bob.memConn, frame)
+    waitFor(t, "bob's untraced frame", func() bool { return len(received(alice.memConn, "video-frame", "bob")) == 1 })
+    if code, got := call(http.MethodGet, "secret", ""); code != http.StatusOK || got.Enabled || len(got.Entries) != 0 {
+        t.Errorf("trace before enabling: %d %+v", code, got)
+    }
+    if code, _ := call(http.MethodPost, "wrong", `{"enabled": true}`); code != http.StatusUnauthorized {
+        t.Errorf("enabling with the wrong token = %d, want 401", code)
+    }
+    if code, got := call(http.MethodPost, "secret", `{"enabled": true}`); code != http.StatusOK || !got.Enabled {
+        t.Fatalf("enabling the trace: %d %+v", code, got)
+    }
+
+    // carol only watches alice. bob's frame reaches alice alone, and the one
+    // straight after it is over his fps cap
+    send(t, carol.memConn, Message{Type: "subscribe-video", IDs: []string{"alice"}})
+    send(t, carol.memConn, Message{Type: "typing-start"})
+    waitFor(t, "carol's subscription", func() bool { return len(received(alice.memConn, "typing-start", "carol")) == 1 })
+    time.Sleep(time.Second / time.Duration(maxSenderFPS(3)))
+    send(t, bob.memConn, frame)
+    send(t, bob.memConn, frame)
+    var got trace
+    waitFor(t, "bob's frames in the trace", func() bool {
+        _, got = call(http.MethodGet, "secret", "")
+        return len(got.Entries) == 2
+    })
+    var routed, throttled traceEntry
+    for _, e := range got.Entries {
+        if e.Reason == "" {
+            routed = e
+        } else {
+            throttled = e
+        }
+    }
+    if routed.From != "bob" || !reflect.DeepEqual(routed.Intended, []string{"alice", "carol"}) ||
+        !reflect.DeepEqual(routed.Delivered, []string{"alice"}) || routed.Dropped["carol"] != dropNotSubscribed {
+        t.Errorf("bob's routed frame traced as %+v, want delivered to alice and %s at carol", routed, dropNotSubscribed)
+    }
+    if throttled.From != "bob" || throttled.Reason != dropThrottled || len(throttled.Delivered) != 0 {
+        t.Errorf("bob's second frame traced as %+v, want %s", throttled, dropThrottled)
+    }
+
+    if code, got := call(http.MethodPost, "secret", `{"enabled": false}`); code != http.StatusOK || got.Enabled || len(got.Entries) != 0 {
+        t.Errorf("disabling the trace: %d %+v", code, got)
+    }
+}
+
+func TestRoomSeriesAdvancesEachTickAndWraps(t *testing.T) {
+    var series roomSeries
+    start := time.UnixMilli(1_700_000_000_000)
+    tick := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+    // The first tick is only the baseline; the next is the second between
+    series.add(tick(0), 1, 0, 0, 0)
+    if got := series.snapshot(); len(got) != 0 {
+        t.Fatalf("the baseline tick added %+v", got)
+    }
+    series.add(tick(1), 2, 1000, 3, 1)
+    want := roomSample{Time: tick(1).UnixMilli(), Participants: 2, BitrateKbps: 8, DropRate: 25}
+    if got := series.snapshot(); len(got) != 1 || got[0] != want {
+        t.Fatalf("after one second the series is %+v, want [%+v]", got, want)
+    }
+
+    // Past capacity the oldest samples give way, and the rest stay in order
+    last := seriesLength + 20
+    for i := 2; i <= last; i++ {
+        series.add(tick(i), i, int64(i)*1000, int64(i)*3, int64(i))
+    }
+    got := series.snapshot()
+    if len(got) != seriesLength {
+        t.Fatalf("%d samples after %d ticks, want the %d the ring holds", len(got), last, seriesLength)
+    }
+    for n, sample := range got {
+        i := last - seriesLength + 1 + n
+        if want := (roomSample{Time: tick(i).UnixMilli(), Participants: i, BitrateKbps: 8, DropRate: 25}); sample != want {
+            t.Fatalf("sample %d is %+v, want %+v", n, sample, want)
+        }
+    }
+
+    // The endpoint serves the hub's own, sampled every tick
+    h := startHub(t)
+    joinAs(t, "series", "alice")
+    h.sampleRooms()
+    h.sampleRooms()
+    timeseries := func(name string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodGet, "/rooms/"+name+"/timeseries", nil)
+        req.SetPathValue("name", name)
+        rec := httptest.NewRecorder()
+        handleTimeseries(rec, req)
+        return rec
+    }
+    var body struct {
+        Room       string
+        IntervalMs int64
+        Samples    []roomSample
+    }
+    rec := timeseries("series")
+    if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+        t.Fatalf("%v: %s", err, rec.Body)
+    }
+    if body.Room != "series" || body.IntervalMs != 1000 || len(body.Samples) == 0 || body.Samples[len(body.Samples)-1].Participants != 1 {
+        t.Errorf("/rooms/series/timeseries = %s, want alice's room sampled", rec.Body)
+    }
+    if rec := timeseries("nowhere"); rec.Code != http.StatusNotFound {
+        t.Errorf("the timeseries of a room that doesn't exist = %d, want 404", rec.Code)
+    }
+}
+
+// stallConn is a memConn whose streamed writes take accept bytes and then
+// stop draining, failing only once the write deadline passes
+type stallConn struct {
+    *memConn
+    accept int
+
+    mu       sync.Mutex
+    deadline time.Time
+    slack    []time.Duration // Each deadline set, from when it was set
+    chunks   []int
+}
+
+func (c *stallConn) SetWriteDeadline(t time.Time) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.deadline = t
+    c.slack = append(c.slack, time.Until(t))
+    return nil
+}
+
+func (c *stallConn) NextWriter(messageType int) (io.WriteCloser, error) {
+    return &stallWriter{conn: c}, nil
+}
+
+type stallWriter struct {
+    conn    *stallConn
+    written int
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+    w.conn.mu.Lock()
+    w.conn.chunks = append(w.conn.chunks, len(p))
+    deadline := w.conn.deadline
+    w.conn.mu.Unlock()
+    if w.written+len(p) <= w.conn.accept {
+        w.written += len(p)
+        return len(p), nil
+    }
+    time.Sleep(time.Until(deadline))
+    return 0, os.ErrDeadlineExceeded
+}
+
+func (w *stallWriter) Close() error { return nil }
+
+func TestStalledStreamedWriteTearsDownTheConnection(t *testing.T) {
+    h := startHub(t)
+    conn := &stallConn{memConn: newMemConn("alice"), accept: 2 * streamChunk}
+    go serveConn(conn, "test", "127.0.0.1", nil)
+    send(t, conn.memConn, Message{Type: "join", Room: "stall", ID: "alice"})
+    waitFor(t, "alice's welcome", func() bool { return len(received(conn.memConn, "welcome", "")) > 0 })
+    joinAs(t, "stall", "bob")
+    room := h.room("stall")
+
+    // A 4K frame's worth goes out in chunks until the socket stops draining
+    big, err := json.Marshal(Message{Type: "chat", From: "bob", Text: strings.Repeat("A", 4*streamThreshold)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    stalled := atomic.LoadInt64(&h.StalledWrites)
+    start := time.Now()
+    if !room.client("alice").pipe(big) {
+        t.Fatal("alice's queue took nothing")
+    }
+    select {
+    case <-conn.closed:
+    case <-time.After(writeTimeout):
+        t.Fatalf("alice's connection is still open after WRITE_TIMEOUT (%s) of a stalled write", writeTimeout)
+    }
+    if took := time.Since(start); took < writeStallTimeout || took > writeStallTimeout+time.Second {
+        t.Errorf("the stalled write was torn down after %s, want about WRITE_STALL_TIMEOUT (%s)", took, writeStallTimeout)
+    }
+    if got := atomic.LoadInt64(&h.StalledWrites) - stalled; got != 1 {
+        t.Errorf("StalledWrites went up by %d, want 1", got)
+    }
+    waitFor(t, "alice to leave the room", func() bool { return room.client("alice") == nil })
+    if room.client("bob") == nil {
+        t.Error("bob was removed along with alice")
+    }
+
+    conn.mu.Lock()
+    defer conn.mu.Unlock()
+    if len(conn.chunks) != 3 {
+        t.Errorf("the message was written in chunks %v, want two accepted and the one that stalled", conn.chunks)
+    }
+    for _, n := range conn.chunks {
+        if n > streamChunk {
+            t.Errorf("a %d-byte chunk was written, want at most %d", n, streamChunk)
+        }
+    }
+    // Each chunk gets the stall timeout, not what's left of the whole write's
+    for _, slack := range conn.slack[len(conn.slack)-len(conn.chunks)-1:] {
+        if slack > writeStallTimeout {
+            t.Errorf("a streamed chunk's deadline was %s away, want at most %s", slack, writeStallTimeout)
+        }
+    }
+}
+
+func TestResentControlMessageIsDroppedByMsgID(t *testing.T) {
+    var w msgWindow
+    for _, tc := range []struct {
+        id    uint64
+        first bool
+    }{
+        {5, true}, {5, false}, {3, true}, {3, false}, {6, true},
+        {6 + dedupWindow, true}, {6, false}, {7, true}, // 7 is inside the window, 6 just out
+    } {
+        if got := w.first(tc.id); got != tc.first {
+            t.Errorf("msgId %d after the ones before: first = %v, want %v", tc.id, got, tc.first)
+        }
+    }
+
+    h := startHub(t)
+    alice := tapJoin(t, "dedup", "alice", Message{})
+    bob := tapJoin(t, "dedup", "bob", Message{})
+    hand := func(id uint64, kind string) {
+        send(t, alice.memConn, Message{Type: "reaction", Reaction: kind, MsgID: id})
+    }
+    hands := func(kind string) int {
+        n := 0
+        for _, msg := range bob.got("reaction") {
+            if msg.From == "alice" && msg.Reaction == kind {
+                n++
+            }
+        }
+        return n
+    }
+    duplicates := atomic.LoadInt64(&h.DuplicateMessages)
+
+    // Resending the raise after the lower would put the hand back up
+    hand(1, "raise-hand")
+    hand(2, "lower-hand")
+    hand(1, "raise-hand")
+    send(t, alice.memConn, Message{Type: "audio-chunk", Data: "AAAA", MsgID: 1})
+    waitFor(t, "alice's audio at bob", func() bool { return len(received(bob.memConn, "audio-chunk", "alice")) == 1 })
+    if hands("raise-hand") != 1 || hands("lower-hand") != 1 {
+        t.Errorf("bob saw %d raises and %d lowers, want the resent raise dropped", hands("raise-hand"), hands("lower-hand"))
+    }
+
+    // The ids outlive the connection, and the welcome says how far they got
+    alice.Close()
+    room := h.room("dedup")
+    waitFor(t, "alice to leave", func() bool { return room.client("alice") == nil })
+    alice = tapJoin(t, "dedup", "alice", Message{})
+    if welcome := alice.got("welcome"); len(welcome) != 1 || welcome[0].MsgID != 2 {
+        t.Fatalf("alice rejoined to %+v, want msgId 2 as the last relayed", welcome)
+    }
+    hand(2, "lower-hand")
+    hand(3, "raise-hand")
+    waitFor(t, "alice's new raise at bob", func() bool { return hands("raise-hand") == 2 })
+    if got := hands("lower-hand"); got != 1 {
+        t.Errorf("bob saw %d lowers, want the one resent after the reconnect dropped", got)
+    }
+    if got := atomic.LoadInt64(&h.DuplicateMessages) - duplicates; got != 2 {
+        t.Errorf("DuplicateMessages went up by %d, want 2", got)
+    }
+}
+
+func TestLeaveNotifiesPeersAndClosesRightAway(t *testing.T) {
+    h := startHub(t)
+    alice := codeJoin(t, "bye", "alice", Message{})
+    bob := tapJoin(t, "bye", "bob", Message{})
+    carol := tapJoin(t, "bye", "carol", Message{})
+    room := h.room("bye")
+    left := func(id string) []Message {
+        var out []Message
+        for _, msg := range bob.got("participant-left") {
+            if msg.From == id {
+                out = append(out, msg)
+            }
+        }
+        return out
+    }
+
+    // alice says goodbye: nothing waits on her read deadline
+    start := time.Now()
+    send(t, alice.memConn, Message{Type: "leave"})
+    if code, reason := alice.closedWith(t); code != websocket.CloseNormalClosure || reason != "left" {
+        t.Errorf("alice's leave closed with %d %q, want %d left", code, reason, websocket.CloseNormalClosure)
+    }
+    waitFor(t, "bob to hear alice left", func() bool { return len(left("alice")) > 0 })
+    if took := time.Since(start); took > time.Second {
+        t.Errorf("bob heard alice left %s after her leave, want it right away (READ_TIMEOUT is %s)", took, readTimeout)
+    }
+    <-alice.closed
+    if got := left("alice"); len(got) != 1 || got[0].Text != "left" || room.client("alice") != nil {
+        t.Errorf("bob was told %+v, want alice left once for \"left\"", got)
+    }
+
+    // carol's socket just goes away
+    carol.Close()
+    waitFor(t, "bob to hear carol went", func() bool { return len(left("carol")) > 0 })
+    if got := left("carol"); got[0].Text != "disconnected" {
+        t.Errorf("a dropped socket was announced as %q, want disconnected", got[0].Text)
+    }
+}
+
+func TestStaleVideoIsSkippedButAudioAndFreshVideoPass(t *testing.T) {
+    prev := framePacing
+    t.Cleanup(func() { framePacing = prev })
+    queue := func(c *Client, from, kind string, age time.Duration) {
+        t.Helper()
+        msg := Message{Type: kind, From: from, Data: "AAAA"}
+        if age >= 0 {
+            msg.ServerTime = time.Now().Add(-age).UnixMilli()
+        }
+        data, err := json.Marshal(msg)
+        if err != nil {
+            t.Fatal(err)
+        }
+        c.Send <- data
+    }
+
+    for _, pacing := range []bool{false, true} {
+        framePacing = pacing
+        conn := newMemConn("bob")
+        c := &Client{ID: "bob", Conn: conn, Send: make(chan []byte, 64), Hub: NewHub(), flushed: make(chan struct{})}
+        done := make(chan struct{})
+        go func() {
+            c.WritePump()
+            close(done)
+        }()
+
+        queue(c, "stale", "video-frame", 4*staleVideoAfter)
+        queue(c, "late", "video-frame", staleVideoAfter+200*time.Millisecond)
+        queue(c, "fresh", "video-frame", 0)
+        queue(c, "unstamped", "video-frame", -1)
+        queue(c, "old-audio", "audio-chunk", 4*staleVideoAfter)
+        queue(c, "control", "typing-start", 4*staleVideoAfter)
+        waitFor(t, "the fresh and unstamped frames", func() bool {
+            return len(received(conn, "video-frame", "fresh")) == 1 && len(received(conn, "video-frame", "unstamped")) == 1
+        })
+        close(c.Send)
+        <-done
+
+        for _, from := range []string{"stale", "late"} {
+            if got := len(received(conn, "video-frame", from)); got != 0 {
+                t.Errorf("pacing %v: the %s frame was written", pacing, from)
+            }
+        }
+        if len(received(conn, "audio-chunk", "old-audio")) != 1 || len(received(conn, "typing-start", "control")) != 1 {
+            t.Errorf("pacing %v: audio or control was held to the video's age limit", pacing)
+        }
+        if got := atomic.LoadInt64(&c.Hub.StaleDropped); got != 2 {
+            t.Errorf("pacing %v: StaleDropped = %d, want the 2 old frames", pacing, got)
+        }
+    }
+}
+
+func TestAppMessagesRelayUntouchedWithinTheirBudget(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "canvas", "alice", Message{})
+    bob := tapJoin(t, "canvas", "bob", Message{})
+    carol := tapJoin(t, "canvas", "carol", Message{})
+    cursor := json.RawMessage(`{"x":0.25,"y":[1,2,{"pen":"ünïcode ☃"}],"down":true,"n":null}`)
+    apps := func(conn *tapConn, channel string) []Message {
+        var out []Message
+        for _, msg := range conn.got("app") {
+            if msg.Channel == channel {
+                out = append(out, msg)
+            }
+        }
+        return out
+    }
+
+    // To the room, or only to a target
+    send(t, alice.memConn, Message{Type: "app", Channel: "cursor", Payload: cursor})
+    send(t, alice.memConn, Message{Type: "app", Channel: "whisper", Target: "carol", Payload: json.RawMessage(`"psst"`)})
+    waitFor(t, "the whisper at carol", func() bool { return len(apps(carol, "whisper")) == 1 })
+    for _, conn := range []*tapConn{bob, carol} {
+        got := apps(conn, "cursor")
+        if len(got) != 1 || got[0].From != "alice" || !bytes.Equal(got[0].Payload, cursor) {
+            t.Errorf("%s got cursor messages %+v, want alice's payload as sent", conn.key, got)
+        }
+    }
+    if len(apps(alice, "cursor")) != 0 || len(apps(bob, "whisper")) != 0 {
+        t.Error("an app message went back to its sender or past its target")
+    }
+
+    // A burst past the budget: the rest are dropped, with one error
+    dropped := atomic.LoadInt64(&h.AppDropped)
+    for i := 0; i < maxAppPerSecond+20; i++ {
+        send(t, bob.memConn, Message{Type: "app", Channel: "stroke", Payload: json.RawMessage(strconv.Itoa(i))})
+    }
+    waitFor(t, "bob's error", func() bool { return len(errorsFor(bob, "app")) > 0 })
+    // A typing-stop after the burst means everything before it is handled
+    send(t, bob.memConn, Message{Type: "typing-start"})
+    send(t, bob.memConn, Message{Type: "typing-stop"})
+    waitFor(t, "bob's typing-stop", func() bool { return len(received(alice.memConn, "typing-stop", "bob")) == 1 })
+    if got := len(apps(alice, "stroke")); got != maxAppPerSecond {
+        t.Errorf("alice got %d of bob's %d strokes, want the %d a second allows", got, maxAppPerSecond+20, maxAppPerSecond)
+    }
+    if got := atomic.LoadInt64(&h.AppDropped) - dropped; got != 20 {
+        t.Errorf("AppDropped went up by %d, want 20", got)
+    }
+    if codes := errorsFor(bob, "app"); len(codes) != 1 || codes[0] != ErrRateLimited {
+        t.Errorf("bob was sent %v for the burst, want one %s", codes, ErrRateLimited)
+    }
+}
+
+// audioRoom is a room of n listeners and the sender alice
+func audioRoom(n int) *Room {
+    room := &Room{ID: "audio", Clients: map[string]*Client{"alice": {ID: "alice", Send: make(chan []byte, 1)}}}
+    for i := 0; i < n; i++ {
+        id := fmt.Sprintf("listener%d", i)
+        room.Clients[id] = &Client{ID: id, Send: make(chan []byte, 1024)}
+    }
+    return room
+}
+
+func TestAudioIsMarshalledOncePerChunk(t *testing.T) {
+    h := NewHub()
+    chunk := Message{Type: "audio-chunk", Data: base64.StdEncoding.EncodeToString(make([]byte, 4096))}
+    allocs := func(listeners int) float64 {
+        room := audioRoom(listeners)
+        return testing.AllocsPerRun(100, func() {
+            h.distributeAudio(room, chunk, "alice")
+            for id, client := range room.Clients {
+                if id != "alice" {
+                    <-client.Send
+                }
+            }
+        })
+    }
+    if two, six := allocs(2), allocs(6); six > two {
+        t.Errorf("a chunk to 6 listeners took %.0f allocations and to 2 took %.0f, want the same", six, two)
+    }
+
+    // Every listener is queued the very same bytes
+    room := audioRoom(5)
+    h.distributeAudio(room, chunk, "alice")
+    var first []byte
+    for id, client := range room.Clients {
+        if id == "alice" {
+            if len(client.Send) != 0 {
+                t.Error("alice was sent her own audio")
+            }
+            continue
+        }
+        data := <-client.Send
+        if first == nil {
+            first = data
+        }
+        if &data[0] != &first[0] {
+            t.Fatalf("%s was queued its own copy of the chunk", id)
+        }
+    }
+
+    // The shared write buffer pool is on unless turned off
+    if !defaultConfig().WriteBufferPool {
+        t.Error("WRITE_BUFFER_POOL is off by default")
+    }
+    t.Setenv("WRITE_BUFFER_POOL", "false")
+    if cfg, err := loadConfig(""); err != nil || cfg.WriteBufferPool {
+        t.Errorf("WRITE_BUFFER_POOL=false loaded as %v (%v)", cfg.WriteBufferPool, err)
+    }
+}
+
+func BenchmarkDistributeAudio(b *testing.B) {
+    h := NewHub()
+    room := audioRoom(5)
+    chunk := Message{Type: "audio-chunk", Data: base64.StdEncoding.EncodeToString(make([]byte, 4096))}
+    b.ReportAllocs()
+    for i := 0; i < b.N; i++ {
+        h.distributeAudio(room, chunk, "alice")
+        for id, client := range room.Clients {
+            if id != "alice" {
+                <-client.Send
+            }
+        }
+    }
+}
+
+func TestSelfMutedSenderIsDroppedAndShownMuted(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "mic", "alice", Message{})
+    bob := tapJoin(t, "mic", "bob", Message{})
+    on, off := true, false
+    states := func(conn *tapConn) []MuteState {
+        var out []MuteState
+        for _, msg := range conn.got("mute-state") {
+            if msg.From == "alice" && msg.Audio != nil && msg.Video != nil {
+                out = append(out, MuteState{Audio: *msg.Audio, Video: *msg.Video})
+            }
+        }
+        return out
+    }
+    // A typing-stop after alice's media means the hub has handled it all
+    handled := 0
+    settle := func() {
+        t.Helper()
+        handled++
+        send(t, alice.memConn, Message{Type: "typing-start"})
+        send(t, alice.memConn, Message{Type: "typing-stop"})
+        waitFor(t, "alice's typing-stop", func() bool { return len(received(bob.memConn, "typing-stop", "alice")) == handled })
+    }
+    snapshot := func() map[string]MuteState {
+        t.Helper()
+        req := httptest.NewRequest(http.MethodGet, "/rooms/mic/participants", nil)
+        req.SetPathValue("name", "mic")
+        rec := httptest.NewRecorder()
+        handleParticipants(rec, req)
+        var body struct {
+            Participants []struct {
+                ID         string
+                AudioMuted bool
+                VideoMuted bool
+            }
+        }
+        if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+            t.Fatalf("%v: %s", err, rec.Body)
+        }
+        mutes := make(map[string]MuteState)
+        for _, p := range body.Participants {
+            mutes[p.ID] = MuteState{Audio: p.AudioMuted, Video: p.VideoMuted}
+        }
+        return mutes
+    }
+
+    // alice mutes her mic: everyone hears of it, alice included
+    send(t, alice.memConn, Message{Type: "mute-state", Audio: &on})
+    waitFor(t, "alice's mute at bob", func() bool { return len(states(bob)) > 0 })
+    waitFor(t, "alice's mute echoed to her", func() bool { return len(states(alice)) > 0 })
+    if got := states(bob)[0]; got != (MuteState{Audio: true}) {
+        t.Errorf("bob was told alice's state is %+v, want audio muted", got)
+    }
+
+    // A buggy client still sending audio goes no further
+    dropped := atomic.LoadInt64(&h.MutedDropped)
+    send(t, alice.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    settle()
+    if n := len(received(bob.memConn, "audio-chunk", "alice")); n != 0 {
+        t.Errorf("bob got %d audio chunks from muted alice", n)
+    }
+
+    // Muting video keeps the omitted audio muted, and drops her frames too
+    send(t, alice.memConn, Message{Type: "mute-state", Video: &on})
+    send(t, alice.memConn, videoFrame(t, 64, 48))
+    settle()
+    if got := states(bob); len(got) != 2 || got[1] != (MuteState{Audio: true, Video: true}) {
+        t.Errorf("bob was told alice's states %+v, want audio then audio and video muted", got)
+    }
+    if n := len(received(bob.memConn, "video-frame", "alice")); n != 0 {
+        t.Errorf("bob got %d video frames from alice with her camera muted", n)
+    }
+    if got := atomic.LoadInt64(&h.MutedDropped) - dropped; got != 2 {
+        t.Errorf("MutedDropped went up by %d, want 2", got)
+    }
+    if got := snapshot(); got["alice"] != (MuteState{Audio: true, Video: true}) || got["bob"] != (MuteState{}) {
+        t.Errorf("participants has mutes %+v, want only alice's both", got)
+    }
+    carol := tapJoin(t, "mic", "carol", Message{})
+    if got := carol.got("welcome")[0].Mutes; !reflect.DeepEqual(got, map[string]MuteState{"alice": {Audio: true, Video: true}}) {
+        t.Errorf("a late joiner was welcomed with mutes %+v, want alice's", got)
+    }
+
+    // Saying the same again relays nothing; unmuting lets audio through
+    send(t, alice.memConn, Message{Type: "mute-state", Audio: &on})
+    send(t, alice.memConn, Message{Type: "mute-state", Audio: &off})
+    send(t, alice.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "alice's audio after unmuting", func() bool { return len(received(bob.memConn, "audio-chunk", "alice")) == 1 })
+    if got := states(bob); len(got) != 3 || got[2] != (MuteState{Video: true}) {
+        t.Errorf("bob was told alice's states %+v, want a third with only video muted", got)
+    }
+    send(t, alice.memConn, Message{Type: "mute-state"})
+    waitFor(t, "an empty mute-state refused", func() bool { return len(errorsFor(alice, "mute-state")) > 0 })
+
+    // Leaving clears her state for whoever joins next
+    send(t, alice.memConn, Message{Type: "leave"})
+    room := h.room("mic")
+    waitFor(t, "alice's mutes cleared", func() bool { return room.client("alice") == nil && room.muteStates() == nil })
+    if got := snapshot(); len(got) != 2 || got["bob"] != (MuteState{}) || got["carol"] != (MuteState{}) {
+        t.Errorf("after alice left, participants has mutes %+v", got)
+    }
+}
+
+// hookEndpoint records the webhook deliveries it is sent, answering the
+// first fail of them 503 and holding any made while stall is set
+type hookEndpoint struct {
+    mu       sync.Mutex
+    events   []webhookEvent
+    unsigned int
+    fail     int
+    stall    chan struct{}
+    stalled  chan struct{}
+}
+
+func (e *hookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    body, _ := io.ReadAll(r.Body)
+    mac := hmac.New(sha256.New, []byte("s3cret"))
+    mac.Write(body)
+    var event webhookEvent
+    json.Unmarshal(body, &event)
+
+    e.mu.Lock()
+    if r.Header.Get("X-Webhook-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+        e.unsigned++
+    }
+    e.events = append(e.events, event)
+    stall, fail := e.stall, e.fail > 0
+    if fail {
+        e.fail--
+    }
+    e.mu.Unlock()
+
+    if stall != nil {
+        select {
+        case e.stalled <- struct{}{}:
+        default:
+        }
+        <-stall
+    }
+    if fail {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+}
+
+// got is the deliveries so far for one room, retries included
+func (e *hookEndpoint) got(room string) []webhookEvent {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+
+    var out []webhookEvent
+    for _, event := range e.events {
+        if event.Room == room {
+            out = append(out, event)
+        }
+    }
+    return out
+}
+
+func TestRoomLifecycleWebhooksAreSignedAndNeverStallTheHub(t *testing.T) {
+    endpoint := &hookEndpoint{stalled: make(chan struct{}, 1)}
+    srv := httptest.NewServer(endpoint)
+    t.Cleanup(srv.Close)
+    release := make(chan struct{})
+    var released sync.Once
+    unstall := func() { released.Do(func() { close(release) }) }
+    t.Cleanup(unstall) // Before srv.Close, which waits out held requests
+    sender, err := newWebhookSender(srv.URL, "s3cret")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go sender.run()
+    prev := webhooks
+    webhooks = sender
+    t.Cleanup(func() { webhooks = prev })
+    if _, err := newWebhookSender("ftp://hooks.example", ""); err == nil {
+        t.Error("a non-http WEBHOOK_URL was accepted")
+    }
+
+    h := startHub(t)
+    alice := joinAs(t, "hooks", "alice")
+    bob := joinAs(t, "hooks", "bob")
+    send(t, bob, Message{Type: "leave"})
+    waitFor(t, "bob to leave", func() bool { return h.room("hooks").size() == 1 })
+    alice.Close()
+    waitFor(t, "alice to leave", func() bool { return h.room("hooks").size() == 0 })
+    room := h.room("hooks")
+    room.withLock(func() { room.LastActivity = time.Now().Add(-roomTTL - time.Second) })
+    h.reapIdleRooms()
+    want := []webhookEvent{
+        {Event: "room-created", Room: "hooks"},
+        {Event: "first-participant-joined", Room: "hooks", Participant: "alice", Participants: 1},
+        {Event: "participant-left", Room: "hooks", Participant: "bob", Reason: "left", Participants: 1},
+        {Event: "participant-left", Room: "hooks", Participant: "alice", Reason: "disconnected"},
+        {Event: "room-destroyed", Room: "hooks", Reason: "idle"},
+    }
+    waitFor(t, "the room's events", func() bool { return len(endpoint.got("hooks")) == len(want) })
+    for i, event := range endpoint.got("hooks") {
+        if event.ID == "" || event.Timestamp == 0 {
+            t.Errorf("event %d has no id or timestamp: %+v", i, event)
+        }
+        event.ID, event.Timestamp = "", 0
+        if event != want[i] {
+            t.Errorf("event %d = %+v, want %+v", i, event, want[i])
+        }
+    }
+
+    // A 503 is retried with the same id, so the receiver can dedupe it
+    endpoint.mu.Lock()
+    endpoint.fail = 1
+    endpoint.mu.Unlock()
+    joinAs(t, "retry", "carol")
+    waitFor(t, "the retried events", func() bool { return len(endpoint.got("retry")) == 3 })
+    if got := endpoint.got("retry"); got[0].ID != got[1].ID || got[1].Event != "room-created" || got[2].ID == got[1].ID {
+        t.Errorf("a 503 then its events arrived as %+v, want room-created twice under one id", got)
+    }
+
+    // An endpoint that stops answering: the queue fills and sheds, the hub
+    // carries on
+    endpoint.mu.Lock()
+    endpoint.stall = release
+    endpoint.mu.Unlock()
+    sender.emit("room-created", "held", "", "", 0)
+    <-endpoint.stalled
+    for i := 0; i < webhookQueue; i++ {
+        sender.emit("room-created", "queued", "", "", 0)
+    }
+    start := time.Now()
+    dave := joinAs(t, "stuck", "dave")
+    erin := joinAs(t, "stuck", "erin")
+    send(t, dave, Message{Type: "typing-start"})
+    waitFor(t, "dave typing at erin", func() bool { return len(received(erin, "typing-start", "dave")) == 1 })
+    if took := time.Since(start); took > time.Second {
+        t.Errorf("the hub took %s to seat two and relay a message with the webhook stuck", took)
+    }
+    if got := atomic.LoadInt64(&sender.Dropped); got != 2 {
+        t.Errorf("Dropped = %d with the queue full, want the stuck room's 2 events", got)
+    }
+    if got := atomic.LoadInt64(&sender.Failed); got != 0 {
+        t.Errorf("Failed = %d, want 0", got)
+    }
+
+    // Once it answers again the backlog is delivered, every one signed
+    endpoint.mu.Lock()
+    endpoint.stall = nil
+    endpoint.mu.Unlock()
+    unstall()
+    waitFor(t, "the backlog delivered", func() bool { return len(endpoint.got("queued")) == webhookQueue })
+    endpoint.mu.Lock()
+    defer endpoint.mu.Unlock()
+    if endpoint.unsigned != 0 {
+        t.Errorf("%d deliveries without a valid X-Webhook-Signature", endpoint.unsigned)
+    }
+}
+
+// gateConn is a codeConn whose text writes each wait for a token on gate, so
+// a test decides how fast the client reads; closing it ends a waiting write
+type gateConn struct {
+    *codeConn
+    gate chan struct{}
+}
+
+func (c *gateConn) WriteMessage(messageType int, data []byte) error {
+    if messageType == websocket.TextMessage {
+        select {
+        case <-c.gate:
+        case <-c.closed:
+            return net.ErrClosed
+        }
+    }
+    return c.codeConn.WriteMessage(messageType, data)
+}
+
+func TestStuckSendQueueDisconnectsOnceItAgesOut(t *testing.T) {
+    h := NewHub()
+    room := &Room{ID: "zombie", Clients: make(map[string]*Client)}
+    h.Rooms[room.ID] = room
+    seat := func(id string) (*Client, *gateConn) {
+        conn := &gateConn{codeConn: &codeConn{tapConn: &tapConn{memConn: newMemConn(id)}}, gate: make(chan struct{})}
+        c := &Client{ID: id, Room: room.ID, Conn: conn, Send: make(chan []byte, 64), Hub: h, flushed: make(chan struct{})}
+        room.Clients[id] = c
+        go c.WritePump()
+        return c, conn
+    }
+    typing, _ := json.Marshal(Message{Type: "typing-start", From: "alice"})
+    // queue hands c another message once WritePump holds the last in a write
+    queue := func(c *Client, n int) {
+        t.Helper()
+        for i := 0; i < n; i++ {
+            c.Send <- typing
+        }
+        waitFor(t, c.ID+"'s pump to take a batch", func() bool { return len(c.Send) == 0 })
+    }
+    ageOut := 50 * time.Millisecond
+
+    // carol stops reading: her first message never finishes writing. bob
+    // reads slowly, so his queue is never empty but keeps moving.
+    carol, carolConn := seat("carol")
+    bob, bobConn := seat("bob")
+    queue(carol, 1)
+    queue(bob, 1)
+    for _, c := range []*Client{carol, bob} {
+        c.Send <- typing
+        c.Send <- typing
+    }
+    h.sweepBacklogs(ageOut)
+    // Each round bob reads until his pump has taken the queue, then one more
+    // message arrives
+    for round := 0; round < 3; round++ {
+        time.Sleep(ageOut)
+        waitFor(t, "bob's pump to take what was queued", func() bool {
+            select {
+            case bobConn.gate <- struct{}{}:
+            case <-time.After(time.Millisecond):
+            }
+            return len(bob.Send) == 0
+        })
+        bob.Send <- typing
+        if round == 0 {
+            // Turned off, nobody is removed however old the backlog
+            h.sweepBacklogs(0)
+            if room.client("carol") == nil {
+                t.Fatal("carol was removed with MAX_BACKLOG_AGE 0")
+            }
+        }
+        h.sweepBacklogs(ageOut)
+    }
+
+    if room.client("carol") != nil {
+        t.Fatalf("carol is still seated with %d messages queued for over %s", len(carol.Send), 3*ageOut)
+    }
+    if code, reason := carolConn.closedWith(t); code != CloseBacklog || reason != "backlog" {
+        t.Errorf("carol was closed with %d %q, want %d backlog", code, reason, CloseBacklog)
+    }
+    select {
+    case <-carolConn.closed:
+    case <-time.After(time.Second):
+        t.Error("carol's socket is still open, stuck in the write she stopped reading")
+    }
+    if got := atomic.LoadInt64(&h.BacklogDisconnects); got != 1 {
+        t.Errorf("BacklogDisconnects = %d, want 1", got)
+    }
+    if room.client("bob") != bob {
+        t.Error("bob was removed though his queue kept moving")
+    }
+
+    // The knob is read from the environment and refused below the sweep's 1s
+    t.Setenv("MAX_BACKLOG_AGE", "3s")
+    if cfg, err := loadConfig(""); err != nil {
+        t.Errorf("MAX_BACKLOG_AGE=3s: %v", err)
+    } else if cfg.MaxBacklogAge.Duration != 3*time.Second {
+        t.Errorf("MAX_BACKLOG_AGE=3s loaded as %s", cfg.MaxBacklogAge.Duration)
+    }
+    t.Setenv("MAX_BACKLOG_AGE", "200ms")
+    if _, err := loadConfig(""); err == nil || !strings.Contains(err.Error(), "maxBacklogAge") {
+        t.Errorf("MAX_BACKLOG_AGE=200ms: err = %v, want maxBacklogAge refused", err)
+    }
+}
+
+// binaryConn is a tapConn that can also be fed binary messages and keeps
+// the binary ones written to it
+type binaryConn struct {
+    *tapConn
+    binIn  chan []byte
+    binMu  sync.Mutex
+    binOut [][]byte
+}
+
+func (c *binaryConn) ReadMessage() (int, []byte, error) {
+    select {
+    case data := <-c.binIn:
+        return websocket.BinaryMessage, data, nil
+    case data := <-c.in:
+        if data == nil {
+            return 0, nil, io.EOF
+        }
+        return websocket.TextMessage, data, nil
+    case <-c.closed:
+        return 0, nil, io.EOF
+    }
+}
+
+func (c *binaryConn) WriteMessage(messageType int, data []byte) error {
+    if messageType == websocket.BinaryMessage {
+        c.binMu.Lock()
+        c.binOut = append(c.binOut, append([]byte(nil), data...))
+        c.binMu.Unlock()
+        return nil
+    }
+    return c.tapConn.WriteMessage(messageType, data)
+}
+
+func (c *binaryConn) NextWriter(messageType int) (io.WriteCloser, error) {
+    return &tapWriter{conn: c.tapConn, messageType: messageType}, nil
+}
+
+func (c *binaryConn) binary() [][]byte {
+    c.binMu.Lock()
+    defer c.binMu.Unlock()
+    return append([][]byte(nil), c.binOut...)
+}
+
+// directJoin connects a binaryConn that joins room as id offering direct media
+func directJoin(t *testing.T, room, id string) *binaryConn {
+    t.Helper()
+    conn := &binaryConn{tapConn: &tapConn{memConn: newMemConn(id)}, binIn: make(chan []byte, 16)}
+    go serveConn(conn, "test", "127.0.0.1", nil)
+    send(t, conn.memConn, Message{Type: "join", Room: room, ID: id, Direct: true})
+    waitFor(t, "an answer to "+id+"'s join", func() bool { return len(conn.got("welcome")) > 0 })
+    return conn
+}
+
+func TestTwoPartyRoomPipesBinaryUntilAThirdJoins(t *testing.T) {
+    h := startHub(t)
+    alice := directJoin(t, "pair", "alice")
+    bob := directJoin(t, "pair", "bob")
+    for _, pair := range [][2]*binaryConn{{alice, bob}, {bob, alice}} {
+        waitFor(t, "direct-start at "+pair[0].key, func() bool { return len(pair[0].got("direct-start")) == 1 })
+        if got := pair[0].got("direct-start")[0].Target; got != pair[1].key {
+            t.Errorf("%s was told to go direct with %q, want %s", pair[0].key, got, pair[1].key)
+        }
+    }
+
+    // Media goes to the peer byte for byte, never through the hub
+    audio, video := []byte{directAudio, 0, 1, 2, 3}, []byte{directVideo, 'R', 'I', 'F', 'F'}
+    piped, dropped := atomic.LoadInt64(&h.DirectMessages), atomic.LoadInt64(&h.DirectDropped)
+    alice.binIn <- audio
+    alice.binIn <- video
+    alice.binIn <- []byte{9, 9}
+    waitFor(t, "alice's media at bob", func() bool { return len(bob.binary()) == 2 })
+    if got := bob.binary(); !bytes.Equal(got[0], audio) || !bytes.Equal(got[1], video) {
+        t.Errorf("bob got %q, want alice's audio and video unchanged", got)
+    }
+    waitFor(t, "the unknown kind dropped", func() bool { return atomic.LoadInt64(&h.DirectDropped)-dropped == 1 })
+    if got := atomic.LoadInt64(&h.DirectMessages) - piped; got != 2 {
+        t.Errorf("DirectMessages went up by %d, want 2", got)
+    }
+
+    // Muting still holds: bob's camera off keeps his video from alice
+    on := true
+    muted := atomic.LoadInt64(&h.MutedDropped)
+    send(t, bob.memConn, Message{Type: "mute-state", Video: &on})
+    // A typing-stop after it means the hub has updated bob's route too
+    send(t, bob.memConn, Message{Type: "typing-start"})
+    send(t, bob.memConn, Message{Type: "typing-stop"})
+    waitFor(t, "bob's typing-stop at alice", func() bool { return len(received(alice.memConn, "typing-stop", "bob")) == 1 })
+    bob.binIn <- video
+    bob.binIn <- audio
+    waitFor(t, "bob's audio at alice", func() bool { return len(alice.binary()) == 1 })
+    if got := alice.binary()[0]; !bytes.Equal(got, audio) || atomic.LoadInt64(&h.MutedDropped)-muted != 1 {
+        t.Errorf("with bob's video muted alice got %q and MutedDropped went up by %d", got, atomic.LoadInt64(&h.MutedDropped)-muted)
+    }
+    if len(bob.got("direct-start")) != 1 {
+        t.Error("a mute restarted direct mode")
+    }
+
+    // A third participant ends it for both, and binary is dropped from then on
+    carol := tapJoin(t, "pair", "carol", Message{})
+    for _, conn := range []*binaryConn{alice, bob} {
+        waitFor(t, "direct-end at "+conn.key, func() bool { return len(conn.got("direct-end")) == 1 })
+        if got := conn.got("direct-end")[0].Text; got != "participant-joined" {
+            t.Errorf("%s's direct mode ended for %q, want participant-joined", conn.key, got)
+        }
+    }
+    dropped = atomic.LoadInt64(&h.DirectDropped)
+    alice.binIn <- audio
+    send(t, alice.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    for _, conn := range []*tapConn{bob.tapConn, carol} {
+        waitFor(t, "alice's JSON audio at "+conn.key, func() bool { return len(received(conn.memConn, "audio-chunk", "alice")) == 1 })
+    }
+    if got := len(bob.binary()); got != 2 || atomic.LoadInt64(&h.DirectDropped)-dropped != 1 {
+        t.Errorf("after direct-end bob holds %d binary messages and DirectDropped went up by %d, want 2 and 1", got, atomic.LoadInt64(&h.DirectDropped)-dropped)
+    }
+    if len(carol.got("direct-start")) != 0 {
+        t.Error("carol was offered direct mode in a room of three")
+    }
+
+    // Back to two, the pair goes direct again
+    send(t, carol.memConn, Message{Type: "leave"})
+    waitFor(t, "direct mode again", func() bool { return len(alice.got("direct-start")) == 2 && len(bob.got("direct-start")) == 2 })
+}
+
+func TestWelcomeDescribesTheRoomsMedia(t *testing.T) {
+    startHub(t)
+    media := func(room, mode string) *MediaProfile {
+        t.Helper()
+        conn := tapJoin(t, room, "alice", Message{Mode: mode})
+        welcome := conn.got("welcome")
+        if len(welcome) == 0 || welcome[0].Media == nil {
+            t.Fatalf("%s's welcome has no media profile", room)
+        }
+        return welcome[0].Media
+    }
+
+    got := media("plain", "")
+    want := &MediaProfile{Video: true, Transcoded: true, Codec: frameCodec.Name(), Accepts: []string{"jpeg", "png"}, Ladder: qualityLadder}
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("a plain room's media is %+v, want %+v", got, want)
+    }
+    if len(got.Ladder) == 0 {
+        t.Error("the welcome's ladder is empty")
+    }
+    if got := media("voice", "audio-only"); !reflect.DeepEqual(got, &MediaProfile{}) {
+        t.Errorf("an audio-only room's media is %+v, want no video and audio untouched", got)
+    }
+    if got := media("sealed", "e2ee"); !reflect.DeepEqual(got, &MediaProfile{Video: true}) {
+        t.Errorf("an e2ee room's media is %+v, want video relayed as sent", got)
+    }
+}
+
+func TestUplinkGovernorCapsAFloodButNotAudio(t *testing.T) {
+    if newUplinkGovernor(0, 64) != nil {
+        t.Error("UPLINK_KBPS 0 made a governor")
+    }
+    const kbps, audioKbps = 400, 64
+    g := newUplinkGovernor(kbps, audioKbps)
+
+    // Four pumps flood video as fast as it is admitted while one sends
+    // 64 kbps of audio, all on the real clock
+    var refused, audio, video atomic.Int64
+    stop := make(chan struct{})
+    var wg sync.WaitGroup
+    for i := 0; i < 4; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for {
+                select {
+                case <-stop:
+                    return
+                default:
+                }
+                if g.takeVideo(1500, time.Now()) {
+                    video.Add(1500)
+                } else {
+                    refused.Add(1)
+                    time.Sleep(time.Millisecond)
+                }
+            }
+        }()
+    }
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        tick := time.NewTicker(20 * time.Millisecond)
+        defer tick.Stop()
+        for {
+            select {
+            case <-stop:
+                return
+            case <-tick.C:
+                g.charge(160, time.Now())
+                audio.Add(160)
+            }
+        }
+    }()
+    start := time.Now()
+    time.Sleep(time.Second)
+    close(stop)
+    wg.Wait()
+    elapsed := time.Since(start)
+
+    ceiling := float64(kbps)*1000/8*elapsed.Seconds() + g.burst
+    if sent := float64(atomic.LoadInt64(&g.Sent)); sent > ceiling {
+        t.Errorf("%.0f bytes went out in %s, over the %.0f UPLINK_KBPS allows", sent, elapsed, ceiling)
+    }
+    if got := atomic.LoadInt64(&g.Sent); got != video.Load()+audio.Load() {
+        t.Errorf("Sent = %d, want the %d of video and %d of audio charged", got, video.Load(), audio.Load())
+    }
+    if audio.Load() < 40*160 {
+        t.Errorf("only %d bytes of audio in %s", audio.Load(), elapsed)
+    }
+    // Video gets what the reserve leaves, and no more
+    if got := float64(video.Load()); got < 0.5*ceiling || refused.Load() == 0 || atomic.LoadInt64(&g.Dropped) != refused.Load() {
+        t.Errorf("the flood got %.0f of %.0f bytes through with %d frames refused and Dropped %d", got, ceiling, refused.Load(), atomic.LoadInt64(&g.Dropped))
+    }
+
+    // A drained bucket refuses video but still takes audio, going into debt
+    // no deeper than a burst
+    now := time.Now()
+    g.mu.Lock()
+    g.tokens, g.last = g.reserve, now
+    g.mu.Unlock()
+    if g.takeVideo(1, now) {
+        t.Error("video was let into the audio reserve")
+    }
+    for i := 0; i < 1000; i++ {
+        g.charge(1500, now)
+    }
+    if g.tokens != -g.burst {
+        t.Errorf("an audio spike left the bucket at %.0f, want the floor of %.0f", g.tokens, -g.burst)
+    }
+    if !g.takeVideo(1500, now.Add(2*uplinkBurst+uplinkBurst/4)) {
+        t.Error("video still refused once the debt was paid back")
+    }
+    // However long it was quiet, one burst at most goes out at once
+    later, frames := now.Add(time.Hour), 0
+    for g.takeVideo(1500, later) {
+        frames++
+    }
+    if limit := int((g.burst - g.reserve) / 1500); frames > limit {
+        t.Errorf("%d frames went out at once after an idle hour, want at most a burst's %d", frames, limit)
+    }
+
+    t.Setenv("UPLINK_KBPS", "64")
+    if _, err := loadConfig(""); err == nil || !strings.Contains(err.Error(), "uplinkAudioKbps") {
+        t.Errorf("an uplink no bigger than the audio reserve: err = %v", err)
+    }
+}
+
+func TestResumeRequestsKeyframesAndReplaysRoomState(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "resume", "alice", Message{})
+    bob := tapJoin(t, "resume", "bob", Message{})
+    carol := tapJoin(t, "resume", "carol", Message{})
+    asked := func(conn *tapConn, by string) int {
+        n := 0
+        for _, msg := range conn.got("keyframe-request") {
+            if msg.From == by {
+                n++
+            }
+        }
+        return n
+    }
+
+    // alice spotlights bob
+    spotlight := RoomLayout{Mode: "spotlight", SpotlightID: "bob"}
+    send(t, alice.memConn, Message{Type: "set-layout", Layout: &spotlight})
+    waitFor(t, "the layout at carol", func() bool { return len(carol.got("layout-changed")) == 1 })
+
+    // A plain rejoin replays nothing. carol then watches only alice.
+    requests := atomic.LoadInt64(&h.KeyframeRequests)
+    carol = tapJoin(t, "resume", "carol", Message{})
+    if len(carol.got("layout-changed")) != 0 || atomic.LoadInt64(&h.KeyframeRequests) != requests {
+        t.Error("a rejoin without resume replayed state")
+    }
+    send(t, carol.memConn, Message{Type: "subscribe-video", IDs: []string{"alice"}})
+    // Refused after the subscription, so it has been handled by the answer
+    send(t, carol.memConn, Message{Type: "keyframe-request", Target: "nobody"})
+    waitFor(t, "carol's subscription", func() bool { return len(errorsFor(carol, "keyframe-request")) > 0 })
+
+    // Resuming, alice is asked for a keyframe on carol's behalf; bob, whom
+    // she doesn't watch, is not
+    carol = tapJoin(t, "resume", "carol", Message{Resume: true})
+    waitFor(t, "alice asked for a keyframe", func() bool { return asked(alice, "carol") == 1 })
+    waitFor(t, "carol's replayed state", func() bool { return len(carol.got("fps-limit")) > 0 })
+    if got := carol.got("layout-changed"); len(got) != 1 || got[0].Layout == nil || *got[0].Layout != spotlight {
+        t.Errorf("carol resumed with layouts %+v, want bob's spotlight", got)
+    }
+    if got := carol.got("fps-limit")[0].MaxFPS; got != maxSenderFPS(3) {
+        t.Errorf("carol resumed with an fps cap of %d, want %d for three senders", got, maxSenderFPS(3))
+    }
+    if asked(bob, "carol") != 0 {
+        t.Error("bob was asked for a keyframe for a receiver not subscribed to him")
+    }
+    if got := atomic.LoadInt64(&h.KeyframeRequests) - requests; got != 1 {
+        t.Errorf("KeyframeRequests went up by %d, want 1", got)
+    }
+
+    // Receivers can ask a source directly too
+    send(t, bob.memConn, Message{Type: "keyframe-request", Target: "alice"})
+    send(t, bob.memConn, Message{Type: "keyframe-request", Target: "dave"})
+    waitFor(t, "bob's request at alice", func() bool { return asked(alice, "bob") == 1 })
+    waitFor(t, "bob's request for nobody refused", func() bool { return len(errorsFor(bob, "keyframe-request")) > 0 })
+    if got := errorsFor(bob, "keyframe-request"); got[0] != ErrNoTarget {
+        t.Errorf("a keyframe-request for nobody got %q, want %q", got, ErrNoTarget)
+    }
+}
+
+func TestSanitizeDisplayName(t *testing.T) {
+    for in, want := range map[string]string{
+        "  Ada \t\n Lovelace  ":      "Ada Lovelace",
+        "\u202eevil\u200b":           "evil",
+        "bad\xffutf\x00":             "badutf",
+        "🎉 party":                    "🎉 party",
+        strings.Repeat("é", 100):     strings.Repeat("é", maxDisplayName),
+        strings.Repeat("x", 63) + " y": strings.Repeat("x", 63),
+        "\n\t ":                      "",
+    } {
+        if got := sanitizeDisplayName(in); got != want {
+            t.Errorf("sanitizeDisplayName(%q) = %q, want %q", in, got, want)
+        }
+    }
+}
+
+func TestDisplayNamesReachPeersAndLateJoiners(t *testing.T) {
+    startHub(t)
+    alice := tapJoin(t, "names", "alice", Message{DisplayName: " Alice\u0007  Smith "})
+    tapJoin(t, "names", "bob", Message{DisplayName: "Bob"})
+    joined := func(conn *tapConn, from string) []string {
+        var names []string
+        for _, msg := range conn.got("participant-joined") {
+            if msg.From == from {
+                names = append(names, msg.DisplayName)
+            }
+        }
+        return names
+    }
+
+    waitFor(t, "bob's join at alice", func() bool { return len(joined(alice, "bob")) == 1 })
+    if got := joined(alice, "bob"); got[0] != "Bob" {
+        t.Errorf("alice was told bob joined as %q", got[0])
+    }
+    carol := tapJoin(t, "names", "carol", Message{})
+    want := map[string]string{"alice": "Alice Smith", "bob": "Bob"}
+    if got := carol.got("welcome")[0].Names; !reflect.DeepEqual(got, want) {
+        t.Errorf("a late joiner was welcomed with names %q, want %q", got, want)
+    }
+
+    req := httptest.NewRequest(http.MethodGet, "/rooms/names/participants", nil)
+    req.SetPathValue("name", "names")
+    rec := httptest.NewRecorder()
+    handleParticipants(rec, req)
+    var snapshot struct {
+        Participants []struct {
+            ID          string
+            DisplayName string
+        }
+    }
+    if err := json.Unmarshal(rec.Body.Bytes(), &snapshot); err != nil {
+        t.Fatalf("%v: %s", err, rec.Body)
+    }
+    for _, p := range snapshot.Participants {
+        if p.DisplayName != want[p.ID] {
+            t.Errorf("participants has %s as %q, want %q", p.ID, p.DisplayName, want[p.ID])
+        }
+    }
+
+    // A rejoin is announced again only if the name changed
+    tapJoin(t, "names", "bob", Message{DisplayName: "Bob"})
+    tapJoin(t, "names", "bob", Message{DisplayName: "Robert"})
+    waitFor(t, "bob's new name at carol", func() bool { return len(joined(carol, "bob")) == 1 })
+    if got := joined(alice, "bob"); !reflect.DeepEqual(got, []string{"Bob", "Robert"}) {
+        t.Errorf("alice was told bob joined as %q, want Bob then Robert", got)
+    }
+    if got := joined(carol, "bob"); got[0] != "Robert" {
+        t.Errorf("carol was told bob rejoined as %q", got[0])
+    }
+}
+
+func TestEchoRoomReturnsOwnMediaAndOthersNever(t *testing.T) {
+    h := startHub(t)
+    alice := tapJoin(t, "check", "alice", Message{Mode: "echo"})
+    if got := alice.got("welcome")[0].EchoDelayMs; got != echoDelay.Milliseconds() {
+        t.Errorf("alice's echo test was welcomed with a %dms delay, want %s", got, echoDelay)
+    }
+    // Naming someone's echo room gets a join its own, not theirs
+    mallory := tapJoin(t, echoRoomPrefix+"alice", "mallory", Message{})
+    for _, id := range []string{"alice", "mallory"} {
+        room := h.room(echoRoomPrefix + id)
+        if room == nil || room.client(id) == nil || room.size() != 1 {
+            t.Fatalf("%s is not alone in %s", id, echoRoomPrefix+id)
+        }
+    }
+
+    echoed := atomic.LoadInt64(&h.Echoed)
+    start := time.Now()
+    send(t, alice.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    send(t, alice.memConn, videoFrame(t, 64, 48))
+    waitFor(t, "alice's media back", func() bool {
+        return len(received(alice.memConn, "audio-chunk", "alice")) == 1 && len(received(alice.memConn, "video-frame", "alice")) == 1
+    })
+    if took := time.Since(start); took < echoDelay {
+        t.Errorf("alice's media came back after %s, want at least the %s echo delay", took, echoDelay)
+    }
+    if got := atomic.LoadInt64(&h.Echoed) - echoed; got != 2 {
+        t.Errorf("Echoed went up by %d, want 2", got)
+    }
+    if n := len(received(mallory.memConn, "audio-chunk", "alice")) + len(received(mallory.memConn, "video-frame", "alice")); n != 0 {
+        t.Errorf("mallory got %d of alice's echoes", n)
+    }
+
+    // An ordinary room never sends a sender its own media
+    carol := tapJoin(t, "plain", "carol", Message{})
+    dave := tapJoin(t, "plain", "dave", Message{})
+    if carol.got("welcome")[0].EchoDelayMs != 0 {
+        t.Error("an ordinary room's welcome has an echo delay")
+    }
+    send(t, carol.memConn, Message{Type: "audio-chunk", Data: "AAAA"})
+    send(t, carol.memConn, videoFrame(t, 64, 48))
+    waitFor(t, "carol's media at dave", func() bool {
+        return len(received(dave.memConn, "audio-chunk", "carol")) == 1 && len(received(dave.memConn, "video-frame", "carol")) == 1
+    })
+    time.Sleep(echoDelay + 100*time.Millisecond)
+    if n := len(received(carol.memConn, "audio-chunk", "carol")) + len(received(carol.memConn, "video-frame", "carol")); n != 0 {
+        t.Errorf("carol got %d of her own messages back in an ordinary room", n)
+    }
+}
+
+// recordingSink keeps what the hub reports, as a test's MetricsSink
+type recordingSink struct {
+    mu      sync.Mutex
+    counts  map[string]int64
+    timings map[string]int
+}
+
+func (s *recordingSink) Count(name string, delta int64) {
+    s.mu.Lock()
+    s.counts[name] += delta
+    s.mu.Unlock()
+}
+
+func (s *recordingSink) Gauge(string, float64) {}
+
+func (s *recordingSink) Timing(name string, d time.Duration) {
+    s.mu.Lock()
+    s.timings[name]++
+    s.mu.Unlock()
+}
+
+func (s *recordingSink) count(name string) int64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.counts[name]
+}
+
+func TestStatsdSinkWritesLinesAndTheHubReportsThroughIt(t *testing.T) {
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pc.Close()
+    t.Setenv("STATSD_ADDR", pc.LocalAddr().String())
+    sink, err := newMetricsSink("statsd", "conference.")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // lines reads datagrams until n lines have come in
+    lines := func(n int) (got []string, packets int) {
+        buf := make([]byte, 64<<10)
+        for len(got) < n {
+            pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+            size, _, err := pc.ReadFrom(buf)
+            if err != nil {
+                t.Fatalf("after %d of %d lines: %v", len(got), n, err)
+            }
+            if size > statsdPacket {
+                t.Errorf("a %d byte datagram, over the %d limit", size, statsdPacket)
+            }
+            got = append(got, strings.Split(string(buf[:size]), "\n")...)
+            packets++
+        }
+        return got, packets
+    }
+
+    sink.Count("clients.joined", 1)
+    if got, _ := lines(1); len(got) != 1 || got[0] != "conference.clients.joined:1|c" {
+        t.Errorf("a counter increment was sent as %q, want conference.clients.joined:1|c", got)
+    }
+    sink.Gauge("rooms", 2.5)
+    sink.Timing("broadcast", 1500*time.Microsecond)
+    sink.Count("messages.audio-chunk", 3)
+    want := []string{"conference.rooms:2.5|g", "conference.broadcast:1.5|ms", "conference.messages.audio-chunk:3|c"}
+    if got, _ := lines(len(want)); !reflect.DeepEqual(got, want) {
+        t.Errorf("a gauge, timing and count were sent as %q, want %q", got, want)
+    }
+
+    // A burst is packed into datagrams that fit, no line split between two
+    for i := 0; i < 200; i++ {
+        sink.Count(fmt.Sprintf("burst.%03d", i), 1)
+    }
+    got, packets := lines(200)
+    for i, line := range got {
+        if want := fmt.Sprintf("conference.burst.%03d:1|c", i); line != want {
+            t.Fatalf("burst line %d = %q, want %q", i, line, want)
+        }
+    }
+    if packets < 2 || packets > 10 {
+        t.Errorf("200 lines went out in %d datagrams", packets)
+    }
+
+    if _, err := newMetricsSink("graphite", ""); err == nil {
+        t.Error("an unknown METRICS_SINK was accepted")
+    }
+    t.Setenv("OTLP_ENDPOINT", "collector:4318")
+    if _, err := newMetricsSink("otlp", ""); err == nil {
+        t.Error("an OTLP_ENDPOINT that isn't an http URL was accepted")
+    }
+
+    // The hub reports its lifecycle and broadcasts through whichever sink
+    rec := &recordingSink{counts: make(map[string]int64), timings: make(map[string]int)}
+    h := NewHub()
+    h.metrics = rec
+    hub = h
+    go h.Run()
+    alice := joinAs(t, "metered", "alice")
+    bob := joinAs(t, "metered", "bob")
+    send(t, alice, Message{Type: "audio-chunk", Data: "AAAA"})
+    waitFor(t, "alice's audio at bob", func() bool { return len(received(bob, "audio-chunk", "alice")) == 1 })
+    send(t, bob, Message{Type: "leave"})
+    waitFor(t, "bob to leave", func() bool { return h.room("metered").size() == 1 })
+    alice.Close()
+    waitFor(t, "alice to leave", func() bool { return h.room("metered").size() == 0 })
+    room := h.room("metered")
+    room.withLock(func() { room.LastActivity = time.Now().Add(-roomTTL - time.Second) })
+    h.reapIdleRooms()
+    for name, want := range map[string]int64{
+        "rooms.created": 1, "clients.joined": 2, "messages.audio-chunk": 1, "clients.left": 2, "rooms.destroyed": 1,
+    } {
+        if got := rec.count(name); got != want {
+            t.Errorf("%s = %d, want %d", name, got, want)
+        }
+    }
+    rec.mu.Lock()
+    defer rec.mu.Unlock()
+    if rec.timings["broadcast"] == 0 {
+        t.Error("no broadcast timing was reported")
+    }
+}
+
+func TestRoundRobinKeepsReceiversEvenWhateverTheSenders(t *testing.T) {
+    room := encodeRoom(6)
+    frames := make(map[string]int)
+    bytesServed := make(map[string]int64)
+    distribute := func(from string, size int) {
+        receivers := make([]*Client, 0, len(room.Clients))
+        for id, client := range room.Clients {
+            if id != from {
+                receivers = append(receivers, client)
+            }
+        }
+        for _, client := range (roundRobinStrategy{}).Select(room, from, receivers, len(room.Clients)) {
+            room.serveVideo(client.ID, size)
+            frames[client.ID]++
+            bytesServed[client.ID] += int64(size)
+        }
+    }
+    spread := func(counts map[string]int) (least, most int) {
+        least = -1
+        for id := range room.Clients {
+            if least < 0 || counts[id] < least {
+                least = counts[id]
+            }
+            most = max(most, counts[id])
+        }
+        return least, most
+    }
+
+    // user0 sends half the frames, user1 and user2 the rest, at mixed sizes
+    const maxFrame = 8000
+    rng := rand.New(rand.NewSource(1))
+    for i := 0; i < 3000; i++ {
+        from := "user0"
+        if i%2 == 1 {
+            from = fmt.Sprintf("user%d", 1+rng.Intn(2))
+        }
+        distribute(from, 1000+rng.Intn(maxFrame-1000))
+    }
+    least, most := spread(frames)
+    if most-least > most/10 {
+        t.Errorf("over 3000 frames receivers got between %d and %d, want within 10%%: %v", least, most, frames)
+    }
+    var lo, hi int64 = -1, 0
+    for _, n := range bytesServed {
+        if lo < 0 || n < lo {
+            lo = n
+        }
+        hi = max(hi, n)
+    }
+    if hi-lo > 2*maxFrame {
+        t.Errorf("receivers were served between %d and %d bytes, want within two frames", lo, hi)
+    }
+
+    // A newcomer starts level with the least served rather than owed the
+    // whole history
+    room.Clients["user6"] = &Client{ID: "user6", Room: room.ID}
+    frames = make(map[string]int)
+    for i := 0; i < 70; i++ {
+        distribute("user1", 1000)
+    }
+    others := 0
+    for id, n := range frames {
+        if id != "user6" {
+            others = max(others, n)
+        }
+    }
+    if frames["user6"] > others {
+        t.Errorf("user6 got %d of the 70 frames after joining, more than anyone already there: %v", frames["user6"], frames)
+    }
+
+    // One left unserved for long catches up within videoCredit, not all of it
+    top := int64(0)
+    for _, served := range room.VideoServed {
+        top = max(top, served)
+    }
+    room.VideoServed["user3"] = top - 10*videoCredit
+    room.fairShare([]*Client{room.Clients["user3"], room.Clients["user4"]})
+    if got := room.VideoServed["user3"]; got != top-videoCredit {
+        t.Errorf("a long-unserved receiver is %d bytes behind, want videoCredit (%d)", top-got, videoCredit)
+    }
+}
+
+func TestSourceEventsFollowASendersVideo(t *testing.T) {
+    h := startHub(t)
+    alice := joinAs(t, "sources", "alice")
+    bob := tapJoin(t, "sources", "bob", Message{})
+    carol := joinAs(t, "sources", "carol")
+    events := func(kind string) []string {
+        var got []string
+        for _, msg := range bob.got(kind) {
+            got = append(got, msg.SourceID+" "+msg.Text)
+        }
+        return got
+    }
+    // barrier waits until bob has everything a sender sent before it
+    barrier := func(conn *memConn, id string) {
+        t.Helper()
+        sent := len(received(bob.memConn, "typing-stop", id))
+        send(t, conn, Message{Type: "typing-start"})
+        send(t, conn, Message{Type: "typing-stop"})
+        waitFor(t, id+"'s barrier", func() bool { return len(received(bob.memConn, "typing-stop", id)) > sent })
+    }
+
+    for i := 0; i < 3; i++ {
+        send(t, alice, videoFrame(t, 64, 48))
+        time.Sleep(time.Second / time.Duration(maxSenderFPS(3)))
+    }
+    barrier(alice, "alice")
+    if got := atomic.LoadInt64(&h.ThrottledFrames); got != 0 {
+        t.Fatalf("%d of alice's frames were throttled", got)
+    }
+    if got := events("source-started"); !reflect.DeepEqual(got, []string{"alice "}) {
+        t.Errorf("three frames from alice announced %q, want alice starting once", got)
+    }
+    if received(alice, "source-started", "") != nil {
+        t.Error("alice was told her own source started")
+    }
+
+    // Frames stopping for sourceIdleAfter end it, and the next starts it again
+    room := h.room("sources")
+    sender := room.client("alice")
+    sender.mu.Lock()
+    sender.LastVideoAccepted = time.Now().Add(-sourceIdleAfter)
+    sender.mu.Unlock()
+    waitFor(t, "alice's source to idle", func() bool { return len(bob.got("source-ended")) == 1 })
+    send(t, alice, videoFrame(t, 64, 48))
+    waitFor(t, "alice's source again", func() bool { return len(bob.got("source-started")) == 2 })
+
+    // A reconnect keeps the source going; leaving ends it, and a participant
+    // who never sent video leaves without one
+    send(t, carol, videoFrame(t, 64, 48))
+    waitFor(t, "carol's source", func() bool { return len(bob.got("source-started")) == 3 })
+    carol = joinAs(t, "sources", "carol")
+    barrier(carol, "carol")
+    send(t, carol, Message{Type: "leave"})
+    waitFor(t, "carol to leave", func() bool { return room.size() == 2 })
+    send(t, alice, Message{Type: "leave"})
+    waitFor(t, "alice to leave", func() bool { return room.size() == 1 })
+    dave := joinAs(t, "sources", "dave")
+    send(t, dave, Message{Type: "leave"})
+    waitFor(t, "dave to leave", func() bool { return len(bob.got("participant-left")) == 3 })
+    want := map[string][]string{
+        "source-started": {"alice ", "alice ", "carol "},
+        "source-ended":   {"alice idle", "carol left", "alice left"},
+    }
+    for kind, want := range want {
+        if got := events(kind); !reflect.DeepEqual(got, want) {
+            t.Errorf("bob was sent %s %q, want %q", kind, got, want)
+        }
+    }
+}
@@ -0,0 +1,59 @@
+// Package framecodec holds the encoders the conference servers relay video
+// frames with, picked by VIDEO_CODEC. WebP needs cgo (see webpcodec), so
+// builds without it get JPEG whatever was asked, and the frames'
+// compressionType says so.
+package framecodec
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+
+	"conference/webpcodec"
+)
+
+// Codec encodes a decoded frame for relay; quality is 0-100
+type Codec interface {
+	Name() string
+	Encode(img image.Image, quality float32) ([]byte, error)
+}
+
+// WebP encodes at an Effort (libwebp method) from webpcodec.MinEffort,
+// fastest and largest, to webpcodec.MaxEffort, slowest and smallest
+type WebP struct {
+	Effort int
+}
+
+func (WebP) Name() string { return "webp" }
+
+func (c WebP) Encode(img image.Image, quality float32) ([]byte, error) {
+	return webpcodec.Encode(img, quality, c.Effort)
+}
+
+// JPEG is larger on the wire but much cheaper to encode on small hosts
+type JPEG struct{}
+
+func (JPEG) Name() string { return "jpeg" }
+
+func (JPEG) Encode(img image.Image, quality float32) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: int(quality)}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// New returns the codec called name, webp or jpeg; effort only applies to
+// webp. Any other name gets webp, and ok is false so the caller can say so.
+func New(name string, effort int) (codec Codec, ok bool) {
+	switch name {
+	case "", "webp":
+		ok = true
+	case "jpeg":
+		return JPEG{}, true
+	}
+	if !webpcodec.Available {
+		return JPEG{}, ok
+	}
+	return WebP{Effort: effort}, ok
+}
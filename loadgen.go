@@ -0,0 +1,277 @@
+package main
+
+// Synthetic load generator: ramps simulated participants into one room until
+// the measured video drop rate crosses a threshold, then reports the largest
+// participant count the server sustained. The room is created with
+// dropStrategy "all", so the server means every frame for every receiver and
+// a frame that doesn't arrive was refused or lost, never skipped by design.
+//
+//   go run loadgen.go -url ws://localhost:3001/ws -max 20 -step 2 -interval 10s
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "math"
+    "math/rand"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "conference/synthmedia"
+
+    "github.com/gorilla/websocket"
+)
+
+// Message types matching the conference server
+type Message struct {
+    Type      string `json:"type"`
+    ID        string `json:"id,omitempty"`
+    Room      string `json:"room,omitempty"`
+    From      string `json:"from,omitempty"`
+    Data      string `json:"data,omitempty"`
+    Timestamp int64  `json:"timestamp,omitempty"`
+    Seq       int    `json:"seq,omitempty"`
+
+    DropStrategy string `json:"dropStrategy,omitempty"`
+}
+
+// LoadClient is a simulated participant sending synthetic media
+type LoadClient struct {
+    ID          string
+    WS          *websocket.Conn
+
+    // Test data
+    VideoFrames [][]byte
+    AudioChunks [][]byte
+
+    // Tracking, reset at the start of each ramp step
+    FramesSent     int64
+    FramesReceived int64
+    AudioSent      int64
+    AudioReceived  int64
+
+    done chan struct{}
+    mu   sync.Mutex // Serialises writes to WS
+}
+
+func main() {
+    serverURL := flag.String("url", "ws://localhost:3001/ws", "conference server WebSocket URL")
+    room := flag.String("room", fmt.Sprintf("loadgen-%d", time.Now().Unix()), "room to load")
+    start := flag.Int("start", 2, "initial participant count")
+    step := flag.Int("step", 1, "participants added per step")
+    max := flag.Int("max", 20, "stop after this many participants")
+    interval := flag.Duration("interval", 10*time.Second, "measurement window per step")
+    threshold := flag.Float64("drop-threshold", 5, "max acceptable video drop rate (%)")
+    fps := flag.Int("fps", 10, "video frames per second per participant")
+    resolution := flag.String("resolution", "160x120", "synthetic frame resolution")
+    profile := flag.String("profile", "solid", "frame content: one of "+strings.Join(synthmedia.Profiles, ", "))
+    csvPath := flag.String("csv", "loadgen.csv", "CSV output path")
+    flag.Parse()
+    if !synthmedia.ValidProfile(*profile) {
+        log.Fatalf("unknown frame profile %q, want one of %s", *profile, strings.Join(synthmedia.Profiles, ", "))
+    }
+
+    csv, err := os.Create(*csvPath)
+    if err != nil {
+        log.Fatal("Failed to create CSV: ", err)
+    }
+    defer csv.Close()
+    fmt.Fprintln(csv, "participants,video_drop_rate,audio_drop_rate,video_sent,video_received")
+
+    fmt.Println("📈 Conference Load Generator")
+    fmt.Printf("   Target: %s (room %s), ramp %d→%d step %d every %s\n\n",
+        *serverURL, *room, *start, *max, *step, *interval)
+
+    var clients []*LoadClient
+    defer func() {
+        for _, c := range clients {
+            c.Close()
+        }
+    }()
+
+    maxSustained := 0
+
+ramp:
+    for n := *start; n <= *max; n += *step {
+        for len(clients) < n {
+            c := &LoadClient{
+                ID:   fmt.Sprintf("load-%d", len(clients)+1),
+                done: make(chan struct{}),
+            }
+            c.generateTestData(*resolution, *profile, *fps, rand.New(rand.NewSource(int64(len(clients)+1))))
+
+            if err := c.Connect(*serverURL, *room); err != nil {
+                log.Printf("Client %s failed to connect: %v", c.ID, err)
+                break ramp
+            }
+            clients = append(clients, c)
+
+            go c.receiveLoop()
+            go c.sendLoop(*fps)
+        }
+
+        for _, c := range clients {
+            c.resetCounters()
+        }
+        time.Sleep(*interval)
+
+        videoDrop, audioDrop, sent, received := measure(clients)
+        fmt.Fprintf(csv, "%d,%.2f,%.2f,%d,%d\n", n, videoDrop, audioDrop, sent, received)
+        fmt.Printf("   %3d participants: video drop %.1f%%, audio drop %.1f%%\n", n, videoDrop, audioDrop)
+
+        if videoDrop > *threshold {
+            fmt.Printf("   ⚠️  Drop rate above %.1f%%, stopping ramp\n", *threshold)
+            break
+        }
+        maxSustained = n
+    }
+
+    fmt.Printf("\n✅ Maximum sustainable participants: %d\n", maxSustained)
+    fmt.Printf("📊 Results written to %s\n", *csvPath)
+}
+
+// measure compares what every receiver should have seen against what
+// arrived; with dropStrategy "all" that's every frame sent
+func measure(clients []*LoadClient) (videoDrop, audioDrop float64, videoSent, videoReceived int64) {
+    receivers := int64(len(clients) - 1)
+    if receivers <= 0 {
+        return 0, 0, 0, 0
+    }
+
+    var audioSent, audioReceived int64
+    for _, c := range clients {
+        videoSent += atomic.LoadInt64(&c.FramesSent)
+        videoReceived += atomic.LoadInt64(&c.FramesReceived)
+        audioSent += atomic.LoadInt64(&c.AudioSent)
+        audioReceived += atomic.LoadInt64(&c.AudioReceived)
+    }
+
+    return dropRate(videoSent*receivers, videoReceived), dropRate(audioSent*receivers, audioReceived), videoSent, videoReceived
+}
+
+func dropRate(expected, received int64) float64 {
+    if expected == 0 {
+        return 0
+    }
+    rate := 100 * (1 - float64(received)/float64(expected))
+    return math.Max(rate, 0)
+}
+
+func (c *LoadClient) Connect(serverURL, room string) error {
+    conn, _, err := websocket.DefaultDialer.Dial(serverURL, nil)
+    if err != nil {
+        return err
+    }
+    c.WS = conn
+
+    return c.write(Message{Type: "join", ID: c.ID, Room: room, DropStrategy: "all"})
+}
+
+func (c *LoadClient) Close() {
+    close(c.done)
+    c.WS.Close()
+}
+
+func (c *LoadClient) resetCounters() {
+    atomic.StoreInt64(&c.FramesSent, 0)
+    atomic.StoreInt64(&c.FramesReceived, 0)
+    atomic.StoreInt64(&c.AudioSent, 0)
+    atomic.StoreInt64(&c.AudioReceived, 0)
+}
+
+func (c *LoadClient) write(msg Message) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    c.WS.SetWriteDeadline(time.Now().Add(10 * time.Second))
+    return c.WS.WriteJSON(msg)
+}
+
+// generateTestData renders one second of the KPI suite's frames, looped,
+// and its per-user tone
+func (c *LoadClient) generateTestData(resolution, profile string, fps int, r *rand.Rand) {
+    var width, height int
+    fmt.Sscanf(resolution, "%dx%d", &width, &height)
+    if width <= 0 || height <= 0 {
+        width, height = 160, 120
+    }
+    user := int(c.ID[len(c.ID)-1] - '0')
+
+    c.VideoFrames = make([][]byte, fps)
+    for i := range c.VideoFrames {
+        c.VideoFrames[i] = synthmedia.Frame(profile, width, height, i, user, r)
+    }
+
+    c.AudioChunks = make([][]byte, 50)
+    for i := range c.AudioChunks {
+        c.AudioChunks[i] = synthmedia.Tone(user, i)
+    }
+}
+
+func (c *LoadClient) sendLoop(fps int) {
+    videoTicker := time.NewTicker(time.Second / time.Duration(fps))
+    defer videoTicker.Stop()
+
+    // Audio always at 50 Hz (20ms)
+    audioTicker := time.NewTicker(20 * time.Millisecond)
+    defer audioTicker.Stop()
+
+    frame, chunk := 0, 0
+    for {
+        select {
+        case <-c.done:
+            return
+
+        case <-videoTicker.C:
+            msg := Message{
+                Type:      "video-frame",
+                Data:      base64.StdEncoding.EncodeToString(c.VideoFrames[frame%len(c.VideoFrames)]),
+                Timestamp: time.Now().UnixMilli(),
+                Seq:       frame,
+            }
+            if err := c.write(msg); err != nil {
+                return
+            }
+            frame++
+            atomic.AddInt64(&c.FramesSent, 1)
+
+        case <-audioTicker.C:
+            msg := Message{
+                Type:      "audio-chunk",
+                Data:      base64.StdEncoding.EncodeToString(c.AudioChunks[chunk%len(c.AudioChunks)]),
+                Timestamp: time.Now().UnixMilli(),
+                Seq:       chunk,
+            }
+            if err := c.write(msg); err != nil {
+                return
+            }
+            chunk++
+            atomic.AddInt64(&c.AudioSent, 1)
+        }
+    }
+}
+
+func (c *LoadClient) receiveLoop() {
+    for {
+        _, data, err := c.WS.ReadMessage()
+        if err != nil {
+            return
+        }
+
+        var msg Message
+        if err := json.Unmarshal(data, &msg); err != nil || msg.From == c.ID {
+            continue
+        }
+
+        switch msg.Type {
+        case "video-frame":
+            atomic.AddInt64(&c.FramesReceived, 1)
+        case "audio-chunk":
+            atomic.AddInt64(&c.AudioReceived, 1)
+        }
+    }
+}
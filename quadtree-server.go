@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"time"
@@ -26,6 +31,10 @@ type VideoPacket struct {
 	Quality   string       `json:"q"`  // quality level
 	UserID    string       `json:"userId,omitempty"`
 	Room      string       `json:"room,omitempty"`
+
+	// Set by the processor, never serialized: the sender should be sent a
+	// request-keyframe
+	KeyframeDue bool `json:"-"`
 }
 
 // AudioData represents audio samples with priority handling
@@ -42,6 +51,243 @@ type VideoData struct {
 	Height  int            `json:"h,omitempty"` // frame height
 }
 
+// Binary wire format, negotiated with "binary": true on join.
+//
+// Header (16 bytes, big endian):
+//
+//	version u8 | type u8 | flags u8 | reserved u8 | frame u32 | timestamp i64
+//
+// followed by quality, userId and room as u8-length strings, then:
+//
+//	audio (flagAudio):   samples u32 | len u32 | raw PCM
+//	video (flagVideo):   width u16 | height u16, then either
+//	  flagRegions:       count u32 | count x (x, y, w, h u16 | color u32)
+//	  otherwise:         len u32 | raw keyframe bytes
+//
+// Payloads travel as raw bytes instead of base64, and a delta region packs
+// into 12 bytes instead of a JSON object.
+const (
+	binaryPacketVersion = 1 // Never '{', so writers can tell binary from JSON
+	binaryHeaderSize    = 16
+
+	flagAudio   = 1 << 0
+	flagVideo   = 1 << 1
+	flagRegions = 1 << 2
+)
+
+// packetTypes maps VideoPacket.Type to its wire byte; "" is audio-only
+var packetTypes = []string{"", "key", "delta"}
+
+var errShortPacket = errors.New("binary packet truncated")
+
+// EncodeBinaryPacket serializes a packet in the binary wire format
+func EncodeBinaryPacket(p *VideoPacket) ([]byte, error) {
+	typ := -1
+	for i, name := range packetTypes {
+		if name == p.Type {
+			typ = i
+		}
+	}
+	if typ < 0 {
+		return nil, fmt.Errorf("packet type %q has no binary encoding", p.Type)
+	}
+
+	var audio, video []byte
+	var flags byte
+	if p.Audio != nil {
+		pcm, err := base64.StdEncoding.DecodeString(p.Audio.Data)
+		if err != nil {
+			return nil, fmt.Errorf("audio payload: %w", err)
+		}
+		audio = pcm
+		flags |= flagAudio
+	}
+	if p.Video != nil {
+		flags |= flagVideo
+		if p.Video.Regions != nil {
+			flags |= flagRegions
+		} else {
+			frame, err := base64.StdEncoding.DecodeString(p.Video.Data)
+			if err != nil {
+				return nil, fmt.Errorf("video payload: %w", err)
+			}
+			video = frame
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(binaryHeaderSize + len(audio) + len(video) + 64)
+
+	header := make([]byte, binaryHeaderSize)
+	header[0] = binaryPacketVersion
+	header[1] = byte(typ)
+	header[2] = flags
+	binary.BigEndian.PutUint32(header[4:], uint32(p.Frame))
+	binary.BigEndian.PutUint64(header[8:], uint64(p.Timestamp))
+	buf.Write(header)
+
+	for _, str := range []string{p.Quality, p.UserID, p.Room} {
+		if len(str) > 255 {
+			return nil, fmt.Errorf("string field %q longer than 255 bytes", str)
+		}
+		buf.WriteByte(byte(len(str)))
+		buf.WriteString(str)
+	}
+
+	if flags&flagAudio != 0 {
+		binary.Write(&buf, binary.BigEndian, uint32(p.Audio.Samples))
+		binary.Write(&buf, binary.BigEndian, uint32(len(audio)))
+		buf.Write(audio)
+	}
+
+	if flags&flagVideo != 0 {
+		binary.Write(&buf, binary.BigEndian, uint16(p.Video.Width))
+		binary.Write(&buf, binary.BigEndian, uint16(p.Video.Height))
+
+		if flags&flagRegions != 0 {
+			binary.Write(&buf, binary.BigEndian, uint32(len(p.Video.Regions)))
+			region := make([]byte, 12)
+			for _, r := range p.Video.Regions {
+				binary.BigEndian.PutUint16(region[0:], uint16(r.X))
+				binary.BigEndian.PutUint16(region[2:], uint16(r.Y))
+				binary.BigEndian.PutUint16(region[4:], uint16(r.W))
+				binary.BigEndian.PutUint16(region[6:], uint16(r.H))
+				binary.BigEndian.PutUint32(region[8:], uint32(r.Color))
+				buf.Write(region)
+			}
+		} else {
+			binary.Write(&buf, binary.BigEndian, uint32(len(video)))
+			buf.Write(video)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeBinaryPacket parses the binary wire format back into a packet
+func DecodeBinaryPacket(data []byte) (*VideoPacket, error) {
+	if len(data) < binaryHeaderSize {
+		return nil, errShortPacket
+	}
+	if data[0] != binaryPacketVersion {
+		return nil, fmt.Errorf("unsupported binary packet version %d", data[0])
+	}
+	if int(data[1]) >= len(packetTypes) {
+		return nil, fmt.Errorf("unknown binary packet type %d", data[1])
+	}
+
+	flags := data[2]
+	p := &VideoPacket{
+		Type:      packetTypes[data[1]],
+		Frame:     int(binary.BigEndian.Uint32(data[4:])),
+		Timestamp: int64(binary.BigEndian.Uint64(data[8:])),
+	}
+	rest := data[binaryHeaderSize:]
+
+	take := func(n int) ([]byte, error) {
+		if n < 0 || len(rest) < n {
+			return nil, errShortPacket
+		}
+		b := rest[:n]
+		rest = rest[n:]
+		return b, nil
+	}
+	takeString := func() (string, error) {
+		n, err := take(1)
+		if err != nil {
+			return "", err
+		}
+		b, err := take(int(n[0]))
+		return string(b), err
+	}
+	takeUint := func(size int) (uint32, error) {
+		b, err := take(size)
+		if err != nil {
+			return 0, err
+		}
+		if size == 2 {
+			return uint32(binary.BigEndian.Uint16(b)), nil
+		}
+		return binary.BigEndian.Uint32(b), nil
+	}
+
+	var err error
+	if p.Quality, err = takeString(); err != nil {
+		return nil, err
+	}
+	if p.UserID, err = takeString(); err != nil {
+		return nil, err
+	}
+	if p.Room, err = takeString(); err != nil {
+		return nil, err
+	}
+
+	if flags&flagAudio != 0 {
+		samples, err := takeUint(4)
+		if err != nil {
+			return nil, err
+		}
+		n, err := takeUint(4)
+		if err != nil {
+			return nil, err
+		}
+		pcm, err := take(int(n))
+		if err != nil {
+			return nil, err
+		}
+		p.Audio = &AudioData{
+			Data:    base64.StdEncoding.EncodeToString(pcm),
+			Samples: int(samples),
+		}
+	}
+
+	if flags&flagVideo != 0 {
+		width, err := takeUint(2)
+		if err != nil {
+			return nil, err
+		}
+		height, err := takeUint(2)
+		if err != nil {
+			return nil, err
+		}
+		p.Video = &VideoData{Width: int(width), Height: int(height)}
+
+		if flags&flagRegions != 0 {
+			count, err := takeUint(4)
+			if err != nil {
+				return nil, err
+			}
+			packed, err := take(int(count) * 12)
+			if err != nil {
+				return nil, err
+			}
+			p.Video.Regions = make([]DeltaRegion, count)
+			for i := range p.Video.Regions {
+				r := packed[i*12:]
+				p.Video.Regions[i] = DeltaRegion{
+					X:     int(binary.BigEndian.Uint16(r[0:])),
+					Y:     int(binary.BigEndian.Uint16(r[2:])),
+					W:     int(binary.BigEndian.Uint16(r[4:])),
+					H:     int(binary.BigEndian.Uint16(r[6:])),
+					Color: int(binary.BigEndian.Uint32(r[8:])),
+				}
+			}
+		} else {
+			n, err := takeUint(4)
+			if err != nil {
+				return nil, err
+			}
+			frame, err := take(int(n))
+			if err != nil {
+				return nil, err
+			}
+			p.Video.Data = base64.StdEncoding.EncodeToString(frame)
+		}
+	}
+
+	return p, nil
+}
+
 // FrameBuffer manages frame buffering and prioritization
 type FrameBuffer struct {
 	mu           sync.RWMutex
@@ -50,6 +296,12 @@ type FrameBuffer struct {
 	maxAudioSize int
 	maxVideoSize int
 	stats        BufferStats
+
+	// Keyframe refresh: deltas since the sender's last keyframe, and when
+	// one was last seen and last requested
+	lastKeyframe   time.Time
+	deltasSinceKey int
+	keyframeAsked  time.Time
 }
 
 // BufferStats tracks performance metrics
@@ -72,7 +324,37 @@ func NewFrameBuffer() *FrameBuffer {
 		stats: BufferStats{
 			LastUpdate: time.Now(),
 		},
+		lastKeyframe: time.Now(),
+	}
+}
+
+// trackKeyframe counts deltas since the last keyframe and reports whether
+// the sender should be asked for a new one. A request that goes unanswered
+// is repeated after keyframeRetry.
+func (fb *FrameBuffer) trackKeyframe(packet *VideoPacket, interval time.Duration, maxDeltas int) bool {
+	if packet.Video == nil {
+		return false
+	}
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+
+	now := time.Now()
+	if packet.Type == "key" {
+		fb.lastKeyframe = now
+		fb.deltasSinceKey = 0
+		fb.keyframeAsked = time.Time{}
+		return false
+	}
+
+	fb.deltasSinceKey++
+	stale := (maxDeltas > 0 && fb.deltasSinceKey >= maxDeltas) ||
+		(interval > 0 && now.Sub(fb.lastKeyframe) >= interval)
+	if !stale || now.Sub(fb.keyframeAsked) < keyframeRetry {
+		return false
 	}
+	fb.keyframeAsked = now
+	return true
 }
 
 // AddPacket adds a packet with audio priority
@@ -182,30 +464,42 @@ func (fb *FrameBuffer) calculatePacketSize(packet *VideoPacket) int64 {
 	return size
 }
 
+// How long a sender has to answer a keyframe request before it is repeated
+const keyframeRetry = time.Second
+
 // QuadTreeProcessor handles quad-tree codec processing
 type QuadTreeProcessor struct {
 	buffers map[string]*FrameBuffer // Per-user buffers
 	mu      sync.RWMutex
 	stats   ProcessorStats
+
+	// Bound delta drift: ask a sender for a keyframe after this long or
+	// this many deltas since its last one, whichever comes first (0 disables either)
+	KeyframeInterval  time.Duration
+	KeyframeMaxDeltas int
 }
 
 // ProcessorStats tracks overall performance
 type ProcessorStats struct {
-	TotalPackets    int64
-	ProcessingTime  time.Duration
-	AverageFPS      float64
-	AudioIntegrity  float64 // Percentage of audio preserved
-	BandwidthMbps   float64
+	TotalPackets     int64
+	ProcessingTime   time.Duration
+	AverageFPS       float64
+	AudioIntegrity   float64 // Percentage of audio preserved
+	BandwidthMbps    float64
+	KeyframeRequests int64
 }
 
 // NewQuadTreeProcessor creates a new processor
 func NewQuadTreeProcessor() *QuadTreeProcessor {
 	return &QuadTreeProcessor{
-		buffers: make(map[string]*FrameBuffer),
+		buffers:           make(map[string]*FrameBuffer),
+		KeyframeInterval:  10 * time.Second,
+		KeyframeMaxDeltas: 300,
 	}
 }
 
-// ProcessPacket processes incoming packet with audio priority
+// ProcessPacket processes incoming packet with audio priority. The packet's
+// Keyframe field is set when the sender is due for a keyframe.
 func (qp *QuadTreeProcessor) ProcessPacket(userID string, data []byte) (*VideoPacket, error) {
 	startTime := time.Now()
 	defer func() {
@@ -218,6 +512,26 @@ func (qp *QuadTreeProcessor) ProcessPacket(userID string, data []byte) (*VideoPa
 		return nil, err
 	}
 
+	return qp.processDecoded(userID, packet), nil
+}
+
+// ProcessBinaryPacket is ProcessPacket for the binary wire format
+func (qp *QuadTreeProcessor) ProcessBinaryPacket(userID string, data []byte) (*VideoPacket, error) {
+	startTime := time.Now()
+	defer func() {
+		qp.stats.ProcessingTime += time.Since(startTime)
+		qp.stats.TotalPackets++
+	}()
+
+	packet, err := DecodeBinaryPacket(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return qp.processDecoded(userID, *packet), nil
+}
+
+func (qp *QuadTreeProcessor) processDecoded(userID string, packet VideoPacket) *VideoPacket {
 	// Get or create user buffer
 	qp.mu.Lock()
 	buffer, exists := qp.buffers[userID]
@@ -227,11 +541,19 @@ func (qp *QuadTreeProcessor) ProcessPacket(userID string, data []byte) (*VideoPa
 	}
 	qp.mu.Unlock()
 
+	keyframeDue := buffer.trackKeyframe(&packet, qp.KeyframeInterval, qp.KeyframeMaxDeltas)
+
 	// Add packet to buffer with priority handling
 	buffer.AddPacket(packet)
 
 	// Get optimized packet for transmission
 	optimizedPacket := buffer.GetNextPacket()
+	optimizedPacket.KeyframeDue = keyframeDue
+	if keyframeDue {
+		qp.mu.Lock()
+		qp.stats.KeyframeRequests++
+		qp.mu.Unlock()
+	}
 	
 	// Update stats
 	stats := buffer.GetStats()
@@ -239,7 +561,7 @@ func (qp *QuadTreeProcessor) ProcessPacket(userID string, data []byte) (*VideoPa
 		qp.stats.AudioIntegrity = float64(stats.AudioPackets-stats.AudioDropped) / float64(stats.AudioPackets) * 100
 	}
 	
-	return optimizedPacket, nil
+	return optimizedPacket
 }
 
 // OptimizeForBandwidth adjusts quality based on available bandwidth
@@ -319,16 +641,12 @@ func HandleQuadTreeMessage(hub *Hub, client *Client, message []byte) {
 	// Set user info for routing
 	optimizedPacket.UserID = client.userId
 	optimizedPacket.Room = client.room
-
-	// Serialize optimized packet
-	data, err := json.Marshal(optimizedPacket)
-	if err != nil {
-		log.Printf("Error marshaling packet: %v", err)
-		return
+	if optimizedPacket.KeyframeDue {
+		client.requestKeyframe()
 	}
 
-	// Broadcast to room with audio priority
-	hub.broadcastToRoom(client.room, data, client)
+	// Broadcast to room with audio priority, in each client's negotiated format
+	hub.broadcastPacket(client.room, optimizedPacket, client)
 	
 	// Log stats periodically
 	stats := processor.GetStats()
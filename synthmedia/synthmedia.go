@@ -0,0 +1,155 @@
+// Package synthmedia renders the synthetic video frames and audio the KPI
+// suite and loadgen send, so both load a server with the same content.
+package synthmedia
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/rand"
+)
+
+// Audio is 20ms chunks of 16-bit mono PCM
+const (
+	SampleRate   = 48000
+	ChunkSamples = SampleRate / 50
+)
+
+// Profiles are the frame contents Frame renders. JPEG and WebP sizes depend
+// on what's in the picture far more than on its resolution, so a load test
+// is only as good as its content.
+var Profiles = []string{"solid", "noise", "gradient", "realistic-photo", "static-slide"}
+
+// ValidProfile reports whether name is one of Profiles
+func ValidProfile(name string) bool {
+	for _, p := range Profiles {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Frame renders frame i of a profile for user and returns it as JPEG. The
+// noise in every profile but static-slide comes from r, so a seeded r gives
+// the same frames each run.
+func Frame(profile string, width, height, i, user int, r *rand.Rand) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	switch profile {
+	case "noise":
+		// Every pixel random: the incompressible worst case
+		r.Read(img.Pix)
+		for p := 3; p < len(img.Pix); p += 4 {
+			img.Pix[p] = 255
+		}
+
+	case "gradient":
+		// Smooth diagonal color ramp drifting a little each frame
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				t := float64(x+y+i*2) / float64(width+height)
+				img.SetRGBA(x, y, color.RGBA{
+					R: uint8(127 + 127*math.Sin(2*math.Pi*t)),
+					G: uint8(127 + 127*math.Sin(2*math.Pi*(t+0.33))),
+					B: uint8(40 * user),
+					A: 255,
+				})
+			}
+		}
+
+	case "realistic-photo":
+		renderPhoto(img, i, user, r)
+
+	case "static-slide":
+		// White slide with dark text lines, the same every frame
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+		lineHeight := max(height/12, 3)
+		for y := lineHeight * 2; y+lineHeight < height-lineHeight; y += lineHeight * 2 {
+			indent := width / 10
+			if y == lineHeight*2 {
+				indent = width / 5 // Title
+			}
+			fill(img, image.Rect(indent, y, width-indent, y+lineHeight/2+1), color.RGBA{30, 30, 60, 255})
+		}
+
+	default: // solid
+		// The original content: user color, a bar growing with the frame
+		// number and sparse sensor noise
+		userColor := color.RGBA{
+			R: uint8(100 + user*50),
+			G: uint8(50 + user*30),
+			B: uint8(150),
+			A: 255,
+		}
+		draw.Draw(img, img.Bounds(), &image.Uniform{userColor}, image.Point{}, draw.Src)
+		fill(img, image.Rect(0, 0, i%width, height/10), color.White)
+		for n := 0; n < width*height/20; n++ {
+			level := uint8(r.Intn(256))
+			img.Set(r.Intn(width), r.Intn(height), color.RGBA{level, level, level, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, &jpeg.Options{Quality: 70})
+	return buf.Bytes()
+}
+
+// renderPhoto approximates a webcam shot: a lit wall with texture, a
+// head-and-shoulders subject that sways slightly, and per-pixel sensor noise
+func renderPhoto(img *image.RGBA, i, user int, r *rand.Rand) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	sway := 0.03 * math.Sin(float64(i)/10)
+	headX, headY := (0.5+sway)*float64(width), 0.4*float64(height)
+	headR := 0.18 * float64(height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x), float64(y)
+
+			// Wall: light falloff from the top left plus plaster texture
+			light := 1 - 0.5*(fx/float64(width)+fy/float64(height))/2
+			texture := 10 * math.Sin(fx*0.9+math.Sin(fy*0.7)*2) * math.Sin(fy*1.3)
+			cr, cg, cb := 190*light+texture, 175*light+texture, 150*light+texture
+
+			// Shoulders, then the head over them
+			dx, dy := fx-headX, fy-headY
+			switch {
+			case dx*dx+dy*dy < headR*headR:
+				shade := 1 - 0.4*(dx/headR)
+				cr, cg, cb = 200*shade, 150*shade, 120*shade
+			case fy > headY+headR*0.9 && math.Abs(dx) < headR*2.2-(fy-headY-headR)*0.2:
+				cr, cg, cb = float64(40+30*user), 60, float64(90+20*user)
+				cr += 12 * math.Sin(fx*1.7) // Fabric weave
+			}
+
+			noise := float64(r.Intn(17) - 8)
+			img.SetRGBA(x, y, color.RGBA{clamp8(cr + noise), clamp8(cg + noise), clamp8(cb + noise), 255})
+		}
+	}
+}
+
+func fill(img *image.RGBA, rect image.Rectangle, c color.Color) {
+	draw.Draw(img, rect, &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+func clamp8(v float64) uint8 {
+	return uint8(math.Max(0, math.Min(255, v)))
+}
+
+// Tone is chunk i of user's sine tone, 440Hz raised a tenth per user digit
+// so each participant is told apart by ear. Chunks carry on the phase, so
+// a looped run of them plays without clicks.
+func Tone(user, i int) []byte {
+	frequency := 440.0 * (1 + float64(user)/10)
+	chunk := make([]byte, ChunkSamples*2)
+	for j := 0; j < ChunkSamples; j++ {
+		t := float64(i*ChunkSamples+j) / SampleRate
+		sample := int16(32767 * math.Sin(2*math.Pi*frequency*t))
+		chunk[j*2] = byte(sample & 0xFF)
+		chunk[j*2+1] = byte(sample >> 8)
+	}
+	return chunk
+}
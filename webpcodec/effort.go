@@ -0,0 +1,17 @@
+// Package webpcodec encodes lossy WebP video frames at a chosen libwebp
+// effort. chai2010/webp wraps libwebp through cgo, so CGO_ENABLED=0 builds
+// get a stub whose Available is false and callers fall back to another codec.
+package webpcodec
+
+import "errors"
+
+// Efforts are libwebp methods: 0 is fastest and largest, 6 slowest and
+// smallest. DefaultEffort is libwebp's own, the only one webp.Encode uses.
+const (
+	MinEffort     = 0
+	MaxEffort     = 6
+	DefaultEffort = 4
+)
+
+// ErrUnavailable is Encode's error in builds without cgo
+var ErrUnavailable = errors.New("webp: encoder needs cgo, this build has none")
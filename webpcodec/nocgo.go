@@ -0,0 +1,13 @@
+//go:build !cgo
+
+package webpcodec
+
+import "image"
+
+// Available reports whether this build can encode WebP
+const Available = false
+
+// Encode always fails without cgo
+func Encode(img image.Image, quality float32, effort int) ([]byte, error) {
+	return nil, ErrUnavailable
+}
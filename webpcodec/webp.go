@@ -0,0 +1,139 @@
+//go:build cgo
+
+package webpcodec
+
+// webp.Options has no effort setting, and the package's simple encoder always
+// runs libwebp at method 4. encodeWebPMethod drives the advanced API of the
+// libwebp 1.4.0 that github.com/chai2010/webp v1.4.0 compiles in; the two
+// structs are declared from that version's encode.h (ABI 0x020f) so no
+// system headers are needed.
+
+/*
+#include <stdint.h>
+#include <stddef.h>
+#include <string.h>
+
+typedef struct {
+    int lossless; float quality; int method; int image_hint;
+    int target_size; float target_PSNR; int segments; int sns_strength;
+    int filter_strength; int filter_sharpness; int filter_type; int autofilter;
+    int alpha_compression; int alpha_filtering; int alpha_quality; int pass;
+    int show_compressed; int preprocessing; int partitions; int partition_limit;
+    int emulate_jpeg_size; int thread_level; int low_memory; int near_lossless;
+    int exact; int use_delta_palette; int use_sharp_yuv; int qmin; int qmax;
+} WebPConfig;
+
+typedef struct {
+    uint8_t* mem; size_t size; size_t max_size; uint32_t pad[1];
+} WebPMemoryWriter;
+
+typedef struct WebPPicture WebPPicture;
+typedef int (*WebPWriterFunction)(const uint8_t* data, size_t data_size, const WebPPicture* picture);
+
+struct WebPPicture {
+    int use_argb; int colorspace; int width, height;
+    uint8_t *y, *u, *v; int y_stride, uv_stride; uint8_t* a; int a_stride; uint32_t pad1[2];
+    uint32_t* argb; int argb_stride; uint32_t pad2[3];
+    WebPWriterFunction writer; void* custom_ptr;
+    int extra_info_type; uint8_t* extra_info;
+    void* stats; int error_code; void* progress_hook; void* user_data;
+    uint32_t pad3[3]; uint8_t *pad4, *pad5; uint32_t pad6[8];
+    void* memory_; void* memory_argb_; void* pad7[2];
+};
+
+extern int WebPConfigInitInternal(WebPConfig*, int, float, int);
+extern int WebPValidateConfig(const WebPConfig*);
+extern int WebPPictureInitInternal(WebPPicture*, int);
+extern int WebPPictureImportRGBA(WebPPicture*, const uint8_t*, int);
+extern void WebPPictureFree(WebPPicture*);
+extern void WebPMemoryWriterInit(WebPMemoryWriter*);
+extern void WebPMemoryWriterClear(WebPMemoryWriter*);
+extern int WebPMemoryWrite(const uint8_t*, size_t, const WebPPicture*);
+extern int WebPEncode(const WebPConfig*, WebPPicture*);
+
+// Lossy RGBA encode at the given method; copies into out (cap bytes) and
+// returns the encoded size, 0 on failure or -size when out is too small
+static long encodeWebPMethod(const uint8_t* rgba, int width, int height, int stride,
+                             float quality, int method, uint8_t* out, size_t cap) {
+    WebPConfig config;
+    WebPPicture picture;
+    WebPMemoryWriter writer;
+    long n = 0;
+
+    if (!WebPConfigInitInternal(&config, 0, quality, 0x020f)) return 0;
+    config.method = method;
+    if (!WebPValidateConfig(&config) || !WebPPictureInitInternal(&picture, 0x020f)) return 0;
+    picture.width = width;
+    picture.height = height;
+    WebPMemoryWriterInit(&writer);
+    picture.writer = WebPMemoryWrite;
+    picture.custom_ptr = &writer;
+
+    if (WebPPictureImportRGBA(&picture, rgba, stride) && WebPEncode(&config, &picture)) {
+        n = (long)writer.size;
+        if (writer.size <= cap) {
+            memcpy(out, writer.mem, writer.size);
+        } else {
+            n = -n;
+        }
+    }
+    WebPPictureFree(&picture);
+    WebPMemoryWriterClear(&writer);
+    return n;
+}
+*/
+import "C"
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"unsafe"
+
+	"github.com/chai2010/webp"
+)
+
+// Available reports whether this build can encode WebP
+const Available = true
+
+// Encode compresses img as lossy WebP at quality 0-100 and effort 0-6
+func Encode(img image.Image, quality float32, effort int) ([]byte, error) {
+	if effort != DefaultEffort {
+		return encodeMethod(img, quality, effort)
+	}
+
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, &webp.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeMethod is webp.Encode for lossy frames with the method set
+func encodeMethod(img image.Image, quality float32, effort int) ([]byte, error) {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	width, height := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	if width == 0 || height == 0 {
+		return nil, errors.New("webp: empty image")
+	}
+
+	// Lossy output is far below raw size; retry once if a frame exceeds that
+	out := make([]byte, len(rgba.Pix)/4+1024)
+	for {
+		n := C.encodeWebPMethod((*C.uint8_t)(unsafe.Pointer(&rgba.Pix[0])), C.int(width), C.int(height), C.int(rgba.Stride),
+			C.float(quality), C.int(effort), (*C.uint8_t)(unsafe.Pointer(&out[0])), C.size_t(len(out)))
+		switch {
+		case n == 0:
+			return nil, errors.New("webp: encode failed")
+		case n < 0:
+			out = make([]byte, -n)
+			continue
+		}
+		return out[:n], nil
+	}
+}